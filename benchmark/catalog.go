@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// List the FileDistribArrays in a directory:
+//		benchmark ls -dir DIR
+func runList(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	dir := flags.String("dir", "", "Directory holding the arrays (required)")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	fact := data.NewFileArrayFactory(*dir)
+
+	names, err := fact.List()
+	if err != nil {
+		return errors.Wrap(err, "Failed to list arrays")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tNPART\tBYTES\tMODIFIED\n")
+	for _, name := range names {
+		info, err := fact.Stat(name)
+		if err != nil {
+			fmt.Fprintf(w, "%v\t?\t?\t%v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", name, info.Shape.NPart(), info.TotalLen(),
+			info.ModTime.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// Remove leftover FileDistribArrays (e.g. after a failed run):
+//		benchmark gc -dir DIR [-prefix NAME] [-ttl DURATION] [-dry-run]
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dir := flags.String("dir", "", "Directory holding the arrays (required)")
+	prefix := flags.String("prefix", "", "Remove arrays whose name starts with this (e.g. a sort's base name)")
+	ttl := flags.Duration("ttl", 0, "Remove arrays not modified for this long (e.g. 24h)")
+	dryRun := flags.Bool("dry-run", false, "Only print what would be removed")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	removed, err := data.GCArrays(data.NewFileArrayFactory(*dir),
+		data.GCPolicy{Prefix: *prefix, TTL: *ttl, DryRun: *dryRun})
+	for _, name := range removed {
+		if *dryRun {
+			fmt.Printf("Would remove %v\n", name)
+		} else {
+			fmt.Printf("Removed %v\n", name)
+		}
+	}
+	return err
+}
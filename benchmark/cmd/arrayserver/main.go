@@ -0,0 +1,59 @@
+// Serves DistribArrays over HTTP so that intermediate data can live on a
+// dedicated storage node. Clients use data.NewHttpArrayFactory (or set
+// RADIXBENCH_ARRAY_SERVER for FaaS workers).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+)
+
+func main() {
+	listen := flag.String("listen", ":7070", "Address to serve on")
+	dir := flag.String("dir", "", "Directory to store arrays in, arrays are kept in memory if empty")
+	perPart := flag.Bool("perpart", false, "Store each partition in its own file (only with -dir)")
+	flag.Parse()
+
+	var factory *data.ArrayFactory
+	if *dir == "" {
+		factory = data.MemArrayFactory
+	} else {
+		if err := os.MkdirAll(*dir, 0700); err != nil {
+			fmt.Printf("Couldn't create array directory: %v\n", err)
+			os.Exit(1)
+		}
+
+		var opts []data.FileOption
+		if *perPart {
+			opts = append(opts, data.WithLayout(data.PERPART))
+		}
+		factory = data.NewFileArrayFactory(*dir, opts...)
+	}
+
+	arrServer := data.NewArrayServer(factory)
+	server := &http.Server{Addr: *listen, Handler: arrServer}
+
+	// Commit any open arrays on exit
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		server.Close()
+	}()
+
+	fmt.Printf("Serving arrays on %v\n", *listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Printf("Array server failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := arrServer.Close(); err != nil {
+		fmt.Printf("Failed to close arrays: %v\n", err)
+		os.Exit(1)
+	}
+}
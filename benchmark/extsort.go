@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/sort"
+)
+
+// Sort a file of uint32s that may not fit in device memory:
+//		benchmark sort -in FILE -out FILE [-run-len N] [-tmp DIR] [-cpu]
+func runExternalSort(args []string) error {
+	flags := flag.NewFlagSet("sort", flag.ExitOnError)
+	in := flags.String("in", "", "File of little-endian uint32s to sort (required)")
+	out := flags.String("out", "", "Where to write the sorted file (required)")
+	runLen := flags.Int("run-len", sort.MaxDeviceElems, "Elements sorted at a time")
+	tmpDir := flags.String("tmp", "", "Directory for sorted runs (default a temporary directory)")
+	cpu := flags.Bool("cpu", false, "Sort runs on the CPU instead of the GPU")
+	flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+
+	opts := sort.ExternalOptions{RunLen: *runLen, TmpDir: *tmpDir}
+	if *cpu {
+		opts.Sorter = sort.CpuFull
+	}
+	return sort.SortFileExternal(context.Background(), *in, *out, opts)
+}
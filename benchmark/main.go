@@ -10,6 +10,28 @@ import (
 func main() {
 	var err error
 
+	// Array maintenance subcommands, see catalog.go
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ls":
+			err = runList(os.Args[2:])
+		case "gc":
+			err = runGC(os.Args[2:])
+		case "sort":
+			// External sort, see extsort.go
+			err = runExternalSort(os.Args[2:])
+		default:
+			fmt.Printf("Unrecognized command %q (expected ls, gc, sort, or no arguments to run the benchmarks)\n", os.Args[1])
+			os.Exit(1)
+		}
+
+		if err != nil {
+			fmt.Printf("%v failed: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// err = benchmark.TestFaasSortFull(4051)
 	// // err = benchmark.TestFaasSortPartial(4051)
 	// if err != nil {
@@ -59,6 +59,40 @@ func BenchFileLocalDistrib(arr []byte, stats SortStats) error {
 	return nil
 }
 
+// Like BenchMemLocalDistrib but at most memBudget bytes of intermediate data
+// are kept in memory, the rest spills to a temporary directory
+func BenchTieredLocalDistrib(arr []byte, memBudget int64, stats SortStats) error {
+	var ok bool
+
+	var TTotal *PerfTimer
+	if TTotal, ok = stats["TTotal"]; !ok {
+		TTotal = &PerfTimer{}
+		stats["TTotal"] = TTotal
+	}
+
+	tmpDir, err := ioutil.TempDir("", "benchTieredLocalDistrib")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := data.NewTieredStore(memBudget, tmpDir)
+
+	TTotal.Start()
+	_, err = sort.SortDistribFromRaw(arr, "benchTieredLocalDistrib", data.NewTieredArrayFactory(store), sort.LocalDistribWorker)
+	TTotal.Record()
+
+	tierStats := store.Stats()
+	fmt.Printf("Tiered arrays: peak memory %vB, spilled %vB (%v partitions)\n",
+		tierStats.PeakMemBytes, tierStats.SpilledBytes, tierStats.NSpill)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func BenchFaasOne(arr []byte, stats SortStats) error {
 	var ok bool
 
@@ -146,6 +180,16 @@ func RunBenchmarks() (map[string]SortStats, error) {
 	// 	runtime.GC()
 	// }
 
+	// stats["TieredLocalDistrib"] = make(SortStats)
+	// for i := 0; i < nrepeat; i++ {
+	// 	copy(iterIn, origRaw)
+	// 	err = BenchTieredLocalDistrib(iterIn, 4*1024*1024*1024, stats["TieredLocalDistrib"])
+	// 	if err != nil {
+	// 		return stats, errors.Wrap(err, "Failed to benchmark TieredLocalDistrib")
+	// 	}
+	// 	runtime.GC()
+	// }
+
 	// stats["FileLocalDistrib"] = make(SortStats)
 	// for i := 0; i < nrepeat; i++ {
 	// 	copy(iterIn, origRaw)
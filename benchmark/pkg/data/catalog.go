@@ -0,0 +1,105 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Summary of an array returned by ArrayFactory.Stat
+type ArrayInfo struct {
+	Name  string
+	Shape DistribArrayShape
+
+	// Last time the array was created or written to
+	ModTime time.Time
+}
+
+// Total number of bytes stored in the array
+func (self *ArrayInfo) TotalLen() int64 {
+	total := (int64)(0)
+	for _, l := range self.Shape.lens {
+		total += l
+	}
+	return total
+}
+
+// Selects arrays for GCArrays. Arrays matching any of the set criteria are
+// removed, at least one must be set.
+type GCPolicy struct {
+	// Arrays whose name starts with Prefix (e.g. the baseName of a sort,
+	// which prefixes all of its intermediate arrays)
+	Prefix string
+
+	// Arrays that haven't been modified for at least TTL
+	TTL time.Duration
+
+	// Report what would be removed without removing anything
+	DryRun bool
+}
+
+// Remove every array from factory matching policy. Returns the names of the
+// arrays removed (or that would be removed if policy.DryRun). Errors don't
+// stop the collection, the first one is returned once every array has been
+// tried.
+func GCArrays(factory *ArrayFactory, policy GCPolicy) ([]string, error) {
+	if factory.List == nil || factory.Stat == nil {
+		return nil, fmt.Errorf("Array factory does not support listing arrays")
+	}
+	if policy.Prefix == "" && policy.TTL <= 0 {
+		return nil, fmt.Errorf("GC policy must set a prefix or TTL")
+	}
+
+	names, err := factory.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list arrays")
+	}
+
+	now := time.Now()
+	var removed []string
+	var firstErr error
+	for _, name := range names {
+		match := policy.Prefix != "" && strings.HasPrefix(name, policy.Prefix)
+
+		if !match && policy.TTL > 0 {
+			info, err := factory.Stat(name)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "Failed to stat array %v", name)
+				}
+				continue
+			}
+			match = now.Sub(info.ModTime) >= policy.TTL
+		}
+
+		if !match {
+			continue
+		}
+
+		if !policy.DryRun {
+			if err := removeArray(factory, name); err != nil {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "Failed to remove array %v", name)
+				}
+				continue
+			}
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, firstErr
+}
+
+func removeArray(factory *ArrayFactory, name string) error {
+	if factory.Remove != nil {
+		return factory.Remove(name)
+	}
+
+	arr, err := factory.Open(name)
+	if err != nil {
+		return err
+	}
+	return arr.Destroy()
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Exercise List/Stat/Exists and prefix-based GC. Only arrays named "cat*" are
+// considered so that leftovers from other tests don't matter.
+func testCatalog(t *testing.T, fact *ArrayFactory) {
+	names := []string{"catA_step0_worker0_output", "catA_step1_worker0_output", "catB_input"}
+	for _, name := range names {
+		arr, err := fact.Create(name, CreateShapeUniform(8, 2))
+		require.Nilf(t, err, "Failed to create %v", name)
+		generateBytes(t, arr, 8)
+		require.Nil(t, arr.Close())
+	}
+
+	listCat := func() []string {
+		all, err := fact.List()
+		require.Nil(t, err, "Failed to list arrays")
+
+		var cat []string
+		for _, name := range all {
+			if strings.HasPrefix(name, "cat") {
+				cat = append(cat, name)
+			}
+		}
+		return cat
+	}
+	require.ElementsMatch(t, names, listCat())
+
+	exists, err := fact.Exists("catB_input")
+	require.Nil(t, err)
+	require.True(t, exists, "Existing array not found")
+
+	exists, err = fact.Exists("catMissing")
+	require.Nil(t, err)
+	require.False(t, exists, "Missing array found")
+
+	info, err := fact.Stat("catB_input")
+	require.Nil(t, err, "Failed to stat array")
+	require.Equal(t, "catB_input", info.Name)
+	require.Equal(t, 2, info.Shape.NPart())
+	require.Equal(t, (int64)(16), info.TotalLen())
+	require.WithinDuration(t, time.Now(), info.ModTime, time.Minute, "Bad modification time")
+
+	_, err = fact.Stat("catMissing")
+	require.NotNil(t, err, "Stat of a missing array succeeded")
+
+	removed, err := GCArrays(fact, GCPolicy{Prefix: "catA", DryRun: true})
+	require.Nil(t, err)
+	require.ElementsMatch(t, names[:2], removed)
+	require.ElementsMatch(t, names, listCat(), "Dry run removed arrays")
+
+	removed, err = GCArrays(fact, GCPolicy{Prefix: "catA"})
+	require.Nil(t, err)
+	require.ElementsMatch(t, names[:2], removed)
+	require.ElementsMatch(t, names[2:], listCat(), "GC removed the wrong arrays")
+
+	_, err = GCArrays(fact, GCPolicy{})
+	require.NotNil(t, err, "GC without a policy should be refused")
+
+	arr, err := fact.Open("catB_input")
+	require.Nil(t, err)
+	require.Nil(t, arr.Destroy())
+}
+
+func TestMemCatalog(t *testing.T) {
+	testCatalog(t, MemArrayFactory)
+}
+
+func TestFileCatalog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	fact := NewFileArrayFactory(tmpDir)
+	testCatalog(t, fact)
+
+	// Stray files and directories aren't arrays
+	require.Nil(t, os.Mkdir(filepath.Join(tmpDir, "notAnArray"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(tmpDir, "stray"), []byte{}, 0600))
+	names, err := fact.List()
+	require.Nil(t, err)
+	require.Empty(t, names)
+}
+
+func TestTieredCatalog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	testCatalog(t, NewTieredArrayFactory(NewTieredStore(16, tmpDir)))
+}
+
+func TestFileGCTTL(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	fact := NewFileArrayFactory(tmpDir)
+	for _, name := range []string{"old", "new"} {
+		arr, err := fact.Create(name, CreateShapeUniform(8, 1))
+		require.Nil(t, err)
+		require.Nil(t, arr.Close())
+	}
+
+	// Age every file in "old"
+	old := time.Now().Add(-2 * time.Hour)
+	files, err := ioutil.ReadDir(filepath.Join(tmpDir, "old"))
+	require.Nil(t, err)
+	for _, f := range files {
+		require.Nil(t, os.Chtimes(filepath.Join(tmpDir, "old", f.Name()), old, old))
+	}
+
+	info, err := fact.Stat("old")
+	require.Nil(t, err)
+	require.WithinDuration(t, old, info.ModTime, time.Second)
+
+	removed, err := GCArrays(fact, GCPolicy{TTL: time.Hour})
+	require.Nil(t, err)
+	require.Equal(t, []string{"old"}, removed)
+
+	names, err := fact.List()
+	require.Nil(t, err)
+	require.Equal(t, []string{"new"}, names)
+
+	// Arrays left half-written by a crash can't be opened but are still removed
+	require.Nil(t, os.Remove(filepath.Join(tmpDir, "new", "data.dat")))
+	_, err = fact.Open("new")
+	require.NotNil(t, err)
+
+	removed, err = GCArrays(fact, GCPolicy{Prefix: "new"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"new"}, removed)
+	_, err = os.Stat(filepath.Join(tmpDir, "new"))
+	require.True(t, os.IsNotExist(err), "Damaged array not removed")
+}
+
+func TestGCUnsupported(t *testing.T) {
+	// Checked before anything is sent so no server is needed
+	_, err := GCArrays(NewS3ArrayFactory(S3Config{Bucket: "radixsort"}), GCPolicy{Prefix: "x"})
+	require.NotNil(t, err, "GC on a factory without List")
+}
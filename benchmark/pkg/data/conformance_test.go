@@ -0,0 +1,92 @@
+package data_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/datatest"
+	"github.com/stretchr/testify/require"
+)
+
+// Every backend runs the shared datatest suite
+
+func TestMemConformance(t *testing.T) {
+	datatest.TestFactory(t, data.MemArrayFactory, datatest.Options{ConcurrentWriters: true})
+}
+
+func TestFileConformance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	configs := map[string][]data.FileOption{
+		"Packed":     nil,
+		"PerPart":    {data.WithLayout(data.PERPART)},
+		"Mmap":       {data.WithMmap()},
+		"Direct":     {data.WithDirectIO()},
+		"Compressed": {data.WithCodec(data.FLATE)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			datatest.TestFactory(t, data.NewFileArrayFactory(tmpDir, opts...), datatest.Options{ConcurrentWriters: true})
+		})
+	}
+}
+
+func TestTieredConformance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("Memory", func(t *testing.T) {
+		datatest.TestFactory(t, data.NewTieredArrayFactory(data.NewTieredStore(1024*1024, tmpDir)),
+			datatest.Options{ConcurrentWriters: true})
+	})
+
+	// Smaller than most arrays in the suite
+	t.Run("Mixed", func(t *testing.T) {
+		datatest.TestFactory(t, data.NewTieredArrayFactory(data.NewTieredStore(10, tmpDir)),
+			datatest.Options{ConcurrentWriters: true})
+	})
+}
+
+func TestS3Conformance(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	datatest.TestFactory(t, data.NewS3ArrayFactory(fake.Config("radixsort", "conform")),
+		datatest.Options{ConcurrentWriters: true})
+}
+
+func TestRedisConformance(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	datatest.TestFactory(t, data.NewRedisArrayFactory(fake.Config("conform:")),
+		datatest.Options{ConcurrentWriters: true})
+}
+
+func TestHttpConformance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	backends := map[string]*data.ArrayFactory{
+		"Mem":  data.MemArrayFactory,
+		"File": data.NewFileArrayFactory(tmpDir),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			arrServer := data.NewArrayServer(backend)
+			server := httptest.NewServer(arrServer)
+			defer arrServer.Close()
+			defer server.Close()
+
+			datatest.TestFactory(t, data.NewHttpArrayFactory(server.URL), datatest.Options{ConcurrentWriters: true})
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File formats understood by ImportFile and ExportFile. Elements are always
+// uint32s, BINARY files hold them in little-endian byte order (the same as a
+// DistribArray), CSV files hold one decimal integer per record and PARQUET
+// files hold them in a column (see parquet.go for what is supported).
+type DataFormat int
+
+const (
+	BINARY DataFormat = iota
+	CSV
+	PARQUET
+)
+
+var formatNames = map[DataFormat]string{
+	BINARY:  "binary",
+	CSV:     "csv",
+	PARQUET: "parquet",
+}
+
+func (self DataFormat) String() string {
+	return formatNames[self]
+}
+
+func ParseDataFormat(name string) (DataFormat, error) {
+	for format, formatName := range formatNames {
+		if name == formatName {
+			return format, nil
+		}
+	}
+	return BINARY, fmt.Errorf("Unrecognized data format: %q", name)
+}
+
+// Guess the format of a file from its extension
+func DataFormatFromPath(path string) (DataFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bin", ".dat", ".raw":
+		return BINARY, nil
+	case ".csv":
+		return CSV, nil
+	case ".parquet", ".pq":
+		return PARQUET, nil
+	}
+	return BINARY, fmt.Errorf("Can't tell the format of %v from its extension", path)
+}
+
+type ImportOptions struct {
+	Format DataFormat
+
+	// Number of partitions in the new array (default 1). Elements are split
+	// as evenly as possible, in order.
+	NPart int
+
+	// For CSV files, the field to read from each record: a name from the
+	// header (requires Header) or an index (default 0). For PARQUET files,
+	// the column name (default the first column), nested columns use their
+	// dotted path.
+	Column string
+
+	// The first record of a CSV file is a header
+	Header bool
+}
+
+type ExportOptions struct {
+	Format DataFormat
+
+	// The PARQUET column name (default "value"). CSV files get a header
+	// with this name if it is set.
+	Column string
+}
+
+// Create a new array from factory called name holding the integers in the
+// file at path. Partitions are written in parallel (every built-in backend
+// allows concurrent writers for different partitions) and the array is closed
+// before returning. BINARY files are copied straight from the file, other
+// formats are decoded into memory first.
+func ImportFile(factory *ArrayFactory, name string, path string, opts ImportOptions) (DistribArray, error) {
+	nPart := opts.NPart
+	if nPart == 0 {
+		nPart = 1
+	} else if nPart < 0 {
+		return nil, fmt.Errorf("Invalid number of partitions: %v", nPart)
+	}
+
+	var src io.ReaderAt
+	var nByte int64
+	switch opts.Format {
+	case BINARY:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size()%4 != 0 {
+			return nil, fmt.Errorf("%v is %v bytes, not a whole number of 4-byte integers", path, info.Size())
+		}
+		src = f
+		nByte = info.Size()
+
+	case CSV, PARQUET:
+		var raw []byte
+		var err error
+		if opts.Format == CSV {
+			raw, err = readCsvColumn(path, opts)
+		} else {
+			raw, err = readParquetColumn(path, opts.Column)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read %v", path)
+		}
+		src = bytes.NewReader(raw)
+		nByte = (int64)(len(raw))
+
+	default:
+		return nil, fmt.Errorf("Unrecognized data format: %v", opts.Format)
+	}
+
+	nElem := nByte / 4
+	caps := make([]int64, nPart)
+	for i := range caps {
+		caps[i] = nElem / (int64)(nPart)
+		if (int64)(i) < nElem%(int64)(nPart) {
+			caps[i]++
+		}
+		caps[i] *= 4
+	}
+
+	arr, err := factory.Create(name, CreateShape(caps))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create array %v", name)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(nPart)
+	errChan := make(chan error, nPart)
+	start := (int64)(0)
+	for partId := 0; partId < nPart; partId++ {
+		go func(id int, section *io.SectionReader) {
+			defer wg.Done()
+			if err := importPart(arr, id, section); err != nil {
+				errChan <- errors.Wrapf(err, "Failed to import partition %v", id)
+			}
+		}(partId, io.NewSectionReader(src, start, caps[partId]))
+		start += caps[partId]
+	}
+	wg.Wait()
+
+	select {
+	case firstErr := <-errChan:
+		arr.Destroy()
+		return nil, firstErr
+	default:
+	}
+
+	if err := arr.Close(); err != nil {
+		arr.Destroy()
+		return nil, errors.Wrap(err, "Array commit failure")
+	}
+	return arr, nil
+}
+
+func importPart(arr DistribArray, partId int, section *io.SectionReader) error {
+	if section.Size() == 0 {
+		return nil
+	}
+
+	writer, err := arr.GetPartWriter(partId)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.CopyBuffer(writer, section, make([]byte, 1024*1024))
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != section.Size() {
+		return fmt.Errorf("Only wrote %v of %v bytes", n, section.Size())
+	}
+	return nil
+}
+
+// Read one field of every record in a CSV file as little-endian uint32s
+func readCsvColumn(path string, opts ImportOptions) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReaderSize(f, 1024*1024))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	reader.TrimLeadingSpace = true
+
+	col := -1
+	nRecord := 0
+	if opts.Header {
+		header, err := reader.Read()
+		if err == io.EOF {
+			return []byte{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		nRecord++
+
+		for i, field := range header {
+			if opts.Column != "" && strings.TrimSpace(field) == opts.Column {
+				col = i
+				break
+			}
+		}
+	}
+
+	if col == -1 {
+		if opts.Column == "" {
+			col = 0
+		} else if col, err = strconv.Atoi(opts.Column); err != nil || col < 0 {
+			return nil, fmt.Errorf("No column %q", opts.Column)
+		}
+	}
+
+	var out []byte
+	var tmp [4]byte
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		nRecord++
+
+		if col >= len(record) {
+			return nil, fmt.Errorf("Record %v has no field %v", nRecord, col)
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(record[col]), 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value in record %v", nRecord)
+		}
+
+		binary.LittleEndian.PutUint32(tmp[:], (uint32)(v))
+		out = append(out, tmp[:]...)
+	}
+	return out, nil
+}
+
+// Encodes whole elements in an output format
+type exportEncoder interface {
+	encode(elems []byte) error
+	finish() error
+}
+
+type binaryEncoder struct {
+	w io.Writer
+}
+
+func (self *binaryEncoder) encode(elems []byte) error {
+	_, err := self.w.Write(elems)
+	return err
+}
+
+func (self *binaryEncoder) finish() error {
+	return nil
+}
+
+type csvEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (self *csvEncoder) encode(elems []byte) error {
+	self.buf = self.buf[:0]
+	for i := 0; i+4 <= len(elems); i += 4 {
+		self.buf = strconv.AppendUint(self.buf, (uint64)(binary.LittleEndian.Uint32(elems[i:])), 10)
+		self.buf = append(self.buf, '\n')
+	}
+	_, err := self.w.Write(self.buf)
+	return err
+}
+
+func (self *csvEncoder) finish() error {
+	return nil
+}
+
+// Accepts little-endian uint32s split at any byte and passes whole elements
+// to an exportEncoder
+type exportWriter struct {
+	enc      exportEncoder
+	nElem    int64
+	partial  [4]byte
+	nPartial int
+}
+
+func (self *exportWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	if self.nPartial != 0 {
+		copied := copy(self.partial[self.nPartial:], b)
+		self.nPartial += copied
+		b = b[copied:]
+		if self.nPartial < len(self.partial) {
+			return n, nil
+		}
+
+		if err := self.enc.encode(self.partial[:]); err != nil {
+			return 0, err
+		}
+		self.nElem++
+		self.nPartial = 0
+	}
+
+	whole := len(b) - len(b)%4
+	if whole != 0 {
+		if err := self.enc.encode(b[:whole]); err != nil {
+			return 0, err
+		}
+		self.nElem += (int64)(whole / 4)
+	}
+	self.nPartial = copy(self.partial[:], b[whole:])
+
+	return n, nil
+}
+
+// Create a file at path in opts.Format and pass an exportWriter for it to
+// fill. The file is removed if anything fails. Returns the number of
+// elements written.
+func exportTo(path string, opts ExportOptions, fill func(w io.Writer) error) (nElem int64, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	buffered := bufio.NewWriterSize(f, 1024*1024)
+	out := &exportWriter{}
+	switch opts.Format {
+	case BINARY:
+		out.enc = &binaryEncoder{w: buffered}
+
+	case CSV:
+		if opts.Column != "" {
+			if _, err := fmt.Fprintf(buffered, "%v\n", opts.Column); err != nil {
+				return 0, err
+			}
+		}
+		out.enc = &csvEncoder{w: buffered}
+
+	case PARQUET:
+		column := opts.Column
+		if column == "" {
+			column = "value"
+		}
+		if out.enc, err = newParquetWriter(buffered, column); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, fmt.Errorf("Unrecognized data format: %v", opts.Format)
+	}
+
+	if err := fill(out); err != nil {
+		return 0, err
+	}
+	if out.nPartial != 0 {
+		return 0, fmt.Errorf("Input ended with a partial element")
+	}
+
+	if err := out.enc.finish(); err != nil {
+		return 0, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+	return out.nElem, nil
+}
+
+// Write the little-endian uint32s from src to a new file at path. Returns
+// the number of elements written.
+func ExportFile(src io.Reader, path string, opts ExportOptions) (int64, error) {
+	return exportTo(path, opts, func(w io.Writer) error {
+		_, err := io.CopyBuffer(w, src, make([]byte, 1024*1024))
+		return err
+	})
+}
+
+// Write the contents of arrs to a new file at path in bucket order (every
+// array's partition 0, then every array's partition 1, and so on). This is
+// the STRIDED order of sort.BucketReader, i.e. sorted order for the output
+// of a distributed sort. Returns the number of elements written.
+func ExportArrays(arrs []DistribArray, path string, opts ExportOptions) (int64, error) {
+	shapes := make([]*DistribArrayShape, len(arrs))
+	for i, arr := range arrs {
+		var err error
+		if shapes[i], err = arr.GetShape(); err != nil {
+			return 0, errors.Wrapf(err, "Failed to get shape of array %v", i)
+		}
+		if shapes[i].NPart() != shapes[0].NPart() {
+			return 0, fmt.Errorf("Array %v has %v partitions, expected %v", i, shapes[i].NPart(), shapes[0].NPart())
+		}
+	}
+	if len(arrs) == 0 {
+		return exportTo(path, opts, func(w io.Writer) error { return nil })
+	}
+
+	return exportTo(path, opts, func(w io.Writer) error {
+		buf := make([]byte, 1024*1024)
+		for partId := 0; partId < shapes[0].NPart(); partId++ {
+			for arrId, arr := range arrs {
+				partLen := shapes[arrId].Len(partId)
+				if partLen == 0 {
+					continue
+				}
+
+				reader, err := arr.GetPartRangeReader(partId, 0, (int)(partLen))
+				if err != nil {
+					return errors.Wrapf(err, "Couldn't read input %v:%v", arrId, partId)
+				}
+				n, err := io.CopyBuffer(w, reader, buf)
+				reader.Close()
+				if err != nil {
+					return errors.Wrapf(err, "Failed to read from partition %v:%v", arrId, partId)
+				}
+				if n != partLen {
+					return fmt.Errorf("Partition %v:%v ended after %v of %v bytes", arrId, partId, n, partLen)
+				}
+			}
+		}
+		return nil
+	})
+}
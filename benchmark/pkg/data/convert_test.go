@@ -0,0 +1,242 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Concatenate every partition of arr
+func readArr(t *testing.T, arr DistribArray) []byte {
+	shape, err := arr.GetShape()
+	require.Nil(t, err)
+
+	var out []byte
+	for partId := 0; partId < shape.NPart(); partId++ {
+		reader, err := arr.GetPartReader(partId)
+		require.Nilf(t, err, "Failed to get reader for part %v", partId)
+		part, err := ioutil.ReadAll(reader)
+		reader.Close()
+		require.Nilf(t, err, "Failed to read part %v", partId)
+		out = append(out, part...)
+	}
+	return out
+}
+
+func uint32Bytes(vals ...uint32) []byte {
+	out := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+func TestImportExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	require.Nil(t, os.Mkdir(filepath.Join(tmpDir, "arrs"), 0700))
+	factories := map[string]*ArrayFactory{
+		"mem":    MemArrayFactory,
+		"file":   NewFileArrayFactory(filepath.Join(tmpDir, "arrs")),
+		"direct": NewFileArrayFactory(filepath.Join(tmpDir, "arrs"), WithDirectIO()),
+		"tiered": NewTieredArrayFactory(NewTieredStore(1024, tmpDir)),
+	}
+
+	// Doesn't divide evenly into partitions
+	raw := make([]byte, 1003*4)
+	rand.Read(raw)
+
+	for _, format := range []DataFormat{BINARY, CSV, PARQUET} {
+		path := filepath.Join(tmpDir, "input."+format.String())
+		nElem, err := ExportFile(bytes.NewReader(raw), path, ExportOptions{Format: format})
+		require.Nilf(t, err, "Failed to export %v", format)
+		require.Equal(t, (int64)(1003), nElem)
+
+		for factName, fact := range factories {
+			t.Run(format.String()+"_"+factName, func(t *testing.T) {
+				arr, err := ImportFile(fact, "imported", path, ImportOptions{Format: format, NPart: 7})
+				require.Nilf(t, err, "Failed to import %v", format)
+				defer arr.Destroy()
+
+				shape, err := arr.GetShape()
+				require.Nil(t, err)
+				require.Equal(t, 7, shape.NPart())
+				for partId := 0; partId < 7; partId++ {
+					expect := (int64)(143 * 4)
+					if partId < 2 {
+						expect += 4
+					}
+					require.Equalf(t, expect, shape.Len(partId), "Partition %v has the wrong length", partId)
+				}
+
+				require.True(t, bytes.Equal(raw, readArr(t, arr)), "Imported data corrupted")
+			})
+		}
+	}
+}
+
+// Partitions are imported in parallel, PACKED direct I/O writers share
+// blocks at the partition boundaries
+func TestImportDirectIO(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	raw := make([]byte, 2*1024*1024*4+12)
+	rand.Read(raw)
+	path := filepath.Join(tmpDir, "input.dat")
+	require.Nil(t, ioutil.WriteFile(path, raw, 0600))
+
+	factory := NewFileArrayFactory(tmpDir, WithDirectIO())
+	for i := 0; i < 3; i++ {
+		arr, err := ImportFile(factory, "imported", path, ImportOptions{Format: BINARY, NPart: 7})
+		require.Nil(t, err, "Failed to import")
+		require.True(t, bytes.Equal(raw, readArr(t, arr)), "Imported data corrupted")
+		require.Nil(t, arr.Destroy())
+	}
+}
+
+// Exports go in bucket order across arrays
+func TestExportArrays(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	arr0, err := MemArrayFactory.Create("export0", CreateShapeUniform(8, 2))
+	require.Nil(t, err)
+	defer arr0.Destroy()
+	raw0 := generateBytes(t, arr0, 8)
+
+	// Partition 0 is left empty
+	arr1, err := MemArrayFactory.Create("export1", CreateShapeUniform(8, 2))
+	require.Nil(t, err)
+	defer arr1.Destroy()
+	writeTieredPart(t, arr1, 1, raw0[:4])
+
+	expect := append(append(append([]byte{}, raw0[:8]...), raw0[8:]...), raw0[:4]...)
+
+	for _, format := range []DataFormat{BINARY, CSV, PARQUET} {
+		path := filepath.Join(tmpDir, "sorted."+format.String())
+		nElem, err := ExportArrays([]DistribArray{arr0, arr1}, path, ExportOptions{Format: format, Column: "key"})
+		require.Nilf(t, err, "Failed to export %v", format)
+		require.Equal(t, (int64)(5), nElem)
+
+		arr, err := ImportFile(MemArrayFactory, "reimported", path, ImportOptions{Format: format, Column: "key", Header: true})
+		require.Nilf(t, err, "Failed to import %v", format)
+		require.True(t, bytes.Equal(expect, readArr(t, arr)), "%v export in the wrong order", format)
+		require.Nil(t, arr.Destroy())
+	}
+
+	// Nothing left behind on failure
+	path := filepath.Join(tmpDir, "partial.bin")
+	_, err = ExportFile(bytes.NewReader(raw0[:6]), path, ExportOptions{Format: BINARY})
+	require.NotNil(t, err, "Exported a partial element")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "Failed export left a file behind")
+}
+
+func TestImportCsv(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	writeCsv := func(content string) string {
+		path := filepath.Join(tmpDir, "in.csv")
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	importCsv := func(path string, opts ImportOptions) ([]byte, error) {
+		opts.Format = CSV
+		arr, err := ImportFile(MemArrayFactory, "csv", path, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer arr.Destroy()
+		return readArr(t, arr), nil
+	}
+
+	path := writeCsv("id, key\n1,\"42\"\n\n2, 4294967295\n")
+
+	out, err := importCsv(path, ImportOptions{Header: true, Column: "key"})
+	require.Nil(t, err)
+	require.Equal(t, uint32Bytes(42, 4294967295), out)
+
+	out, err = importCsv(path, ImportOptions{Header: true})
+	require.Nil(t, err)
+	require.Equal(t, uint32Bytes(1, 2), out)
+
+	out, err = importCsv(path, ImportOptions{Header: true, Column: "1", NPart: 4})
+	require.Nil(t, err)
+	require.Equal(t, uint32Bytes(42, 4294967295), out)
+
+	_, err = importCsv(path, ImportOptions{Header: true, Column: "missing"})
+	require.NotNil(t, err, "Imported a missing column")
+
+	_, err = importCsv(path, ImportOptions{})
+	require.NotNil(t, err, "Imported a header as data")
+
+	_, err = importCsv(writeCsv("1\n-1\n"), ImportOptions{})
+	require.NotNil(t, err, "Imported a negative value")
+
+	_, err = importCsv(writeCsv("4294967296\n"), ImportOptions{})
+	require.NotNil(t, err, "Imported a value that doesn't fit in a uint32")
+
+	_, err = importCsv(writeCsv("1,2\n3\n"), ImportOptions{Column: "1"})
+	require.NotNil(t, err, "Imported a short record")
+
+	out, err = importCsv(writeCsv(""), ImportOptions{NPart: 2})
+	require.Nil(t, err)
+	require.Empty(t, out)
+}
+
+func TestImportErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "odd.bin")
+	require.Nil(t, ioutil.WriteFile(path, []byte{1, 2, 3, 4, 5}, 0600))
+	_, err = ImportFile(MemArrayFactory, "odd", path, ImportOptions{Format: BINARY})
+	require.NotNil(t, err, "Imported a partial element")
+
+	_, err = ImportFile(MemArrayFactory, "odd", path, ImportOptions{Format: PARQUET})
+	require.NotNil(t, err, "Imported a binary file as parquet")
+
+	_, err = ImportFile(MemArrayFactory, "missing", filepath.Join(tmpDir, "missing.bin"), ImportOptions{})
+	require.NotNil(t, err, "Imported a missing file")
+
+	// Failed imports don't leave an array behind
+	exists, err := MemArrayFactory.Exists("odd")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestDataFormat(t *testing.T) {
+	for _, format := range []DataFormat{BINARY, CSV, PARQUET} {
+		parsed, err := ParseDataFormat(format.String())
+		require.Nil(t, err)
+		require.Equal(t, format, parsed)
+	}
+	_, err := ParseDataFormat("json")
+	require.NotNil(t, err)
+
+	format, err := DataFormatFromPath("/data/keys.Parquet")
+	require.Nil(t, err)
+	require.Equal(t, PARQUET, format)
+
+	format, err = DataFormatFromPath("keys.dat")
+	require.Nil(t, err)
+	require.Equal(t, BINARY, format)
+
+	_, err = DataFormatFromPath("keys")
+	require.NotNil(t, err)
+}
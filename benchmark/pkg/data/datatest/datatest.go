@@ -0,0 +1,543 @@
+// Package datatest checks that a data.ArrayFactory and the DistribArrays it
+// creates follow the semantics documented in the data package. New backends
+// should pass TestFactory, e.g.:
+//
+//	func TestMyConformance(t *testing.T) {
+//		datatest.TestFactory(t, NewMyArrayFactory(cfg), datatest.Options{})
+//	}
+//
+// Only the exported data API is used so the suite can run against backends
+// defined outside the data package.
+//
+// The package also has in-process fakes of the services that remote backends
+// talk to (e.g. StartFakeS3) so that tests don't need real servers. It is only
+// meant to be imported by tests.
+package datatest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Optional behavior that the suite should check for. The zero value only
+// checks what every DistribArray must support.
+type Options struct {
+	// Writers for different partitions may be used from different goroutines
+	// at the same time. DistribArray doesn't require this but most backends
+	// allow it.
+	ConcurrentWriters bool
+}
+
+// Run the conformance suite against factory. Arrays are named
+// "datatest${Test}", anything left from a previous run is removed first.
+// Zero capacity partitions are checked against factory.Unlimited.
+// Every array the suite creates is destroyed before it returns.
+func TestFactory(t *testing.T, factory *data.ArrayFactory, opts Options) {
+	t.Run("Shape", func(t *testing.T) { testShape(t, factory) })
+	t.Run("Append", func(t *testing.T) { testAppend(t, factory) })
+	t.Run("Unlimited", func(t *testing.T) { testUnlimited(t, factory) })
+	t.Run("Ranges", func(t *testing.T) { testRanges(t, factory) })
+	t.Run("Reopen", func(t *testing.T) { testReopen(t, factory) })
+	t.Run("Destroy", func(t *testing.T) { testDestroy(t, factory) })
+	t.Run("ConcurrentReaders", func(t *testing.T) { testConcurrentReaders(t, factory) })
+	if opts.ConcurrentWriters {
+		t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, factory) })
+	}
+	t.Run("BadPartition", func(t *testing.T) { testBadPartition(t, factory) })
+	t.Run("BadRange", func(t *testing.T) { testBadRange(t, factory) })
+	t.Run("Destroyed", func(t *testing.T) { testDestroyed(t, factory) })
+}
+
+// Create a fresh array called name, destroying any leftover array first
+func create(t *testing.T, factory *data.ArrayFactory, name string, caps []int64) data.DistribArray {
+	if old, err := factory.Open(name); err == nil {
+		require.Nilf(t, old.Destroy(), "Failed to remove leftover array %v", name)
+	}
+
+	arr, err := factory.Create(name, data.CreateShape(caps))
+	require.Nilf(t, err, "Failed to create array %v", name)
+	return arr
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// Write b to partId with a new writer, in chunks of at most chunkSz bytes
+func writePart(t *testing.T, arr data.DistribArray, partId int, b []byte, chunkSz int) {
+	writer, err := arr.GetPartWriter(partId)
+	require.Nilf(t, err, "Failed to get writer for partition %v", partId)
+
+	for len(b) > 0 {
+		n := chunkSz
+		if n > len(b) {
+			n = len(b)
+		}
+		written, err := writer.Write(b[:n])
+		require.Nilf(t, err, "Failed to write partition %v", partId)
+		require.Equalf(t, n, written, "Short write to partition %v", partId)
+		b = b[n:]
+	}
+	require.Nilf(t, writer.Close(), "Failed to close writer for partition %v", partId)
+}
+
+func readRange(t *testing.T, arr data.DistribArray, partId, start, end int) []byte {
+	reader, err := arr.GetPartRangeReader(partId, start, end)
+	require.Nilf(t, err, "Failed to get reader for [%v, %v) of partition %v", start, end, partId)
+	defer reader.Close()
+
+	out, err := ioutil.ReadAll(reader)
+	require.Nilf(t, err, "Failed to read [%v, %v) of partition %v", start, end, partId)
+	return out
+}
+
+// Check the length and contents of every partition against expect
+func checkParts(t *testing.T, arr data.DistribArray, expect [][]byte) {
+	shape, err := arr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	require.Equal(t, len(expect), shape.NPart(), "Wrong number of partitions")
+
+	for partId, part := range expect {
+		require.Equalf(t, (int64)(len(part)), shape.Len(partId), "Partition %v has the wrong length", partId)
+		require.Truef(t, bytes.Equal(part, readRange(t, arr, partId, 0, 0)),
+			"Partition %v has the wrong contents", partId)
+	}
+}
+
+func requireCause(t *testing.T, expect error, err error, msg string) {
+	require.NotNilf(t, err, "%v succeeded", msg)
+	require.Equalf(t, expect, errors.Cause(err), "%v returned the wrong error: %v", msg, err)
+}
+
+// New arrays have the requested capacities and are empty, names are unique
+func testShape(t *testing.T, factory *data.ArrayFactory) {
+	caps := []int64{16, 8, 4}
+	arr := create(t, factory, "datatestShape", caps)
+	defer arr.Destroy()
+
+	shape, err := arr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	require.Equal(t, len(caps), shape.NPart(), "Wrong number of partitions")
+	for partId, partCap := range caps {
+		require.Equalf(t, partCap, shape.Cap(partId), "Partition %v has the wrong capacity", partId)
+		require.Equalf(t, (int64)(0), shape.Len(partId), "New partition %v isn't empty", partId)
+	}
+
+	// Writes show up in shapes fetched afterwards, only in their partition
+	writePart(t, arr, 1, randomBytes(6), 6)
+	shape, err = arr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	require.Equal(t, []int64{0, 6, 0}, []int64{shape.Len(0), shape.Len(1), shape.Len(2)},
+		"Wrong lengths after writing partition 1")
+	require.Equal(t, (int64)(8), shape.Cap(1), "Writing changed the capacity")
+
+	_, err = factory.Create("datatestShape", data.CreateShape(caps))
+	require.NotNil(t, err, "Created an array that already exists")
+
+	_, err = factory.Open("datatestMissing")
+	require.NotNil(t, err, "Opened an array that doesn't exist")
+}
+
+// Each writer appends to what is already in the partition, up to its capacity
+func testAppend(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestAppend", []int64{16, 16})
+	defer arr.Destroy()
+
+	raw := randomBytes(16)
+	writePart(t, arr, 0, raw[:6], 4)
+	writePart(t, arr, 0, raw[6:10], 1)
+	checkParts(t, arr, [][]byte{raw[:10], {}})
+
+	// Writes past the capacity are cut short with io.EOF
+	writer, err := arr.GetPartWriter(0)
+	require.Nil(t, err, "Failed to get writer")
+	n, err := writer.Write(append(append([]byte{}, raw[10:]...), 1, 2, 3))
+	require.Equal(t, io.EOF, err, "Overfilling a partition didn't return io.EOF")
+	require.Equal(t, 6, n, "Overfilling a partition wrote the wrong number of bytes")
+
+	n, err = writer.Write(raw[:1])
+	require.Equal(t, io.EOF, err, "Writing a full partition didn't return io.EOF")
+	require.Equal(t, 0, n, "Wrote to a full partition")
+	require.Nil(t, writer.Close(), "Failed to close writer")
+
+	checkParts(t, arr, [][]byte{raw, {}})
+
+	// Empty writers leave the partition alone
+	writer, err = arr.GetPartWriter(1)
+	require.Nil(t, err, "Failed to get writer")
+	require.Nil(t, writer.Close(), "Failed to close empty writer")
+	checkParts(t, arr, [][]byte{raw, {}})
+}
+
+// Zero capacity partitions grow without limit if factory.Unlimited is set and
+// are always full otherwise
+func testUnlimited(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestUnlimited", []int64{0, 8})
+	defer arr.Destroy()
+
+	small := randomBytes(8)
+	writePart(t, arr, 1, small, 8)
+
+	if !factory.Unlimited {
+		writer, err := arr.GetPartWriter(0)
+		require.Nil(t, err, "Failed to get writer")
+		n, err := writer.Write(randomBytes(4))
+		require.Equal(t, io.EOF, err, "Zero capacity partition accepted data without factory.Unlimited")
+		require.Equal(t, 0, n, "Wrote to a zero capacity partition without factory.Unlimited")
+		require.Nil(t, writer.Close(), "Failed to close writer")
+
+		checkParts(t, arr, [][]byte{{}, small})
+		return
+	}
+
+	// Several writers, some larger than any one write
+	raw := randomBytes(3*64*1024 + 5)
+	writePart(t, arr, 0, raw[:100], 7)
+	writePart(t, arr, 0, raw[100:], 16*1024)
+	checkParts(t, arr, [][]byte{raw, small})
+	require.Equal(t, raw[1000:2000], readRange(t, arr, 0, 1000, 2000), "Wrong range of an unlimited partition")
+
+	shape, err := arr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	require.Equal(t, (int64)(0), shape.Cap(0), "Writing changed the capacity of an unlimited partition")
+
+	require.Nil(t, arr.Close(), "Failed to close array")
+	arr, err = factory.Open("datatestUnlimited")
+	require.Nil(t, err, "Failed to reopen array")
+
+	// Still unlimited after reopening
+	more := randomBytes(10)
+	writePart(t, arr, 0, more, 10)
+	checkParts(t, arr, [][]byte{append(raw, more...), small})
+}
+
+// Range reads return [start, end), with end <= 0 relative to the length
+func testRanges(t *testing.T, factory *data.ArrayFactory) {
+	// Partitions aren't full so relative ranges must use the length
+	arr := create(t, factory, "datatestRanges", []int64{16, 16})
+	defer arr.Destroy()
+
+	raw := randomBytes(12)
+	writePart(t, arr, 1, raw, 12)
+
+	ranges := []struct {
+		start, end int
+		expect     []byte
+	}{
+		{0, 0, raw},
+		{0, 4, raw[:4]},
+		{3, 9, raw[3:9]},
+		{8, 12, raw[8:]},
+		{8, 0, raw[8:]},
+		{2, -3, raw[2:9]},
+		{0, -12, raw[:0]},
+		{5, 5, raw[:0]},
+		{12, 0, raw[:0]},
+	}
+
+	slicer, isSlicer := arr.(data.PartByteSlicer)
+	for _, r := range ranges {
+		out := readRange(t, arr, 1, r.start, r.end)
+		require.Truef(t, bytes.Equal(r.expect, out), "Read the wrong data for [%v, %v)", r.start, r.end)
+
+		if isSlicer {
+			out, err := slicer.GetPartRangeBytes(1, r.start, r.end)
+			require.Nilf(t, err, "Failed to slice [%v, %v)", r.start, r.end)
+			require.Truef(t, bytes.Equal(r.expect, out), "Sliced the wrong data for [%v, %v)", r.start, r.end)
+		}
+	}
+
+	require.Empty(t, readRange(t, arr, 0, 0, 0), "Read data from an empty partition")
+
+	// Readers can be consumed in small pieces
+	reader, err := arr.GetPartRangeReader(1, 1, -1)
+	require.Nil(t, err, "Failed to get reader")
+	var out []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := reader.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err, "Failed to read")
+	}
+	require.Nil(t, reader.Close(), "Failed to close reader")
+	require.True(t, bytes.Equal(raw[1:11], out), "Piecewise read returned the wrong data")
+}
+
+// Closed arrays can be opened again with the same name, shape and data, and
+// writers on the reopened array continue where the old ones stopped
+func testReopen(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestReopen", []int64{8, 12, 4})
+	raw := [][]byte{randomBytes(8), randomBytes(5), {}}
+	writePart(t, arr, 0, raw[0], 8)
+	writePart(t, arr, 1, raw[1], 2)
+	require.Nil(t, arr.Close(), "Failed to close array")
+
+	arr, err := factory.Open("datatestReopen")
+	require.Nil(t, err, "Failed to reopen array")
+	defer arr.Destroy()
+
+	// Named arrays report the name they can be reopened with
+	if named, ok := arr.(data.NamedArray); ok {
+		require.Equal(t, "datatestReopen", named.ArrayName(), "Reopened array has the wrong name")
+	}
+
+	shape, err := arr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	for partId, partCap := range []int64{8, 12, 4} {
+		require.Equalf(t, partCap, shape.Cap(partId), "Reopened partition %v has the wrong capacity", partId)
+	}
+	checkParts(t, arr, raw)
+
+	more := randomBytes(7)
+	writePart(t, arr, 1, more, 7)
+	raw[1] = append(raw[1], more...)
+	require.Nil(t, arr.Close(), "Failed to close reopened array")
+
+	arr, err = factory.Open("datatestReopen")
+	require.Nil(t, err, "Failed to reopen array again")
+	checkParts(t, arr, raw)
+}
+
+// Destroyed arrays are gone for good, their names can be reused
+func testDestroy(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestDestroy", []int64{8, 8})
+	writePart(t, arr, 0, randomBytes(8), 8)
+
+	if factory.Exists != nil {
+		exists, err := factory.Exists("datatestDestroy")
+		require.Nil(t, err, "Exists failed")
+		require.True(t, exists, "Exists didn't find a new array")
+	}
+
+	require.Nil(t, arr.Destroy(), "Failed to destroy array")
+
+	_, err := factory.Open("datatestDestroy")
+	require.NotNil(t, err, "Opened a destroyed array")
+
+	if factory.Exists != nil {
+		exists, err := factory.Exists("datatestDestroy")
+		require.Nil(t, err, "Exists failed")
+		require.False(t, exists, "Exists found a destroyed array")
+	}
+	if factory.List != nil {
+		names, err := factory.List()
+		require.Nil(t, err, "List failed")
+		require.NotContains(t, names, "datatestDestroy", "List returned a destroyed array")
+	}
+
+	// Arrays closed before being destroyed are gone too
+	arr, err = factory.Create("datatestDestroy", data.CreateShape([]int64{4, 4, 4}))
+	require.Nil(t, err, "Failed to reuse the name of a destroyed array")
+	checkParts(t, arr, [][]byte{{}, {}, {}})
+	require.Nil(t, arr.Close(), "Failed to close array")
+
+	arr, err = factory.Open("datatestDestroy")
+	require.Nil(t, err, "Failed to reopen array")
+	require.Nil(t, arr.Destroy(), "Failed to destroy reopened array")
+
+	_, err = factory.Open("datatestDestroy")
+	require.NotNil(t, err, "Opened a destroyed array")
+}
+
+// Any number of readers may be active at once
+func testConcurrentReaders(t *testing.T, factory *data.ArrayFactory) {
+	nPart := 4
+	caps := make([]int64, nPart)
+	for i := range caps {
+		caps[i] = 4096
+	}
+	arr := create(t, factory, "datatestReaders", caps)
+	defer arr.Destroy()
+
+	raw := make([][]byte, nPart)
+	for partId := range raw {
+		raw[partId] = randomBytes(4096)
+		writePart(t, arr, partId, raw[partId], 1000)
+	}
+
+	// Several readers per partition, all open before any of them is read
+	nReader := 4 * nPart
+	readers := make([]io.ReadCloser, nReader)
+	for i := range readers {
+		var err error
+		readers[i], err = arr.GetPartRangeReader(i%nPart, i, 0)
+		require.Nilf(t, err, "Failed to get reader %v", i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(nReader)
+	errChan := make(chan error, nReader)
+	for i, reader := range readers {
+		go func(i int, reader io.ReadCloser) {
+			defer wg.Done()
+			defer reader.Close()
+
+			out, err := ioutil.ReadAll(reader)
+			if err != nil {
+				errChan <- errors.Wrapf(err, "Reader %v failed", i)
+			} else if !bytes.Equal(raw[i%nPart][i:], out) {
+				errChan <- fmt.Errorf("Reader %v returned the wrong data", i)
+			}
+		}(i, reader)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errChan:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// Writers for different partitions may run at the same time (if the backend
+// supports it)
+func testConcurrentWriters(t *testing.T, factory *data.ArrayFactory) {
+	nPart := 4
+	caps := make([]int64, nPart)
+	for i := range caps {
+		caps[i] = 64 * 1024
+	}
+	arr := create(t, factory, "datatestWriters", caps)
+	defer arr.Destroy()
+
+	raw := make([][]byte, nPart)
+	writers := make([]io.WriteCloser, nPart)
+	for partId := range raw {
+		raw[partId] = randomBytes((int)(caps[partId]) - partId)
+
+		var err error
+		writers[partId], err = arr.GetPartWriter(partId)
+		require.Nilf(t, err, "Failed to get writer for partition %v", partId)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(nPart)
+	errChan := make(chan error, nPart)
+	for partId, writer := range writers {
+		go func(partId int, writer io.WriteCloser) {
+			defer wg.Done()
+
+			// Small writes so that the writers interleave
+			b := raw[partId]
+			for len(b) > 0 {
+				n := 1000
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err := writer.Write(b[:n]); err != nil {
+					writer.Close()
+					errChan <- errors.Wrapf(err, "Failed to write partition %v", partId)
+					return
+				}
+				b = b[n:]
+			}
+			if err := writer.Close(); err != nil {
+				errChan <- errors.Wrapf(err, "Failed to close writer for partition %v", partId)
+			}
+		}(partId, writer)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errChan:
+		t.Fatal(err)
+	default:
+	}
+
+	checkParts(t, arr, raw)
+	require.Nil(t, arr.Close(), "Failed to close array")
+
+	reArr, err := factory.Open("datatestWriters")
+	require.Nil(t, err, "Failed to reopen array")
+	checkParts(t, reArr, raw)
+	require.Nil(t, reArr.Destroy(), "Failed to destroy reopened array")
+}
+
+func testBadPartition(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestBadPart", []int64{8, 8})
+	defer arr.Destroy()
+
+	for _, partId := range []int{-1, 2} {
+		_, err := arr.GetPartReader(partId)
+		requireCause(t, data.ErrNoSuchPartition, err, "Reading a missing partition")
+
+		_, err = arr.GetPartRangeReader(partId, 0, 0)
+		requireCause(t, data.ErrNoSuchPartition, err, "Range reading a missing partition")
+
+		_, err = arr.GetPartWriter(partId)
+		requireCause(t, data.ErrNoSuchPartition, err, "Writing a missing partition")
+	}
+}
+
+func testBadRange(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestBadRange", []int64{8, 8})
+	defer arr.Destroy()
+
+	// Half full, ranges are checked against the length, not capacity
+	writePart(t, arr, 0, randomBytes(4), 4)
+
+	for _, r := range [][2]int{{-1, 0}, {3, 2}, {0, 5}, {4, -1}, {0, 8}, {0, -5}, {5, 0}} {
+		_, err := arr.GetPartRangeReader(0, r[0], r[1])
+		requireCause(t, data.ErrOutOfRange, err, fmt.Sprintf("Reading [%v, %v)", r[0], r[1]))
+	}
+
+	_, err := arr.GetPartRangeReader(1, 0, 1)
+	requireCause(t, data.ErrOutOfRange, err, "Reading an empty partition")
+
+	if slicer, ok := arr.(data.PartByteSlicer); ok {
+		_, err = slicer.GetPartRangeBytes(0, 2, 6)
+		requireCause(t, data.ErrOutOfRange, err, "Slicing past the end")
+		_, err = slicer.GetPartRangeBytes(2, 0, 0)
+		requireCause(t, data.ErrNoSuchPartition, err, "Slicing a missing partition")
+	}
+}
+
+// Destroyed handles return data.ErrClosed and Destroy is idempotent
+func testDestroyed(t *testing.T, factory *data.ArrayFactory) {
+	arr := create(t, factory, "datatestDestroyed", []int64{8})
+	writePart(t, arr, 0, randomBytes(8), 8)
+
+	require.Nil(t, arr.Destroy(), "Failed to destroy array")
+	require.Nil(t, arr.Destroy(), "Destroy isn't idempotent")
+
+	_, err := arr.GetShape()
+	requireCause(t, data.ErrClosed, err, "Getting the shape of a destroyed array")
+	_, err = arr.GetPartReader(0)
+	requireCause(t, data.ErrClosed, err, "Reading a destroyed array")
+	_, err = arr.GetPartRangeReader(0, 0, 4)
+	requireCause(t, data.ErrClosed, err, "Range reading a destroyed array")
+	_, err = arr.GetPartWriter(0)
+	requireCause(t, data.ErrClosed, err, "Writing a destroyed array")
+
+	// The name can be reused and stale handles don't affect the new array
+	newArr, err := factory.Create("datatestDestroyed", data.CreateShape([]int64{8}))
+	require.Nil(t, err, "Couldn't reuse the name of a destroyed array")
+	defer newArr.Destroy()
+	writePart(t, newArr, 0, randomBytes(4), 4)
+
+	require.Nil(t, arr.Destroy(), "Destroying a stale handle failed")
+	require.Nil(t, arr.Close(), "Closing a destroyed handle failed")
+	_, err = newArr.GetShape()
+	require.Nil(t, err, "Destroying a stale handle destroyed the new array")
+	require.Nil(t, newArr.Close(), "Failed to close new array")
+
+	reArr, err := factory.Open("datatestDestroyed")
+	require.Nil(t, err, "Stale handle removed the new array")
+	shape, err := reArr.GetShape()
+	require.Nil(t, err, "Failed to get shape")
+	require.Equal(t, (int64)(4), shape.Len(0), "Stale handle changed the new array")
+}
@@ -0,0 +1,346 @@
+package datatest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/internal/resp"
+)
+
+// An in-process stand-in for a redis server, used to test
+// data.RedisDistribArray without a real redis-server. It speaks RESP2 and
+// implements just the commands the client uses (plus a few handy for
+// debugging) on strings and hashes.
+type FakeRedis struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	lock     sync.Mutex
+	password string
+	strings  map[string][]byte
+	hashes   map[string]map[string][]byte
+	conns    map[net.Conn]bool
+}
+
+// Start a FakeRedis listening on localhost. Call Close() when done.
+func StartFakeRedis() (*FakeRedis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	fake := &FakeRedis{
+		listener: listener,
+		strings:  map[string][]byte{},
+		hashes:   map[string]map[string][]byte{},
+		conns:    map[net.Conn]bool{},
+	}
+
+	fake.wg.Add(1)
+	go fake.serve()
+	return fake, nil
+}
+
+// Returns a config that stores arrays on this server under prefix
+func (self *FakeRedis) Config(prefix string) data.RedisConfig {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return data.RedisConfig{Addr: self.listener.Addr().String(), Password: self.password, Prefix: prefix}
+}
+
+// Require new connections to AUTH with password (empty disables auth)
+func (self *FakeRedis) SetPassword(password string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.password = password
+}
+
+// Number of keys currently stored
+func (self *FakeRedis) NKey() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.strings) + len(self.hashes)
+}
+
+func (self *FakeRedis) Close() {
+	self.listener.Close()
+
+	self.lock.Lock()
+	for conn := range self.conns {
+		conn.Close()
+	}
+	self.lock.Unlock()
+
+	self.wg.Wait()
+}
+
+func (self *FakeRedis) serve() {
+	defer self.wg.Done()
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		self.lock.Lock()
+		self.conns[conn] = true
+		self.lock.Unlock()
+
+		self.wg.Add(1)
+		go self.handle(conn)
+	}
+}
+
+func (self *FakeRedis) handle(conn net.Conn) {
+	defer self.wg.Done()
+	defer func() {
+		self.lock.Lock()
+		delete(self.conns, conn)
+		self.lock.Unlock()
+		conn.Close()
+	}()
+
+	rd := bufio.NewReader(conn)
+	wr := bufio.NewWriter(conn)
+	self.lock.Lock()
+	password := self.password
+	self.lock.Unlock()
+	authed := password == ""
+
+	for {
+		// Commands are arrays of bulk strings, which is just what the client
+		// parser returns
+		reply, err := resp.ReadReply(rd)
+		if err != nil {
+			return
+		}
+
+		cmd, ok := reply.([]interface{})
+		if !ok || len(cmd) == 0 {
+			writeFakeRedisReply(wr, resp.Error("ERR protocol error"))
+		} else {
+			args := make([][]byte, len(cmd))
+			for i := range cmd {
+				args[i], _ = cmd[i].([]byte)
+			}
+			name := strings.ToUpper(string(args[0]))
+
+			if name == "AUTH" {
+				if len(args) == 2 && string(args[1]) == password {
+					authed = true
+					writeFakeRedisReply(wr, "OK")
+				} else {
+					writeFakeRedisReply(wr, resp.Error("WRONGPASS invalid password"))
+				}
+			} else if !authed {
+				writeFakeRedisReply(wr, resp.Error("NOAUTH Authentication required."))
+			} else {
+				self.lock.Lock()
+				writeFakeRedisReply(wr, self.exec(name, args[1:]))
+				self.lock.Unlock()
+			}
+		}
+
+		if wr.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeFakeRedisReply(wr *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case resp.Error:
+		fmt.Fprintf(wr, "-%v\r\n", string(v))
+	case string:
+		fmt.Fprintf(wr, "+%v\r\n", v)
+	case int:
+		fmt.Fprintf(wr, ":%v\r\n", v)
+	case []byte:
+		if v == nil {
+			wr.WriteString("$-1\r\n")
+		} else {
+			fmt.Fprintf(wr, "$%v\r\n", len(v))
+			wr.Write(v)
+			wr.WriteString("\r\n")
+		}
+	case []interface{}:
+		fmt.Fprintf(wr, "*%v\r\n", len(v))
+		for _, elem := range v {
+			writeFakeRedisReply(wr, elem)
+		}
+	}
+}
+
+// Redis ranges are inclusive and negative indices count from the end
+func fakeRedisRange(start, end, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	return start, end
+}
+
+var fakeRedisArity = map[string]int{
+	"PING": 0, "SELECT": 1, "GET": 1, "SET": 2, "APPEND": 2, "STRLEN": 1,
+	"GETRANGE": 3, "EXISTS": -1, "DEL": -1, "KEYS": 1, "HSET": -3,
+	"HSETNX": 3, "HGET": 2, "HMGET": -2, "HGETALL": 1,
+}
+
+// Run a command, the caller holds self.lock
+func (self *FakeRedis) exec(name string, args [][]byte) interface{} {
+	arity, ok := fakeRedisArity[name]
+	if !ok {
+		return resp.Error(fmt.Sprintf("ERR unknown command '%v'", name))
+	}
+	if (arity >= 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for '%v' command", name))
+	}
+
+	wrongType := resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	switch name {
+	case "PING":
+		return "PONG"
+
+	case "SELECT":
+		return "OK"
+
+	case "GET":
+		if _, isHash := self.hashes[string(args[0])]; isHash {
+			return wrongType
+		}
+		return self.strings[string(args[0])]
+
+	case "SET":
+		delete(self.hashes, string(args[0]))
+		self.strings[string(args[0])] = append([]byte{}, args[1]...)
+		return "OK"
+
+	case "APPEND":
+		key := string(args[0])
+		if _, isHash := self.hashes[key]; isHash {
+			return wrongType
+		}
+		self.strings[key] = append(self.strings[key], args[1]...)
+		return len(self.strings[key])
+
+	case "STRLEN":
+		return len(self.strings[string(args[0])])
+
+	case "GETRANGE":
+		val := self.strings[string(args[0])]
+		start, err1 := strconv.Atoi(string(args[1]))
+		end, err2 := strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		start, end = fakeRedisRange(start, end, len(val))
+		if start > end || start >= len(val) {
+			return []byte{}
+		}
+		return append([]byte{}, val[start:end+1]...)
+
+	case "EXISTS", "DEL":
+		n := 0
+		for _, key := range args {
+			_, isStr := self.strings[string(key)]
+			_, isHash := self.hashes[string(key)]
+			if isStr || isHash {
+				n++
+			}
+			if name == "DEL" {
+				delete(self.strings, string(key))
+				delete(self.hashes, string(key))
+			}
+		}
+		return n
+
+	case "KEYS":
+		// Only '*' globs at the end of the pattern are supported
+		pattern := string(args[0])
+		var keys []string
+		for key := range self.strings {
+			keys = append(keys, key)
+		}
+		for key := range self.hashes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var out []interface{}
+		for _, key := range keys {
+			if key == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(key, strings.TrimSuffix(pattern, "*"))) {
+				out = append(out, []byte(key))
+			}
+		}
+		return out
+
+	case "HSET", "HSETNX":
+		key := string(args[0])
+		if _, isStr := self.strings[key]; isStr {
+			return wrongType
+		}
+		if len(args)%2 != 1 {
+			return resp.Error("ERR wrong number of arguments for '" + name + "' command")
+		}
+
+		hash, ok := self.hashes[key]
+		if !ok {
+			hash = map[string][]byte{}
+			self.hashes[key] = hash
+		}
+
+		n := 0
+		for i := 1; i < len(args); i += 2 {
+			_, exists := hash[string(args[i])]
+			if name == "HSETNX" && exists {
+				return 0
+			}
+			if !exists {
+				n++
+			}
+			hash[string(args[i])] = append([]byte{}, args[i+1]...)
+		}
+		return n
+
+	case "HGET":
+		return self.hashes[string(args[0])][string(args[1])]
+
+	case "HMGET":
+		out := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			out[i] = self.hashes[string(args[0])][string(field)]
+		}
+		return out
+
+	case "HGETALL":
+		hash := self.hashes[string(args[0])]
+		var fields []string
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		out := []interface{}{}
+		for _, field := range fields {
+			out = append(out, []byte(field), hash[field])
+		}
+		return out
+	}
+
+	return resp.Error("ERR unknown command")
+}
@@ -0,0 +1,333 @@
+package datatest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/internal/s3sign"
+)
+
+// An in-process stand-in for an S3 server, used to test data.S3DistribArray
+// without a real object store. It implements just the calls the data package
+// makes and checks request signatures, but it has no notion of buckets (any
+// bucket name works) or permissions.
+type FakeS3 struct {
+	AccessKey string
+	SecretKey string
+
+	// Knobs to exercise client edge-cases. MinPartSz defaults to 5MB like S3,
+	// ListPageSz to 1000.
+	MinPartSz  int64
+	ListPageSz int
+
+	server *httptest.Server
+
+	lock    sync.Mutex
+	objects map[string][]byte // Indexed by bucket/key
+	uploads map[string]*fakeUpload
+	nextId  int
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// Start a FakeS3 listening on localhost. Call Close() when done.
+func StartFakeS3() *FakeS3 {
+	fake := &FakeS3{
+		AccessKey:  "fakeAccessKey",
+		SecretKey:  "fakeSecretKey",
+		MinPartSz:  5 * 1024 * 1024,
+		ListPageSz: 1000,
+		objects:    map[string][]byte{},
+		uploads:    map[string]*fakeUpload{},
+	}
+	fake.server = httptest.NewServer(fake)
+	return fake
+}
+
+// Returns a config that stores arrays in bucket under prefix on this server
+func (self *FakeS3) Config(bucket, prefix string) data.S3Config {
+	return data.S3Config{
+		Endpoint:  self.server.URL,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		AccessKey: self.AccessKey,
+		SecretKey: self.SecretKey,
+	}
+}
+
+func (self *FakeS3) Close() {
+	self.server.Close()
+}
+
+// Number of objects currently stored
+func (self *FakeS3) NObject() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.objects)
+}
+
+// Number of multipart uploads that were neither completed nor aborted
+func (self *FakeS3) NUpload() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.uploads)
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, msg)
+}
+
+func fakeS3XML(w http.ResponseWriter, v interface{}) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		fakeS3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Write(out)
+}
+
+// Recompute the request's signature with our secret key and compare
+func (self *FakeS3) checkAuth(r *http.Request, payloadHash string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, s3sign.Algorithm+" ") {
+		return false
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, s3sign.Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[0] != self.AccessKey {
+		return false
+	}
+
+	t, err := time.Parse(s3sign.AmzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	sig := s3sign.Signature(self.SecretKey, cred[2], r.Method, r.URL.EscapedPath(),
+		s3sign.CanonicalQuery(r.URL.Query()), r.Host,
+		r.Header, strings.Split(fields["SignedHeaders"], ";"), payloadHash, t)
+
+	return sig == fields["Signature"]
+}
+
+func (self *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != s3sign.SHA256Hex(body) {
+		fakeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "Payload hash doesn't match body")
+		return
+	}
+	if !self.checkAuth(r, payloadHash) {
+		fakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", "Bad request signature")
+		return
+	}
+
+	// Path-style addressing: /bucket[/key]
+	pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := pathParts[0]
+	key := ""
+	if len(pathParts) == 2 {
+		key = pathParts[1]
+	}
+	objName := bucket + "/" + key
+	query := r.URL.Query()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		self.list(w, bucket, query)
+
+	case r.Method == http.MethodGet:
+		self.get(w, r, objName)
+
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload, ok := self.uploads[query.Get("uploadId")]
+		partNum, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || err != nil || upload.key != objName {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", "Unknown upload")
+			return
+		}
+		upload.parts[partNum] = body
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodPut:
+		self.objects[objName] = body
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		self.nextId++
+		uploadId := fmt.Sprintf("upload%v", self.nextId)
+		self.uploads[uploadId] = &fakeUpload{key: objName, parts: map[int][]byte{}}
+		fakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadId})
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		self.complete(w, query.Get("uploadId"), objName, body)
+
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(self.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(self.objects, objName)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+func fakeETag(b []byte) string {
+	sum := md5.Sum(b)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func (self *FakeS3) get(w http.ResponseWriter, r *http.Request, objName string) {
+	obj, ok := self.objects[objName]
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		w.Write(obj)
+		return
+	}
+
+	var start, last int
+	_, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &last)
+	if err != nil || start > last || start >= len(obj) {
+		fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+		return
+	}
+	if last >= len(obj) {
+		last = len(obj) - 1
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, last, len(obj)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(obj[start : last+1])
+}
+
+type fakeListContents struct {
+	Key  string
+	Size int64
+}
+
+func (self *FakeS3) list(w http.ResponseWriter, bucket string, query map[string][]string) {
+	prefix := bucket + "/"
+	if p, ok := query["prefix"]; ok {
+		prefix += p[0]
+	}
+
+	var names []string
+	for name := range self.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Continuation tokens are just the last key returned
+	if token, ok := query["continuation-token"]; ok {
+		skip := sort.SearchStrings(names, bucket+"/"+token[0]+"\x00")
+		names = names[skip:]
+	}
+
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Contents              []fakeListContents
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{Name: bucket}
+
+	if len(names) > self.ListPageSz {
+		names = names[:self.ListPageSz]
+		res.IsTruncated = true
+		res.NextContinuationToken = strings.TrimPrefix(names[len(names)-1], bucket+"/")
+	}
+
+	for _, name := range names {
+		res.Contents = append(res.Contents, fakeListContents{
+			Key:  strings.TrimPrefix(name, bucket+"/"),
+			Size: (int64)(len(self.objects[name]))})
+	}
+	fakeS3XML(w, res)
+}
+
+func (self *FakeS3) complete(w http.ResponseWriter, uploadId, objName string, body []byte) {
+	upload, ok := self.uploads[uploadId]
+	if !ok || upload.key != objName {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", "Unknown upload")
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML", "Bad completion request")
+		return
+	}
+
+	var obj []byte
+	for i, part := range req.Parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if !ok || fakeETag(partData) != part.ETag {
+			fakeS3Error(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %v", part.PartNumber))
+			return
+		}
+		if i != len(req.Parts)-1 && (int64)(len(partData)) < self.MinPartSz {
+			fakeS3Error(w, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("Part %v", part.PartNumber))
+			return
+		}
+		obj = append(obj, partData...)
+	}
+
+	self.objects[objName] = obj
+	delete(self.uploads, uploadId)
+
+	fakeS3XML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+	}{Key: strings.SplitN(objName, "/", 2)[1]})
+}
@@ -0,0 +1,12 @@
+package data
+
+// Helpers from data_test.go for the tests in package data_test, which can use
+// the fakes in datatest
+var (
+	CheckDistribArr      = testDistribArr
+	CheckArrayFactory    = testArrayFactory
+	CheckPartRangeReader = testPartRangeReader
+	GenerateBytes        = generateBytes
+)
+
+const RedisChunkSz = redisChunkSz
@@ -0,0 +1,264 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default error returned by injected faults
+var ErrInjected = errors.New("Injected failure")
+
+// The DistribArray operations that faults can be injected into
+type FaultOp int
+
+const (
+	FaultCreate  FaultOp = iota // ArrayFactory.Create
+	FaultOpen                   // ArrayFactory.Open
+	FaultShape                  // GetShape
+	FaultRead                   // GetPartReader and GetPartRangeReader
+	FaultWrite                  // GetPartWriter
+	FaultClose                  // DistribArray.Close
+	FaultDestroy                // DistribArray.Destroy
+)
+
+var faultOpNames = map[FaultOp]string{
+	FaultCreate:  "Create",
+	FaultOpen:    "Open",
+	FaultShape:   "GetShape",
+	FaultRead:    "Read",
+	FaultWrite:   "Write",
+	FaultClose:   "Close",
+	FaultDestroy: "Destroy",
+}
+
+func (self FaultOp) String() string {
+	if name, ok := faultOpNames[self]; ok {
+		return name
+	}
+	return fmt.Sprintf("FaultOp(%d)", (int)(self))
+}
+
+type FaultKind int
+
+const (
+	// The call returns Fault.Err (ErrInjected if nil)
+	FaultError FaultKind = iota
+
+	// The call panics with Fault.Err
+	FaultPanic
+
+	// The call is delayed by Fault.Delay, then runs normally
+	FaultLatency
+
+	// FaultRead only: the reader returns io.EOF after Fault.Bytes bytes, as
+	// if the data were truncated
+	FaultTruncate
+
+	// FaultWrite only: the writer accepts Fault.Bytes bytes, then fails
+	// with io.ErrShortWrite
+	FaultShortWrite
+)
+
+// A failure to inject with NewFaultyFactory
+type Fault struct {
+	Op   FaultOp
+	Kind FaultKind
+
+	// Only affect arrays whose name contains Array ("" for every array)
+	Array string
+
+	// Only affect the Nth matching call of Op, counting from 1 across every
+	// array of the factory. 0 affects every matching call.
+	Call int
+
+	Err   error
+	Delay time.Duration
+	Bytes int
+}
+
+// Counts calls and decides which faults apply, shared by a faulty factory
+// and all of its arrays
+type faultInjector struct {
+	faults []Fault
+
+	lock   sync.Mutex
+	nCalls []int // Matching calls so far, per fault
+}
+
+// Apply the faults for a call of op on the array called name. Latency and
+// error/panic faults are handled here, the rest are returned for the caller
+// to apply to the reader or writer.
+func (self *faultInjector) inject(op FaultOp, name string) ([]Fault, error) {
+	var active []Fault
+
+	self.lock.Lock()
+	for i, fault := range self.faults {
+		if fault.Op != op || !strings.Contains(name, fault.Array) {
+			continue
+		}
+		self.nCalls[i]++
+		if fault.Call == 0 || fault.Call == self.nCalls[i] {
+			active = append(active, fault)
+		}
+	}
+	self.lock.Unlock()
+
+	var streamFaults []Fault
+	for _, fault := range active {
+		err := fault.Err
+		if err == nil {
+			err = errors.Wrapf(ErrInjected, "Op %v on %v", op, name)
+		}
+
+		switch fault.Kind {
+		case FaultLatency:
+			time.Sleep(fault.Delay)
+		case FaultError:
+			return nil, err
+		case FaultPanic:
+			panic(err)
+		default:
+			streamFaults = append(streamFaults, fault)
+		}
+	}
+	return streamFaults, nil
+}
+
+// Wrap factory so that the arrays it creates or opens suffer the given
+// faults. Catalog operations are passed through untouched. The arrays don't
+// implement PartByteSlicer so reads always go through (faulty) readers.
+func NewFaultyFactory(factory *ArrayFactory, faults ...Fault) *ArrayFactory {
+	injector := &faultInjector{faults: faults, nCalls: make([]int, len(faults))}
+
+	return &ArrayFactory{
+		Unlimited: factory.Unlimited,
+
+		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
+			if _, err := injector.inject(FaultCreate, name); err != nil {
+				return nil, err
+			}
+			arr, err := factory.Create(name, shape)
+			if err != nil {
+				return nil, err
+			}
+			return &faultyArray{inner: arr, name: name, injector: injector}, nil
+		},
+		Open: func(name string) (DistribArray, error) {
+			if _, err := injector.inject(FaultOpen, name); err != nil {
+				return nil, err
+			}
+			arr, err := factory.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			return &faultyArray{inner: arr, name: name, injector: injector}, nil
+		},
+		List:   factory.List,
+		Stat:   factory.Stat,
+		Exists: factory.Exists,
+		Remove: factory.Remove,
+	}
+}
+
+type faultyArray struct {
+	inner    DistribArray
+	name     string
+	injector *faultInjector
+}
+
+func (self *faultyArray) ArrayName() string {
+	return self.name
+}
+
+func (self *faultyArray) GetShape() (*DistribArrayShape, error) {
+	if _, err := self.injector.inject(FaultShape, self.name); err != nil {
+		return nil, err
+	}
+	return self.inner.GetShape()
+}
+
+func (self *faultyArray) GetPartReader(partId int) (io.ReadCloser, error) {
+	return self.GetPartRangeReader(partId, 0, 0)
+}
+
+func (self *faultyArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	faults, err := self.injector.inject(FaultRead, self.name)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := self.inner.GetPartRangeReader(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fault := range faults {
+		if fault.Kind == FaultTruncate {
+			reader = &truncatedReader{Reader: io.LimitReader(reader, (int64)(fault.Bytes)), Closer: reader}
+		}
+	}
+	return reader, nil
+}
+
+func (self *faultyArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	faults, err := self.injector.inject(FaultWrite, self.name)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := self.inner.GetPartWriter(partId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fault := range faults {
+		if fault.Kind == FaultShortWrite {
+			writer = &shortWriter{WriteCloser: writer, remaining: fault.Bytes}
+		}
+	}
+	return writer, nil
+}
+
+func (self *faultyArray) Close() error {
+	if _, err := self.injector.inject(FaultClose, self.name); err != nil {
+		return err
+	}
+	return self.inner.Close()
+}
+
+func (self *faultyArray) Destroy() error {
+	if _, err := self.injector.inject(FaultDestroy, self.name); err != nil {
+		return err
+	}
+	return self.inner.Destroy()
+}
+
+type truncatedReader struct {
+	io.Reader
+	io.Closer
+}
+
+type shortWriter struct {
+	io.WriteCloser
+	remaining int
+}
+
+func (self *shortWriter) Write(b []byte) (int, error) {
+	if len(b) <= self.remaining {
+		n, err := self.WriteCloser.Write(b)
+		self.remaining -= n
+		return n, err
+	}
+
+	n, err := self.WriteCloser.Write(b[:self.remaining])
+	self.remaining -= n
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Create a memory array called name with one full partition per entry of
+// parts and close it
+func faultTestArray(t *testing.T, name string, parts ...[]byte) {
+	caps := make([]int64, len(parts))
+	for i, part := range parts {
+		caps[i] = (int64)(len(part))
+	}
+	arr, err := MemArrayFactory.Create(name, CreateShape(caps))
+	require.Nil(t, err, "Failed to create array")
+	for i, part := range parts {
+		_, err = WritePartCtx(context.Background(), arr, i, part)
+		require.Nil(t, err, "Failed to write array")
+	}
+	require.Nil(t, arr.Close())
+}
+
+func TestFaultyFactoryErrors(t *testing.T) {
+	faultTestArray(t, "faultErrors", make([]byte, 8))
+	defer removeArray(MemArrayFactory, "faultErrors")
+
+	factory := NewFaultyFactory(MemArrayFactory,
+		Fault{Op: FaultOpen, Kind: FaultError, Call: 2},
+		Fault{Op: FaultOpen, Kind: FaultError, Array: "other"},
+		Fault{Op: FaultShape, Kind: FaultPanic})
+
+	arr, err := factory.Open("faultErrors")
+	require.Nil(t, err, "First open failed")
+
+	_, err = factory.Open("faultErrors")
+	require.Equal(t, ErrInjected, errors.Cause(err), "Second open didn't fail")
+
+	_, err = factory.Open("faultErrors")
+	require.Nil(t, err, "Third open failed")
+
+	_, err = factory.Open("otherArray")
+	require.Equal(t, ErrInjected, errors.Cause(err), "Fault for another array didn't apply")
+
+	require.Panics(t, func() { arr.GetShape() }, "GetShape didn't panic")
+}
+
+func TestFaultyFactoryLatency(t *testing.T) {
+	faultTestArray(t, "faultLatency", make([]byte, 8))
+	defer removeArray(MemArrayFactory, "faultLatency")
+
+	factory := NewFaultyFactory(MemArrayFactory, Fault{Op: FaultRead, Kind: FaultLatency, Delay: 20 * time.Millisecond})
+	arr, err := factory.Open("faultLatency")
+	require.Nil(t, err)
+
+	start := time.Now()
+	reader, err := arr.GetPartReader(0)
+	require.Nil(t, err)
+	reader.Close()
+	require.True(t, time.Since(start) >= 20*time.Millisecond, "Read wasn't delayed")
+}
+
+// Truncated reads show up as a FetchError for the reference they hit
+func TestFetchPartRefsTruncated(t *testing.T) {
+	faultTestArray(t, "faultTruncated", make([]byte, 64), make([]byte, 64))
+	defer removeArray(MemArrayFactory, "faultTruncated")
+
+	factory := NewFaultyFactory(MemArrayFactory, Fault{Op: FaultRead, Kind: FaultTruncate, Call: 2, Bytes: 10})
+	arr, err := factory.Open("faultTruncated")
+	require.Nil(t, err)
+
+	refs := []*PartRef{
+		&PartRef{Arr: arr, PartIdx: 0, Start: 0, NByte: 64},
+		&PartRef{Arr: arr, PartIdx: 1, Start: 0, NByte: 32},
+		&PartRef{Arr: arr, PartIdx: 1, Start: 32, NByte: 32},
+	}
+	_, err = FetchPartRefsCtx(context.Background(), refs, FetchOptions{Concurrency: 1})
+	require.NotNil(t, err, "Truncated fetch succeeded")
+	require.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err), "Wrong error for a truncated read")
+
+	fetchErr, ok := err.(*FetchError)
+	require.True(t, ok, "Fetch didn't return a FetchError")
+	require.Equal(t, 1, fetchErr.RefIdx, "Wrong reference blamed")
+	require.Equal(t, 10, fetchErr.NRead, "Wrong number of bytes read")
+}
+
+func TestWritePartShortWrite(t *testing.T) {
+	factory := NewFaultyFactory(MemArrayFactory, Fault{Op: FaultWrite, Kind: FaultShortWrite, Bytes: 5})
+	arr, err := factory.Create("faultShortWrite", CreateShape([]int64{16}))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	n, err := WritePartCtx(context.Background(), arr, 0, make([]byte, 16))
+	require.Equal(t, io.ErrShortWrite, err, "Short write wasn't reported")
+	require.Equal(t, 5, n, "Wrong number of bytes written")
+
+	shape, err := arr.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(5), shape.Len(0), "Short write stored the wrong amount")
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -17,31 +18,228 @@ import (
 type fileShape struct {
 	Lens []int64
 	Caps []int64
+
+	// Omitted for PACKED arrays so that older readers (and pylibsort) still
+	// understand the metadata.
+	Layout string `json:",omitempty"`
+
+	// Compression (see file_compress.go), omitted for RAW arrays. Blocks
+	// holds the stored size of each block in each partition.
+	Codec   string    `json:",omitempty"`
+	BlockSz int64     `json:",omitempty"`
+	Blocks  [][]int64 `json:",omitempty"`
+}
+
+// Describes how a FileDistribArray lays its partitions out on disk
+type FileLayout int
+
+const (
+	// All partitions share a single data.dat at fixed offsets
+	PACKED FileLayout = iota
+	// Each partition is stored in its own p${partID}.dat
+	PERPART
+)
+
+var layoutNames = map[FileLayout]string{
+	PACKED:  "packed",
+	PERPART: "perpart",
+}
+
+func (self FileLayout) String() string {
+	return layoutNames[self]
+}
+
+// Metadata without a layout predates PERPART and is always PACKED
+func parseLayout(name string) (FileLayout, error) {
+	if name == "" {
+		return PACKED, nil
+	}
+
+	for layout, layoutName := range layoutNames {
+		if name == layoutName {
+			return layout, nil
+		}
+	}
+	return PACKED, fmt.Errorf("Unrecognized array layout: %q", name)
+}
+
+// Options for a FileDistribArray. Options describing the on-disk format (e.g.
+// layout) only apply to Create, opening an existing array always uses the
+// format recorded in its metadata. The rest apply to both.
+type fileOpts struct {
+	layout   FileLayout
+	codec    FileCodec
+	mmap     bool
+	direct   bool
+	prealloc bool
+}
+
+type FileOption func(*fileOpts)
+
+func newFileOpts(opts []FileOption) fileOpts {
+	var cfg fileOpts
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// Select the on-disk layout for new arrays (defaults to PACKED)
+func WithLayout(layout FileLayout) FileOption {
+	return func(opts *fileOpts) {
+		opts.layout = layout
+	}
+}
+
+// Compress partitions of new arrays with codec (defaults to RAW). Compressed
+// arrays always use buffered I/O, WithMmap() and WithDirectIO() are ignored
+// for them.
+func WithCodec(codec FileCodec) FileOption {
+	return func(opts *fileOpts) {
+		opts.codec = codec
+	}
+}
+
+// Serve range readers from a memory mapping of the data files rather than
+// re-opening and seeking for each reader.
+func WithMmap() FileOption {
+	return func(opts *fileOpts) {
+		opts.mmap = true
+	}
 }
 
-func NewFileArrayFactory(rootDir string) *ArrayFactory {
+// Bypass the page cache (O_DIRECT) for readers and writers. Filesystems that
+// don't support direct I/O (e.g. tmpfs on older kernels) silently fall back to
+// buffered I/O. Readers from arrays opened WithMmap() always use the page
+// cache, as do writes to blocks only partly covered by the data written (e.g.
+// blocks shared by neighbouring PACKED partitions).
+func WithDirectIO() FileOption {
+	return func(opts *fileOpts) {
+		opts.direct = true
+	}
+}
+
+// Reserve disk space for each partition's full capacity up front (with
+// fallocate) rather than as data is written. File sizes still track the data
+// written. This is ignored if the filesystem does not support it.
+func WithPrealloc() FileOption {
+	return func(opts *fileOpts) {
+		opts.prealloc = true
+	}
+}
+
+func NewFileArrayFactory(rootDir string, opts ...FileOption) *ArrayFactory {
 	return &ArrayFactory{
+		Unlimited: newFileOpts(opts).layout == PERPART,
+
 		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
-			a, err := CreateFileDistribArray(filepath.Join(rootDir, name), shape)
+			a, err := CreateFileDistribArray(filepath.Join(rootDir, name), shape, opts...)
 			return (DistribArray)(a), err
 		},
 
 		Open: func(name string) (DistribArray, error) {
-			a, err := OpenFileDistribArray(filepath.Join(rootDir, name))
+			a, err := OpenFileDistribArray(filepath.Join(rootDir, name), opts...)
 			return (DistribArray)(a), err
 		},
+
+		// Arrays are the subdirectories of rootDir with a meta.json
+		List: func() ([]string, error) {
+			entries, err := ioutil.ReadDir(rootDir)
+			if err != nil {
+				return nil, err
+			}
+
+			var names []string
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(rootDir, entry.Name(), "meta.json")); err == nil {
+					names = append(names, entry.Name())
+				}
+			}
+			return names, nil
+		},
+
+		Stat: func(name string) (*ArrayInfo, error) {
+			return StatFileDistribArray(filepath.Join(rootDir, name))
+		},
+
+		Exists: func(name string) (bool, error) {
+			_, err := os.Stat(filepath.Join(rootDir, name, "meta.json"))
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+
+		Remove: func(name string) error {
+			return os.RemoveAll(filepath.Join(rootDir, name))
+		},
+	}
+}
+
+// Describe the array at rootPath without opening it. The modification time is
+// that of the most recently modified file in the array.
+func StatFileDistribArray(rootPath string) (*ArrayInfo, error) {
+	metaBytes, err := ioutil.ReadFile(filepath.Join(rootPath, "meta.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read metadata")
+	}
+
+	var jsonShape fileShape
+	if err := json.Unmarshal(metaBytes, &jsonShape); err != nil {
+		return nil, errors.Wrap(err, "Failed to interpret metadata")
+	}
+
+	info := &ArrayInfo{Name: filepath.Base(rootPath),
+		Shape: DistribArrayShape{lens: jsonShape.Lens, caps: jsonShape.Caps}}
+
+	entries, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.ModTime().After(info.ModTime) {
+			info.ModTime = entry.ModTime()
+		}
 	}
+
+	return info, nil
 }
 
 // Stores a distributed array in the filesystem (in the directory at RootPath).
-// There are two files:
+// The files depend on the array's layout:
 //		meta.json: stores metadata about the array. First 'lens', then 'caps'
-//			(file size can be used to dermine the number of partitions)
-//		data.dat: Stores the actual data, each partition starts at offset
-//			starts[partID] in the file.
+//			(file size can be used to dermine the number of partitions). Also
+//			records the layout for non-PACKED arrays.
+//		data.dat (PACKED): Stores the actual data, each partition starts at
+//			offset starts[partID] in the file.
+//		p${partID}.dat (PERPART): Stores the data for partition partID. Files
+//			are created on the first write, a missing file is an empty
+//			partition.
 type FileDistribArray struct {
 	RootPath string
-	fd       *os.File
+	layout   FileLayout
+	fd       *os.File // Shared data.dat handle (PACKED only)
+	useMmap  bool
+	prealloc bool
+
+	// Non-zero while O_DIRECT should be attempted, see file_direct.go
+	directIO int32
+
+	// Read-only mappings of the data files, see file_mmap.go
+	maps mmapCache
+
+	// Compression state, see file_compress.go. blocks[partID] lists the
+	// stored size of each blockSz block in the partition.
+	codec   FileCodec
+	blockSz int64
+	blocks  [][]int64
+
+	// Running totals of blocks, blockEnds[partID][i] is where block i of the
+	// partition ends relative to the start of the partition
+	blockEnds [][]int64
 
 	// like len and cap for slices for each partition
 	shape DistribArrayShape
@@ -49,6 +247,11 @@ type FileDistribArray struct {
 	// Optimization/convenience stores the starting point of each partition in
 	// the file
 	starts []int64
+
+	// Closed arrays can still be read but not written, destroyed arrays can't
+	// be used at all
+	closed    bool
+	destroyed bool
 }
 
 type FileDistribRangeReader struct {
@@ -61,13 +264,24 @@ type FileDistribRangeReader struct {
 type FileDistribWriter struct {
 	arr    *FileDistribArray
 	partId int
+
+	// Private handle for PERPART arrays, PACKED writers share arr.fd
+	fd *os.File
+
+	// Where the next write goes in fd. Writers don't use the file position so
+	// that PACKED writers for different partitions can be used concurrently.
+	pos int64
 }
 
 // Create a new FileDistribArray object from an existing on-disk array
-func OpenFileDistribArray(rootPath string) (*FileDistribArray, error) {
+func OpenFileDistribArray(rootPath string, opts ...FileOption) (*FileDistribArray, error) {
 	var err error
 
-	arr := &FileDistribArray{}
+	cfg := newFileOpts(opts)
+	arr := &FileDistribArray{useMmap: cfg.mmap, prealloc: cfg.prealloc}
+	if cfg.direct {
+		arr.directIO = 1
+	}
 
 	arr.RootPath, err = filepath.Abs(rootPath)
 	if err != nil {
@@ -79,22 +293,29 @@ func OpenFileDistribArray(rootPath string) (*FileDistribArray, error) {
 		return nil, errors.Wrap(err, "Failed to load metadata")
 	}
 
-	dataPath := filepath.Join(arr.RootPath, "data.dat")
-	dataFile, err := os.OpenFile(dataPath, os.O_RDWR, 0600)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to create data file")
+	if arr.layout == PACKED {
+		dataFile, err := os.OpenFile(arr.dataPath(), os.O_RDWR, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create data file")
+		}
+		arr.fd = dataFile
 	}
-	arr.fd = dataFile
 
 	return arr, nil
 }
 
 // Create a new file-backed distributed array. caps describes the size of each
-// partition (like capacity in a slice). Partitions cannot be resized.
-func CreateFileDistribArray(rootPath string, shape DistribArrayShape) (*FileDistribArray, error) {
+// partition (like capacity in a slice). Partitions cannot be resized, except
+// that a zero capacity in a PERPART array means the partition is unlimited.
+func CreateFileDistribArray(rootPath string, shape DistribArrayShape, opts ...FileOption) (*FileDistribArray, error) {
 	var err error
 
-	arr := &FileDistribArray{}
+	cfg := newFileOpts(opts)
+	arr := &FileDistribArray{layout: cfg.layout, codec: cfg.codec,
+		useMmap: cfg.mmap, prealloc: cfg.prealloc}
+	if cfg.direct {
+		arr.directIO = 1
+	}
 
 	rootPath, err = filepath.Abs(rootPath)
 	if err != nil {
@@ -115,6 +336,12 @@ func CreateFileDistribArray(rootPath string, shape DistribArrayShape) (*FileDist
 	copy(arr.shape.caps, shape.caps)
 	copy(arr.shape.lens, shape.lens)
 
+	if arr.codec != RAW {
+		arr.blockSz = compressBlockSz
+		arr.blocks = make([][]int64, len(shape.caps))
+		arr.blockEnds = make([][]int64, len(shape.caps))
+	}
+
 	arr.starts = make([]int64, len(shape.caps))
 	capSum := (int64)(0)
 	for i := 0; i < len(shape.caps); i++ {
@@ -125,15 +352,20 @@ func CreateFileDistribArray(rootPath string, shape DistribArrayShape) (*FileDist
 	//=============================
 	// Backing file
 	//=============================
-	dataPath := filepath.Join(rootPath, "data.dat")
-
-	// Go's create() doesn't allow you to set permissions so we have to
-	// open and then immediately close
-	dataFile, err := os.OpenFile(dataPath, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to create data file")
+	// PERPART files are created by their first writer
+	if arr.layout == PACKED {
+		// Go's create() doesn't allow you to set permissions so we have to
+		// open and then immediately close
+		dataFile, err := os.OpenFile(arr.dataPath(), os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create data file")
+		}
+		arr.fd = dataFile
+
+		if err = arr.preallocate(dataFile, capSum); err != nil {
+			return nil, err
+		}
 	}
-	arr.fd = dataFile
 
 	err = arr.commitMeta()
 	if err != nil {
@@ -143,11 +375,45 @@ func CreateFileDistribArray(rootPath string, shape DistribArrayShape) (*FileDist
 	return arr, nil
 }
 
+func (self *FileDistribArray) dataPath() string {
+	return filepath.Join(self.RootPath, "data.dat")
+}
+
+func (self *FileDistribArray) partPath(partId int) string {
+	return filepath.Join(self.RootPath, fmt.Sprintf("p%v.dat", partId))
+}
+
+// The file holding partId and the offset of the partition within it
+func (self *FileDistribArray) partLocation(partId int) (string, int64) {
+	if self.layout == PERPART {
+		return self.partPath(partId), 0
+	}
+	return self.dataPath(), self.starts[partId]
+}
+
+// Layout reports how this array is stored on disk
+func (self *FileDistribArray) Layout() FileLayout {
+	return self.layout
+}
+
+// Codec reports how this array's partitions are compressed
+func (self *FileDistribArray) Codec() FileCodec {
+	return self.codec
+}
+
 func (self *FileDistribArray) commitMeta() error {
 	jsonShape := fileShape{Lens: self.shape.lens, Caps: self.shape.caps}
+	if self.layout != PACKED {
+		jsonShape.Layout = self.layout.String()
+	}
+	if self.codec != RAW {
+		jsonShape.Codec = self.codec.String()
+		jsonShape.BlockSz = self.blockSz
+		jsonShape.Blocks = self.blocks
+	}
 
 	metaPath := filepath.Join(self.RootPath, "meta.json")
-	metaFile, err := os.OpenFile(metaPath, os.O_CREATE|os.O_WRONLY, 0600)
+	metaFile, err := os.OpenFile(metaPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to create metdata file")
 	}
@@ -188,6 +454,31 @@ func (self *FileDistribArray) loadMeta() error {
 	self.shape.lens = jsonShape.Lens
 	self.shape.caps = jsonShape.Caps
 
+	self.layout, err = parseLayout(jsonShape.Layout)
+	if err != nil {
+		return err
+	}
+
+	self.codec, err = parseCodec(jsonShape.Codec)
+	if err != nil {
+		return err
+	}
+	if self.codec != RAW {
+		self.blockSz = jsonShape.BlockSz
+		self.blocks = jsonShape.Blocks
+		if self.blocks == nil {
+			self.blocks = make([][]int64, len(self.shape.lens))
+		}
+		self.blockEnds = make([][]int64, len(self.blocks))
+		for partId, sizes := range self.blocks {
+			end := (int64)(0)
+			for _, sz := range sizes {
+				end += sz
+				self.blockEnds[partId] = append(self.blockEnds[partId], end)
+			}
+		}
+	}
+
 	if err := metaFile.Close(); err != nil {
 		return errors.Wrapf(err, "Failed to close metadata file")
 	}
@@ -201,33 +492,73 @@ func (self *FileDistribArray) loadMeta() error {
 	return nil
 }
 
+func (self *FileDistribArray) ArrayName() string {
+	return filepath.Base(self.RootPath)
+}
+
 func (self *FileDistribArray) GetShape() (*DistribArrayShape, error) {
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
 	// Copy the slices but not their underlying array (DistribArrayShape is immutable)
 	return &DistribArrayShape{lens: self.shape.lens, caps: self.shape.caps}, nil
 }
 
+// Validate GetPartRangeReader arguments and convert them into an absolute
+// limit within partId
+func (self *FileDistribArray) rangeLimit(partId, start, end int) (int, error) {
+	if self.destroyed {
+		return 0, ErrClosed
+	}
+	return self.shape.resolveRange(partId, start, end)
+}
+
 func (self *FileDistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
-	var err error
+	limit, err := self.rangeLimit(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.codec != RAW {
+		return self.getCompressReader(partId, start, limit)
+	}
+
+	if self.useMmap && mmapSupported {
+		buf, err := self.GetPartRangeBytes(partId, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return &MemDistribPartReadCloser{buf: buf, start: 0, limit: len(buf)}, nil
+	}
 
 	reader := FileDistribRangeReader{}
+	reader.nRemaining = limit - start
+
+	path, partStart := self.partLocation(partId)
 
 	// Re-open file to get thread-safe readers
-	reader.file, err = os.Open(filepath.Join(self.RootPath, "data.dat"))
+	var direct bool
+	reader.file, direct, err = self.openData(path, os.O_RDONLY)
+	if direct {
+		return &FileDistribDirectReader{file: reader.file, buf: alignedBuf(directBufSz),
+			pos: partStart + (int64)(start), limit: partStart + (int64)(start+reader.nRemaining)}, nil
+	}
 	if err != nil {
+		// PERPART files don't exist until they are written to
+		if os.IsNotExist(err) && self.layout == PERPART && reader.nRemaining == 0 {
+			reader.file = nil
+			return &reader, nil
+		}
 		return nil, err
 	}
 
-	_, err = reader.file.Seek(self.starts[partId]+(int64)(start), 0)
+	_, err = reader.file.Seek(partStart+(int64)(start), 0)
 	if err != nil {
+		reader.file.Close()
 		return nil, err
 	}
 
-	if end <= 0 {
-		reader.nRemaining = (int)(self.shape.lens[partId] + (int64)(end) - (int64)(start))
-	} else {
-		reader.nRemaining = end - start
-	}
-
 	return &reader, nil
 }
 
@@ -238,7 +569,15 @@ func (self *FileDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
 func (self *FileDistribArray) Close() error {
 	// var eMsg string
 
-	closeErr := self.fd.Close()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+
+	var closeErr error
+	if self.fd != nil {
+		closeErr = self.fd.Close()
+	}
 	metaErr := self.commitMeta()
 
 	if closeErr != nil || metaErr != nil {
@@ -248,15 +587,40 @@ func (self *FileDistribArray) Close() error {
 	return nil
 }
 
+// Destroy may be called more than once
 func (self *FileDistribArray) Destroy() error {
+	if self.destroyed {
+		return nil
+	}
+
 	// It really doesn't matter if there is an error on closing. We might eat
 	// up resources but RemoveAll means the OS will get to it eventually (the
 	// fd will be closed on process exit at a minimum). Consistency is
 	// irrelevant since the resource is being removed anyway.
 	self.Close()
+	// Byte slices and mmap readers handed out earlier stay valid until now,
+	// including mappings made after Close
+	self.maps.unmapAll()
+	self.destroyed = true
 
 	return os.RemoveAll(self.RootPath)
 }
+
+// Release the storage for a single partition of a PERPART array (e.g. once
+// every consumer has read it). The partition's metadata is untouched but
+// subsequent reads of its data will fail.
+func (self *FileDistribArray) DestroyPart(partId int) error {
+	if self.layout != PERPART {
+		return fmt.Errorf("Partitions can only be destroyed individually in %v arrays, this array is %v", PERPART, self.layout)
+	}
+
+	err := os.Remove(self.partPath(partId))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove partition %v", partId)
+	}
+	return nil
+}
+
 func (self *FileDistribRangeReader) Read(dst []byte) (n int, err error) {
 	var toRead int
 	if len(dst) < self.nRemaining {
@@ -266,6 +630,10 @@ func (self *FileDistribRangeReader) Read(dst []byte) (n int, err error) {
 		err = io.EOF
 	}
 
+	if self.file == nil {
+		return 0, err
+	}
+
 	n, readErr := self.file.Read(dst[:toRead])
 	self.nRemaining -= n
 	if readErr != nil {
@@ -276,35 +644,100 @@ func (self *FileDistribRangeReader) Read(dst []byte) (n int, err error) {
 }
 
 func (self *FileDistribRangeReader) Close() error {
+	if self.file == nil {
+		return nil
+	}
 	return self.file.Close()
 }
 
+// Writers for different partitions may run concurrently. PACKED writers
+// share the array's file handle but write at their own offsets, PERPART
+// writers have their own handle. Direct I/O writers only use O_DIRECT for
+// blocks inside their own data, blocks shared with a neighbouring partition
+// go through the page cache.
 func (self *FileDistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
 	var err error
 
-	writer := &FileDistribWriter{arr: self, partId: partId}
+	if self.closed {
+		return nil, ErrClosed
+	}
+	if err = self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+
+	if self.codec != RAW {
+		return self.getCompressWriter(partId)
+	}
 
-	_, err = writer.arr.fd.Seek(self.starts[partId]+(int64)(self.shape.lens[partId]), 0)
+	if self.layout == PACKED && atomic.LoadInt32(&self.directIO) == 0 {
+		return self.getPackedWriter(partId)
+	}
+
+	path, partStart := self.partLocation(partId)
+	f, direct, err := self.openData(path, os.O_CREATE|os.O_WRONLY)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "Failed to open partition %v", partId)
+	}
+
+	if self.layout == PACKED && !direct {
+		// Fell back to buffered I/O
+		f.Close()
+		return self.getPackedWriter(partId)
+	}
+
+	// PACKED arrays are preallocated in one go by Create
+	if self.layout == PERPART && self.shape.lens[partId] == 0 {
+		if err = self.preallocate(f, self.shape.caps[partId]); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if direct {
+		writer, err := self.newDirectWriter(partId, f, partStart+self.shape.lens[partId])
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return writer, nil
+	}
+
+	return &FileDistribWriter{arr: self, partId: partId, fd: f, pos: self.shape.lens[partId]}, nil
+}
+
+func (self *FileDistribArray) getPackedWriter(partId int) (io.WriteCloser, error) {
+	return &FileDistribWriter{arr: self, partId: partId, fd: self.fd,
+		pos: self.starts[partId] + (int64)(self.shape.lens[partId])}, nil
+}
+
+// Returns how much of a want byte write fits in partId
+func (self *FileDistribArray) writeLimit(partId int, want int64) int64 {
+	partCap := self.shape.caps[partId]
+
+	// File arrays have fixed-sized partitions (they're also append-only).
+	// PERPART files can grow independently so they honor unlimited (zero)
+	// capacities.
+	if self.layout == PERPART && partCap == 0 {
+		return want
 	}
 
-	return writer, nil
+	nRemaining := partCap - self.shape.lens[partId]
+	if want > nRemaining {
+		return nRemaining
+	}
+	return want
 }
 
 func (self *FileDistribWriter) Write(b []byte) (int, error) {
 	var err error
 
-	nRemaining := self.arr.shape.caps[self.partId] - self.arr.shape.lens[self.partId]
-
-	// File arrays have fixed-sized partitions (they're also append-only)
-	toWrite := (int64)(len(b))
-	if toWrite > nRemaining {
+	toWrite := self.arr.writeLimit(self.partId, (int64)(len(b)))
+	if toWrite < (int64)(len(b)) {
 		err = io.EOF
-		toWrite = nRemaining
 	}
 
-	n, wErr := self.arr.fd.Write(b[:toWrite])
+	n, wErr := self.fd.WriteAt(b[:toWrite], self.pos)
+	self.pos += (int64)(n)
 	self.arr.shape.lens[self.partId] += (int64)(n)
 
 	if wErr != nil {
@@ -314,5 +747,8 @@ func (self *FileDistribWriter) Write(b []byte) (int, error) {
 }
 
 func (self *FileDistribWriter) Close() error {
+	if self.arr.layout == PERPART {
+		return self.fd.Close()
+	}
 	return nil
 }
@@ -0,0 +1,392 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Compression applied to the partitions of a FileDistribArray
+type FileCodec int
+
+const (
+	// Data is stored as-is
+	RAW FileCodec = iota
+	// DEFLATE (compress/flate) without string matching. Sort keys have
+	// almost no repeated substrings for LZ77 to find but their bytes are far
+	// from uniform (e.g. every key in a bucket shares its radix bits).
+	FLATE
+	// Data is interpreted as little-endian uint32s and each value is stored
+	// as a varint of the (zig-zag encoded) difference from the previous
+	// value. Works well for fully sorted data (e.g. the final output of a
+	// sort). Intermediate LSD steps only order the low bits so neighboring
+	// values differ in their high bits and DELTA can't beat RAW on them.
+	DELTA
+)
+
+var codecNames = map[FileCodec]string{
+	RAW:   "raw",
+	FLATE: "flate",
+	DELTA: "delta",
+}
+
+func (self FileCodec) String() string {
+	return codecNames[self]
+}
+
+// Metadata without a codec predates compression and is always RAW
+func parseCodec(name string) (FileCodec, error) {
+	if name == "" {
+		return RAW, nil
+	}
+
+	for codec, codecName := range codecNames {
+		if name == codecName {
+			return codec, nil
+		}
+	}
+	return RAW, fmt.Errorf("Unrecognized array codec: %q", name)
+}
+
+// Compressed partitions are split into blocks of this many (uncompressed)
+// bytes. Each block is compressed independently so that range reads only have
+// to decompress the blocks they touch. Recorded in the metadata so that it
+// can change in the future.
+const compressBlockSz = 256 * 1024
+
+// Blocks that don't shrink when compressed are stored uncompressed. A block
+// is raw iff its stored size matches its uncompressed size, this keeps
+// compressed partitions within their (uncompressed) capacity.
+func encodeBlock(codec FileCodec, src []byte) ([]byte, error) {
+	var out []byte
+
+	switch codec {
+	case FLATE:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.HuffmanOnly)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(src); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+
+	case DELTA:
+		out = make([]byte, 0, len(src))
+		varint := make([]byte, binary.MaxVarintLen64)
+		prev := (int64)(0)
+		nWord := len(src) / 4
+		for i := 0; i < nWord; i++ {
+			v := (int64)(binary.LittleEndian.Uint32(src[i*4:]))
+			n := binary.PutVarint(varint, v-prev)
+			out = append(out, varint[:n]...)
+			prev = v
+			if len(out) >= len(src) {
+				break
+			}
+		}
+		out = append(out, src[nWord*4:]...)
+
+	default:
+		return src, nil
+	}
+
+	if len(out) >= len(src) {
+		return src, nil
+	}
+	return out, nil
+}
+
+// Decode stored into dst (which must be exactly the uncompressed size)
+func decodeBlock(codec FileCodec, dst []byte, stored []byte) error {
+	if len(stored) == len(dst) {
+		copy(dst, stored)
+		return nil
+	}
+
+	switch codec {
+	case FLATE:
+		r := flate.NewReader(bytes.NewReader(stored))
+		defer r.Close()
+		if _, err := io.ReadFull(r, dst); err != nil {
+			return errors.Wrap(err, "Corrupted flate block")
+		}
+
+	case DELTA:
+		nWord := len(dst) / 4
+		prev := (int64)(0)
+		pos := 0
+		for i := 0; i < nWord; i++ {
+			d, n := binary.Varint(stored[pos:])
+			if n <= 0 {
+				return fmt.Errorf("Corrupted delta block at word %v", i)
+			}
+			pos += n
+			prev += d
+			binary.LittleEndian.PutUint32(dst[i*4:], (uint32)(prev))
+		}
+		if len(stored)-pos != len(dst)-nWord*4 {
+			return fmt.Errorf("Corrupted delta block: %v trailing bytes, expected %v", len(stored)-pos, len(dst)-nWord*4)
+		}
+		copy(dst[nWord*4:], stored[pos:])
+
+	default:
+		return fmt.Errorf("Block has the wrong size for a %v array: %v, expected %v", codec, len(stored), len(dst))
+	}
+
+	return nil
+}
+
+// Uncompressed size of block blockIdx of partId
+func (self *FileDistribArray) blockLen(partId int, blockIdx int) int {
+	remaining := self.shape.lens[partId] - (int64)(blockIdx)*self.blockSz
+	if remaining > self.blockSz {
+		return (int)(self.blockSz)
+	}
+	return (int)(remaining)
+}
+
+// Offset of the start of blockIdx of partId relative to the start of the
+// partition
+func (self *FileDistribArray) blockOffset(partId int, blockIdx int) int64 {
+	if blockIdx == 0 {
+		return 0
+	}
+	return self.blockEnds[partId][blockIdx-1]
+}
+
+// Add a block of storedSz bytes to the end of partId's index
+func (self *FileDistribArray) appendBlock(partId int, storedSz int64) {
+	self.blockEnds[partId] = append(self.blockEnds[partId], self.blockOffset(partId, len(self.blocks[partId]))+storedSz)
+	self.blocks[partId] = append(self.blocks[partId], storedSz)
+}
+
+func (self *FileDistribArray) readBlock(f *os.File, partId int, blockIdx int, dst []byte) ([]byte, error) {
+	_, partStart := self.partLocation(partId)
+	stored := make([]byte, self.blocks[partId][blockIdx])
+
+	_, err := f.ReadAt(stored, partStart+self.blockOffset(partId, blockIdx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read block %v of partition %v", blockIdx, partId)
+	}
+
+	dst = dst[:self.blockLen(partId, blockIdx)]
+	if err = decodeBlock(self.codec, dst, stored); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode block %v of partition %v", blockIdx, partId)
+	}
+	return dst, nil
+}
+
+// Reads an uncompressed range of a compressed partition
+type FileDistribCompressReader struct {
+	arr    *FileDistribArray
+	partId int
+	file   *os.File
+
+	nextBlock  int
+	buf        []byte // Remainder of the current decompressed block
+	blockBuf   []byte
+	nRemaining int
+}
+
+// limit is absolute and has already been validated
+func (self *FileDistribArray) getCompressReader(partId, start, limit int) (io.ReadCloser, error) {
+	reader := &FileDistribCompressReader{arr: self, partId: partId,
+		nextBlock:  (int)((int64)(start) / self.blockSz),
+		blockBuf:   make([]byte, self.blockSz),
+		nRemaining: limit - start,
+	}
+
+	if reader.nRemaining == 0 {
+		return reader, nil
+	}
+
+	path, _ := self.partLocation(partId)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader.file = f
+
+	if err = reader.loadBlock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	reader.buf = reader.buf[(int64)(start)%self.blockSz:]
+
+	return reader, nil
+}
+
+func (self *FileDistribCompressReader) loadBlock() (err error) {
+	self.buf, err = self.arr.readBlock(self.file, self.partId, self.nextBlock, self.blockBuf)
+	self.nextBlock++
+	return err
+}
+
+func (self *FileDistribCompressReader) Read(dst []byte) (int, error) {
+	n := 0
+	for n < len(dst) && self.nRemaining > 0 {
+		if len(self.buf) == 0 {
+			if err := self.loadBlock(); err != nil {
+				return n, err
+			}
+		}
+
+		toCopy := self.buf
+		if len(toCopy) > self.nRemaining {
+			toCopy = toCopy[:self.nRemaining]
+		}
+		nCopy := copy(dst[n:], toCopy)
+		self.buf = self.buf[nCopy:]
+		self.nRemaining -= nCopy
+		n += nCopy
+	}
+
+	if self.nRemaining == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (self *FileDistribCompressReader) Close() error {
+	if self.file == nil {
+		return nil
+	}
+	return self.file.Close()
+}
+
+// Appends to a compressed partition. Data is buffered until a block fills up
+// (or the writer is closed) and then compressed. Appending to a partition
+// that ends in a partial block re-compresses that block.
+type FileDistribCompressWriter struct {
+	arr    *FileDistribArray
+	partId int
+	file   *os.File
+	ownFd  bool
+
+	pos int64 // Where the next block will be stored
+	buf []byte
+}
+
+func (self *FileDistribArray) getCompressWriter(partId int) (io.WriteCloser, error) {
+	var err error
+
+	writer := &FileDistribCompressWriter{arr: self, partId: partId,
+		buf: make([]byte, 0, self.blockSz)}
+
+	path, partStart := self.partLocation(partId)
+	if self.layout == PERPART {
+		writer.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to open partition %v", partId)
+		}
+		writer.ownFd = true
+	} else {
+		writer.file = self.fd
+	}
+
+	nBlock := len(self.blocks[partId])
+	if nBlock != 0 && self.blockLen(partId, nBlock-1) != (int)(self.blockSz) {
+		writer.buf, err = self.readBlock(writer.file, partId, nBlock-1, writer.buf[:self.blockSz])
+		if err != nil {
+			writer.closeFile()
+			return nil, err
+		}
+		// The block is back in the buffer until the writer stores it again
+		self.shape.lens[partId] -= (int64)(len(writer.buf))
+		self.blocks[partId] = self.blocks[partId][:nBlock-1]
+		self.blockEnds[partId] = self.blockEnds[partId][:nBlock-1]
+		nBlock--
+	}
+	writer.pos = partStart + self.blockOffset(partId, nBlock)
+
+	return writer, nil
+}
+
+func (self *FileDistribCompressWriter) flush() error {
+	if len(self.buf) == 0 {
+		return nil
+	}
+
+	stored, err := encodeBlock(self.arr.codec, self.buf)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compress block")
+	}
+
+	if _, err = self.file.WriteAt(stored, self.pos); err != nil {
+		return err
+	}
+
+	self.pos += (int64)(len(stored))
+
+	// Readers find blocks through lens so it must only cover indexed blocks
+	self.arr.appendBlock(self.partId, (int64)(len(stored)))
+	self.arr.shape.lens[self.partId] += (int64)(len(self.buf))
+	self.buf = self.buf[:0]
+	return nil
+}
+
+func (self *FileDistribCompressWriter) Write(b []byte) (int, error) {
+	var err error
+
+	// Buffered bytes aren't counted in lens yet
+	buffered := (int64)(len(self.buf))
+	toWrite := self.arr.writeLimit(self.partId, buffered+(int64)(len(b))) - buffered
+	if toWrite < (int64)(len(b)) {
+		err = io.EOF
+	}
+
+	nWritten := 0
+	for (int64)(nWritten) < toWrite {
+		space := self.buf[len(self.buf):cap(self.buf)]
+		nCopy := copy(space, b[nWritten:toWrite])
+		self.buf = self.buf[:len(self.buf)+nCopy]
+		nWritten += nCopy
+
+		if len(self.buf) == cap(self.buf) {
+			if flushErr := self.flush(); flushErr != nil {
+				return nWritten, errors.Wrap(flushErr, "Failed to store block")
+			}
+		}
+	}
+
+	return nWritten, err
+}
+
+func (self *FileDistribCompressWriter) closeFile() error {
+	if self.ownFd {
+		return self.file.Close()
+	}
+	return nil
+}
+
+func (self *FileDistribCompressWriter) Close() error {
+	flushErr := self.flush()
+	closeErr := self.closeFile()
+
+	if flushErr != nil {
+		return errors.Wrap(flushErr, "Failed to store final block")
+	}
+	return closeErr
+}
+
+// Compressed arrays can't alias their storage, the returned slice is a copy
+func (self *FileDistribArray) getCompressedBytes(partId, start, limit int) ([]byte, error) {
+	reader, err := self.getCompressReader(partId, start, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Looks like a bucket after a radix step: every value has the same low byte
+// (the bucket) and neighboring values are close to each other.
+func generateCompressible(nByte int) []byte {
+	raw := make([]byte, nByte)
+	noise := make([]byte, nByte/4)
+	rand.Read(noise)
+	for i := 0; i < nByte/4; i++ {
+		binary.LittleEndian.PutUint32(raw[i*4:], (uint32)(i<<16)|(uint32)(noise[i])<<8|0x2a)
+	}
+	rand.Read(raw[(nByte/4)*4:])
+	return raw
+}
+
+func TestCodecBlocks(t *testing.T) {
+	for _, codec := range []FileCodec{FLATE, DELTA} {
+		for _, sz := range []int{0, 1, 7, 4096, compressBlockSz - 3} {
+			name := fmt.Sprintf("%v_%v", codec, sz)
+
+			t.Run(name+"_compressible", func(t *testing.T) {
+				raw := generateCompressible(sz)
+				stored, err := encodeBlock(codec, raw)
+				require.Nil(t, err, "Failed to encode")
+				require.LessOrEqual(t, len(stored), len(raw), "Encoded block grew")
+
+				out := make([]byte, sz)
+				require.Nil(t, decodeBlock(codec, out, stored), "Failed to decode")
+				require.True(t, bytes.Equal(raw, out), "Round trip changed the data")
+			})
+
+			t.Run(name+"_random", func(t *testing.T) {
+				raw := make([]byte, sz)
+				rand.Read(raw)
+				stored, err := encodeBlock(codec, raw)
+				require.Nil(t, err, "Failed to encode")
+				require.LessOrEqual(t, len(stored), len(raw), "Encoded block grew")
+
+				out := make([]byte, sz)
+				require.Nil(t, decodeBlock(codec, out, stored), "Failed to decode")
+				require.True(t, bytes.Equal(raw, out), "Round trip changed the data")
+			})
+		}
+	}
+}
+
+func TestFileDistribArrCompressed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	for _, codec := range []FileCodec{FLATE, DELTA} {
+		for _, layout := range []FileLayout{PACKED, PERPART} {
+			name := fmt.Sprintf("%v_%v", codec, layout)
+			t.Run(name, func(t *testing.T) {
+				arrDir := filepath.Join(tmpDir, name)
+				require.Nil(t, os.Mkdir(arrDir, 0700))
+				testDistribArr(t, NewFileArrayFactory(arrDir, WithCodec(codec), WithLayout(layout)))
+			})
+		}
+	}
+}
+
+func TestFileCompressRanges(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	partLen := 3*compressBlockSz + 4*123
+	caps := []int64{(int64)(partLen), (int64)(partLen)}
+
+	for _, codec := range []FileCodec{FLATE, DELTA} {
+		for _, layout := range []FileLayout{PACKED, PERPART} {
+			name := fmt.Sprintf("%v_%v", codec, layout)
+			t.Run(name, func(t *testing.T) {
+				arrPath := filepath.Join(tmpDir, name)
+				arr, err := CreateFileDistribArray(arrPath, CreateShape(caps), WithCodec(codec), WithLayout(layout))
+				require.Nil(t, err, "Failed to create array")
+				require.Equal(t, codec, arr.Codec())
+
+				raw := generateCompressible(2 * partLen)
+
+				// Odd-sized appends from fresh writers force partial blocks to
+				// be re-compressed
+				chunks := []int{5, compressBlockSz + 11, 4096, compressBlockSz / 2}
+				for partId := 0; partId < 2; partId++ {
+					part := raw[partId*partLen : (partId+1)*partLen]
+					for i, pos := 0, 0; pos < partLen; i++ {
+						end := pos + chunks[i%len(chunks)]
+						if end > partLen {
+							end = partLen
+						}
+
+						writer, err := arr.GetPartWriter(partId)
+						require.Nil(t, err, "Failed to get writer")
+						n, err := writer.Write(part[pos:end])
+						require.Nil(t, err, "Failed to write")
+						require.Equal(t, end-pos, n, "Short write")
+						require.Nil(t, writer.Close(), "Failed to close writer")
+						pos = end
+					}
+				}
+
+				// Writes beyond capacity still fail
+				writer, err := arr.GetPartWriter(0)
+				require.Nil(t, err, "Failed to get writer")
+				n, err := writer.Write([]byte{1})
+				require.NotNil(t, err, "Wrote past the capacity")
+				require.Zero(t, n, "Wrote past the capacity")
+				require.Nil(t, writer.Close())
+
+				require.Nil(t, arr.Close(), "Failed to close array")
+
+				reArr, err := OpenFileDistribArray(arrPath)
+				require.Nil(t, err, "Failed to reopen array")
+				defer reArr.Destroy()
+				require.Equal(t, codec, reArr.Codec(), "Codec not detected from metadata")
+
+				shape, err := reArr.GetShape()
+				require.Nil(t, err)
+				require.Equal(t, (int64)(partLen), shape.Len(1), "Lengths should be uncompressed")
+
+				stored := reArr.blockOffset(1, len(reArr.blocks[1]))
+				require.Less(t, stored, (int64)(partLen), "Data was not compressed")
+
+				ranges := [][2]int{{0, 0}, {0, 1}, {3, compressBlockSz + 1}, {compressBlockSz, 2 * compressBlockSz},
+					{compressBlockSz - 1, -1}, {partLen - 7, 0}}
+				for _, r := range ranges {
+					realEnd := r[1]
+					if realEnd <= 0 {
+						realEnd = partLen + realEnd
+					}
+
+					reader, err := reArr.GetPartRangeReader(1, r[0], r[1])
+					require.Nilf(t, err, "Failed to get reader for %v", r)
+					out, err := ioutil.ReadAll(reader)
+					require.Nilf(t, err, "Failed to read range %v", r)
+					require.Truef(t, bytes.Equal(raw[partLen+r[0]:partLen+realEnd], out), "Range %v returned wrong data", r)
+					require.Nil(t, reader.Close())
+
+					refBytes, err := (&PartRef{Arr: reArr, PartIdx: 1, Start: r[0], NByte: realEnd - r[0]}).Bytes()
+					require.Nilf(t, err, "Failed to get bytes for %v", r)
+					require.Truef(t, bytes.Equal(raw[partLen+r[0]:partLen+realEnd], refBytes), "Bytes() for %v returned wrong data", r)
+				}
+			})
+		}
+	}
+}
+
+// Readers only see data that has been stored in a block, even while a writer
+// is buffering the rest
+func TestFileCompressReadWhileWriting(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	partLen := 2*compressBlockSz + 100
+	arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "readWrite"), CreateShapeUniform((int64)(partLen), 1), WithCodec(FLATE))
+	require.Nil(t, err, "Failed to create array")
+	defer arr.Destroy()
+
+	raw := generateCompressible(partLen)
+	readAll := func() []byte {
+		reader, err := arr.GetPartReader(0)
+		require.Nil(t, err, "Failed to get reader")
+		defer reader.Close()
+		out, err := ioutil.ReadAll(reader)
+		require.Nil(t, err, "Failed to read")
+		return out
+	}
+
+	writer, err := arr.GetPartWriter(0)
+	require.Nil(t, err)
+	_, err = writer.Write(raw[:compressBlockSz+50])
+	require.Nil(t, err)
+	require.Equal(t, raw[:compressBlockSz], readAll(), "Read more than the stored blocks")
+	require.Nil(t, writer.Close())
+	require.Equal(t, raw[:compressBlockSz+50], readAll(), "Final block not readable after close")
+
+	// Reopening the partial block takes it out of the readable data until it
+	// is stored again
+	writer, err = arr.GetPartWriter(0)
+	require.Nil(t, err)
+	_, err = writer.Write(raw[compressBlockSz+50 : compressBlockSz+60])
+	require.Nil(t, err)
+	require.Equal(t, raw[:compressBlockSz], readAll(), "Read a block that is being rewritten")
+
+	n, err := writer.Write(raw[compressBlockSz+60:])
+	require.Nil(t, err)
+	require.Equal(t, partLen-compressBlockSz-60, n)
+	require.Nil(t, writer.Close())
+	require.Equal(t, raw, readAll(), "Wrong data after appending")
+
+	// The buffered bytes count against the capacity
+	writer, err = arr.GetPartWriter(0)
+	require.Nil(t, err)
+	n, err = writer.Write([]byte{1})
+	require.NotNil(t, err, "Wrote past the capacity")
+	require.Zero(t, n)
+	require.Nil(t, writer.Close())
+}
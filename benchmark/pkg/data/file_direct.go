@@ -0,0 +1,247 @@
+package data
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// O_DIRECT requires the buffer address, file offset and length of every
+// request to be aligned. 4KB satisfies every filesystem we care about.
+const directAlign = 4096
+
+// Size of the staging buffer used by direct readers and writers (must be a
+// multiple of directAlign)
+const directBufSz = 1024 * 1024
+
+// Overridable for testing the buffered fallback
+var openDirect = openDirectSys
+
+func alignDown(off int64) int64 {
+	return off &^ (directAlign - 1)
+}
+
+// Allocate a buffer of sz bytes whose first byte is directAlign aligned
+func alignedBuf(sz int) []byte {
+	raw := make([]byte, sz+directAlign)
+	skew := (int)(uintptr(unsafe.Pointer(&raw[0])) & (directAlign - 1))
+	off := 0
+	if skew != 0 {
+		off = directAlign - skew
+	}
+	return raw[off : off+sz]
+}
+
+func isUnsupported(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.EINVAL || err == syscall.EOPNOTSUPP
+}
+
+// Open one of the array's data files, using O_DIRECT if the array was created
+// or opened WithDirectIO() and the filesystem supports it. The returned bool
+// reports whether the file is in direct mode. Once a file is found not to
+// support direct I/O the array stops trying.
+func (self *FileDistribArray) openData(path string, flag int) (*os.File, bool, error) {
+	if atomic.LoadInt32(&self.directIO) != 0 {
+		f, err := openDirect(path, flag, 0600)
+		if err == nil {
+			return f, true, nil
+		} else if !isUnsupported(err) {
+			return nil, false, err
+		}
+		atomic.StoreInt32(&self.directIO, 0)
+	}
+
+	f, err := os.OpenFile(path, flag, 0600)
+	return f, false, err
+}
+
+// Reserve space for size bytes at the start of f. Preallocation is only a
+// hint so filesystems that can't do it are silently ignored.
+func (self *FileDistribArray) preallocate(f *os.File, size int64) error {
+	if !self.prealloc || size == 0 {
+		return nil
+	}
+
+	err := fallocate(f, 0, size)
+	if err != nil && !isUnsupported(err) {
+		return errors.Wrapf(err, "Failed to preallocate %v bytes for %v", size, f.Name())
+	}
+	return nil
+}
+
+// Reads [pos, limit) of an O_DIRECT file through an aligned staging buffer
+type FileDistribDirectReader struct {
+	file *os.File
+
+	buf      []byte
+	bufStart int64 // File offset of buf[0]
+	bufLen   int   // Number of valid bytes in buf
+
+	pos   int64 // Next file offset to return
+	limit int64 // File offset to stop at
+}
+
+func (self *FileDistribDirectReader) Read(dst []byte) (int, error) {
+	if self.pos == self.limit {
+		return 0, io.EOF
+	}
+
+	if self.pos < self.bufStart || self.pos >= self.bufStart+(int64)(self.bufLen) {
+		self.bufStart = alignDown(self.pos)
+		n, err := self.file.ReadAt(self.buf, self.bufStart)
+		if err != nil && err != io.EOF {
+			self.bufLen = 0
+			return 0, err
+		}
+		self.bufLen = n
+
+		if self.bufStart+(int64)(n) <= self.pos {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	avail := self.bufStart + (int64)(self.bufLen)
+	if avail > self.limit {
+		avail = self.limit
+	}
+
+	n := copy(dst, self.buf[self.pos-self.bufStart:avail-self.bufStart])
+	self.pos += (int64)(n)
+
+	if self.pos == self.limit {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (self *FileDistribDirectReader) Close() error {
+	return self.file.Close()
+}
+
+// Appends to a partition through an O_DIRECT file. Only whole blocks that lie
+// inside the data being appended go through O_DIRECT, so blocks shared with
+// existing data or a neighbouring PACKED partition are never rewritten. The
+// unaligned head (up to the first block boundary) is written through a
+// regular descriptor as it arrives, the rest is staged in an aligned buffer
+// and the unaligned tail is written through the regular descriptor on Close()
+// (only then is the data guaranteed to be in the file).
+type FileDistribDirectWriter struct {
+	arr    *FileDistribArray
+	partId int
+	file   *os.File
+	plain  *os.File // Buffered descriptor for the head and tail, opened lazily
+
+	headPos int64 // File offset of the rest of the head
+	nHead   int64 // Bytes left before the first block boundary
+
+	buf      []byte
+	bufStart int64 // File offset of buf[0] (always aligned)
+	nBuf     int   // Number of valid bytes in buf
+}
+
+func (self *FileDistribArray) newDirectWriter(partId int, file *os.File, pos int64) (*FileDistribDirectWriter, error) {
+	bufStart := alignDown(pos + directAlign - 1)
+	return &FileDistribDirectWriter{arr: self, partId: partId, file: file,
+		headPos: pos, nHead: bufStart - pos,
+		buf: alignedBuf(directBufSz), bufStart: bufStart}, nil
+}
+
+// Write b at off through the buffered descriptor
+func (self *FileDistribDirectWriter) writePlain(b []byte, off int64) error {
+	if self.plain == nil {
+		plain, err := os.OpenFile(self.file.Name(), os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "Failed to open file for unaligned data")
+		}
+		self.plain = plain
+	}
+
+	_, err := self.plain.WriteAt(b, off)
+	return err
+}
+
+func (self *FileDistribDirectWriter) flush(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	_, err := self.file.WriteAt(self.buf[:n], self.bufStart)
+	if err != nil {
+		return err
+	}
+
+	self.bufStart += (int64)(n)
+	self.nBuf = copy(self.buf, self.buf[n:self.nBuf])
+	return nil
+}
+
+func (self *FileDistribDirectWriter) Write(b []byte) (int, error) {
+	var err error
+
+	toWrite := self.arr.writeLimit(self.partId, (int64)(len(b)))
+	if toWrite < (int64)(len(b)) {
+		err = io.EOF
+	}
+
+	nWritten := 0
+	if self.nHead != 0 && toWrite != 0 {
+		nHead := self.nHead
+		if nHead > toWrite {
+			nHead = toWrite
+		}
+		if headErr := self.writePlain(b[:nHead], self.headPos); headErr != nil {
+			return 0, errors.Wrap(headErr, "Failed to write unaligned head")
+		}
+		self.headPos += nHead
+		self.nHead -= nHead
+		nWritten = (int)(nHead)
+	}
+
+	for (int64)(nWritten) < toWrite {
+		nCopy := copy(self.buf[self.nBuf:], b[nWritten:toWrite])
+		self.nBuf += nCopy
+		nWritten += nCopy
+
+		if self.nBuf == len(self.buf) {
+			if flushErr := self.flush(self.nBuf); flushErr != nil {
+				// Like the buffered writers, the partition is corrupt at this
+				// point
+				self.arr.shape.lens[self.partId] += (int64)(nWritten)
+				return nWritten, errors.Wrap(flushErr, "Failed to flush direct writer")
+			}
+		}
+	}
+
+	self.arr.shape.lens[self.partId] += (int64)(nWritten)
+	return nWritten, err
+}
+
+func (self *FileDistribDirectWriter) Close() error {
+	defer self.file.Close()
+	defer func() {
+		if self.plain != nil {
+			self.plain.Close()
+		}
+	}()
+
+	err := self.flush((int)(alignDown((int64)(self.nBuf))))
+	if err != nil {
+		return errors.Wrap(err, "Failed to flush direct writer")
+	}
+
+	// O_DIRECT can't write a partial block
+	if self.nBuf != 0 {
+		if err := self.writePlain(self.buf[:self.nBuf], self.bufStart); err != nil {
+			return errors.Wrap(err, "Failed to write unaligned tail")
+		}
+		self.nBuf = 0
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// Open path with O_DIRECT. Returns an error wrapping syscall.EINVAL if the
+// filesystem doesn't support direct I/O.
+func openDirectSys(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag|syscall.O_DIRECT, perm)
+}
+
+// FALLOC_FL_KEEP_SIZE, not defined by package syscall
+const fallocKeepSize = 0x1
+
+// Reserve [off, off+len) of f on disk without changing its size, so that
+// appending to the file (e.g. from pylibsort) still starts at the end of the
+// data. Returns syscall.EOPNOTSUPP if the filesystem can't preallocate.
+func fallocate(f *os.File, off int64, len int64) error {
+	for {
+		err := syscall.Fallocate((int)(f.Fd()), fallocKeepSize, off, len)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
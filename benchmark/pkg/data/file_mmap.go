@@ -0,0 +1,116 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package data
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// WithMmap() only takes effect where mappings are supported, see
+// file_mmap_other.go
+const mmapSupported = true
+
+// Read-only memory mappings of a FileDistribArray's data files, keyed by path.
+// Mappings are created lazily and are shared by every reader of the array.
+type mmapCache struct {
+	lock sync.Mutex
+	maps map[string][]byte
+
+	// Mappings that were replaced by a larger one after the file grew.
+	// Existing readers may still reference them so they live until
+	// unmapAll().
+	stale [][]byte
+}
+
+// Returns a mapping of path that is at least minLen bytes long
+func (self *mmapCache) get(path string, minLen int64) ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.maps == nil {
+		self.maps = make(map[string][]byte)
+	}
+
+	cur := self.maps[path]
+	if (int64)(len(cur)) >= minLen {
+		return cur, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping outlives the descriptor
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't determine size of %v", path)
+	}
+
+	if info.Size() < minLen {
+		return nil, fmt.Errorf("Data file %v is too short: expected at least %v bytes, found %v", path, minLen, info.Size())
+	}
+
+	m, err := syscall.Mmap((int)(f.Fd()), 0, (int)(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to map %v", path)
+	}
+
+	if cur != nil {
+		self.stale = append(self.stale, cur)
+	}
+	self.maps[path] = m
+
+	return m, nil
+}
+
+// Release every mapping. Slices returned by get() are invalid after this.
+func (self *mmapCache) unmapAll() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// Unmapping can only fail for invalid arguments, which would be a bug here
+	for _, m := range self.maps {
+		syscall.Munmap(m)
+	}
+	for _, m := range self.stale {
+		syscall.Munmap(m)
+	}
+	self.maps = nil
+	self.stale = nil
+}
+
+// Returns the bytes in [start, end) of partition partId (end has the same
+// meaning as in GetPartRangeReader) directly from a read-only memory mapping
+// of the data, this works regardless of whether the array was opened
+// WithMmap(). The returned slice must not be modified and is only valid until
+// the array is destroyed. Compressed arrays return a decompressed copy instead.
+func (self *FileDistribArray) GetPartRangeBytes(partId, start, end int) ([]byte, error) {
+	limit, err := self.rangeLimit(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.codec != RAW {
+		return self.getCompressedBytes(partId, start, limit)
+	}
+
+	if limit == start {
+		return []byte{}, nil
+	}
+
+	path, partStart := self.partLocation(partId)
+	m, err := self.maps.get(path, partStart+(int64)(limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't map partition %v", partId)
+	}
+
+	return m[partStart+(int64)(start) : partStart+(int64)(limit)], nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package data
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Data files can't be mapped on this platform, WithMmap() reads through the
+// regular file readers instead
+const mmapSupported = false
+
+type mmapCache struct{}
+
+func (self *mmapCache) unmapAll() {}
+
+// Same as the mmap version (file_mmap.go) except that the bytes are always a
+// copy read from the data file
+func (self *FileDistribArray) GetPartRangeBytes(partId, start, end int) ([]byte, error) {
+	reader, err := self.GetPartRangeReader(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't read partition %v", partId)
+	}
+	return buf, nil
+}
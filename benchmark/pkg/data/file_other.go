@@ -0,0 +1,17 @@
+// +build !linux
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// Direct I/O is only implemented on Linux, callers fall back to buffered I/O
+func openDirectSys(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EINVAL}
+}
+
+func fallocate(f *os.File, off int64, len int64) error {
+	return syscall.EOPNOTSUPP
+}
@@ -1,10 +1,19 @@
 package data
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,3 +32,536 @@ func TestFileFactory(t *testing.T) {
 
 	testArrayFactory(t, NewFileArrayFactory(tmpDir))
 }
+
+func TestFileDistribArrPerPart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	testDistribArr(t, NewFileArrayFactory(tmpDir, WithLayout(PERPART)))
+}
+
+func TestFileFactoryPerPart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	testArrayFactory(t, NewFileArrayFactory(tmpDir, WithLayout(PERPART)))
+}
+
+func TestFilePerPartLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	partLen := 64
+	npart := 4
+	arrPath := filepath.Join(tmpDir, "perPart")
+
+	arr, err := CreateFileDistribArray(arrPath, CreateShapeUniform((int64)(partLen), npart), WithLayout(PERPART))
+	require.Nil(t, err, "Failed to create array")
+
+	// Writers for different partitions may be open at the same time
+	raw := make([]byte, npart*partLen)
+	rand.Read(raw)
+	writers := make([]io.WriteCloser, npart)
+	for i := 0; i < npart; i++ {
+		writers[i], err = arr.GetPartWriter(i)
+		require.Nilf(t, err, "Failed to get writer for part %v", i)
+	}
+	for i := 0; i < npart; i++ {
+		n, err := writers[i].Write(raw[i*partLen : (i+1)*partLen])
+		require.Nilf(t, err, "Failed to write part %v", i)
+		require.Equal(t, partLen, n, "Short write to part %v", i)
+	}
+	for i := 0; i < npart; i++ {
+		require.Nil(t, writers[i].Close(), "Failed to close writer %v", i)
+	}
+	require.Nil(t, arr.Close(), "Failed to close array")
+
+	for i := 0; i < npart; i++ {
+		info, err := os.Stat(filepath.Join(arrPath, fmt.Sprintf("p%v.dat", i)))
+		require.Nilf(t, err, "Missing file for partition %v", i)
+		require.Equal(t, (int64)(partLen), info.Size(), "Partition file %v has the wrong size", i)
+	}
+	_, err = os.Stat(filepath.Join(arrPath, "data.dat"))
+	require.True(t, os.IsNotExist(err), "PERPART array created a packed data file")
+
+	reArr, err := OpenFileDistribArray(arrPath)
+	require.Nil(t, err, "Failed to re-open array")
+	require.Equal(t, PERPART, reArr.Layout(), "Layout not detected from metadata")
+	checkArr(t, reArr, raw)
+
+	t.Run("DestroyPart", func(t *testing.T) {
+		err := reArr.DestroyPart(0)
+		require.Nil(t, err, "Failed to destroy partition")
+
+		_, err = reArr.GetPartReader(0)
+		require.NotNil(t, err, "Read from destroyed partition")
+
+		reader, err := reArr.GetPartReader(1)
+		require.Nil(t, err, "Failed to read surviving partition")
+		readPart(t, reader, make([]byte, partLen))
+	})
+
+	require.Nil(t, reArr.Destroy(), "Failed to destroy array")
+
+	t.Run("Unlimited", func(t *testing.T) {
+		arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "unlimited"), CreateShape([]int64{0, 0}), WithLayout(PERPART))
+		require.Nil(t, err, "Failed to create array")
+		defer arr.Destroy()
+
+		writer, err := arr.GetPartWriter(1)
+		require.Nil(t, err, "Failed to get writer")
+		n, err := writer.Write(raw)
+		require.Nil(t, err, "Zero-capacity partition did not grow")
+		require.Equal(t, len(raw), n, "Short write to unlimited partition")
+		require.Nil(t, writer.Close(), "Failed to close writer")
+
+		shape, err := arr.GetShape()
+		require.Nil(t, err, "Failed to get shape")
+		require.Equal(t, (int64)(0), shape.Len(0), "Untouched partition has data")
+		require.Equal(t, (int64)(len(raw)), shape.Len(1), "Grown partition has the wrong length")
+
+		reader, err := arr.GetPartReader(0)
+		require.Nil(t, err, "Failed to read an unwritten partition")
+		readPart(t, reader, []byte{})
+	})
+
+	t.Run("Packed", func(t *testing.T) {
+		arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "packed"), CreateShapeUniform(1, 1))
+		require.Nil(t, err, "Failed to create array")
+		defer arr.Destroy()
+
+		require.Equal(t, PACKED, arr.Layout(), "Default layout should be PACKED")
+		require.NotNil(t, arr.DestroyPart(0), "PACKED arrays can't destroy individual partitions")
+	})
+}
+
+func TestFileDistribArrMmap(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("Packed", func(t *testing.T) {
+		testDistribArr(t, NewFileArrayFactory(tmpDir, WithMmap()))
+	})
+	t.Run("PerPart", func(t *testing.T) {
+		perPartDir := filepath.Join(tmpDir, "perPart")
+		require.Nil(t, os.Mkdir(perPartDir, 0700))
+		testDistribArr(t, NewFileArrayFactory(perPartDir, WithMmap(), WithLayout(PERPART)))
+	})
+}
+
+func TestFileMmapPartRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	targetSz := 4
+	shape := CreateShapeUniform((int64)(targetSz), 1)
+
+	arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "mmapRange"), shape, WithMmap())
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := generateBytes(t, arr, targetSz)
+
+	t.Run("Full Range", func(t *testing.T) { testPartRangeReader(t, arr, raw, 0, 0) })
+	t.Run("First Two", func(t *testing.T) { testPartRangeReader(t, arr, raw, 0, 2) })
+	t.Run("Middle", func(t *testing.T) { testPartRangeReader(t, arr, raw, 1, 3) })
+	t.Run("Last Two Zero End", func(t *testing.T) { testPartRangeReader(t, arr, raw, 2, 0) })
+	t.Run("Negative End", func(t *testing.T) { testPartRangeReader(t, arr, raw, 1, -1) })
+
+	// The mapping must grow with the file
+	t.Run("Grow", func(t *testing.T) {
+		growArr, err := CreateFileDistribArray(filepath.Join(tmpDir, "mmapGrow"), CreateShapeUniform(8, 1), WithMmap())
+		require.Nil(t, err)
+		defer growArr.Destroy()
+
+		writer, err := growArr.GetPartWriter(0)
+		require.Nil(t, err)
+		_, err = writer.Write(raw)
+		require.Nil(t, err)
+
+		first, err := growArr.GetPartRangeBytes(0, 0, 0)
+		require.Nil(t, err, "Failed to map first half")
+		require.Equal(t, raw, first, "First half wrong")
+
+		_, err = writer.Write(raw)
+		require.Nil(t, err)
+		writer.Close()
+
+		second, err := growArr.GetPartRangeBytes(0, 4, 0)
+		require.Nil(t, err, "Failed to map second half")
+		require.Equal(t, raw, second, "Second half wrong")
+	})
+
+	// Slices and readers handed out before Close stay usable until Destroy
+	t.Run("After Close", func(t *testing.T) {
+		closeArr, err := CreateFileDistribArray(filepath.Join(tmpDir, "mmapClose"), shape, WithMmap())
+		require.Nil(t, err)
+		defer closeArr.Destroy()
+
+		writer, err := closeArr.GetPartWriter(0)
+		require.Nil(t, err)
+		_, err = writer.Write(raw)
+		require.Nil(t, err)
+		writer.Close()
+
+		mapped, err := closeArr.GetPartRangeBytes(0, 0, 0)
+		require.Nil(t, err)
+		reader, err := closeArr.GetPartReader(0)
+		require.Nil(t, err)
+		defer reader.Close()
+
+		require.Nil(t, closeArr.Close(), "Failed to close array")
+		require.Equal(t, raw, mapped, "Mapped bytes changed after close")
+
+		readBytes, err := ioutil.ReadAll(reader)
+		require.Nil(t, err, "Failed to read after close")
+		require.Equal(t, raw, readBytes, "Reader returned wrong data after close")
+
+		// Mapped after Close, released by Destroy
+		late, err := closeArr.GetPartRangeBytes(0, 1, 3)
+		require.Nil(t, err, "Failed to map closed array")
+		require.Equal(t, raw[1:3], late)
+
+		require.Nil(t, closeArr.Destroy(), "Failed to destroy array")
+		require.Nil(t, closeArr.maps.maps, "Mappings not released by Destroy")
+	})
+}
+
+// Size of the arrays used by the read benchmarks. These are intentionally
+// larger than most page caches are willing to keep hot for a single file.
+const benchArrSz = 4 * 1024 * 1024 * 1024
+const benchNPart = 256
+
+func benchmarkFileRead(b *testing.B, opts ...FileOption) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataBench")
+	if err != nil {
+		b.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	partSz := benchArrSz / benchNPart
+	arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "bench"), CreateShapeUniform((int64)(partSz), benchNPart), opts...)
+	if err != nil {
+		b.Fatalf("Failed to create array: %v", err)
+	}
+	defer arr.Destroy()
+
+	raw := make([]byte, partSz)
+	rand.Read(raw)
+	for i := 0; i < benchNPart; i++ {
+		writer, err := arr.GetPartWriter(i)
+		if err != nil {
+			b.Fatalf("Failed to get writer: %v", err)
+		}
+		if _, err := writer.Write(raw); err != nil {
+			b.Fatalf("Failed to write partition %v: %v", i, err)
+		}
+		writer.Close()
+	}
+
+	// Mimic FetchPartRefs on references that split each partition in two
+	refs := make([]*PartRef, 0, 2*benchNPart)
+	for i := 0; i < benchNPart; i++ {
+		refs = append(refs, &PartRef{Arr: arr, PartIdx: i, Start: 0, NByte: partSz / 2})
+		refs = append(refs, &PartRef{Arr: arr, PartIdx: i, Start: partSz / 2, NByte: partSz - partSz/2})
+	}
+
+	b.SetBytes(benchArrSz)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FetchPartRefs(refs); err != nil {
+			b.Fatalf("Failed to read array: %v", err)
+		}
+	}
+}
+
+func BenchmarkFileRead(b *testing.B) {
+	benchmarkFileRead(b)
+}
+
+func BenchmarkFileReadMmap(b *testing.B) {
+	benchmarkFileRead(b, WithMmap())
+}
+
+func TestFileDistribArrDirect(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	for name, layout := range map[string]FileLayout{"Packed": PACKED, "PerPart": PERPART} {
+		t.Run(name, func(t *testing.T) {
+			layoutDir := filepath.Join(tmpDir, name)
+			require.Nil(t, os.Mkdir(layoutDir, 0700))
+			testDistribArr(t, NewFileArrayFactory(layoutDir, WithDirectIO(), WithPrealloc(), WithLayout(layout)))
+		})
+	}
+}
+
+// Direct I/O has to handle appends and reads that don't line up with blocks
+// or with the staging buffer
+func TestFileDirectUnaligned(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	partLen := directBufSz + 1237
+	caps := []int64{(int64)(partLen), (int64)(partLen)}
+
+	for name, layout := range map[string]FileLayout{"Packed": PACKED, "PerPart": PERPART} {
+		t.Run(name, func(t *testing.T) {
+			arr, err := CreateFileDistribArray(filepath.Join(tmpDir, name), CreateShape(caps), WithDirectIO(), WithLayout(layout))
+			require.Nil(t, err, "Failed to create array")
+			defer arr.Destroy()
+
+			raw := make([]byte, 2*partLen)
+			rand.Read(raw)
+
+			// Write the second partition first so that the first one is
+			// written on top of an existing (PACKED) block
+			chunks := []int{1, 4095, 3, directBufSz / 2, 77}
+			for _, partId := range []int{1, 0} {
+				part := raw[partId*partLen : (partId+1)*partLen]
+				pos := 0
+				for i := 0; pos < partLen; i++ {
+					end := pos + chunks[i%len(chunks)]
+					if end > partLen {
+						end = partLen
+					}
+
+					// A fresh writer for every chunk starts and ends most
+					// writes in the middle of a block
+					writer, err := arr.GetPartWriter(partId)
+					require.Nilf(t, err, "Failed to get writer for part %v", partId)
+					n, err := writer.Write(part[pos:end])
+					require.Nil(t, err, "Failed to write")
+					require.Equal(t, end-pos, n, "Short write")
+					require.Nil(t, writer.Close(), "Failed to close writer")
+					pos = end
+				}
+			}
+
+			// checkArr compares byte-by-byte which is too slow here
+			for partId := 0; partId < 2; partId++ {
+				reader, err := arr.GetPartReader(partId)
+				require.Nilf(t, err, "Failed to get reader for part %v", partId)
+				out, err := ioutil.ReadAll(reader)
+				require.Nilf(t, err, "Failed to read part %v", partId)
+				require.Truef(t, bytes.Equal(raw[partId*partLen:(partId+1)*partLen], out), "Part %v returned wrong data", partId)
+				reader.Close()
+			}
+
+			ranges := [][2]int{{0, 1}, {1, 4097}, {4095, partLen - 7}, {partLen - 5, 0}, {12345, -3}}
+			for _, r := range ranges {
+				realEnd := r[1]
+				if realEnd <= 0 {
+					realEnd = partLen + realEnd
+				}
+
+				reader, err := arr.GetPartRangeReader(1, r[0], r[1])
+				require.Nilf(t, err, "Failed to get reader for %v", r)
+
+				out, err := ioutil.ReadAll(reader)
+				require.Nilf(t, err, "Failed to read range %v", r)
+				require.Truef(t, bytes.Equal(raw[partLen+r[0]:partLen+realEnd], out), "Range %v returned wrong data", r)
+				reader.Close()
+			}
+		})
+	}
+}
+
+// PACKED partitions share blocks with their neighbours, writers created
+// before a neighbour's data lands must not overwrite it
+func TestFileDirectSharedBlocks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	caps := make([]int64, 7)
+	for i := range caps {
+		caps[i] = (int64)(100 + i*3001)
+	}
+	chunks := []int{1, 99, 4099, 3, 2048}
+
+	check := func(t *testing.T, arr *FileDistribArray, raw [][]byte) {
+		require.NotZero(t, arr.directIO, "Filesystem doesn't support direct I/O")
+		for partId, part := range raw {
+			reader, err := arr.GetPartReader(partId)
+			require.Nilf(t, err, "Failed to get reader for part %v", partId)
+			out, err := ioutil.ReadAll(reader)
+			require.Nilf(t, err, "Failed to read part %v", partId)
+			require.Truef(t, bytes.Equal(part, out), "Part %v returned wrong data", partId)
+			reader.Close()
+		}
+	}
+
+	newRaw := func() [][]byte {
+		raw := make([][]byte, len(caps))
+		for i := range raw {
+			raw[i] = make([]byte, caps[i])
+			rand.Read(raw[i])
+		}
+		return raw
+	}
+
+	t.Run("Interleaved", func(t *testing.T) {
+		arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "interleaved"), CreateShape(caps), WithDirectIO())
+		require.Nil(t, err, "Failed to create array")
+		defer arr.Destroy()
+		raw := newRaw()
+
+		// Every writer exists before any data is written and chunks are
+		// interleaved across partitions
+		writers := make([]io.WriteCloser, len(caps))
+		for partId := range writers {
+			writers[partId], err = arr.GetPartWriter(partId)
+			require.Nilf(t, err, "Failed to get writer for part %v", partId)
+		}
+		pos := make([]int, len(caps))
+		for i := 0; ; i++ {
+			done := true
+			for partId, part := range raw {
+				end := pos[partId] + chunks[(i+partId)%len(chunks)]
+				if end > len(part) {
+					end = len(part)
+				}
+				_, err := writers[partId].Write(part[pos[partId]:end])
+				require.Nilf(t, err, "Failed to write part %v", partId)
+				pos[partId] = end
+				done = done && end == len(part)
+			}
+			if done {
+				break
+			}
+		}
+		for partId := range writers {
+			require.Nilf(t, writers[partId].Close(), "Failed to close writer for part %v", partId)
+		}
+
+		check(t, arr, raw)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "concurrent"), CreateShape(caps), WithDirectIO())
+		require.Nil(t, err, "Failed to create array")
+		defer arr.Destroy()
+		raw := newRaw()
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(caps))
+		for partId := range raw {
+			wg.Add(1)
+			go func(partId int) {
+				defer wg.Done()
+				for pos := 0; pos < len(raw[partId]); {
+					end := pos + chunks[pos%len(chunks)]
+					if end > len(raw[partId]) {
+						end = len(raw[partId])
+					}
+					// A fresh writer per chunk, like repeated appends
+					if _, errs[partId] = WritePartCtx(context.Background(), arr, partId, raw[partId][pos:end]); errs[partId] != nil {
+						return
+					}
+					pos = end
+				}
+			}(partId)
+		}
+		wg.Wait()
+		for partId, err := range errs {
+			require.Nilf(t, err, "Failed to write part %v", partId)
+		}
+
+		check(t, arr, raw)
+	})
+}
+
+func TestFileDirectFallback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	// Pretend to be a filesystem without O_DIRECT
+	origOpen := openDirect
+	openDirect = func(path string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EINVAL}
+	}
+	defer func() { openDirect = origOpen }()
+
+	testDistribArr(t, NewFileArrayFactory(tmpDir, WithDirectIO()))
+
+	arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "fallback"), CreateShapeUniform(16, 1), WithDirectIO())
+	require.Nil(t, err, "Failed to create array")
+	defer arr.Destroy()
+
+	generateBytes(t, arr, 16)
+	require.Zero(t, arr.directIO, "Array did not notice the missing direct I/O support")
+}
+
+func TestFilePrealloc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	caps := []int64{8192, 100, 0}
+
+	packed, err := CreateFileDistribArray(filepath.Join(tmpDir, "packed"), CreateShape(caps), WithPrealloc())
+	require.Nil(t, err, "Failed to create array")
+	defer packed.Destroy()
+
+	info, err := os.Stat(filepath.Join(tmpDir, "packed", "data.dat"))
+	require.Nil(t, err)
+	require.Equal(t, (int64)(0), info.Size(), "Preallocation changed the data file size")
+
+	perPart, err := CreateFileDistribArray(filepath.Join(tmpDir, "perPart"), CreateShape(caps), WithPrealloc(), WithLayout(PERPART))
+	require.Nil(t, err, "Failed to create array")
+	defer perPart.Destroy()
+
+	for partId := range caps {
+		writer, err := perPart.GetPartWriter(partId)
+		require.Nil(t, err, "Failed to get writer")
+		require.Nil(t, writer.Close())
+
+		info, err := os.Stat(filepath.Join(tmpDir, "perPart", fmt.Sprintf("p%v.dat", partId)))
+		require.Nil(t, err)
+		require.Equalf(t, (int64)(0), info.Size(), "Preallocation changed the size of partition %v", partId)
+	}
+
+	// Preallocation must not change the logical contents. Partition files
+	// must end with their data since pylibsort appends to them.
+	raw := generateBytes(t, perPart, 100)
+	info, err = os.Stat(filepath.Join(tmpDir, "perPart", "p0.dat"))
+	require.Nil(t, err)
+	require.Equal(t, (int64)(100), info.Size(), "Partition file is longer than its data")
+	shape, err := perPart.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(100), shape.Len(0), "Preallocation changed the partition length")
+	reader, err := perPart.GetPartReader(0)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, raw[:100], out, "Preallocated partition returned wrong data")
+}
+
+// Closed file arrays can be read but not written
+func TestFileClosed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	arr, err := CreateFileDistribArray(filepath.Join(tmpDir, "closed"), CreateShapeUniform(8, 1))
+	require.Nil(t, err)
+	raw := generateBytes(t, arr, 8)
+	require.Nil(t, arr.Close())
+	require.Nil(t, arr.Close(), "Close isn't idempotent")
+
+	checkArr(t, arr, raw)
+
+	_, err = arr.GetPartWriter(0)
+	require.Equal(t, ErrClosed, errors.Cause(err), "Wrote to a closed array")
+
+	require.Nil(t, arr.Destroy())
+}
@@ -1,38 +1,279 @@
 package data
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
+// Returns the referenced bytes. If the array implements PartByteSlicer the
+// result aliases the array's storage and must be treated as read-only,
+// otherwise the data is copied into a new buffer.
+func (self *PartRef) Bytes() ([]byte, error) {
+	// An end of 0 means "the whole partition" to the range interfaces
+	if self.NByte == 0 {
+		return []byte{}, nil
+	}
+
+	if slicer, ok := self.Arr.(PartByteSlicer); ok {
+		return slicer.GetPartRangeBytes(self.PartIdx, self.Start, self.Start+self.NByte)
+	}
+
+	return FetchPartRefs([]*PartRef{self})
+}
+
+// Number of range reads FetchPartRefs keeps in flight by default
+const fetchDefaultConcurrency = 8
+
+// DistribArray readers and writers can't be interrupted, the context-aware
+// helpers move data in pieces of at most this size so that cancellation is
+// noticed part way through large transfers
+const ctxChunkSz = 4 * 1024 * 1024
+
+type FetchOptions struct {
+	// Maximum number of range reads in flight at once (default 8)
+	Concurrency int
+
+	// Take the output buffer from Pool instead of allocating it. The caller
+	// may Put() it back once it is done with the data.
+	Pool *BufferPool
+}
+
+// Returned by FetchPartRefsCtx when a reference couldn't be read. Use
+// errors.Cause() to get the underlying error (e.g. ErrOutOfRange).
+type FetchError struct {
+	RefIdx int     // Index of the failed reference in the refs argument
+	Ref    PartRef // The failed reference
+	NRead  int     // Bytes of Ref that were read before the failure
+	Err    error
+}
+
+func (self *FetchError) Error() string {
+	return fmt.Sprintf("Couldn't read ref %v (partition %v [%v, %v)) after %v of %v bytes: %v",
+		self.RefIdx, self.Ref.PartIdx, self.Ref.Start, self.Ref.Start+self.Ref.NByte,
+		self.NRead, self.Ref.NByte, self.Err)
+}
+
+func (self *FetchError) Cause() error {
+	return self.Err
+}
+
+// Reusable buffers for FetchPartRefsCtx (or anything else). The zero value is
+// ready to use and a BufferPool may be shared between goroutines.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// Returns a buffer of length n, its contents are undefined
+func (self *BufferPool) Get(n int) []byte {
+	if pooled, ok := self.pool.Get().(*[]byte); ok && cap(*pooled) >= n {
+		return (*pooled)[:n]
+	}
+	return make([]byte, n)
+}
+
+// Make b available to future calls to Get(). The caller must not use b
+// afterwards.
+func (self *BufferPool) Put(b []byte) {
+	self.pool.Put(&b)
+}
+
+// A run of consecutive references that are adjacent in the same partition,
+// fetched with a single range read
+type fetchSpan struct {
+	firstRef int
+	lastRef  int // Inclusive
+	outPos   int
+	nByte    int
+}
+
+// Group refs into spans. References of the same partition that follow each
+// other both in refs and in the partition become a single span. Empty
+// references are skipped (a zero length range means "the whole partition").
+func coalesceRefs(refs []*PartRef) []fetchSpan {
+	var spans []fetchSpan
+	outPos := 0
+	for i, ref := range refs {
+		if ref.NByte == 0 {
+			continue
+		}
+
+		if len(spans) != 0 {
+			last := &spans[len(spans)-1]
+			prev := refs[last.lastRef]
+			if prev.Arr == ref.Arr && prev.PartIdx == ref.PartIdx && prev.Start+prev.NByte == ref.Start {
+				last.lastRef = i
+				last.nByte += ref.NByte
+				outPos += ref.NByte
+				continue
+			}
+		}
+
+		spans = append(spans, fetchSpan{firstRef: i, lastRef: i, outPos: outPos, nByte: ref.NByte})
+		outPos += ref.NByte
+	}
+	return spans
+}
+
+// Read span into dst (which is exactly span.nByte long), returns the number
+// of bytes read
+func fetchSpanData(ctx context.Context, ref *PartRef, span fetchSpan, dst []byte) (int, error) {
+	reader, err := ref.Arr.GetPartRangeReader(ref.PartIdx, ref.Start, ref.Start+span.nByte)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	nRead := 0
+	for nRead < len(dst) {
+		if err := ctx.Err(); err != nil {
+			return nRead, err
+		}
+
+		chunkEnd := nRead + ctxChunkSz
+		if chunkEnd > len(dst) {
+			chunkEnd = len(dst)
+		}
+
+		n, err := io.ReadFull(reader, dst[nRead:chunkEnd])
+		nRead += n
+		if err != nil {
+			return nRead, err
+		}
+	}
+	return nRead, nil
+}
+
+// Convert a failure nRead bytes into span into a FetchError for the
+// reference it happened in
+func spanError(refs []*PartRef, span fetchSpan, nRead int, err error) *FetchError {
+	for i := span.firstRef; i < span.lastRef; i++ {
+		if nRead < refs[i].NByte {
+			return &FetchError{RefIdx: i, Ref: *refs[i], NRead: nRead, Err: err}
+		}
+		nRead -= refs[i].NByte
+	}
+	return &FetchError{RefIdx: span.lastRef, Ref: *refs[span.lastRef], NRead: nRead, Err: err}
+}
+
+// Concatenate the data of every reference in refs
 func FetchPartRefs(refs []*PartRef) ([]byte, error) {
+	return FetchPartRefsCtx(context.Background(), refs, FetchOptions{})
+}
+
+// Concatenate the data of every reference in refs. References are read in
+// parallel (at most opts.Concurrency at a time) and adjacent references are
+// combined into a single read. Failed reads are reported as a *FetchError for
+// the first reference (in refs order) that failed, the remaining reads are
+// cancelled.
+func FetchPartRefsCtx(ctx context.Context, refs []*PartRef, opts FetchOptions) ([]byte, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = fetchDefaultConcurrency
+	}
+
 	totalLen := 0
 	for i := 0; i < len(refs); i++ {
 		totalLen += refs[i].NByte
 	}
 
-	// Fetch data to local memory
-	var out = make([]byte, totalLen)
-	inPos := 0
-	for i := 0; i < len(refs); i++ {
-		bktRef := refs[i]
+	var out []byte
+	if opts.Pool != nil {
+		out = opts.Pool.Get(totalLen)
+	} else {
+		out = make([]byte, totalLen)
+	}
 
-		reader, err := bktRef.Arr.GetPartRangeReader(bktRef.PartIdx, bktRef.Start, bktRef.Start+bktRef.NByte)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Couldn't read partition from ref %v", i)
-		}
+	spans := coalesceRefs(refs)
+	spanErrs := make([]error, len(spans))
+
+	// Cancelled by the first failure so that the other reads stop early
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		n, err := io.ReadFull(reader, out[inPos:inPos+bktRef.NByte])
-		if err != nil || n != bktRef.NByte {
-			fmt.Printf("len, n: %v, %v\n", bktRef.NByte, n)
-			return nil, errors.Wrapf(err, "Couldn't read from input ref %v", i)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for spanIdx, span := range spans {
+		select {
+		case sem <- struct{}{}:
+		case <-fetchCtx.Done():
 		}
+		if fetchCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(spanIdx int, span fetchSpan) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-		inPos += bktRef.NByte
-		reader.Close()
+			n, err := fetchSpanData(fetchCtx, refs[span.firstRef], span, out[span.outPos:span.outPos+span.nByte])
+			if err != nil && fetchCtx.Err() == nil {
+				spanErrs[spanIdx] = spanError(refs, span, n, err)
+				cancel()
+			}
+		}(spanIdx, span)
 	}
+	wg.Wait()
 
+	var firstErr error
+	if err := ctx.Err(); err != nil {
+		firstErr = errors.Wrap(err, "Fetch cancelled")
+	} else {
+		for _, err := range spanErrs {
+			if err != nil {
+				firstErr = err
+				break
+			}
+		}
+	}
+
+	if firstErr != nil {
+		if opts.Pool != nil {
+			opts.Pool.Put(out)
+		}
+		return nil, firstErr
+	}
 	return out, nil
 }
+
+// Append b to partition partId of arr with a new writer, checking ctx between
+// pieces. Returns the number of bytes written. Running out of capacity before
+// all of b is written is an error.
+func WritePartCtx(ctx context.Context, arr DistribArray, partId int, b []byte) (int, error) {
+	writer, err := arr.GetPartWriter(partId)
+	if err != nil {
+		return 0, err
+	}
+
+	nWritten := 0
+	for nWritten < len(b) {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		chunkEnd := nWritten + ctxChunkSz
+		if chunkEnd > len(b) {
+			chunkEnd = len(b)
+		}
+
+		var n int
+		n, err = writer.Write(b[nWritten:chunkEnd])
+		nWritten += n
+		if err == io.EOF {
+			err = fmt.Errorf("Partition %v full after %v of %v bytes", partId, nWritten, len(b))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return nWritten, err
+}
@@ -1,11 +1,65 @@
 package data
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
+// Wraps a DistribArray to record how its range readers are used
+type trackedArr struct {
+	DistribArray
+
+	// Readers are held open this long so that concurrent reads overlap
+	delay time.Duration
+
+	// Readers return this many bytes fewer than requested
+	shortBy int
+
+	lock    sync.Mutex
+	nReader int
+	nOpen   int
+	maxOpen int
+}
+
+type trackedReader struct {
+	io.Reader
+	arr    *trackedArr
+	closer io.Closer
+}
+
+func (self *trackedArr) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	reader, err := self.DistribArray.GetPartRangeReader(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	self.nReader++
+	self.nOpen++
+	if self.nOpen > self.maxOpen {
+		self.maxOpen = self.nOpen
+	}
+	self.lock.Unlock()
+
+	time.Sleep(self.delay)
+	return &trackedReader{Reader: io.LimitReader(reader, (int64)(end-start-self.shortBy)), arr: self, closer: reader}, nil
+}
+
+func (self *trackedReader) Close() error {
+	self.arr.lock.Lock()
+	self.arr.nOpen--
+	self.arr.lock.Unlock()
+	return self.closer.Close()
+}
+
 func TestFetchPartRefs(t *testing.T) {
 	nByte := 1024
 
@@ -54,3 +108,138 @@ func TestFetchPartRefs(t *testing.T) {
 		out[outPos:outPos+sz],
 		"Third ref wrong")
 }
+
+func TestPartRefBytes(t *testing.T) {
+	nByte := 64
+
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	factories := map[string]*ArrayFactory{
+		"Mem":  MemArrayFactory,
+		"File": NewFileArrayFactory(tmpDir),
+	}
+
+	for name, factory := range factories {
+		t.Run(name, func(t *testing.T) {
+			arr, err := factory.Create("PartRefBytes", CreateShapeUniform((int64)(nByte), 2))
+			require.Nil(t, err, "Failed to create array")
+			defer arr.Destroy()
+
+			raw := generateBytes(t, arr, nByte)
+
+			ref := &PartRef{Arr: arr, PartIdx: 1, Start: 8, NByte: 16}
+			b, err := ref.Bytes()
+			require.Nil(t, err, "Failed to get bytes for reference")
+			require.Equal(t, raw[nByte+8:nByte+24], b, "Returned the wrong bytes")
+
+			empty := &PartRef{Arr: arr, PartIdx: 0, Start: 0, NByte: 0}
+			b, err = empty.Bytes()
+			require.Nil(t, err, "Failed to get bytes for empty reference")
+			require.Zero(t, len(b), "Empty reference returned data")
+		})
+	}
+}
+
+// Adjacent references are read together, everything else separately
+func TestFetchPartRefsCoalesce(t *testing.T) {
+	a0, err := MemArrayFactory.Create("FetchCoalesce0", CreateShapeUniform(1024, 2))
+	require.Nil(t, err)
+	defer a0.Destroy()
+	a1, err := MemArrayFactory.Create("FetchCoalesce1", CreateShapeUniform(1024, 2))
+	require.Nil(t, err)
+	defer a1.Destroy()
+
+	raw0 := generateBytes(t, a0, 1024)
+	raw1 := generateBytes(t, a1, 1024)
+	t0 := &trackedArr{DistribArray: a0}
+	t1 := &trackedArr{DistribArray: a1}
+
+	refs := []*PartRef{
+		{Arr: t0, PartIdx: 0, Start: 0, NByte: 100},
+		{Arr: t0, PartIdx: 0, Start: 100, NByte: 200},
+		{Arr: t0, PartIdx: 0, Start: 300, NByte: 724},
+		{Arr: t1, PartIdx: 0, Start: 0, NByte: 10},
+		{Arr: t0, PartIdx: 0, Start: 0, NByte: 10},
+		{Arr: t1, PartIdx: 1, Start: 0, NByte: 0},
+		{Arr: t0, PartIdx: 1, Start: 0, NByte: 512},
+		{Arr: t0, PartIdx: 1, Start: 512, NByte: 512},
+	}
+
+	var expect []byte
+	expect = append(expect, raw0[:1024]...)
+	expect = append(expect, raw1[:10]...)
+	expect = append(expect, raw0[:10]...)
+	expect = append(expect, raw0[1024:]...)
+
+	out, err := FetchPartRefs(refs)
+	require.Nil(t, err)
+	require.Equal(t, expect, out, "Fetched the wrong data")
+	require.Equal(t, 3, t0.nReader, "Adjacent references weren't coalesced")
+	require.Equal(t, 1, t1.nReader, "Empty reference was read")
+}
+
+func TestFetchPartRefsConcurrency(t *testing.T) {
+	nPart := 16
+	arr, err := MemArrayFactory.Create("FetchConcurrency", CreateShapeUniform(64, nPart))
+	require.Nil(t, err)
+	defer arr.Destroy()
+	raw := generateBytes(t, arr, 64)
+
+	tracked := &trackedArr{DistribArray: arr, delay: 5 * time.Millisecond}
+
+	// Every other partition so that nothing is coalesced
+	var refs []*PartRef
+	var expect []byte
+	for partId := 0; partId < nPart; partId += 2 {
+		refs = append(refs, &PartRef{Arr: tracked, PartIdx: partId, Start: 0, NByte: 64})
+		expect = append(expect, raw[partId*64:(partId+1)*64]...)
+	}
+
+	var pool BufferPool
+	out, err := FetchPartRefsCtx(context.Background(), refs, FetchOptions{Concurrency: 3, Pool: &pool})
+	require.Nil(t, err)
+	require.Equal(t, expect, out, "Fetched the wrong data")
+	require.Equal(t, len(refs), tracked.nReader)
+	require.True(t, tracked.maxOpen <= 3, "%v reads in flight, expected at most 3", tracked.maxOpen)
+
+	pool.Put(out)
+	require.Len(t, pool.Get(10), 10, "Pool returned the wrong length")
+}
+
+func TestFetchPartRefsErrors(t *testing.T) {
+	arr, err := MemArrayFactory.Create("FetchErrors", CreateShapeUniform(64, 2))
+	require.Nil(t, err)
+	defer arr.Destroy()
+	generateBytes(t, arr, 32)
+
+	refs := []*PartRef{
+		{Arr: arr, PartIdx: 0, Start: 0, NByte: 16},
+		{Arr: arr, PartIdx: 1, Start: 0, NByte: 16},
+		{Arr: arr, PartIdx: 0, Start: 16, NByte: 32},
+	}
+	_, err = FetchPartRefs(refs)
+	require.IsType(t, &FetchError{}, err)
+	fetchErr := err.(*FetchError)
+	require.Equal(t, 2, fetchErr.RefIdx, "Reported the wrong reference")
+	require.Equal(t, ErrOutOfRange, errors.Cause(err), "Lost the cause")
+
+	// Failures part way through a coalesced read are pinned on the right ref
+	short := &trackedArr{DistribArray: arr, shortBy: 4}
+	refs = []*PartRef{
+		{Arr: short, PartIdx: 0, Start: 0, NByte: 8},
+		{Arr: short, PartIdx: 0, Start: 8, NByte: 8},
+	}
+	_, err = FetchPartRefs(refs)
+	require.IsType(t, &FetchError{}, err)
+	fetchErr = err.(*FetchError)
+	require.Equal(t, 1, fetchErr.RefIdx, "Reported the wrong reference")
+	require.Equal(t, 4, fetchErr.NRead, "Reported the wrong progress")
+	require.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = FetchPartRefsCtx(ctx, refs[:1], FetchOptions{})
+	require.Equal(t, context.Canceled, errors.Cause(err), "Cancelled fetch didn't fail")
+}
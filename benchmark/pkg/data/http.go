@@ -0,0 +1,374 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Returns the ArrayServer address for FaaS workers (see faasTest/README.md)
+// from RADIXBENCH_ARRAY_SERVER (e.g. "http://10.0.0.5:7070")
+func ArrayServerFromEnv() (string, error) {
+	addr := os.Getenv("RADIXBENCH_ARRAY_SERVER")
+	if addr == "" {
+		return "", fmt.Errorf("RADIXBENCH_ARRAY_SERVER must be set to use http arrays")
+	}
+	return addr, nil
+}
+
+// Arrays are accessed through the ArrayServer at baseUrl (e.g.
+// "http://localhost:7070")
+func NewHttpArrayFactory(baseUrl string) *ArrayFactory {
+	return &ArrayFactory{
+		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
+			a, err := CreateHttpDistribArray(baseUrl, name, shape)
+			return (DistribArray)(a), err
+		},
+
+		Open: func(name string) (DistribArray, error) {
+			a, err := OpenHttpDistribArray(baseUrl, name)
+			return (DistribArray)(a), err
+		},
+	}
+}
+
+// A DistribArray hosted by an ArrayServer on another machine. Reads stream
+// the requested range, writers stream their data to the server as it is
+// written and the new length is visible once the writer is closed.
+type HttpDistribArray struct {
+	Name    string
+	BaseUrl string
+	client  *http.Client
+
+	// Protects shape.lens, writers for different partitions may close
+	// concurrently
+	lock  sync.Mutex
+	shape DistribArrayShape
+
+	// Destroy() may be called more than once (as with local arrays)
+	closed    bool
+	destroyed bool
+}
+
+type HttpDistribRangeReader struct {
+	body io.ReadCloser
+
+	// The number of bytes still to read before hitting the limit
+	nRemaining int64
+}
+
+type HttpDistribWriter struct {
+	arr    *HttpDistribArray
+	partId int
+
+	// Data is streamed through pipe to the request running in the
+	// background, its result is sent on done
+	pipe    *io.PipeWriter
+	done    chan httpWriteResult
+	written int64
+}
+
+type httpWriteResult struct {
+	resp httpAppendResp
+	err  error
+}
+
+func CreateHttpDistribArray(baseUrl string, name string, shape DistribArrayShape) (*HttpDistribArray, error) {
+	arr := newHttpDistribArray(baseUrl, name)
+
+	body, err := json.Marshal(httpShape{Caps: shape.caps})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't convert shape to json")
+	}
+
+	if arr.shape, err = arr.callShape(http.MethodPut, "", body); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create array %v", name)
+	}
+	return arr, nil
+}
+
+func OpenHttpDistribArray(baseUrl string, name string) (*HttpDistribArray, error) {
+	arr := newHttpDistribArray(baseUrl, name)
+
+	var err error
+	if arr.shape, err = arr.callShape(http.MethodPost, "/open", nil); err != nil {
+		return nil, errors.Wrapf(err, "Failed to open array %v", name)
+	}
+	return arr, nil
+}
+
+func newHttpDistribArray(baseUrl string, name string) *HttpDistribArray {
+	return &HttpDistribArray{Name: name, BaseUrl: strings.TrimRight(baseUrl, "/"), client: &http.Client{}}
+}
+
+func (self *HttpDistribArray) url(suffix string) string {
+	return self.BaseUrl + "/arrays/" + url.PathEscape(self.Name) + suffix
+}
+
+// Convert a non-2xx response into an error
+func httpRespError(resp *http.Response) error {
+	raw, _ := ioutil.ReadAll(resp.Body)
+
+	var errResp httpErrResp
+	if json.Unmarshal(raw, &errResp) != nil || errResp.Err == "" {
+		errResp.Err = string(raw)
+	}
+	return fmt.Errorf("Array server error (%v): %v", resp.Status, errResp.Err)
+}
+
+// Issue a request against this array and decode the JSON response into out
+// (if out is non-nil)
+func (self *HttpDistribArray) call(method, suffix string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, self.url(suffix), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpRespError(resp)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return errors.Wrap(err, "Failed to parse array server response")
+		}
+	}
+	return nil
+}
+
+// Fetch the shape returned by method on suffix (e.g. "/open")
+func (self *HttpDistribArray) callShape(method, suffix string, body []byte) (DistribArrayShape, error) {
+	var wire httpShape
+	if err := self.call(method, suffix, body, &wire); err != nil {
+		return DistribArrayShape{}, err
+	}
+	if len(wire.Lens) != len(wire.Caps) {
+		return DistribArrayShape{}, fmt.Errorf("Array server returned an invalid shape")
+	}
+	return DistribArrayShape{lens: wire.Lens, caps: wire.Caps}, nil
+}
+
+func (self *HttpDistribArray) ArrayName() string {
+	return self.Name
+}
+
+func (self *HttpDistribArray) GetShape() (*DistribArrayShape, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	// Writers and Refresh() update the shape
+	shape := CreateShapeFrom(self.shape)
+	return &shape, nil
+}
+
+// Re-fetch the shape from the server, e.g. to see writes from other clients
+func (self *HttpDistribArray) Refresh() error {
+	shape, err := self.callShape(http.MethodGet, "/shape", nil)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	self.shape = shape
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *HttpDistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+
+	// Ranges are resolved by the server so that they match its view of the
+	// partition
+	reqUrl := fmt.Sprintf("%v?start=%v&end=%v", self.url(fmt.Sprintf("/%v", partId)), start, end)
+
+	resp, err := self.client.Get(reqUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read partition %v", partId)
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		defer resp.Body.Close()
+		return nil, errors.Wrap(ErrOutOfRange, httpRespError(resp).Error())
+	} else if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, errors.Wrapf(httpRespError(resp), "Failed to read partition %v", partId)
+	}
+
+	return &HttpDistribRangeReader{body: resp.Body, nRemaining: resp.ContentLength}, nil
+}
+
+func (self *HttpDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
+	return self.GetPartRangeReader(partId, 0, 0)
+}
+
+// Release this client's reference to the array, the server commits the
+// backing array once every client has closed it
+func (self *HttpDistribArray) Close() error {
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+
+	if err := self.call(http.MethodPost, "/close", nil, nil); err != nil {
+		return errors.Wrap(err, "Array commit failure")
+	}
+	return nil
+}
+
+func (self *HttpDistribArray) Destroy() error {
+	if self.destroyed {
+		return nil
+	}
+	self.closed = true
+	self.destroyed = true
+	return self.call(http.MethodDelete, "", nil, nil)
+}
+
+// Reads behave like io.ReadFull, the only short read is the last one (which
+// returns io.EOF).
+func (self *HttpDistribRangeReader) Read(dst []byte) (n int, err error) {
+	var toRead int64
+	if (int64)(len(dst)) < self.nRemaining {
+		toRead = (int64)(len(dst))
+	} else {
+		toRead = self.nRemaining
+		err = io.EOF
+	}
+
+	if toRead == 0 {
+		return 0, err
+	}
+
+	n, readErr := io.ReadFull(self.body, dst[:toRead])
+	self.nRemaining -= (int64)(n)
+	if readErr != nil {
+		err = errors.Wrap(readErr, "Array server response ended early")
+	}
+
+	return n, err
+}
+
+func (self *HttpDistribRangeReader) Close() error {
+	return self.body.Close()
+}
+
+// Writers for different partitions may be used concurrently, the server
+// applies them one at a time.
+func (self *HttpDistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+	return &HttpDistribWriter{arr: self, partId: partId}, nil
+}
+
+// Start the streaming upload
+func (self *HttpDistribWriter) start() {
+	var pipeRd *io.PipeReader
+	pipeRd, self.pipe = io.Pipe()
+	self.done = make(chan httpWriteResult, 1)
+
+	go func() {
+		var res httpWriteResult
+		defer func() { self.done <- res }()
+
+		reqUrl := self.arr.url(fmt.Sprintf("/%v", self.partId))
+		resp, err := self.arr.client.Post(reqUrl, "application/octet-stream", pipeRd)
+		if err != nil {
+			res.err = err
+			pipeRd.CloseWithError(err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			res.err = httpRespError(resp)
+		} else if err := json.NewDecoder(resp.Body).Decode(&res.resp); err != nil {
+			res.err = errors.Wrap(err, "Failed to parse array server response")
+		}
+
+		// Unblock the writer if the server stopped reading early
+		pipeRd.CloseWithError(fmt.Errorf("Upload finished early"))
+	}()
+}
+
+func (self *HttpDistribWriter) Write(data []byte) (n int, err error) {
+	arr := self.arr
+
+	// Enforce the capacity locally so that callers get io.EOF right away. The
+	// server's arrays may not support unlimited partitions, so a zero
+	// capacity is always full.
+	toWrite := (int64)(len(data))
+	arr.lock.Lock()
+	nRemaining := arr.shape.caps[self.partId] - arr.shape.lens[self.partId] - self.written
+	arr.lock.Unlock()
+
+	if toWrite > nRemaining {
+		toWrite = nRemaining
+		err = io.EOF
+	}
+	if toWrite <= 0 {
+		return 0, err
+	}
+
+	if self.pipe == nil {
+		self.start()
+	}
+
+	nWritten, pipeErr := self.pipe.Write(data[:toWrite])
+	self.written += (int64)(nWritten)
+	if pipeErr != nil {
+		return nWritten, errors.Wrapf(pipeErr, "Failed to send data for partition %v", self.partId)
+	}
+
+	return nWritten, err
+}
+
+// Finish the upload and publish the new partition length
+func (self *HttpDistribWriter) Close() error {
+	if self.pipe == nil {
+		return nil
+	}
+
+	self.pipe.Close()
+	res := <-self.done
+	self.pipe = nil
+
+	if res.err != nil {
+		return errors.Wrapf(res.err, "Failed to write partition %v", self.partId)
+	}
+	if res.resp.N != self.written {
+		return fmt.Errorf("Array server only accepted %v of %v bytes for partition %v", res.resp.N, self.written, self.partId)
+	}
+
+	self.arr.lock.Lock()
+	self.arr.shape.lens[self.partId] = res.resp.Len
+	self.arr.lock.Unlock()
+
+	return nil
+}
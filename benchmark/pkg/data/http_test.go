@@ -0,0 +1,237 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Start an ArrayServer backed by FileDistribArrays in a temporary directory.
+// The returned function shuts everything down.
+func startFileArrayServer(t *testing.T) (*httptest.Server, func()) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+
+	arrServer := NewArrayServer(NewFileArrayFactory(tmpDir))
+	server := httptest.NewServer(arrServer)
+
+	return server, func() {
+		server.Close()
+		arrServer.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestHttpDistribArr(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	testDistribArr(t, NewHttpArrayFactory(server.URL))
+}
+
+func TestHttpFactory(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	testArrayFactory(t, NewHttpArrayFactory(server.URL))
+}
+
+func TestHttpPartRange(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	arr, err := CreateHttpDistribArray(server.URL, "httpRange", CreateShapeUniform(4, 1))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := generateBytes(t, arr, 4)
+
+	t.Run("Full Range", func(t *testing.T) { testPartRangeReader(t, arr, raw, 0, 0) })
+	t.Run("First Two", func(t *testing.T) { testPartRangeReader(t, arr, raw, 0, 2) })
+	t.Run("Middle", func(t *testing.T) { testPartRangeReader(t, arr, raw, 1, 3) })
+	t.Run("Last Two Zero End", func(t *testing.T) { testPartRangeReader(t, arr, raw, 2, 0) })
+	t.Run("Negative End", func(t *testing.T) { testPartRangeReader(t, arr, raw, 1, -1) })
+	t.Run("Empty", func(t *testing.T) { testPartRangeReader(t, arr, raw, 2, 2) })
+}
+
+func TestHttpMemBacked(t *testing.T) {
+	server := httptest.NewServer(NewArrayServer(MemArrayFactory))
+	defer server.Close()
+
+	fact := NewHttpArrayFactory(server.URL)
+
+	arr, err := fact.Create("httpMem", CreateShapeUniform(16, 2))
+	require.Nil(t, err)
+	raw := generateBytes(t, arr, 16)
+	checkArr(t, arr, raw)
+	require.Nil(t, arr.Destroy())
+}
+
+// Arrays stay open on the server until every client has closed them
+func TestHttpShared(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	// Streamed in several writes, bigger than any single buffer
+	raw := make([]byte, 1024*1024+7)
+	rand.Read(raw)
+
+	arr0, err := CreateHttpDistribArray(server.URL, "shared", CreateShape([]int64{(int64)(len(raw)), 8}))
+	require.Nil(t, err)
+
+	arr1, err := OpenHttpDistribArray(server.URL, "shared")
+	require.Nil(t, err)
+
+	writer, err := arr0.GetPartWriter(0)
+	require.Nil(t, err)
+	for i := 0; i < len(raw); i += 64 * 1024 {
+		end := i + 64*1024
+		if end > len(raw) {
+			end = len(raw)
+		}
+		n, err := writer.Write(raw[i:end])
+		require.Nil(t, err)
+		require.Equal(t, end-i, n)
+	}
+	require.Nil(t, writer.Close())
+
+	// Capped partition
+	writer, err = arr0.GetPartWriter(1)
+	require.Nil(t, err)
+	n, err := writer.Write(raw[:20])
+	require.NotNil(t, err, "Wrote past the partition capacity")
+	require.Equal(t, 8, n)
+	require.Nil(t, writer.Close())
+
+	require.Nil(t, arr0.Close())
+
+	// arr1 still holds a reference, its cached shape is stale until refreshed
+	require.Nil(t, arr1.Refresh())
+	shape, err := arr1.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, []int64{(int64)(len(raw)), 8}, shape.lens)
+
+	reader, err := arr1.GetPartRangeReader(0, 100, 0)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(raw[100:], out), "Streamed partition corrupted")
+	reader.Close()
+
+	require.Nil(t, arr1.Close())
+
+	// Closed by everyone, handles are still usable like with local arrays
+	reader, err = arr1.GetPartRangeReader(1, 0, 0)
+	require.Nil(t, err, "Couldn't read from a closed array")
+	out, err = ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, raw[:8], out)
+	reader.Close()
+
+	reArr, err := OpenHttpDistribArray(server.URL, "shared")
+	require.Nil(t, err)
+	require.Nil(t, reArr.Destroy())
+}
+
+// One client may stream to several partitions of an array at once
+func TestHttpInterleavedWriters(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	// Chunks are larger than the socket buffers so a request that the
+	// server isn't reading stalls the client
+	chunkSz := 4 * 1024 * 1024
+	nChunk := 4
+	raw := make([]byte, 2*chunkSz*nChunk)
+	rand.Read(raw)
+	partLen := chunkSz * nChunk
+
+	arr, err := CreateHttpDistribArray(server.URL, "interleaved", CreateShapeUniform((int64)(partLen), 2))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	done := make(chan error)
+	go func() {
+		writers := make([]io.WriteCloser, 2)
+		for partId := range writers {
+			var err error
+			if writers[partId], err = arr.GetPartWriter(partId); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		for i := 0; i < nChunk; i++ {
+			for partId, writer := range writers {
+				start := partId*partLen + i*chunkSz
+				if _, err := writer.Write(raw[start : start+chunkSz]); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+
+		for _, writer := range writers {
+			if err := writer.Close(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		require.Nil(t, err, "Interleaved writes failed")
+	case <-time.After(30 * time.Second):
+		// Unblock everything so that the cleanup doesn't hang too
+		server.CloseClientConnections()
+		t.Fatal("Interleaved writers deadlocked")
+	}
+
+	for partId := 0; partId < 2; partId++ {
+		reader, err := arr.GetPartReader(partId)
+		require.Nil(t, err)
+		out, err := ioutil.ReadAll(reader)
+		require.Nil(t, err)
+		reader.Close()
+		require.Truef(t, bytes.Equal(raw[partId*partLen:(partId+1)*partLen], out), "Partition %v corrupted", partId)
+	}
+}
+
+func TestHttpErrors(t *testing.T) {
+	server, cleanup := startFileArrayServer(t)
+	defer cleanup()
+
+	_, err := OpenHttpDistribArray(server.URL, "missing")
+	require.NotNil(t, err, "Opened a missing array")
+
+	arr, err := CreateHttpDistribArray(server.URL, "dup", CreateShapeUniform(4, 1))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	_, err = CreateHttpDistribArray(server.URL, "dup", CreateShapeUniform(4, 1))
+	require.NotNil(t, err, "Created the same array twice")
+
+	_, err = arr.GetPartReader(5)
+	require.NotNil(t, err, "Read a missing partition")
+
+	_, err = arr.GetPartRangeReader(0, 2, 1)
+	require.NotNil(t, err, "Read an invalid range")
+
+	resp, err := http.Get(server.URL + "/bogus")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = CreateHttpDistribArray("http://127.0.0.1:1", "noServer", CreateShapeUniform(4, 1))
+	require.NotNil(t, err, "Connected to a missing server")
+}
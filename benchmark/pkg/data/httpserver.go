@@ -0,0 +1,374 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Serves the arrays of an ArrayFactory over HTTP so that they can be used
+// from other machines with an HttpDistribArray. The API is:
+//		PUT    /arrays/${name}               Create, the body is {"Caps": [...]}
+//		POST   /arrays/${name}/open          Open
+//		POST   /arrays/${name}/close         Close
+//		DELETE /arrays/${name}               Destroy
+//		GET    /arrays/${name}/shape         Current shape
+//		GET    /arrays/${name}/${partID}     Read, with optional start/end query
+//			parameters that mean the same as in GetPartRangeReader
+//		POST   /arrays/${name}/${partID}     Append the body to the partition
+//
+// Shapes are returned as {"Lens": [...], "Caps": [...]} and errors as
+// {"Err": "..."} with a non-2xx status (416 for ranges outside the
+// partition). Arrays are opened once on the server no matter how many clients
+// open them, the backing array is closed (i.e. committed) when the last client
+// closes it. Append bodies are read in full before they are written, so a
+// client may stream to several partitions of one array at once, and the writes
+// to the same array are serialized.
+type ArrayServer struct {
+	factory *ArrayFactory
+
+	lock sync.Mutex
+	arrs map[string]*servedArray
+}
+
+type servedArray struct {
+	arr  DistribArray
+	refs int
+
+	// Serializes writers, some arrays (e.g. PACKED FileDistribArrays) can't
+	// have more than one at a time
+	writeLock sync.Mutex
+}
+
+// JSON form of a DistribArrayShape on the wire
+type httpShape struct {
+	Lens []int64
+	Caps []int64
+}
+
+// Response to an append
+type httpAppendResp struct {
+	N    int64 // Bytes written
+	Full bool  // The partition ran out of capacity before the whole body was written
+	Len  int64 // New length of the partition
+}
+
+type httpErrResp struct {
+	Err string
+}
+
+func NewArrayServer(factory *ArrayFactory) *ArrayServer {
+	return &ArrayServer{factory: factory, arrs: map[string]*servedArray{}}
+}
+
+// Close every array that is still open. The server should not be used after
+// this.
+func (self *ArrayServer) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var firstErr error
+	for name, served := range self.arrs {
+		if err := served.arr.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(self.arrs, name)
+	}
+	return firstErr
+}
+
+func httpError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(httpErrResp{Err: fmt.Sprintf(format, args...)})
+}
+
+func httpJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func shapeToHttp(shape *DistribArrayShape) httpShape {
+	return httpShape{Lens: shape.lens, Caps: shape.caps}
+}
+
+func (self *ArrayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "arrays" || path[1] == "" {
+		httpError(w, http.StatusNotFound, "Unrecognized path %v", r.URL.Path)
+		return
+	}
+	name := path[1]
+
+	switch {
+	case len(path) == 2 && r.Method == http.MethodPut:
+		self.create(w, r, name)
+
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		self.destroy(w, name)
+
+	case len(path) == 3 && path[2] == "open" && r.Method == http.MethodPost:
+		self.open(w, name)
+
+	case len(path) == 3 && path[2] == "close" && r.Method == http.MethodPost:
+		self.close(w, name)
+
+	case len(path) == 3 && path[2] == "shape" && r.Method == http.MethodGet:
+		served, ok := self.get(w, name)
+		if !ok {
+			return
+		}
+		self.shape(w, served)
+
+	case len(path) == 3 && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		partId, err := strconv.Atoi(path[2])
+		if err != nil {
+			httpError(w, http.StatusNotFound, "Invalid partition %q", path[2])
+			return
+		}
+
+		served, ok := self.get(w, name)
+		if !ok {
+			return
+		}
+
+		shape, err := served.arr.GetShape()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Failed to get shape: %v", err)
+			return
+		}
+		if partId < 0 || partId >= shape.NPart() {
+			httpError(w, http.StatusNotFound, "Array %v has no partition %v", name, partId)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			self.read(w, r, served, shape, partId)
+		} else {
+			self.append(w, r, served, partId)
+		}
+
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "Unsupported request %v %v", r.Method, r.URL.Path)
+	}
+}
+
+// Look up an array for a data operation, reporting an error to the client if
+// it doesn't exist. Like local arrays, handles stay usable after Close() so
+// arrays that were closed by every client are re-opened on demand (without
+// taking a reference).
+func (self *ArrayServer) get(w http.ResponseWriter, name string) (*servedArray, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	served, ok := self.arrs[name]
+	if !ok {
+		arr, err := self.factory.Open(name)
+		if err != nil {
+			httpError(w, http.StatusNotFound, "Failed to open array %v: %v", name, err)
+			return nil, false
+		}
+		served = &servedArray{arr: arr}
+		self.arrs[name] = served
+	}
+	return served, true
+}
+
+func (self *ArrayServer) shape(w http.ResponseWriter, served *servedArray) {
+	shape, err := served.arr.GetShape()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to get shape: %v", err)
+		return
+	}
+	httpJSON(w, http.StatusOK, shapeToHttp(shape))
+}
+
+func (self *ArrayServer) create(w http.ResponseWriter, r *http.Request, name string) {
+	var req httpShape
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid shape: %v", err)
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.arrs[name]; ok {
+		httpError(w, http.StatusConflict, "Array %v exists", name)
+		return
+	}
+
+	arr, err := self.factory.Create(name, CreateShape(req.Caps))
+	if err != nil {
+		httpError(w, http.StatusConflict, "Failed to create array %v: %v", name, err)
+		return
+	}
+
+	served := &servedArray{arr: arr, refs: 1}
+	self.arrs[name] = served
+	self.shape(w, served)
+}
+
+func (self *ArrayServer) open(w http.ResponseWriter, name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	served, ok := self.arrs[name]
+	if !ok {
+		arr, err := self.factory.Open(name)
+		if err != nil {
+			httpError(w, http.StatusNotFound, "Failed to open array %v: %v", name, err)
+			return
+		}
+		served = &servedArray{arr: arr}
+		self.arrs[name] = served
+	}
+	served.refs++
+
+	self.shape(w, served)
+}
+
+func (self *ArrayServer) close(w http.ResponseWriter, name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	served, ok := self.arrs[name]
+	if !ok {
+		httpError(w, http.StatusNotFound, "Array %v is not open", name)
+		return
+	}
+
+	// Arrays re-opened by get() may be closed without a reference
+	served.refs--
+	if served.refs > 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	delete(self.arrs, name)
+	if err := served.arr.Close(); err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to close array %v: %v", name, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *ArrayServer) destroy(w http.ResponseWriter, name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	served, ok := self.arrs[name]
+	if !ok {
+		// Arrays can be destroyed without being opened first
+		arr, err := self.factory.Open(name)
+		if err != nil {
+			httpError(w, http.StatusNotFound, "Failed to open array %v: %v", name, err)
+			return
+		}
+		served = &servedArray{arr: arr}
+	}
+
+	delete(self.arrs, name)
+	if err := served.arr.Destroy(); err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to destroy array %v: %v", name, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *ArrayServer) read(w http.ResponseWriter, r *http.Request, served *servedArray, shape *DistribArrayShape, partId int) {
+	var start, end int
+	var err error
+
+	query := r.URL.Query()
+	if s := query.Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid start %q", s)
+			return
+		}
+	}
+	if s := query.Get("end"); s != "" {
+		if end, err = strconv.Atoi(s); err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid end %q", s)
+			return
+		}
+	}
+
+	// Clients turn this status back into ErrOutOfRange
+	limit, err := shape.resolveRange(partId, start, end)
+	if err != nil {
+		httpError(w, http.StatusRequestedRangeNotSatisfiable, "%v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(limit-start))
+
+	// An end of 0 would mean "the whole partition" to the backing array
+	if limit == start {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	reader, err := served.arr.GetPartRangeReader(partId, start, limit)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to read partition %v: %v", partId, err)
+		return
+	}
+	defer reader.Close()
+
+	// The length lets clients return io.EOF along with the last bytes. Once
+	// the header is out errors can only be reported by cutting the body short.
+	w.WriteHeader(http.StatusOK)
+	io.CopyN(w, reader, (int64)(limit-start))
+}
+
+func (self *ArrayServer) append(w http.ResponseWriter, r *http.Request, served *servedArray, partId int) {
+	// Don't hold writeLock while waiting on the client, it may be
+	// interleaving this body with appends to other partitions
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to receive data for partition %v: %v", partId, err)
+		return
+	}
+
+	served.writeLock.Lock()
+	defer served.writeLock.Unlock()
+
+	writer, err := served.arr.GetPartWriter(partId)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to open partition %v: %v", partId, err)
+		return
+	}
+
+	var resp httpAppendResp
+	nWritten, err := writer.Write(body)
+	resp.N = (int64)(nWritten)
+	closeErr := writer.Close()
+
+	if err == io.EOF {
+		resp.Full = true
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to write partition %v after %v bytes: %v", partId, resp.N, err)
+		return
+	}
+	if closeErr != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to close writer for partition %v: %v", partId, closeErr)
+		return
+	}
+
+	shape, err := served.arr.GetShape()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to get shape: %v", err)
+		return
+	}
+	resp.Len = shape.Len(partId)
+
+	httpJSON(w, http.StatusOK, resp)
+}
@@ -3,6 +3,22 @@ package data
 import (
 	"fmt"
 	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by DistribArray implementations for bad arguments. They are
+// wrapped with more detail, use errors.Cause() to check for them.
+var (
+	// The partition ID is negative or not less than NPart()
+	ErrNoSuchPartition = errors.New("No such partition")
+
+	// A range doesn't fit within the current length of its partition
+	ErrOutOfRange = errors.New("Range out of bounds")
+
+	// The array was destroyed, or closed and the operation needs an open
+	// array (e.g. writing to a closed FileDistribArray)
+	ErrClosed = errors.New("Array is closed")
 )
 
 // Describe the logical layout of a distributed array
@@ -32,6 +48,14 @@ func CreateShapeUniform(cap int64, npart int) DistribArrayShape {
 	return DistribArrayShape{caps: caps, lens: lens}
 }
 
+// Deep copy of shape, e.g. to snapshot the shape of an array that is still
+// being written
+func CreateShapeFrom(shape DistribArrayShape) DistribArrayShape {
+	newShape := CreateShape(shape.caps)
+	copy(newShape.lens, shape.lens)
+	return newShape
+}
+
 // DistribArrayShapes are immutable so we abstract access
 func (self *DistribArrayShape) Len(partIdx int) int64 {
 	return self.lens[partIdx]
@@ -45,6 +69,32 @@ func (self *DistribArrayShape) NPart() int {
 	return len(self.caps)
 }
 
+func (self *DistribArrayShape) checkPart(partId int) error {
+	if partId < 0 || partId >= len(self.caps) {
+		return errors.Wrapf(ErrNoSuchPartition, "Partition %v of %v", partId, len(self.caps))
+	}
+	return nil
+}
+
+// Validate GetPartRangeReader arguments against the current length of partId
+// and return the end of the range as an absolute offset
+func (self *DistribArrayShape) resolveRange(partId, start, end int) (int, error) {
+	if err := self.checkPart(partId); err != nil {
+		return 0, err
+	}
+
+	partLen := (int)(self.lens[partId])
+	limit := end
+	if end <= 0 {
+		limit = partLen + end
+	}
+
+	if start < 0 || limit < start || limit > partLen {
+		return 0, errors.Wrapf(ErrOutOfRange, "Range [%v, %v) of partition %v (length %v)", start, limit, partId, partLen)
+	}
+	return limit, nil
+}
+
 func (self *DistribArrayShape) ToString() string {
 	var lenStr string
 	var capStr string
@@ -82,7 +132,9 @@ type DistribArray interface {
 
 	// Multiple readers may exist simultaneously for the same array, but the
 	// user must ensure that the array does not change while there are active
-	// readers.
+	// readers. The range is [start, end), an end <= 0 is relative to the
+	// current length of the partition. Ranges outside the partition return
+	// ErrOutOfRange.
 	GetPartRangeReader(partId, start, end int) (io.ReadCloser, error)
 
 	// Writers are append-only
@@ -98,6 +150,22 @@ type DistribArray interface {
 	Destroy() error
 }
 
+// DistribArrays that can expose their data in memory without copying may also
+// implement PartByteSlicer (see PartRef.Bytes()).
+type PartByteSlicer interface {
+	// Returns the bytes in [start, end) of partition partId, end has the same
+	// meaning as in GetPartRangeReader. The returned slice aliases the
+	// array's storage, it must not be modified and is only valid until the
+	// array is destroyed.
+	GetPartRangeBytes(partId, start, end int) ([]byte, error)
+}
+
+// DistribArrays that know the name they were created with (the name to pass
+// to ArrayFactory.Open) implement NamedArray. All of the built-in backends do.
+type NamedArray interface {
+	ArrayName() string
+}
+
 // A reference to an input partition
 type PartRef struct {
 	Arr     DistribArray // DistribArray to read from
@@ -109,4 +177,19 @@ type PartRef struct {
 type ArrayFactory struct {
 	Create func(name string, shape DistribArrayShape) (DistribArray, error)
 	Open   func(name string) (DistribArray, error)
+
+	// Catalog operations (see catalog.go). These are nil for backends that
+	// can't enumerate their arrays.
+	List   func() ([]string, error)
+	Stat   func(name string) (*ArrayInfo, error)
+	Exists func(name string) (bool, error)
+
+	// Removes an array without opening it (so that damaged arrays can be
+	// cleaned up). Optional, Open() followed by Destroy() is used otherwise.
+	Remove func(name string) error
+
+	// Arrays from Create honor zero (unlimited) partition capacities.
+	// Otherwise a zero capacity partition is always full, i.e. it can only
+	// hold an empty bucket.
+	Unlimited bool
 }
@@ -0,0 +1,122 @@
+// Package resp implements the Redis wire protocol (RESP2). It is shared by
+// the Redis client in package data and the fake server in datatest.
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Error reply from the server (e.g. "ERR wrong number of arguments")
+type Error string
+
+func (self Error) Error() string {
+	return "Redis error: " + string(self)
+}
+
+// Commands are sent as an array of bulk strings
+func WriteCommand(wr *bufio.Writer, args ...interface{}) error {
+	fmt.Fprintf(wr, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		default:
+			return fmt.Errorf("Unsupported redis argument type %T", arg)
+		}
+
+		fmt.Fprintf(wr, "$%d\r\n", len(b))
+		wr.Write(b)
+		if _, err := wr.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("Malformed redis line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// Read one reply. Error replies are returned as an Error, the other types as
+// string (simple strings), int64, []byte (bulk strings, nil for null) or
+// []interface{} (arrays).
+func ReadReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read redis reply")
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, Error(line[1:])
+
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad redis integer %q", line)
+		}
+		return n, nil
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad redis bulk length %q", line)
+		}
+		if n < 0 {
+			return ([]byte)(nil), nil
+		}
+
+		// Includes the trailing \r\n
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, errors.Wrap(err, "Failed to read redis bulk string")
+		}
+		return buf[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad redis array length %q", line)
+		}
+		if n < 0 {
+			return ([]interface{})(nil), nil
+		}
+
+		arr := make([]interface{}, n)
+		for i := 0; i < n; i++ {
+			// Errors nested in an array (e.g. from EXEC) are returned in place
+			elem, err := ReadReply(rd)
+			if replyErr, isReply := err.(Error); isReply {
+				elem = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			arr[i] = elem
+		}
+		return arr, nil
+
+	default:
+		return nil, fmt.Errorf("Unrecognized redis reply %q", line)
+	}
+}
@@ -0,0 +1,43 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	wr := bufio.NewWriter(&buf)
+	WriteCommand(wr, "APPEND", "k", []byte("a\r\nb"))
+	wr.Flush()
+	require.Equal(t, "*3\r\n$6\r\nAPPEND\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n", buf.String())
+
+	replies := "+OK\r\n-ERR bad\r\n:42\r\n$3\r\nabc\r\n$-1\r\n*2\r\n$1\r\nx\r\n:1\r\n"
+	rd := bufio.NewReader(bytes.NewBufferString(replies))
+
+	reply, err := ReadReply(rd)
+	require.Nil(t, err)
+	require.Equal(t, "OK", reply)
+
+	_, err = ReadReply(rd)
+	require.Equal(t, Error("ERR bad"), err)
+
+	reply, err = ReadReply(rd)
+	require.Nil(t, err)
+	require.Equal(t, (int64)(42), reply)
+
+	reply, err = ReadReply(rd)
+	require.Nil(t, err)
+	require.Equal(t, []byte("abc"), reply)
+
+	reply, err = ReadReply(rd)
+	require.Nil(t, err)
+	require.Nil(t, reply.([]byte), "Null bulk string not nil")
+
+	reply, err = ReadReply(rd)
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{[]byte("x"), (int64)(1)}, reply)
+}
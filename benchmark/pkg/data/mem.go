@@ -3,9 +3,15 @@ package data
 import (
 	"fmt"
 	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var MemArrayFactory *ArrayFactory = &ArrayFactory{
+	Unlimited: true,
+
 	Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
 		a, err := CreateMemDistribArray(name, shape)
 		return (DistribArray)(a), err
@@ -15,10 +21,54 @@ var MemArrayFactory *ArrayFactory = &ArrayFactory{
 		a, err := OpenMemDistribArray(name)
 		return (DistribArray)(a), err
 	},
+
+	List: func() ([]string, error) {
+		memArrLock.Lock()
+		defer memArrLock.Unlock()
+
+		names := make([]string, 0, len(memArrBacking))
+		for name := range memArrBacking {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	},
+
+	// Reports the committed state, like the metadata of a file array
+	Stat: func(name string) (*ArrayInfo, error) {
+		memArrLock.Lock()
+		defer memArrLock.Unlock()
+
+		backing, ok := memArrBacking[name]
+		if !ok {
+			return nil, fmt.Errorf("Array %v does not exist", name)
+		}
+		return &ArrayInfo{Name: name, Shape: CreateShapeFrom(backing.shape),
+			ModTime: time.Unix(0, backing.modTime)}, nil
+	},
+
+	Exists: func(name string) (bool, error) {
+		memArrLock.Lock()
+		defer memArrLock.Unlock()
+
+		_, ok := memArrBacking[name]
+		return ok, nil
+	},
+}
+
+// The committed state of a MemDistribArray, i.e. what Open() returns. This
+// plays the role of the files behind a FileDistribArray.
+type memBacking struct {
+	shape DistribArrayShape
+	parts [][]byte
+
+	// UnixNano of the last write before the commit
+	modTime int64
 }
 
-// A place to store MemDistribArray data in between create and close calls.
-var memArrBacking map[string]*MemDistribArray = map[string]*MemDistribArray{}
+// Committed arrays by name. memArrLock protects the map and every memBacking.
+var memArrBacking map[string]*memBacking = map[string]*memBacking{}
+var memArrLock sync.Mutex
 
 // A write-closer for MemDistrib, close is a nop in this case
 type MemDistribPartWriteCloser struct {
@@ -36,18 +86,23 @@ type MemDistribPartReadCloser struct {
 }
 
 func (self *MemDistribPartWriteCloser) Write(in []byte) (n int, err error) {
+	if self.arr.destroyed {
+		return 0, ErrClosed
+	}
 	shape := self.arr.shape
 
 	toWrite := (int64)(len(in))
 	nRemaining := shape.caps[self.partId] - shape.lens[self.partId]
 
-	if toWrite > nRemaining {
+	// Zero capacity means unlimited (as in PERPART FileDistribArrays)
+	if shape.caps[self.partId] != 0 && toWrite > nRemaining {
 		toWrite = nRemaining
 		err = io.EOF
 	}
 
 	self.arr.parts[self.partId] = append(self.arr.parts[self.partId], in[:toWrite]...)
 	shape.lens[self.partId] += toWrite
+	atomic.StoreInt64(&self.arr.modTime, time.Now().UnixNano())
 
 	return (int)(toWrite), err
 }
@@ -75,13 +130,34 @@ func (self *MemDistribPartReadCloser) Close() error {
 
 // In-memory 'distributed' array. Does not provide any persistence and cannot
 // share between processes (only threads in the same address space).
+//
+// MemDistribArrays follow the same commit rules as the persistent backends so
+// that they can stand in for them in tests. Each handle has its own view of
+// the array: writes are visible to the handle that made them right away, but
+// other handles (from Open()) only see what was committed by Close() before
+// they were opened. Shapes are snapshots. Committed data is shared rather
+// than copied, partitions are append-only so handles never see each other's
+// later writes.
 type MemDistribArray struct {
 	name  string
 	shape DistribArrayShape
 	parts [][]byte
+
+	// Where Close() commits to. Destroy() only removes it from
+	// memArrBacking if no newer array has reused the name.
+	backing *memBacking
+
+	// UnixNano of the last write, atomic since writers for different
+	// partitions may run concurrently
+	modTime int64
+
+	destroyed bool
 }
 
 func CreateMemDistribArray(name string, shape DistribArrayShape) (*MemDistribArray, error) {
+	memArrLock.Lock()
+	defer memArrLock.Unlock()
+
 	if _, ok := memArrBacking[name]; ok {
 		return nil, fmt.Errorf("Array %v exists", name)
 	}
@@ -91,39 +167,84 @@ func CreateMemDistribArray(name string, shape DistribArrayShape) (*MemDistribArr
 	copy(arrShape.caps, shape.caps)
 	copy(arrShape.lens, shape.lens)
 
-	arr := &MemDistribArray{name: name, shape: arrShape}
+	arr := &MemDistribArray{name: name, shape: arrShape, modTime: time.Now().UnixNano()}
 
 	arr.parts = make([][]byte, len(shape.caps))
 	for i := 0; i < len(shape.caps); i++ {
 		arr.parts[i] = make([]byte, arrShape.lens[i], arrShape.caps[i])
 	}
 
-	memArrBacking[name] = arr
+	// Creating an array commits its (empty) shape, as it does for files
+	arr.backing = &memBacking{}
+	arr.commit()
+	memArrBacking[name] = arr.backing
 
 	return arr, nil
 }
 
 func OpenMemDistribArray(name string) (*MemDistribArray, error) {
+	memArrLock.Lock()
+	defer memArrLock.Unlock()
 
-	arr, ok := memArrBacking[name]
+	backing, ok := memArrBacking[name]
 	if !ok {
 		return nil, fmt.Errorf("Array %v does not exist", name)
 	}
 
+	arr := &MemDistribArray{name: name, shape: CreateShapeFrom(backing.shape),
+		backing: backing, modTime: backing.modTime}
+
+	// The capacity is clipped so that appends through this handle copy the
+	// partition instead of writing into memory other handles may still use
+	arr.parts = make([][]byte, len(backing.parts))
+	for i, part := range backing.parts {
+		arr.parts[i] = part[:len(part):len(part)]
+	}
+
 	return arr, nil
 }
 
+// Publish this handle's view of the array, the caller holds memArrLock
+func (self *MemDistribArray) commit() {
+	self.backing.shape = CreateShapeFrom(self.shape)
+	self.backing.parts = make([][]byte, len(self.parts))
+	for i, part := range self.parts {
+		self.backing.parts[i] = part[:self.shape.lens[i]]
+	}
+	self.backing.modTime = atomic.LoadInt64(&self.modTime)
+}
+
+func (self *MemDistribArray) ArrayName() string {
+	return self.name
+}
+
 func (self *MemDistribArray) GetShape() (*DistribArrayShape, error) {
-	// Copy the slices but not their underlying array (DistribArrayShape is immutable by clients)
-	return &DistribArrayShape{lens: self.shape.lens, caps: self.shape.caps}, nil
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	shape := CreateShapeFrom(self.shape)
+	return &shape, nil
 }
 
 func (self *MemDistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
-	if end <= 0 {
-		return &MemDistribPartReadCloser{buf: self.parts[partId], start: start, limit: (int)(self.shape.caps[partId]) + end}, nil
-	} else {
-		return &MemDistribPartReadCloser{buf: self.parts[partId], start: start, limit: end}, nil
+	buf, err := self.GetPartRangeBytes(partId, start, end)
+	if err != nil {
+		return nil, err
 	}
+	return &MemDistribPartReadCloser{buf: buf, start: 0, limit: len(buf)}, nil
+}
+
+func (self *MemDistribArray) GetPartRangeBytes(partId, start, end int) ([]byte, error) {
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	limit, err := self.shape.resolveRange(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return self.parts[partId][start:limit], nil
 }
 
 func (self *MemDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
@@ -131,15 +252,42 @@ func (self *MemDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
 }
 
 func (self *MemDistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
 	return &MemDistribPartWriteCloser{arr: self, partId: partId}, nil
 }
 
+// Commit writes so that later calls to Open() see them. The handle can still
+// be used afterwards.
 func (self *MemDistribArray) Close() error {
+	if self.destroyed {
+		return nil
+	}
+
+	memArrLock.Lock()
+	defer memArrLock.Unlock()
+	self.commit()
 	return nil
 }
 
+// Destroy may be called more than once
 func (self *MemDistribArray) Destroy() error {
-	delete(memArrBacking, self.name)
+	if self.destroyed {
+		return nil
+	}
+	self.destroyed = true
+
+	// Don't remove a newer array that reused the name
+	memArrLock.Lock()
+	if memArrBacking[self.name] == self.backing {
+		delete(memArrBacking, self.name)
+	}
+	memArrLock.Unlock()
+
 	self.parts = nil
 	return nil
 }
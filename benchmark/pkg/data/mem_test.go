@@ -1,6 +1,7 @@
 package data
 
 import (
+	"crypto/rand"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -32,3 +33,69 @@ func TestMemDistribArr(t *testing.T) {
 func TestMemFactory(t *testing.T) {
 	testArrayFactory(t, MemArrayFactory)
 }
+
+// Writes are only visible to other handles once committed by Close
+func TestMemCommit(t *testing.T) {
+	arr, err := MemArrayFactory.Create("TestMemCommit", CreateShapeUniform(8, 2))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := make([]byte, 8)
+	rand.Read(raw)
+
+	before, err := arr.GetShape()
+	require.Nil(t, err)
+	writeTieredPart(t, arr, 0, raw[:4])
+
+	require.Equal(t, (int64)(0), before.Len(0), "Shapes aren't snapshots")
+	checkTieredPart(t, arr, 0, raw[:4])
+
+	uncommitted, err := MemArrayFactory.Open("TestMemCommit")
+	require.Nil(t, err)
+	shape, err := uncommitted.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(0), shape.Len(0), "Uncommitted writes are visible to other handles")
+
+	info, err := MemArrayFactory.Stat("TestMemCommit")
+	require.Nil(t, err)
+	require.Equal(t, (int64)(0), info.TotalLen(), "Stat reported uncommitted writes")
+
+	require.Nil(t, arr.Close())
+	committed, err := MemArrayFactory.Open("TestMemCommit")
+	require.Nil(t, err)
+	checkTieredPart(t, committed, 0, raw[:4])
+
+	// Handles opened earlier keep their view
+	shape, err = uncommitted.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(0), shape.Len(0), "Commit changed an open handle")
+
+	// Appends through different handles don't interfere
+	writeTieredPart(t, committed, 0, raw[4:])
+	other := []byte{1, 2, 3, 4}
+	writeTieredPart(t, arr, 0, other)
+	checkTieredPart(t, committed, 0, raw)
+	checkTieredPart(t, arr, 0, append(append([]byte{}, raw[:4]...), other...))
+
+	require.Nil(t, committed.Close())
+	reopened, err := MemArrayFactory.Open("TestMemCommit")
+	require.Nil(t, err)
+	checkTieredPart(t, reopened, 0, raw)
+}
+
+func TestMemUnlimited(t *testing.T) {
+	arr, err := MemArrayFactory.Create("TestMemUnlimited", CreateShape([]int64{0, 0}))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := make([]byte, 64)
+	rand.Read(raw)
+	writeTieredPart(t, arr, 1, raw[:32])
+	writeTieredPart(t, arr, 1, raw[32:])
+
+	shape, err := arr.GetShape()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(0), shape.Len(0), "Untouched partition has data")
+	require.Equal(t, (int64)(len(raw)), shape.Len(1), "Zero-capacity partition did not grow")
+	checkTieredPart(t, arr, 1, raw)
+}
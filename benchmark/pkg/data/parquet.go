@@ -0,0 +1,663 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// Just enough of Parquet to move a column of integers in and out of a
+// DistribArray. The writer produces a single REQUIRED UINT_32 column with
+// PLAIN, uncompressed pages. The reader handles a flat INT32 or INT64 column
+// from most writers: v1 and v2 data pages, PLAIN and dictionary encodings,
+// UNCOMPRESSED, SNAPPY or GZIP pages, and OPTIONAL columns without nulls.
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet enum values (from parquet.thrift)
+const (
+	parquetInt32 = 1
+	parquetInt64 = 2
+
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetUint8  = 11
+	parquetUint16 = 12
+	parquetUint32 = 13
+
+	parquetPlain     = 0
+	parquetPlainDict = 2
+	parquetRle       = 3
+	parquetRleDict   = 8
+
+	parquetDataPage   = 0
+	parquetIndexPage  = 1
+	parquetDictPage   = 2
+	parquetDataPageV2 = 3
+
+	parquetUncompressed = 0
+	parquetSnappy       = 1
+	parquetGzip         = 2
+
+	// The INTEGER member of the LogicalType union
+	parquetLogicalInteger = 10
+)
+
+var parquetCodecNames = map[int64]string{
+	0: "UNCOMPRESSED",
+	1: "SNAPPY",
+	2: "GZIP",
+	3: "LZO",
+	4: "BROTLI",
+	5: "LZ4",
+	6: "ZSTD",
+	7: "LZ4_RAW",
+}
+
+const (
+	// Bytes of values in each data page written
+	parquetPageSz = 1024 * 1024
+
+	// Values in each row group written
+	parquetGroupLen = 64 * 1024 * 1024
+)
+
+type parquetGroup struct {
+	offset int64 // File offset of the first page
+	size   int64 // Bytes of pages (including headers)
+	nValue int64
+}
+
+// Writes whole little-endian uint32s as a single column Parquet file
+type parquetWriter struct {
+	w      io.Writer
+	column string
+
+	pos    int64 // Bytes written to w so far
+	page   []byte
+	groups []parquetGroup
+}
+
+func newParquetWriter(w io.Writer, column string) (*parquetWriter, error) {
+	if _, err := w.Write(parquetMagic); err != nil {
+		return nil, err
+	}
+	return &parquetWriter{w: w, column: column, pos: (int64)(len(parquetMagic)),
+		page: make([]byte, 0, parquetPageSz)}, nil
+}
+
+func (self *parquetWriter) encode(elems []byte) error {
+	for len(elems) > 0 {
+		n := copy(self.page[len(self.page):cap(self.page)], elems)
+		self.page = self.page[:len(self.page)+n]
+		elems = elems[n:]
+
+		if len(self.page) == cap(self.page) {
+			if err := self.flushPage(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *parquetWriter) flushPage() error {
+	nValue := (int64)(len(self.page) / 4)
+
+	if len(self.groups) == 0 || self.groups[len(self.groups)-1].nValue+nValue > parquetGroupLen {
+		self.groups = append(self.groups, parquetGroup{offset: self.pos})
+	}
+	group := &self.groups[len(self.groups)-1]
+
+	hdr := newThriftWriter()
+	hdr.i32(1, parquetDataPage)
+	hdr.i32(2, (int32)(len(self.page)))
+	hdr.i32(3, (int32)(len(self.page)))
+	hdr.beginStruct(5)
+	hdr.i32(1, (int32)(nValue))
+	hdr.i32(2, parquetPlain)
+	hdr.i32(3, parquetRle)
+	hdr.i32(4, parquetRle)
+	hdr.end()
+	hdr.end()
+
+	for _, b := range [][]byte{hdr.Bytes(), self.page} {
+		if _, err := self.w.Write(b); err != nil {
+			return err
+		}
+		self.pos += (int64)(len(b))
+		group.size += (int64)(len(b))
+	}
+
+	group.nValue += nValue
+	self.page = self.page[:0]
+	return nil
+}
+
+// Write any remaining values and the file metadata
+func (self *parquetWriter) finish() error {
+	if len(self.page) != 0 {
+		if err := self.flushPage(); err != nil {
+			return err
+		}
+	}
+
+	var nRow int64
+	for _, group := range self.groups {
+		nRow += group.nValue
+	}
+
+	meta := newThriftWriter()
+	meta.i32(1, 1)
+
+	// Schema
+	meta.list(2, tcStruct, 2)
+	meta.push()
+	meta.binary(4, []byte("schema"))
+	meta.i32(5, 1)
+	meta.end()
+	meta.push()
+	meta.i32(1, parquetInt32)
+	meta.i32(3, parquetRequired)
+	meta.binary(4, []byte(self.column))
+	meta.i32(6, parquetUint32)
+	meta.beginStruct(10)
+	meta.beginStruct(parquetLogicalInteger)
+	meta.i8(1, 32)
+	meta.bool(2, false)
+	meta.end()
+	meta.end()
+	meta.end()
+
+	meta.i64(3, nRow)
+
+	meta.list(4, tcStruct, len(self.groups))
+	for _, group := range self.groups {
+		meta.push()
+
+		// Column chunk
+		meta.list(1, tcStruct, 1)
+		meta.push()
+		meta.i64(2, group.offset)
+		meta.beginStruct(3)
+		meta.i32(1, parquetInt32)
+		meta.list(2, tcI32, 2)
+		meta.svarint(parquetPlain)
+		meta.svarint(parquetRle)
+		meta.list(3, tcBinary, 1)
+		meta.rawBinary([]byte(self.column))
+		meta.i32(4, parquetUncompressed)
+		meta.i64(5, group.nValue)
+		meta.i64(6, group.size)
+		meta.i64(7, group.size)
+		meta.i64(9, group.offset)
+		meta.end()
+		meta.end()
+
+		meta.i64(2, group.size)
+		meta.i64(3, group.nValue)
+		meta.end()
+	}
+
+	meta.binary(6, []byte("gpu-radix-sort"))
+	meta.end()
+
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], (uint32)(len(meta.Bytes())))
+	for _, b := range [][]byte{meta.Bytes(), footer[:], parquetMagic} {
+		if _, err := self.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A leaf of the Parquet schema
+type parquetLeaf struct {
+	path   []string
+	elem   thriftStruct
+	maxDef int
+	maxRep int
+}
+
+// List the leaf columns in schema order (the order of column chunks in each
+// row group)
+func parquetLeaves(schema []interface{}) ([]parquetLeaf, error) {
+	var leaves []parquetLeaf
+
+	var walk func(idx int, path []string, def, rep int) (int, error)
+	walk = func(idx int, path []string, def, rep int) (int, error) {
+		if idx >= len(schema) {
+			return 0, fmt.Errorf("Truncated parquet schema")
+		}
+		elem, ok := schema[idx].(thriftStruct)
+		if !ok {
+			return 0, fmt.Errorf("Corrupt parquet schema")
+		}
+
+		// The root's name and repetition don't count
+		if idx != 0 {
+			path = append(path[:len(path):len(path)], string(elem.bytes(4)))
+			switch elem.int(3) {
+			case parquetOptional:
+				def++
+			case parquetRepeated:
+				def++
+				rep++
+			}
+		}
+
+		nChild := (int)(elem.int(5))
+		if nChild == 0 && idx != 0 {
+			leaves = append(leaves, parquetLeaf{path: path, elem: elem, maxDef: def, maxRep: rep})
+			return idx + 1, nil
+		}
+
+		next := idx + 1
+		for i := 0; i < nChild; i++ {
+			var err error
+			if next, err = walk(next, path, def, rep); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	}
+
+	if _, err := walk(0, nil, 0, 0); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// Converts the values of one column chunk to little-endian uint32s
+type parquetColumnReader struct {
+	leaf  parquetLeaf
+	codec int64
+
+	// Physical value size and the largest raw value that fits in a uint32
+	// without changing its meaning
+	width int
+	limit uint64
+
+	dict []uint64
+	out  []byte
+}
+
+func newParquetColumnReader(leaf parquetLeaf) (*parquetColumnReader, error) {
+	name := strings.Join(leaf.path, ".")
+	if leaf.maxRep != 0 {
+		return nil, fmt.Errorf("Column %v is repeated", name)
+	}
+
+	reader := &parquetColumnReader{leaf: leaf}
+	switch leaf.elem.int(1) {
+	case parquetInt32:
+		reader.width = 4
+
+		// Signed values are only valid if they aren't negative
+		converted := leaf.elem.int(6)
+		logical := leaf.elem.strct(10).strct(parquetLogicalInteger)
+		if converted == parquetUint8 || converted == parquetUint16 || converted == parquetUint32 ||
+			(logical != nil && !logical.bool(2)) {
+			reader.limit = math.MaxUint32
+		} else {
+			reader.limit = math.MaxInt32
+		}
+
+	case parquetInt64:
+		reader.width = 8
+		reader.limit = math.MaxUint32
+
+	default:
+		return nil, fmt.Errorf("Column %v must have an INT32 or INT64 type", name)
+	}
+	return reader, nil
+}
+
+func (self *parquetColumnReader) decompress(page []byte, size int64) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid page size %v", size)
+	}
+
+	var out []byte
+	var err error
+	switch self.codec {
+	case parquetUncompressed:
+		out = page
+	case parquetSnappy:
+		// Pages use the snappy block format, not the framed stream format
+		var n int
+		if n, err = snappy.DecodedLen(page); err == nil && (int64)(n) != size {
+			err = snappy.ErrCorrupt
+		}
+		if err == nil {
+			out, err = snappy.Decode(nil, page)
+		}
+	case parquetGzip:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(page)); err == nil {
+			out, err = ioutil.ReadAll(io.LimitReader(gz, size+1))
+		}
+	default:
+		name, ok := parquetCodecNames[self.codec]
+		if !ok {
+			name = fmt.Sprintf("%v", self.codec)
+		}
+		return nil, fmt.Errorf("Unsupported parquet compression %v (use SNAPPY, GZIP or UNCOMPRESSED)", name)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decompress page")
+	}
+	if (int64)(len(out)) != size {
+		return nil, fmt.Errorf("Page decompressed to %v bytes, expected %v", len(out), size)
+	}
+	return out, nil
+}
+
+// Decode n PLAIN values
+func (self *parquetColumnReader) plain(buf []byte, n int) ([]uint64, error) {
+	if n < 0 || len(buf) < n*self.width {
+		return nil, fmt.Errorf("Page too short for %v values", n)
+	}
+
+	vals := make([]uint64, n)
+	for i := range vals {
+		if self.width == 4 {
+			vals[i] = (uint64)(binary.LittleEndian.Uint32(buf[i*4:]))
+		} else {
+			vals[i] = binary.LittleEndian.Uint64(buf[i*8:])
+		}
+	}
+	return vals, nil
+}
+
+// Decode n values with the given encoding and add them to the output
+func (self *parquetColumnReader) values(buf []byte, encoding int64, n int) error {
+	var vals []uint64
+
+	switch encoding {
+	case parquetPlain:
+		var err error
+		if vals, err = self.plain(buf, n); err != nil {
+			return err
+		}
+
+	case parquetPlainDict, parquetRleDict:
+		if self.dict == nil {
+			return fmt.Errorf("Dictionary encoded page without a dictionary")
+		}
+		if len(buf) == 0 {
+			return fmt.Errorf("Missing dictionary index bit width")
+		}
+
+		idxs, err := decodeRleHybrid(buf[1:], (int)(buf[0]), n)
+		if err != nil {
+			return err
+		}
+		vals = make([]uint64, n)
+		for i, idx := range idxs {
+			if (int)(idx) >= len(self.dict) {
+				return fmt.Errorf("Dictionary index %v out of range", idx)
+			}
+			vals[i] = self.dict[idx]
+		}
+
+	default:
+		return fmt.Errorf("Unsupported parquet encoding %v", encoding)
+	}
+
+	var tmp [4]byte
+	for _, v := range vals {
+		if v > self.limit {
+			return fmt.Errorf("Value %v doesn't fit in a uint32", (int64)(v))
+		}
+		binary.LittleEndian.PutUint32(tmp[:], (uint32)(v))
+		self.out = append(self.out, tmp[:]...)
+	}
+	return nil
+}
+
+// Check the definition levels of a page for nulls
+func (self *parquetColumnReader) checkNulls(levels []byte, n int) error {
+	defs, err := decodeRleHybrid(levels, bits.Len((uint)(self.leaf.maxDef)), n)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode definition levels")
+	}
+	for _, def := range defs {
+		if (int)(def) != self.leaf.maxDef {
+			return fmt.Errorf("Null values are not supported")
+		}
+	}
+	return nil
+}
+
+// Decode every page in a column chunk
+func (self *parquetColumnReader) readChunk(chunk []byte, nValue int64) error {
+	pos := 0
+	for nRead := (int64)(0); nRead < nValue; {
+		tr := &thriftReader{buf: chunk, pos: pos}
+		hdr, err := tr.readStruct()
+		if err != nil {
+			return errors.Wrap(err, "Failed to read page header")
+		}
+		pos = tr.pos
+
+		compSize := hdr.int(3)
+		if compSize < 0 || compSize > (int64)(len(chunk)-pos) {
+			return fmt.Errorf("Page extends past the end of its column chunk")
+		}
+		page := chunk[pos : pos+(int)(compSize)]
+		pos += (int)(compSize)
+		uncompSize := hdr.int(2)
+
+		switch hdr.int(1) {
+		case parquetDictPage:
+			dictHdr := hdr.strct(7)
+			if enc := dictHdr.int(2); enc != parquetPlain && enc != parquetPlainDict {
+				return fmt.Errorf("Unsupported dictionary encoding %v", enc)
+			}
+
+			raw, err := self.decompress(page, uncompSize)
+			if err != nil {
+				return err
+			}
+			if self.dict, err = self.plain(raw, (int)(dictHdr.int(1))); err != nil {
+				return errors.Wrap(err, "Failed to read dictionary")
+			}
+
+		case parquetDataPage:
+			dataHdr := hdr.strct(5)
+			n := (int)(dataHdr.int(1))
+			if n < 0 {
+				return fmt.Errorf("Invalid page value count %v", n)
+			}
+
+			raw, err := self.decompress(page, uncompSize)
+			if err != nil {
+				return err
+			}
+
+			// Definition levels are prefixed by their length
+			if self.leaf.maxDef != 0 {
+				if dataHdr.int(3) != parquetRle {
+					return fmt.Errorf("Unsupported definition level encoding %v", dataHdr.int(3))
+				}
+				if len(raw) < 4 {
+					return fmt.Errorf("Page too short for definition levels")
+				}
+				levelsLen := (int64)(binary.LittleEndian.Uint32(raw))
+				if levelsLen > (int64)(len(raw)-4) {
+					return fmt.Errorf("Page too short for definition levels")
+				}
+				if err := self.checkNulls(raw[4:4+levelsLen], n); err != nil {
+					return err
+				}
+				raw = raw[4+levelsLen:]
+			}
+
+			if err := self.values(raw, dataHdr.int(2), n); err != nil {
+				return err
+			}
+			nRead += (int64)(n)
+
+		case parquetDataPageV2:
+			dataHdr := hdr.strct(8)
+			n := (int)(dataHdr.int(1))
+			if n < 0 {
+				return fmt.Errorf("Invalid page value count %v", n)
+			}
+			if dataHdr.int(2) != 0 {
+				return fmt.Errorf("Null values are not supported")
+			}
+
+			// Levels are never compressed
+			levelsLen := dataHdr.int(5) + dataHdr.int(6)
+			if levelsLen < 0 || levelsLen > (int64)(len(page)) {
+				return fmt.Errorf("Page too short for levels")
+			}
+			raw := page[levelsLen:]
+
+			if !dataHdr.has(7) || dataHdr.bool(7) {
+				if raw, err = self.decompress(raw, uncompSize-levelsLen); err != nil {
+					return err
+				}
+			}
+
+			if err := self.values(raw, dataHdr.int(4), n); err != nil {
+				return err
+			}
+			nRead += (int64)(n)
+
+		case parquetIndexPage:
+
+		default:
+			return fmt.Errorf("Unrecognized page type %v", hdr.int(1))
+		}
+
+		if nRead < nValue && pos >= len(chunk) {
+			return fmt.Errorf("Column chunk ended after %v of %v values", nRead, nValue)
+		}
+	}
+	return nil
+}
+
+// Read a column of a Parquet file as little-endian uint32s. An empty column
+// name selects the first column, nested columns are named by their dotted
+// path (e.g. "a.b").
+func readParquetColumn(path string, column string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	var tail [8]byte
+	if size < (int64)(len(parquetMagic)+len(tail)) {
+		return nil, fmt.Errorf("%v is not a parquet file", path)
+	}
+	if _, err := f.ReadAt(tail[:], size-8); err != nil {
+		return nil, errors.Wrap(err, "Failed to read parquet footer")
+	}
+	if !bytes.Equal(tail[4:], parquetMagic) {
+		return nil, fmt.Errorf("%v is not a parquet file", path)
+	}
+
+	metaLen := (int64)(binary.LittleEndian.Uint32(tail[:4]))
+	if metaLen > size-8-(int64)(len(parquetMagic)) {
+		return nil, fmt.Errorf("Corrupt parquet footer")
+	}
+	rawMeta := make([]byte, metaLen)
+	if _, err := f.ReadAt(rawMeta, size-8-metaLen); err != nil {
+		return nil, errors.Wrap(err, "Failed to read parquet metadata")
+	}
+
+	meta, err := (&thriftReader{buf: rawMeta}).readStruct()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse parquet metadata")
+	}
+
+	leaves, err := parquetLeaves(meta.list(2))
+	if err != nil {
+		return nil, err
+	}
+
+	leafIdx := -1
+	var names []string
+	for i, leaf := range leaves {
+		name := strings.Join(leaf.path, ".")
+		names = append(names, name)
+		if leafIdx == -1 && (column == "" || column == name) {
+			leafIdx = i
+		}
+	}
+	if leafIdx == -1 {
+		return nil, fmt.Errorf("No column %q in %v (found %v)", column, path, strings.Join(names, ", "))
+	}
+
+	reader, err := newParquetColumnReader(leaves[leafIdx])
+	if err != nil {
+		return nil, err
+	}
+	// The row count is only a hint, corrupt files shouldn't cause huge
+	// allocations
+	nRow := meta.int(3)
+	if nRow < 0 || nRow > size {
+		nRow = size
+	}
+	reader.out = make([]byte, 0, nRow*4)
+
+	for i, rawGroup := range meta.list(4) {
+		group, _ := rawGroup.(thriftStruct)
+		cols := group.list(1)
+		if len(cols) != len(leaves) {
+			return nil, fmt.Errorf("Row group %v has %v columns, expected %v", i, len(cols), len(leaves))
+		}
+
+		col, _ := cols[leafIdx].(thriftStruct)
+		if col.has(1) {
+			return nil, fmt.Errorf("Columns in external files are not supported")
+		}
+		colMeta := col.strct(3)
+
+		start := colMeta.int(9)
+		if dictStart := colMeta.int(11); dictStart > 0 && dictStart < start {
+			start = dictStart
+		}
+		chunkSz := colMeta.int(7)
+		if start < 0 || chunkSz < 0 || start+chunkSz > size {
+			return nil, fmt.Errorf("Row group %v extends past the end of the file", i)
+		}
+
+		chunk := make([]byte, chunkSz)
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read row group %v", i)
+		}
+
+		reader.codec = colMeta.int(4)
+		reader.dict = nil
+		if err := reader.readChunk(chunk, colMeta.int(5)); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read row group %v", i)
+		}
+	}
+
+	return reader.out, nil
+}
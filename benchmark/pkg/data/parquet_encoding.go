@@ -0,0 +1,386 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Low-level encodings used by Parquet files: the Thrift compact protocol
+// (page headers and file metadata) and the RLE/bit-packed hybrid (levels and
+// dictionary indices). Only the subset used by parquet.go is implemented.
+
+// Thrift compact protocol type codes
+const (
+	tcStop   = 0
+	tcTrue   = 1
+	tcFalse  = 2
+	tcByte   = 3
+	tcI16    = 4
+	tcI32    = 5
+	tcI64    = 6
+	tcDouble = 7
+	tcBinary = 8
+	tcList   = 9
+	tcSet    = 10
+	tcMap    = 11
+	tcStruct = 12
+)
+
+// Builds a compact protocol struct. Nested structs are started with
+// beginStruct (or push for list elements) and finished with end, the
+// outermost struct is finished with a final end.
+type thriftWriter struct {
+	buf bytes.Buffer
+
+	// The last field ID written in each open struct
+	last []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (self *thriftWriter) Bytes() []byte {
+	return self.buf.Bytes()
+}
+
+func (self *thriftWriter) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	self.buf.Write(tmp[:n])
+}
+
+// Thrift integers are zigzag varints, the same as binary.PutVarint
+func (self *thriftWriter) svarint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	self.buf.Write(tmp[:n])
+}
+
+func (self *thriftWriter) field(id int16, typ byte) {
+	last := &self.last[len(self.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		self.buf.WriteByte((byte)(delta)<<4 | typ)
+	} else {
+		self.buf.WriteByte(typ)
+		self.svarint((int64)(id))
+	}
+	*last = id
+}
+
+func (self *thriftWriter) bool(id int16, v bool) {
+	if v {
+		self.field(id, tcTrue)
+	} else {
+		self.field(id, tcFalse)
+	}
+}
+
+func (self *thriftWriter) i8(id int16, v int8) {
+	self.field(id, tcByte)
+	self.buf.WriteByte((byte)(v))
+}
+
+func (self *thriftWriter) i32(id int16, v int32) {
+	self.field(id, tcI32)
+	self.svarint((int64)(v))
+}
+
+func (self *thriftWriter) i64(id int16, v int64) {
+	self.field(id, tcI64)
+	self.svarint(v)
+}
+
+func (self *thriftWriter) binary(id int16, v []byte) {
+	self.field(id, tcBinary)
+	self.rawBinary(v)
+}
+
+// A binary value without a field header (e.g. a list element)
+func (self *thriftWriter) rawBinary(v []byte) {
+	self.uvarint((uint64)(len(v)))
+	self.buf.Write(v)
+}
+
+// Start a list of n elements, the caller writes the elements (without field
+// headers) right after
+func (self *thriftWriter) list(id int16, elemType byte, n int) {
+	self.field(id, tcList)
+	if n < 15 {
+		self.buf.WriteByte((byte)(n)<<4 | elemType)
+	} else {
+		self.buf.WriteByte(0xf0 | elemType)
+		self.uvarint((uint64)(n))
+	}
+}
+
+func (self *thriftWriter) beginStruct(id int16) {
+	self.field(id, tcStruct)
+	self.push()
+}
+
+// Start a struct without a field header (e.g. a list element)
+func (self *thriftWriter) push() {
+	self.last = append(self.last, 0)
+}
+
+func (self *thriftWriter) end() {
+	self.buf.WriteByte(tcStop)
+	self.last = self.last[:len(self.last)-1]
+}
+
+// A decoded compact protocol struct, indexed by field ID. Values are int64
+// (all integer types), bool, float64, []byte, []interface{} (lists and sets)
+// or thriftStruct. Maps are skipped.
+type thriftStruct map[int16]interface{}
+
+func (self thriftStruct) has(id int16) bool {
+	_, ok := self[id]
+	return ok
+}
+
+// Missing fields read as their zero value
+func (self thriftStruct) int(id int16) int64 {
+	v, _ := self[id].(int64)
+	return v
+}
+
+func (self thriftStruct) bool(id int16) bool {
+	v, _ := self[id].(bool)
+	return v
+}
+
+func (self thriftStruct) bytes(id int16) []byte {
+	v, _ := self[id].([]byte)
+	return v
+}
+
+func (self thriftStruct) strct(id int16) thriftStruct {
+	v, _ := self[id].(thriftStruct)
+	return v
+}
+
+func (self thriftStruct) list(id int16) []interface{} {
+	v, _ := self[id].([]interface{})
+	return v
+}
+
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+var errThriftCorrupt = fmt.Errorf("Corrupt thrift data")
+
+func (self *thriftReader) byte() (byte, error) {
+	if self.pos >= len(self.buf) {
+		return 0, errThriftCorrupt
+	}
+	b := self.buf[self.pos]
+	self.pos++
+	return b, nil
+}
+
+func (self *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(self.buf[self.pos:])
+	if n <= 0 {
+		return 0, errThriftCorrupt
+	}
+	self.pos += n
+	return v, nil
+}
+
+func (self *thriftReader) svarint() (int64, error) {
+	v, n := binary.Varint(self.buf[self.pos:])
+	if n <= 0 {
+		return 0, errThriftCorrupt
+	}
+	self.pos += n
+	return v, nil
+}
+
+func (self *thriftReader) readStruct() (thriftStruct, error) {
+	out := thriftStruct{}
+	var last int16
+	for {
+		hdr, err := self.byte()
+		if err != nil {
+			return nil, err
+		}
+		if hdr == tcStop {
+			return out, nil
+		}
+
+		typ := hdr & 0x0f
+		if delta := hdr >> 4; delta != 0 {
+			last += (int16)(delta)
+		} else {
+			id, err := self.svarint()
+			if err != nil {
+				return nil, err
+			}
+			last = (int16)(id)
+		}
+
+		// Boolean fields are stored in the type code
+		if typ == tcTrue || typ == tcFalse {
+			out[last] = typ == tcTrue
+			continue
+		}
+
+		if out[last], err = self.readValue(typ); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (self *thriftReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case tcTrue, tcFalse:
+		// Only reached for list elements, which use a whole byte
+		b, err := self.byte()
+		return b == tcTrue, err
+
+	case tcByte:
+		b, err := self.byte()
+		return (int64)((int8)(b)), err
+
+	case tcI16, tcI32, tcI64:
+		return self.svarint()
+
+	case tcDouble:
+		if self.pos+8 > len(self.buf) {
+			return nil, errThriftCorrupt
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(self.buf[self.pos:]))
+		self.pos += 8
+		return v, nil
+
+	case tcBinary:
+		n, err := self.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > (uint64)(len(self.buf)-self.pos) {
+			return nil, errThriftCorrupt
+		}
+		v := self.buf[self.pos : self.pos+(int)(n)]
+		self.pos += (int)(n)
+		return v, nil
+
+	case tcList, tcSet:
+		hdr, err := self.byte()
+		if err != nil {
+			return nil, err
+		}
+		elemType := hdr & 0x0f
+		n := (uint64)(hdr >> 4)
+		if n == 15 {
+			if n, err = self.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+
+		// Every element takes at least a byte
+		if n > (uint64)(len(self.buf)-self.pos) {
+			return nil, errThriftCorrupt
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = self.readValue(elemType); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case tcMap:
+		n, err := self.uvarint()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		if n > (uint64)(len(self.buf)-self.pos) {
+			return nil, errThriftCorrupt
+		}
+		types, err := self.byte()
+		if err != nil {
+			return nil, err
+		}
+		for i := (uint64)(0); i < n; i++ {
+			if _, err := self.readValue(types >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := self.readValue(types & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case tcStruct:
+		return self.readStruct()
+	}
+
+	return nil, fmt.Errorf("Unrecognized thrift type %v", typ)
+}
+
+// Decode n values from the RLE/bit-packed hybrid encoding
+func decodeRleHybrid(buf []byte, bitWidth int, n int) ([]uint32, error) {
+	if bitWidth < 0 || bitWidth > 32 {
+		return nil, fmt.Errorf("Invalid bit width %v", bitWidth)
+	}
+	mask := (uint64)(1)<<(uint)(bitWidth) - 1
+	valBytes := (bitWidth + 7) / 8
+
+	// Runs can describe far more values than their size so n is trusted
+	// only as far as the input could plausibly hold
+	prealloc := n
+	if prealloc > 8*len(buf)+8 {
+		prealloc = 8*len(buf) + 8
+	}
+	out := make([]uint32, 0, prealloc)
+	pos := 0
+	for len(out) < n {
+		hdr, hdrLen := binary.Uvarint(buf[pos:])
+		if hdrLen <= 0 {
+			return nil, fmt.Errorf("Corrupt RLE data")
+		}
+		pos += hdrLen
+
+		if hdr&1 == 0 {
+			// RLE run
+			count := (int)(hdr >> 1)
+			if pos+valBytes > len(buf) {
+				return nil, fmt.Errorf("Corrupt RLE data")
+			}
+			var v uint32
+			for i := 0; i < valBytes; i++ {
+				v |= (uint32)(buf[pos+i]) << (uint)(8*i)
+			}
+			pos += valBytes
+
+			for i := 0; i < count && len(out) < n; i++ {
+				out = append(out, v)
+			}
+		} else {
+			// Groups of 8 values packed least significant bit first
+			count := (int)(hdr>>1) * 8
+			nByte := (int)(hdr>>1) * bitWidth
+			if pos+nByte > len(buf) {
+				return nil, fmt.Errorf("Corrupt RLE data")
+			}
+			packed := buf[pos : pos+nByte]
+			pos += nByte
+
+			for i := 0; i < count && len(out) < n; i++ {
+				bit := i * bitWidth
+				var window uint64
+				for b := 0; b < 8 && bit/8+b < len(packed); b++ {
+					window |= (uint64)(packed[bit/8+b]) << (uint)(8*b)
+				}
+				out = append(out, (uint32)((window>>(uint)(bit%8))&mask))
+			}
+		}
+	}
+	return out, nil
+}
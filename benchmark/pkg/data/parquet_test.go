@@ -0,0 +1,411 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+// The writer only uses a small part of the format, these build files by hand
+// (following parquet.thrift) to cover what other writers produce.
+
+// One column chunk of a fixture, pages include their headers
+type fixtureColumn struct {
+	typ    int32
+	codec  int32
+	nValue int64
+	dict   []byte
+	pages  []byte
+}
+
+func fixtureUvarint(v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return tmp[:binary.PutUvarint(tmp, v)]
+}
+
+func fixtureCompress(t *testing.T, codec int32, raw []byte) []byte {
+	switch codec {
+	case parquetSnappy:
+		return snappy.Encode(nil, raw)
+	case parquetGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(raw)
+		require.Nil(t, err)
+		require.Nil(t, gz.Close())
+		return buf.Bytes()
+	}
+	return raw
+}
+
+func fixturePlain(width int, vals ...uint64) []byte {
+	out := make([]byte, width*len(vals))
+	for i, v := range vals {
+		if width == 4 {
+			binary.LittleEndian.PutUint32(out[i*4:], (uint32)(v))
+		} else {
+			binary.LittleEndian.PutUint64(out[i*8:], v)
+		}
+	}
+	return out
+}
+
+func fixtureRleRun(v uint32, count int, width int) []byte {
+	out := fixtureUvarint((uint64)(count << 1))
+	for i := 0; i < (width+7)/8; i++ {
+		out = append(out, (byte)(v>>(uint)(8*i)))
+	}
+	return out
+}
+
+func fixtureBitPacked(vals []uint32, width int) []byte {
+	nGroup := (len(vals) + 7) / 8
+	packed := make([]byte, nGroup*width)
+	for i, v := range vals {
+		for b := 0; b < width; b++ {
+			if v>>(uint)(b)&1 != 0 {
+				bit := i*width + b
+				packed[bit/8] |= 1 << (uint)(bit%8)
+			}
+		}
+	}
+	return append(fixtureUvarint((uint64)(nGroup<<1|1)), packed...)
+}
+
+// A v1 data page or dictionary page, hdrField writes the type-specific header
+func fixturePage(t *testing.T, pageType int32, codec int32, body []byte, hdrField func(hdr *thriftWriter)) []byte {
+	comp := fixtureCompress(t, codec, body)
+
+	hdr := newThriftWriter()
+	hdr.i32(1, pageType)
+	hdr.i32(2, (int32)(len(body)))
+	hdr.i32(3, (int32)(len(comp)))
+	hdrField(hdr)
+	hdr.end()
+	return append(hdr.Bytes(), comp...)
+}
+
+func fixtureDataPage(t *testing.T, codec int32, n int, encoding int32, body []byte) []byte {
+	return fixturePage(t, parquetDataPage, codec, body, func(hdr *thriftWriter) {
+		hdr.beginStruct(5)
+		hdr.i32(1, (int32)(n))
+		hdr.i32(2, encoding)
+		hdr.i32(3, parquetRle)
+		hdr.i32(4, parquetRle)
+		hdr.end()
+	})
+}
+
+func fixtureDictPage(t *testing.T, codec int32, n int, body []byte) []byte {
+	return fixturePage(t, parquetDictPage, codec, body, func(hdr *thriftWriter) {
+		hdr.beginStruct(7)
+		hdr.i32(1, (int32)(n))
+		hdr.i32(2, parquetPlainDict)
+		hdr.end()
+	})
+}
+
+// Write a file with the given schema (a list of SchemaElements written by
+// schema) and row groups
+func writeParquetFixture(t *testing.T, path string, schema func(meta *thriftWriter), nRow int64, groups [][]fixtureColumn) {
+	out := bytes.NewBuffer(append([]byte{}, parquetMagic...))
+
+	meta := newThriftWriter()
+	meta.i32(1, 1)
+	schema(meta)
+	meta.i64(3, nRow)
+
+	meta.list(4, tcStruct, len(groups))
+	for _, cols := range groups {
+		meta.push()
+		meta.list(1, tcStruct, len(cols))
+		var groupSz, groupRows int64
+		for _, col := range cols {
+			dictOffset := (int64)(out.Len())
+			out.Write(col.dict)
+			dataOffset := (int64)(out.Len())
+			out.Write(col.pages)
+			size := (int64)(len(col.dict) + len(col.pages))
+			groupSz += size
+			groupRows = col.nValue
+
+			meta.push()
+			meta.i64(2, dataOffset)
+			meta.beginStruct(3)
+			meta.i32(1, col.typ)
+			meta.list(2, tcI32, 1)
+			meta.svarint(parquetPlain)
+			meta.list(3, tcBinary, 1)
+			meta.rawBinary([]byte("unused"))
+			meta.i32(4, col.codec)
+			meta.i64(5, col.nValue)
+			meta.i64(6, size)
+			meta.i64(7, size)
+			meta.i64(9, dataOffset)
+			if col.dict != nil {
+				meta.i64(11, dictOffset)
+			}
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, groupSz)
+		meta.i64(3, groupRows)
+		meta.end()
+	}
+	meta.end()
+
+	out.Write(meta.Bytes())
+	binary.Write(out, binary.LittleEndian, (uint32)(len(meta.Bytes())))
+	out.Write(parquetMagic)
+	require.Nil(t, ioutil.WriteFile(path, out.Bytes(), 0600))
+}
+
+func schemaLeaf(meta *thriftWriter, name string, typ int32, repetition int32, converted int32) {
+	meta.push()
+	meta.i32(1, typ)
+	meta.i32(3, repetition)
+	meta.binary(4, []byte(name))
+	if converted != 0 {
+		meta.i32(6, converted)
+	}
+	meta.end()
+}
+
+func TestParquetReader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	// Schema: a INT32, g { b OPTIONAL INT64 }
+	schema := func(meta *thriftWriter) {
+		meta.list(2, tcStruct, 4)
+		meta.push()
+		meta.binary(4, []byte("root"))
+		meta.i32(5, 2)
+		meta.end()
+		schemaLeaf(meta, "a", parquetInt32, parquetRequired, 0)
+		meta.push()
+		meta.i32(3, parquetRequired)
+		meta.binary(4, []byte("g"))
+		meta.i32(5, 1)
+		meta.end()
+		schemaLeaf(meta, "b", parquetInt64, parquetOptional, 0)
+	}
+
+	defLevels := fixtureRleRun(1, 3, 1)
+	dictIdxs := append([]byte{2}, fixtureBitPacked([]uint32{1, 0, 2}, 2)...)
+	v1Body := append(append(fixturePlain(4, (uint64)(len(defLevels)))[:4], defLevels...), dictIdxs...)
+
+	// Row group 1 uses a v2 page for b, levels stay uncompressed
+	v2Levels := fixtureRleRun(1, 2, 1)
+	v2Values := fixturePlain(8, 7, 3)
+	v2Comp := fixtureCompress(t, parquetGzip, v2Values)
+	v2Hdr := newThriftWriter()
+	v2Hdr.i32(1, parquetDataPageV2)
+	v2Hdr.i32(2, (int32)(len(v2Levels)+len(v2Values)))
+	v2Hdr.i32(3, (int32)(len(v2Levels)+len(v2Comp)))
+	v2Hdr.beginStruct(8)
+	v2Hdr.i32(1, 2)
+	v2Hdr.i32(2, 0)
+	v2Hdr.i32(3, 2)
+	v2Hdr.i32(4, parquetPlain)
+	v2Hdr.i32(5, (int32)(len(v2Levels)))
+	v2Hdr.i32(6, 0)
+	v2Hdr.end()
+	v2Hdr.end()
+	v2Page := append(append(v2Hdr.Bytes(), v2Levels...), v2Comp...)
+
+	path := filepath.Join(tmpDir, "fixture.parquet")
+	writeParquetFixture(t, path, schema, 5, [][]fixtureColumn{
+		{
+			{typ: parquetInt32, nValue: 3,
+				pages: fixtureDataPage(t, parquetUncompressed, 3, parquetPlain, fixturePlain(4, 5, 6, 7))},
+			{typ: parquetInt64, codec: parquetSnappy, nValue: 3,
+				dict:  fixtureDictPage(t, parquetSnappy, 3, fixturePlain(8, 100, 4294967295, 0)),
+				pages: fixtureDataPage(t, parquetSnappy, 3, parquetRleDict, v1Body)},
+		},
+		{
+			{typ: parquetInt32, nValue: 2,
+				pages: fixtureDataPage(t, parquetUncompressed, 2, parquetPlain, fixturePlain(4, 8, 9))},
+			{typ: parquetInt64, codec: parquetGzip, nValue: 2, pages: v2Page},
+		},
+	})
+
+	out, err := readParquetColumn(path, "")
+	require.Nil(t, err, "Failed to read first column")
+	require.Equal(t, uint32Bytes(5, 6, 7, 8, 9), out)
+
+	out, err = readParquetColumn(path, "g.b")
+	require.Nil(t, err, "Failed to read nested column")
+	require.Equal(t, uint32Bytes(4294967295, 100, 0, 7, 3), out)
+
+	_, err = readParquetColumn(path, "b")
+	require.NotNil(t, err, "Nested columns need their full path")
+
+	// Through the public interface
+	arr, err := ImportFile(MemArrayFactory, "parquetFixture", path, ImportOptions{Format: PARQUET, Column: "g.b", NPart: 2})
+	require.Nil(t, err)
+	require.Equal(t, uint32Bytes(4294967295, 100, 0, 7, 3), readArr(t, arr))
+	require.Nil(t, arr.Destroy())
+}
+
+func TestParquetReaderErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	flatSchema := func(repetition int32, converted int32) func(meta *thriftWriter) {
+		return func(meta *thriftWriter) {
+			meta.list(2, tcStruct, 2)
+			meta.push()
+			meta.binary(4, []byte("root"))
+			meta.i32(5, 1)
+			meta.end()
+			schemaLeaf(meta, "v", parquetInt32, repetition, converted)
+		}
+	}
+	plainCol := func(codec int32, vals ...uint64) []fixtureColumn {
+		return []fixtureColumn{{typ: parquetInt32, codec: codec, nValue: (int64)(len(vals)),
+			pages: fixtureDataPage(t, codec, len(vals), parquetPlain, fixturePlain(4, vals...))}}
+	}
+	path := filepath.Join(tmpDir, "bad.parquet")
+
+	// Negative values only make sense for unsigned columns
+	writeParquetFixture(t, path, flatSchema(parquetRequired, 0), 2, [][]fixtureColumn{plainCol(parquetUncompressed, 1, 0xffffffff)})
+	_, err = readParquetColumn(path, "v")
+	require.NotNil(t, err, "Read a negative value")
+
+	writeParquetFixture(t, path, flatSchema(parquetRequired, parquetUint32), 2, [][]fixtureColumn{plainCol(parquetUncompressed, 1, 0xffffffff)})
+	out, err := readParquetColumn(path, "v")
+	require.Nil(t, err)
+	require.Equal(t, uint32Bytes(1, 0xffffffff), out)
+
+	// The second value is null
+	levels := fixtureBitPacked([]uint32{1, 0}, 1)
+	body := append(append(fixturePlain(4, (uint64)(len(levels)))[:4], levels...), fixturePlain(4, 1)...)
+	writeParquetFixture(t, path, flatSchema(parquetOptional, 0), 2, [][]fixtureColumn{{
+		{typ: parquetInt32, nValue: 2, pages: fixtureDataPage(t, parquetUncompressed, 2, parquetPlain, body)}}})
+	_, err = readParquetColumn(path, "v")
+	require.NotNil(t, err, "Read a null value")
+
+	writeParquetFixture(t, path, flatSchema(parquetRequired, 0), 1, [][]fixtureColumn{plainCol(6, 1)})
+	_, err = readParquetColumn(path, "v")
+	require.Contains(t, err.Error(), "ZSTD", "Unsupported codec not reported")
+
+	writeParquetFixture(t, path, flatSchema(parquetRepeated, 0), 1, [][]fixtureColumn{plainCol(parquetUncompressed, 1)})
+	_, err = readParquetColumn(path, "v")
+	require.NotNil(t, err, "Read a repeated column")
+
+	// Truncated files
+	good := filepath.Join(tmpDir, "good.parquet")
+	_, err = ExportFile(bytes.NewReader(uint32Bytes(1, 2, 3)), good, ExportOptions{Format: PARQUET})
+	require.Nil(t, err)
+	raw, err := ioutil.ReadFile(good)
+	require.Nil(t, err)
+	for _, n := range []int{0, 4, 20, len(raw) - 1} {
+		require.Nil(t, ioutil.WriteFile(path, raw[:n], 0600))
+		_, err = readParquetColumn(path, "")
+		require.NotNilf(t, err, "Read a file truncated to %v bytes", n)
+	}
+}
+
+func TestParquetSnappyPages(t *testing.T) {
+	reader := &parquetColumnReader{codec: parquetSnappy}
+
+	// Repetitive data so the encoder emits copies as well as literals
+	raw := bytes.Repeat([]byte("abcdefgh"), 1000)
+	comp := snappy.Encode(nil, raw)
+	require.Less(t, len(comp), len(raw)/10, "Expected a compressible page")
+
+	out, err := reader.decompress(comp, (int64)(len(raw)))
+	require.Nil(t, err)
+	require.Equal(t, raw, out)
+
+	// Wrong size, framed stream instead of a block, truncated block
+	_, err = reader.decompress(comp, (int64)(len(raw)-1))
+	require.NotNil(t, err, "Accepted a page of the wrong size")
+
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, err = sw.Write(raw)
+	require.Nil(t, err)
+	require.Nil(t, sw.Close())
+	_, err = reader.decompress(framed.Bytes(), (int64)(len(raw)))
+	require.NotNil(t, err, "Accepted the framed snappy format")
+
+	_, err = reader.decompress(comp[:len(comp)/2], (int64)(len(raw)))
+	require.NotNil(t, err, "Accepted a truncated page")
+}
+
+// Examples from the Thrift compact protocol specification, independent of
+// thriftWriter
+func TestThriftCompactReader(t *testing.T) {
+	buf := []byte{
+		0x15, 0x02, // 1: i32 = 1 (short form, zigzag value)
+		0x18, 0x03, 'a', 'b', 'c', // 2: binary = "abc"
+		0x06, 0xc8, 0x01, 0x01, // 100: i64 = -1 (long form field id)
+		0x11,                         // 101: bool = true (stored in the type)
+		0x19, 0x35, 0x02, 0x04, 0x06, // 102: list<i32> = [1, 2, 3]
+		0x1c, 0x15, 0x0e, 0x00, // 103: struct { 1: i32 = 7 }
+		0x00,
+	}
+	st, err := (&thriftReader{buf: buf}).readStruct()
+	require.Nil(t, err)
+	require.Equal(t, (int64)(1), st.int(1))
+	require.Equal(t, []byte("abc"), st.bytes(2))
+	require.Equal(t, (int64)(-1), st.int(100))
+	require.True(t, st.bool(101))
+	require.Equal(t, []interface{}{(int64)(1), (int64)(2), (int64)(3)}, st.list(102))
+	require.Equal(t, (int64)(7), st.strct(103).int(1))
+
+	// thriftWriter must produce the same bytes
+	w := newThriftWriter()
+	w.i32(1, 1)
+	w.binary(2, []byte("abc"))
+	w.i64(100, -1)
+	w.bool(101, true)
+	w.list(102, tcI32, 3)
+	for _, v := range []int64{1, 2, 3} {
+		w.svarint(v)
+	}
+	w.beginStruct(103)
+	w.i32(1, 7)
+	w.end()
+	w.end()
+	require.Equal(t, buf, w.Bytes())
+
+	for n := 0; n < len(buf)-1; n++ {
+		_, err = (&thriftReader{buf: buf[:n]}).readStruct()
+		require.NotNilf(t, err, "Read a struct truncated to %v bytes", n)
+	}
+}
+
+func TestDecodeRleHybrid(t *testing.T) {
+	// The example from the Parquet encodings specification: 0-7 bit-packed
+	// with a width of 3
+	out, err := decodeRleHybrid([]byte{0x03, 0x88, 0xc6, 0xfa}, 3, 8)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7}, out)
+
+	// A bit-packed group followed by a run
+	vals := []uint32{1, 5, 7, 0, 3, 2, 6, 4}
+	buf := append(fixtureBitPacked(vals, 3), fixtureRleRun(6, 4, 3)...)
+	out, err = decodeRleHybrid(buf, 3, 12)
+	require.Nil(t, err)
+	require.Equal(t, append(vals, 6, 6, 6, 6), out)
+
+	// Run values take whole bytes
+	out, err = decodeRleHybrid(fixtureRleRun(300, 4, 9), 9, 3)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{300, 300, 300}, out)
+
+	_, err = decodeRleHybrid(fixtureBitPacked(vals, 3), 3, 20)
+	require.NotNil(t, err, "Decoded past the end of the buffer")
+}
@@ -0,0 +1,405 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Largest GETRANGE/APPEND issued at once. Bigger requests are split so that a
+// single reply doesn't have to be buffered in full on either end.
+const redisChunkSz = 4 * 1024 * 1024
+
+// Describes how to reach the redis server holding RedisDistribArrays
+type RedisConfig struct {
+	Addr     string // host:port
+	Password string // Sent with AUTH if set
+	DB       int    // Selected with SELECT if non-zero
+	Prefix   string // Prepended to every key (e.g. "radixsort:")
+}
+
+// Build a RedisConfig from the environment. This is how FaaS workers find
+// the server (see faasTest/README.md):
+//		RADIXBENCH_REDIS_ADDR, RADIXBENCH_REDIS_PASSWORD, RADIXBENCH_REDIS_DB,
+//		RADIXBENCH_REDIS_PREFIX
+func RedisConfigFromEnv() (RedisConfig, error) {
+	cfg := RedisConfig{
+		Addr:     os.Getenv("RADIXBENCH_REDIS_ADDR"),
+		Password: os.Getenv("RADIXBENCH_REDIS_PASSWORD"),
+		Prefix:   os.Getenv("RADIXBENCH_REDIS_PREFIX"),
+	}
+
+	if cfg.Addr == "" {
+		return cfg, fmt.Errorf("RADIXBENCH_REDIS_ADDR must be set to use redis arrays")
+	}
+
+	if db := os.Getenv("RADIXBENCH_REDIS_DB"); db != "" {
+		var err error
+		cfg.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return cfg, errors.Wrapf(err, "Invalid RADIXBENCH_REDIS_DB %q", db)
+		}
+	}
+	return cfg, nil
+}
+
+// Arrays from the same factory share a connection pool
+func NewRedisArrayFactory(cfg RedisConfig) *ArrayFactory {
+	client := newRedisClient(cfg)
+
+	return &ArrayFactory{
+		Unlimited: true,
+
+		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
+			a, err := createRedisDistribArray(client, name, shape)
+			return (DistribArray)(a), err
+		},
+
+		Open: func(name string) (DistribArray, error) {
+			a, err := openRedisDistribArray(client, name)
+			return (DistribArray)(a), err
+		},
+	}
+}
+
+// Stores a distributed array in redis. This avoids the filesystem entirely,
+// which makes it a good fit for many small arrays (e.g. the intermediate
+// outputs of short sorts). Keys:
+//		${Prefix}${Name}:meta: a hash with the same fields as a
+//			FileDistribArray's meta.json ("Lens" and "Caps", JSON encoded).
+//		${Prefix}${Name}:p${partID}: a string holding partition partID.
+//			Missing keys are empty partitions.
+//
+// Writes are APPENDed immediately and are visible to readers right away, but
+// the metadata (partition lengths) is only committed by Close().
+type RedisDistribArray struct {
+	Name   string
+	client *redisClient
+
+	// Arrays opened outside a factory have their own connection pool
+	ownClient bool
+
+	// Protects shape.lens and destroyed, writers for different partitions
+	// may be used concurrently
+	lock  sync.Mutex
+	shape DistribArrayShape
+
+	// Stale handles mustn't touch the keys of a new array with the same name
+	destroyed bool
+}
+
+type RedisDistribRangeReader struct {
+	arr *RedisDistribArray
+	key string
+
+	// Next byte to fetch and the end of the range
+	pos   int64
+	limit int64
+
+	// Fetched but not yet returned
+	buf []byte
+}
+
+type RedisDistribWriter struct {
+	arr    *RedisDistribArray
+	partId int
+}
+
+func CreateRedisDistribArray(cfg RedisConfig, name string, shape DistribArrayShape) (*RedisDistribArray, error) {
+	arr, err := createRedisDistribArray(newRedisClient(cfg), name, shape)
+	if arr != nil {
+		arr.ownClient = true
+	}
+	return arr, err
+}
+
+func OpenRedisDistribArray(cfg RedisConfig, name string) (*RedisDistribArray, error) {
+	arr, err := openRedisDistribArray(newRedisClient(cfg), name)
+	if arr != nil {
+		arr.ownClient = true
+	}
+	return arr, err
+}
+
+func createRedisDistribArray(client *redisClient, name string, shape DistribArrayShape) (*RedisDistribArray, error) {
+	arr := &RedisDistribArray{Name: name, client: client}
+
+	arr.shape.caps = make([]int64, len(shape.caps))
+	arr.shape.lens = make([]int64, len(shape.caps))
+	copy(arr.shape.caps, shape.caps)
+
+	capsJson, err := json.Marshal(arr.shape.caps)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't convert shape to json")
+	}
+
+	// HSETNX doubles as the existence check
+	created, err := redisInt(client.do("HSETNX", arr.metaKey(), "Caps", capsJson))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create array metdata")
+	}
+	if created == 0 {
+		return nil, fmt.Errorf("Array %v exists", name)
+	}
+
+	// Partition keys may be left over from an array that was never destroyed
+	if err := arr.deleteParts(); err != nil {
+		return nil, err
+	}
+
+	err = arr.commitMeta()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create array metdata")
+	}
+
+	return arr, nil
+}
+
+func openRedisDistribArray(client *redisClient, name string) (*RedisDistribArray, error) {
+	arr := &RedisDistribArray{Name: name, client: client}
+
+	reply, err := client.do("HMGET", arr.metaKey(), "Lens", "Caps")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load metadata")
+	}
+
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return nil, fmt.Errorf("Unexpected metadata reply from redis: %v", reply)
+	}
+
+	lensJson, _ := fields[0].([]byte)
+	capsJson, _ := fields[1].([]byte)
+	if lensJson == nil || capsJson == nil {
+		return nil, fmt.Errorf("Array %v does not exist", name)
+	}
+
+	if err := json.Unmarshal(lensJson, &arr.shape.lens); err != nil {
+		return nil, errors.Wrap(err, "Failed to interpret metadata")
+	}
+	if err := json.Unmarshal(capsJson, &arr.shape.caps); err != nil {
+		return nil, errors.Wrap(err, "Failed to interpret metadata")
+	}
+
+	return arr, nil
+}
+
+func (self *RedisDistribArray) metaKey() string {
+	return self.client.cfg.Prefix + self.Name + ":meta"
+}
+
+func (self *RedisDistribArray) partKey(partId int) string {
+	return self.client.cfg.Prefix + self.Name + fmt.Sprintf(":p%v", partId)
+}
+
+func (self *RedisDistribArray) commitMeta() error {
+	self.lock.Lock()
+	lensJson, err := json.Marshal(self.shape.lens)
+	self.lock.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't convert shape to json")
+	}
+
+	capsJson, err := json.Marshal(self.shape.caps)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't convert shape to json")
+	}
+
+	_, err = self.client.do("HSET", self.metaKey(), "Lens", lensJson, "Caps", capsJson)
+	return err
+}
+
+func (self *RedisDistribArray) deleteParts() error {
+	args := []interface{}{"DEL"}
+	for i := 0; i < len(self.shape.caps); i++ {
+		args = append(args, self.partKey(i))
+	}
+	if len(args) == 1 {
+		return nil
+	}
+
+	if _, err := self.client.do(args...); err != nil {
+		return errors.Wrap(err, "Failed to delete partitions")
+	}
+	return nil
+}
+
+func (self *RedisDistribArray) isDestroyed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.destroyed
+}
+
+func (self *RedisDistribArray) ArrayName() string {
+	return self.Name
+}
+
+func (self *RedisDistribArray) GetShape() (*DistribArrayShape, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	// Writers update lens as they append
+	shape := CreateShapeFrom(self.shape)
+	return &shape, nil
+}
+
+func (self *RedisDistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	self.lock.Lock()
+	if self.destroyed {
+		self.lock.Unlock()
+		return nil, ErrClosed
+	}
+	limit, err := self.shape.resolveRange(partId, start, end)
+	self.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisDistribRangeReader{arr: self, key: self.partKey(partId),
+		pos: (int64)(start), limit: (int64)(limit)}, nil
+}
+
+func (self *RedisDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
+	return self.GetPartRangeReader(partId, 0, 0)
+}
+
+func (self *RedisDistribArray) Close() error {
+	if self.isDestroyed() {
+		return nil
+	}
+
+	err := self.commitMeta()
+	if self.ownClient {
+		self.client.close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Array commit failure")
+	}
+	return nil
+}
+
+func (self *RedisDistribArray) Destroy() error {
+	self.lock.Lock()
+	destroyed := self.destroyed
+	self.destroyed = true
+	self.lock.Unlock()
+	if destroyed {
+		return nil
+	}
+
+	err := self.deleteParts()
+	if err != nil {
+		return err
+	}
+
+	_, err = self.client.do("DEL", self.metaKey())
+	if self.ownClient {
+		self.client.close()
+	}
+	return err
+}
+
+// Data is fetched with GETRANGE, at most redisChunkSz at a time
+func (self *RedisDistribRangeReader) Read(dst []byte) (n int, err error) {
+	for n < len(dst) {
+		if len(self.buf) == 0 {
+			if self.pos >= self.limit {
+				break
+			}
+
+			toFetch := self.limit - self.pos
+			if toFetch > redisChunkSz {
+				toFetch = redisChunkSz
+			}
+
+			// GETRANGE's end is inclusive
+			self.buf, err = redisBytes(self.arr.client.do("GETRANGE", self.key,
+				strconv.FormatInt(self.pos, 10), strconv.FormatInt(self.pos+toFetch-1, 10)))
+			if err != nil {
+				return n, errors.Wrap(err, "Failed to read partition")
+			}
+			if (int64)(len(self.buf)) != toFetch {
+				return n, fmt.Errorf("Partition %v shorter than expected", self.key)
+			}
+			self.pos += toFetch
+		}
+
+		copied := copy(dst[n:], self.buf)
+		self.buf = self.buf[copied:]
+		n += copied
+	}
+
+	if len(self.buf) == 0 && self.pos >= self.limit {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (self *RedisDistribRangeReader) Close() error {
+	self.buf = nil
+	return nil
+}
+
+// Writers for different partitions may be used concurrently
+func (self *RedisDistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	if self.isDestroyed() {
+		return nil, ErrClosed
+	}
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+	return &RedisDistribWriter{arr: self, partId: partId}, nil
+}
+
+func (self *RedisDistribWriter) Write(data []byte) (n int, err error) {
+	arr := self.arr
+	key := arr.partKey(self.partId)
+	if arr.isDestroyed() {
+		return 0, ErrClosed
+	}
+
+	// Zero capacity means unlimited (as in PERPART FileDistribArrays)
+	toWrite := (int64)(len(data))
+	partCap := arr.shape.caps[self.partId]
+	if partCap != 0 {
+		arr.lock.Lock()
+		nRemaining := partCap - arr.shape.lens[self.partId]
+		arr.lock.Unlock()
+
+		if toWrite > nRemaining {
+			toWrite = nRemaining
+			err = io.EOF
+		}
+	}
+
+	for (int64)(n) < toWrite {
+		chunk := toWrite - (int64)(n)
+		if chunk > redisChunkSz {
+			chunk = redisChunkSz
+		}
+
+		_, appendErr := arr.client.do("APPEND", key, data[n:(int64)(n)+chunk])
+		if appendErr != nil {
+			return n, errors.Wrapf(appendErr, "Failed to write partition %v", self.partId)
+		}
+		n += (int)(chunk)
+
+		arr.lock.Lock()
+		arr.shape.lens[self.partId] += chunk
+		arr.lock.Unlock()
+	}
+
+	return n, err
+}
+
+func (self *RedisDistribWriter) Close() error {
+	return nil
+}
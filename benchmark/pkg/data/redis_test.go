@@ -0,0 +1,115 @@
+package data_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/datatest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisDistribArr(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	data.CheckDistribArr(t, data.NewRedisArrayFactory(fake.Config("test:")))
+}
+
+func TestRedisFactory(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	data.CheckArrayFactory(t, data.NewRedisArrayFactory(fake.Config("test:")))
+}
+
+func TestRedisPartRange(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	arr, err := data.CreateRedisDistribArray(fake.Config(""), "redisRange", data.CreateShapeUniform(4, 1))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := data.GenerateBytes(t, arr, 4)
+
+	t.Run("Full Range", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 0, 0) })
+	t.Run("First Two", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 0, 2) })
+	t.Run("Middle", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 1, 3) })
+	t.Run("Last Two Zero End", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 2, 0) })
+	t.Run("Negative End", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 1, -1) })
+	t.Run("Empty", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 2, 2) })
+}
+
+func TestRedisLarge(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+	fake.SetPassword("secret")
+
+	cfg := fake.Config("large:")
+
+	// Bigger than data.RedisChunkSz so reads and writes are split
+	raw := make([]byte, data.RedisChunkSz*2+100)
+	rand.Read(raw)
+
+	arr, err := data.CreateRedisDistribArray(cfg, "large", data.CreateShape([]int64{0, 10}))
+	require.Nil(t, err)
+
+	writer, err := arr.GetPartWriter(0)
+	require.Nil(t, err)
+	n, err := writer.Write(raw)
+	require.Nil(t, err)
+	require.Equal(t, len(raw), n)
+	require.Nil(t, writer.Close())
+
+	// Capped partition
+	writer, err = arr.GetPartWriter(1)
+	require.Nil(t, err)
+	n, err = writer.Write(raw[:20])
+	require.NotNil(t, err, "Wrote past the partition capacity")
+	require.Equal(t, 10, n)
+
+	require.Nil(t, arr.Close())
+
+	reArr, err := data.OpenRedisDistribArray(cfg, "large")
+	require.Nil(t, err)
+
+	reader, err := reArr.GetPartRangeReader(0, 7, 0)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(raw[7:], out), "Large partition corrupted")
+
+	shape, _ := reArr.GetShape()
+	require.Equal(t, (int64)(10), shape.Len(1))
+
+	require.Nil(t, reArr.Destroy())
+	require.Zero(t, fake.NKey(), "Destroy left keys behind")
+}
+
+func TestRedisErrors(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	cfg := fake.Config("")
+
+	_, err = data.OpenRedisDistribArray(cfg, "missing")
+	require.NotNil(t, err, "Opened a missing array")
+
+	fake.SetPassword("secret")
+	_, err = data.CreateRedisDistribArray(cfg, "noAuth", data.CreateShapeUniform(4, 1))
+	require.NotNil(t, err, "Server accepted an unauthenticated client")
+	require.Zero(t, fake.NKey())
+
+	badCfg := fake.Config("")
+	badCfg.Addr = "127.0.0.1:1"
+	_, err = data.CreateRedisDistribArray(badCfg, "noServer", data.CreateShapeUniform(4, 1))
+	require.NotNil(t, err, "Connected to a missing server")
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/internal/resp"
+	"github.com/pkg/errors"
+)
+
+// A minimal Redis client speaking RESP2 over TCP. Connections are pooled so
+// that readers and writers in different goroutines don't serialize on a
+// single socket.
+type redisClient struct {
+	cfg  RedisConfig
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	wr   *bufio.Writer
+}
+
+// Maximum number of idle connections kept per client
+const redisPoolSz = 16
+
+func newRedisClient(cfg RedisConfig) *redisClient {
+	return &redisClient{cfg: cfg, pool: make(chan *redisConn, redisPoolSz)}
+}
+
+func (self *redisClient) dial() (*redisConn, error) {
+	conn, err := net.Dial("tcp", self.cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to redis at %v", self.cfg.Addr)
+	}
+	c := &redisConn{conn: conn, rd: bufio.NewReader(conn), wr: bufio.NewWriter(conn)}
+
+	if self.cfg.Password != "" {
+		if _, err := c.do("AUTH", self.cfg.Password); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Redis authentication failed")
+		}
+	}
+	if self.cfg.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(self.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "Failed to select redis DB %v", self.cfg.DB)
+		}
+	}
+	return c, nil
+}
+
+// Run a single command. Arguments may be strings or []byte. Replies are
+// returned as int64, []byte (nil for a null bulk string), string (status
+// replies) or []interface{}.
+func (self *redisClient) do(args ...interface{}) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-self.pool:
+	default:
+		var err error
+		c, err = self.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	if _, isReply := err.(resp.Error); err != nil && !isReply {
+		// The connection is in an unknown state, don't reuse it
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case self.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (self *redisClient) close() {
+	for {
+		select {
+		case c := <-self.pool:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (self *redisConn) do(args ...interface{}) (interface{}, error) {
+	err := resp.WriteCommand(self.wr, args...)
+	if err == nil {
+		err = self.wr.Flush()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to send redis command")
+	}
+
+	return resp.ReadReply(self.rd)
+}
+
+// Helpers for the reply types we expect
+
+func redisInt(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Expected integer reply from redis, got %T", reply)
+	}
+	return n, nil
+}
+
+func redisBytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Expected bulk reply from redis, got %T", reply)
+	}
+	return b, nil
+}
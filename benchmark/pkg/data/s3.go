@@ -0,0 +1,463 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Default size of each multipart upload part. S3 requires every part but the
+// last to be at least 5MB.
+const s3DefaultPartSz = 8 * 1024 * 1024
+
+// Describes where S3DistribArrays are stored and how to reach the server
+type S3Config struct {
+	Endpoint  string // e.g. "https://s3.us-west-2.amazonaws.com" or "http://localhost:9000"
+	Region    string // Defaults to us-east-1 (what MinIO expects)
+	Bucket    string
+	Prefix    string // Arrays are stored under ${Prefix}/${name}/
+	AccessKey string
+	SecretKey string
+
+	// Size of multipart upload parts, defaults to s3DefaultPartSz
+	PartSz int64
+}
+
+// Build an S3Config from the environment. This is how FaaS workers find the
+// object store (see faasTest/README.md):
+//		RADIXBENCH_S3_ENDPOINT, RADIXBENCH_S3_REGION, RADIXBENCH_S3_BUCKET,
+//		RADIXBENCH_S3_PREFIX, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+func S3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("RADIXBENCH_S3_ENDPOINT"),
+		Region:    os.Getenv("RADIXBENCH_S3_REGION"),
+		Bucket:    os.Getenv("RADIXBENCH_S3_BUCKET"),
+		Prefix:    os.Getenv("RADIXBENCH_S3_PREFIX"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return cfg, fmt.Errorf("RADIXBENCH_S3_ENDPOINT and RADIXBENCH_S3_BUCKET must be set to use S3 arrays")
+	}
+	return cfg, nil
+}
+
+func (self *S3Config) region() string {
+	if self.Region == "" {
+		return "us-east-1"
+	}
+	return self.Region
+}
+
+func (self *S3Config) partSz() int64 {
+	if self.PartSz <= 0 {
+		return s3DefaultPartSz
+	}
+	return self.PartSz
+}
+
+func (self *S3Config) newClient() *s3Client {
+	return &s3Client{cfg: *self, http: &http.Client{}}
+}
+
+func NewS3ArrayFactory(cfg S3Config) *ArrayFactory {
+	return &ArrayFactory{
+		Unlimited: true,
+
+		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
+			a, err := CreateS3DistribArray(cfg, name, shape)
+			return (DistribArray)(a), err
+		},
+
+		Open: func(name string) (DistribArray, error) {
+			a, err := OpenS3DistribArray(cfg, name)
+			return (DistribArray)(a), err
+		},
+	}
+}
+
+// Stores a distributed array in an S3-compatible object store. Like a PERPART
+// FileDistribArray, each partition is its own object:
+//		${Prefix}/${Name}/meta.json: the same metadata as a FileDistribArray
+//			(the layout is always "perpart").
+//		${Prefix}/${Name}/p${partID}.dat: the data for partition partID.
+//			Objects are created by the first writer, a missing object is an
+//			empty partition.
+//
+// Readers issue ranged GETs. Objects are immutable so writers buffer their
+// data and upload it in PartSz chunks with a multipart upload, nothing is
+// visible to readers (or counted in the shape) until the writer is closed.
+// Appending to a non-empty partition re-uploads its existing contents.
+type S3DistribArray struct {
+	Name   string
+	client *s3Client
+
+	// Protects shape.lens and destroyed, writers for different partitions
+	// may close concurrently
+	lock  sync.Mutex
+	shape DistribArrayShape
+
+	// Stale handles mustn't touch the objects of a new array with the same name
+	destroyed bool
+}
+
+type S3DistribRangeReader struct {
+	body io.ReadCloser
+
+	// The number of bytes still to read before hitting the limit
+	nRemaining int
+}
+
+type S3DistribWriter struct {
+	arr    *S3DistribArray
+	partId int
+	key    string
+
+	// Bytes not yet uploaded
+	buf []byte
+
+	// Partition length when the writer was opened and bytes accepted since
+	base    int64
+	written int64
+
+	// Multipart state, uploadId is empty until the first full part is ready
+	uploadId string
+	etags    []string
+}
+
+func CreateS3DistribArray(cfg S3Config, name string, shape DistribArrayShape) (*S3DistribArray, error) {
+	arr := &S3DistribArray{Name: name, client: cfg.newClient()}
+
+	_, err := arr.client.getObjectAll(arr.metaKey())
+	if err == nil {
+		return nil, fmt.Errorf("Array %v exists", name)
+	} else if !isS3NotFound(err) {
+		return nil, errors.Wrapf(err, "Failed to check for existing array %v", name)
+	}
+
+	arr.shape.caps = make([]int64, len(shape.caps))
+	arr.shape.lens = make([]int64, len(shape.caps))
+	copy(arr.shape.caps, shape.caps)
+
+	err = arr.commitMeta()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create array metdata")
+	}
+
+	return arr, nil
+}
+
+func OpenS3DistribArray(cfg S3Config, name string) (*S3DistribArray, error) {
+	arr := &S3DistribArray{Name: name, client: cfg.newClient()}
+
+	metaBytes, err := arr.client.getObjectAll(arr.metaKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load metadata")
+	}
+
+	var jsonShape fileShape
+	err = json.Unmarshal(metaBytes, &jsonShape)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to interpret metadata")
+	}
+
+	if jsonShape.Layout != PERPART.String() || jsonShape.Codec != "" {
+		return nil, fmt.Errorf("Unsupported S3 array format (layout %q, codec %q)", jsonShape.Layout, jsonShape.Codec)
+	}
+
+	arr.shape.lens = jsonShape.Lens
+	arr.shape.caps = jsonShape.Caps
+
+	return arr, nil
+}
+
+func (self *S3DistribArray) rootKey() string {
+	return path.Join(self.client.cfg.Prefix, self.Name) + "/"
+}
+
+func (self *S3DistribArray) metaKey() string {
+	return self.rootKey() + "meta.json"
+}
+
+func (self *S3DistribArray) partKey(partId int) string {
+	return self.rootKey() + fmt.Sprintf("p%v.dat", partId)
+}
+
+func (self *S3DistribArray) commitMeta() error {
+	self.lock.Lock()
+	jsonShape := fileShape{Lens: self.shape.lens, Caps: self.shape.caps, Layout: PERPART.String()}
+	jsonBytes, err := json.Marshal(jsonShape)
+	self.lock.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't convert shape to json")
+	}
+
+	return self.client.putObject(self.metaKey(), jsonBytes)
+}
+
+func (self *S3DistribArray) ArrayName() string {
+	return self.Name
+}
+
+func (self *S3DistribArray) GetShape() (*DistribArrayShape, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	// Writers update lens when they commit
+	shape := CreateShapeFrom(self.shape)
+	return &shape, nil
+}
+
+func (self *S3DistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	self.lock.Lock()
+	limit, err := self.rangeLimit(partId, start, end)
+	self.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &S3DistribRangeReader{nRemaining: limit - start}
+	if reader.nRemaining == 0 {
+		// Empty ranges can't be expressed as a Range header (and the object
+		// might not exist yet)
+		return reader, nil
+	}
+
+	body, err := self.client.getObject(self.partKey(partId), (int64)(start), (int64)(limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read partition %v", partId)
+	}
+	reader.body = body
+
+	return reader, nil
+}
+
+// Validate a range and resolve its end, the caller holds lock
+func (self *S3DistribArray) rangeLimit(partId, start, end int) (int, error) {
+	if self.destroyed {
+		return 0, ErrClosed
+	}
+	return self.shape.resolveRange(partId, start, end)
+}
+
+func (self *S3DistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
+	return self.GetPartRangeReader(partId, 0, 0)
+}
+
+func (self *S3DistribArray) Close() error {
+	self.lock.Lock()
+	destroyed := self.destroyed
+	self.lock.Unlock()
+	if destroyed {
+		return nil
+	}
+
+	err := self.commitMeta()
+	if err != nil {
+		return errors.Wrap(err, "Array commit failure")
+	}
+	return nil
+}
+
+func (self *S3DistribArray) Destroy() error {
+	self.lock.Lock()
+	destroyed := self.destroyed
+	self.destroyed = true
+	self.lock.Unlock()
+	if destroyed {
+		return nil
+	}
+
+	keys, err := self.client.listObjects(self.rootKey())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := self.client.deleteObject(key); err != nil {
+			return errors.Wrapf(err, "Failed to delete %v", key)
+		}
+	}
+	return nil
+}
+
+// Reads behave like io.ReadFull, the only short read is the last one (which
+// returns io.EOF).
+func (self *S3DistribRangeReader) Read(dst []byte) (n int, err error) {
+	var toRead int
+	if len(dst) < self.nRemaining {
+		toRead = len(dst)
+	} else {
+		toRead = self.nRemaining
+		err = io.EOF
+	}
+
+	if toRead == 0 {
+		return 0, err
+	}
+
+	n, readErr := io.ReadFull(self.body, dst[:toRead])
+	self.nRemaining -= n
+	if readErr != nil {
+		err = errors.Wrap(readErr, "S3 object shorter than expected")
+	}
+
+	return n, err
+}
+
+func (self *S3DistribRangeReader) Close() error {
+	if self.body == nil {
+		return nil
+	}
+	return self.body.Close()
+}
+
+// Writers for different partitions may be used concurrently
+func (self *S3DistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	destroyed := self.destroyed
+	base := self.shape.lens[partId]
+	self.lock.Unlock()
+	if destroyed {
+		return nil, ErrClosed
+	}
+
+	writer := &S3DistribWriter{arr: self, partId: partId, key: self.partKey(partId), base: base}
+
+	if base != 0 {
+		// Objects can't be appended to, start the upload with the old data
+		reader, err := self.GetPartReader(partId)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		old := make([]byte, self.client.cfg.partSz())
+		for {
+			n, err := reader.Read(old)
+			if err := writer.push(old[:n]); err != nil {
+				writer.abort()
+				return nil, err
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				writer.abort()
+				return nil, errors.Wrapf(err, "Failed to read existing data for partition %v", partId)
+			}
+		}
+	}
+
+	return writer, nil
+}
+
+// Buffer b and upload any full parts
+func (self *S3DistribWriter) push(b []byte) error {
+	partSz := self.arr.client.cfg.partSz()
+
+	self.buf = append(self.buf, b...)
+	for (int64)(len(self.buf)) >= partSz {
+		if err := self.uploadPart(self.buf[:partSz]); err != nil {
+			return err
+		}
+		self.buf = append(self.buf[:0], self.buf[partSz:]...)
+	}
+	return nil
+}
+
+func (self *S3DistribWriter) uploadPart(part []byte) error {
+	var err error
+	client := self.arr.client
+
+	if self.uploadId == "" {
+		self.uploadId, err = client.createMultipart(self.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	etag, err := client.uploadPart(self.key, self.uploadId, len(self.etags)+1, part)
+	if err != nil {
+		return err
+	}
+	self.etags = append(self.etags, etag)
+	return nil
+}
+
+func (self *S3DistribWriter) abort() {
+	if self.uploadId != "" {
+		self.arr.client.abortMultipart(self.key, self.uploadId)
+		self.uploadId = ""
+	}
+}
+
+func (self *S3DistribWriter) Write(data []byte) (n int, err error) {
+	partCap := self.arr.shape.caps[self.partId]
+
+	// Zero capacity means unlimited (as in PERPART FileDistribArrays)
+	toWrite := (int64)(len(data))
+	if partCap != 0 {
+		nRemaining := partCap - (self.base + self.written)
+		if toWrite > nRemaining {
+			toWrite = nRemaining
+			err = io.EOF
+		}
+	}
+
+	if pushErr := self.push(data[:toWrite]); pushErr != nil {
+		return 0, pushErr
+	}
+	self.written += toWrite
+
+	return (int)(toWrite), err
+}
+
+// Upload any remaining data and publish the new partition length
+func (self *S3DistribWriter) Close() error {
+	var err error
+	client := self.arr.client
+
+	if self.uploadId == "" {
+		// Small enough for a single PUT. Skip it entirely if this writer
+		// never wrote anything to an empty partition.
+		if self.base+self.written == 0 {
+			return nil
+		}
+		err = client.putObject(self.key, self.buf)
+	} else {
+		if len(self.buf) != 0 {
+			err = self.uploadPart(self.buf)
+		}
+		if err == nil {
+			err = client.completeMultipart(self.key, self.uploadId, self.etags)
+		}
+		if err != nil {
+			self.abort()
+		}
+	}
+	self.buf = nil
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to upload partition %v", self.partId)
+	}
+
+	self.arr.lock.Lock()
+	self.arr.shape.lens[self.partId] = self.base + self.written
+	self.arr.lock.Unlock()
+
+	return nil
+}
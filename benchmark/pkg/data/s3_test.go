@@ -0,0 +1,140 @@
+package data_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/datatest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3DistribArr(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	data.CheckDistribArr(t, data.NewS3ArrayFactory(fake.Config("radixsort", "test")))
+}
+
+func TestS3Factory(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	data.CheckArrayFactory(t, data.NewS3ArrayFactory(fake.Config("radixsort", "test")))
+}
+
+func TestS3PartRange(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	arr, err := data.CreateS3DistribArray(fake.Config("radixsort", ""), "s3Range", data.CreateShapeUniform(4, 1))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := data.GenerateBytes(t, arr, 4)
+
+	t.Run("Full Range", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 0, 0) })
+	t.Run("First Two", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 0, 2) })
+	t.Run("Middle", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 1, 3) })
+	t.Run("Last Two Zero End", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 2, 0) })
+	t.Run("Negative End", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 1, -1) })
+	t.Run("Empty", func(t *testing.T) { data.CheckPartRangeReader(t, arr, raw, 2, 2) })
+}
+
+func TestS3Multipart(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+	fake.MinPartSz = 64
+	fake.ListPageSz = 2
+
+	cfg := fake.Config("radixsort", "multi")
+	cfg.PartSz = 64
+
+	// Unlimited partition so the appends below aren't capped
+	arr, err := data.CreateS3DistribArray(cfg, "multipart", data.CreateShape([]int64{0, 0, 0}))
+	require.Nil(t, err)
+
+	raw := make([]byte, 1000)
+	rand.Read(raw)
+
+	// Odd-sized writes that don't line up with parts
+	writer, err := arr.GetPartWriter(0)
+	require.Nil(t, err)
+	for i := 0; i < 700; i += 70 {
+		n, err := writer.Write(raw[i : i+70])
+		require.Nil(t, err)
+		require.Equal(t, 70, n)
+	}
+
+	shape, _ := arr.GetShape()
+	require.Zero(t, shape.Len(0), "Uncommitted data visible in shape")
+
+	require.Nil(t, writer.Close())
+	require.Zero(t, shape.Len(0), "Shapes must not change after GetShape")
+	shape, _ = arr.GetShape()
+	require.Equal(t, (int64)(700), shape.Len(0))
+
+	// Append to the existing object
+	writer, err = arr.GetPartWriter(0)
+	require.Nil(t, err)
+	_, err = writer.Write(raw[700:])
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+	require.Zero(t, fake.NUpload(), "Multipart uploads left open")
+
+	require.Nil(t, arr.Close())
+
+	reArr, err := data.OpenS3DistribArray(cfg, "multipart")
+	require.Nil(t, err)
+
+	reader, err := reArr.GetPartReader(0)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(raw, out), "Multipart object corrupted")
+
+	for partId := 1; partId < 3; partId++ {
+		writer, err := reArr.GetPartWriter(partId)
+		require.Nil(t, err)
+		writer.Write(raw[:10])
+		require.Nil(t, writer.Close())
+	}
+
+	// Listing takes several pages here
+	require.Nil(t, reArr.Destroy())
+	require.Zero(t, fake.NObject(), "Destroy left objects behind")
+}
+
+func TestS3Errors(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	cfg := fake.Config("radixsort", "")
+
+	_, err := data.OpenS3DistribArray(cfg, "missing")
+	require.NotNil(t, err, "Opened a missing array")
+
+	badCfg := cfg
+	badCfg.SecretKey = "wrong"
+	_, err = data.CreateS3DistribArray(badCfg, "badAuth", data.CreateShapeUniform(4, 1))
+	require.NotNil(t, err, "Server accepted a bad signature")
+	require.Zero(t, fake.NObject())
+
+	// Too-small parts make the upload fail, the writer must clean up
+	cfg.PartSz = 4
+	arr, err := data.CreateS3DistribArray(cfg, "smallParts", data.CreateShapeUniform(16, 1))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	writer, err := arr.GetPartWriter(0)
+	require.Nil(t, err)
+	_, err = writer.Write(make([]byte, 16))
+	require.Nil(t, err)
+	require.NotNil(t, writer.Close(), "Upload with undersized parts succeeded")
+	require.Zero(t, fake.NUpload(), "Failed upload not aborted")
+
+	shape, _ := arr.GetShape()
+	require.Zero(t, shape.Len(0), "Failed upload changed the partition length")
+}
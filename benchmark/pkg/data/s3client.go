@@ -0,0 +1,253 @@
+package data
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/internal/s3sign"
+	"github.com/pkg/errors"
+)
+
+// A minimal client for the S3 REST API. It only implements the handful of
+// calls S3DistribArray needs (object get/put/delete, ListObjectsV2 and
+// multipart uploads) and signs requests with AWS Signature Version 4. Buckets
+// are always addressed path-style (${endpoint}/${bucket}/${key}) which works
+// with both AWS and local stand-ins like MinIO.
+type s3Client struct {
+	cfg  S3Config
+	http *http.Client
+}
+
+// Error returned by the server
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (self *s3Error) Error() string {
+	return fmt.Sprintf("S3 error %v (%v): %v", self.Code, self.Status, self.Message)
+}
+
+func isS3NotFound(err error) bool {
+	s3Err, ok := errors.Cause(err).(*s3Error)
+	return ok && (s3Err.Status == http.StatusNotFound || s3Err.Code == "NoSuchKey")
+}
+
+// Issue a signed request for key (or the bucket itself if key is empty).
+// Non-2xx responses are returned as *s3Error with the body consumed.
+func (self *s3Client) do(method, key string, query url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	reqUrl := strings.TrimRight(self.cfg.Endpoint, "/") + "/" + s3sign.URIEncode(self.cfg.Bucket, true)
+	if key != "" {
+		reqUrl += "/" + s3sign.URIEncode(key, false)
+	}
+	if len(query) != 0 {
+		reqUrl += "?" + s3sign.CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to build S3 request")
+	}
+	req.ContentLength = (int64)(len(body))
+	for name, vals := range hdr {
+		req.Header[name] = vals
+	}
+	s3sign.Sign(req, self.cfg.AccessKey, self.cfg.SecretKey, self.cfg.region(), s3sign.SHA256Hex(body), time.Now())
+
+	resp, err := self.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "S3 %v %v failed", method, key)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp)
+	}
+	return resp, nil
+}
+
+func readS3Error(resp *http.Response) error {
+	s3Err := &s3Error{Status: resp.StatusCode}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(raw, s3Err) != nil || s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+		s3Err.Message = string(raw)
+	}
+	return s3Err
+}
+
+// Issue a request and decode its XML response into out
+func (self *s3Client) doXML(method, key string, query url.Values, body []byte, out interface{}) error {
+	resp, err := self.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read S3 response")
+	}
+
+	// Some calls (e.g. CompleteMultipartUpload) can fail after the 200 header
+	// has been sent, the error is reported in the body instead.
+	head := raw
+	if len(head) > 128 {
+		head = head[:128]
+	}
+	if bytes.Contains(head, []byte("<Error>")) {
+		s3Err := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(raw, s3Err)
+		return s3Err
+	}
+
+	if err := xml.Unmarshal(raw, out); err != nil {
+		return errors.Wrapf(err, "Failed to parse S3 response: %q", raw)
+	}
+	return nil
+}
+
+// Fetch bytes [start, end) of key
+func (self *s3Client) getObject(key string, start, end int64) (io.ReadCloser, error) {
+	hdr := http.Header{}
+	hdr.Set("Range", fmt.Sprintf("bytes=%v-%v", start, end-1))
+
+	resp, err := self.do(http.MethodGet, key, nil, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Fetch all of key
+func (self *s3Client) getObjectAll(key string) ([]byte, error) {
+	resp, err := self.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (self *s3Client) putObject(key string, body []byte) error {
+	resp, err := self.do(http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (self *s3Client) deleteObject(key string) error {
+	resp, err := self.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List every key starting with prefix (following continuation tokens)
+func (self *s3Client) listObjects(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var res s3ListResult
+		if err := self.doXML(http.MethodGet, "", query, nil, &res); err != nil {
+			return nil, errors.Wrapf(err, "Failed to list %q", prefix)
+		}
+
+		for _, obj := range res.Contents {
+			keys = append(keys, obj.Key)
+		}
+
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (self *s3Client) createMultipart(key string) (string, error) {
+	var res struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err := self.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &res)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to start multipart upload of %v", key)
+	}
+	return res.UploadId, nil
+}
+
+// Upload part partNum (1-based) and return its ETag
+func (self *s3Client) uploadPart(key, uploadId string, partNum int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNum)}, "uploadId": {uploadId}}
+	resp, err := self.do(http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to upload part %v of %v", partNum, key)
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (self *s3Client) completeMultipart(key, uploadId string, etags []string) error {
+	req := s3CompleteUpload{}
+	for i, etag := range etags {
+		req.Parts = append(req.Parts, s3CompletePart{PartNumber: i + 1, ETag: etag})
+	}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var res struct {
+		Key string `xml:"Key"`
+	}
+	err = self.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, body, &res)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to complete multipart upload of %v", key)
+	}
+	return nil
+}
+
+func (self *s3Client) abortMultipart(key, uploadId string) error {
+	resp, err := self.do(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
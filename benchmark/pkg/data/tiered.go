@@ -0,0 +1,565 @@
+package data
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How much data a TieredStore has in each tier
+type TieredStats struct {
+	MemBytes     int64 // Bytes currently held in memory (not counting partitions being spilled)
+	PeakMemBytes int64 // Most bytes ever held in memory at once
+	DiskBytes    int64 // Bytes currently spilled to disk
+	SpilledBytes int64 // Total bytes ever written to disk (including destroyed arrays)
+	NSpill       int   // Number of partitions that were spilled
+}
+
+// Holds the TieredDistribArrays from a factory. Partitions are kept in memory
+// until the store exceeds its memory budget, then the least recently used
+// partitions (across every array in the store) are moved to a PERPART
+// FileDistribArray under the spill directory. Spilled partitions stay on
+// disk.
+type TieredStore struct {
+	memBudget int64
+	spillDir  string
+
+	// Protects everything below as well as the state of every array in the
+	// store. Disk I/O happens without the lock, the partitions involved are
+	// marked busy instead (see tieredPart).
+	lock  sync.Mutex
+	arrs  map[string]*TieredDistribArray
+	stats TieredStats
+
+	// tieredPartRefs of the partitions with data in memory, least recently
+	// used first
+	lru *list.List
+
+	// Broadcast whenever a partition stops being busy
+	ioDone *sync.Cond
+}
+
+// Keep at most memBudget bytes of array data in memory, spilling the rest to
+// spillDir (which must exist)
+func NewTieredStore(memBudget int64, spillDir string) *TieredStore {
+	store := &TieredStore{memBudget: memBudget, spillDir: spillDir,
+		arrs: map[string]*TieredDistribArray{}, lru: list.New()}
+	store.ioDone = sync.NewCond(&store.lock)
+	return store
+}
+
+func (self *TieredStore) Stats() TieredStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats
+}
+
+func NewTieredArrayFactory(store *TieredStore) *ArrayFactory {
+	return &ArrayFactory{
+		Create: func(name string, shape DistribArrayShape) (DistribArray, error) {
+			a, err := CreateTieredDistribArray(store, name, shape)
+			return (DistribArray)(a), err
+		},
+
+		Open: func(name string) (DistribArray, error) {
+			a, err := OpenTieredDistribArray(store, name)
+			return (DistribArray)(a), err
+		},
+
+		List: func() ([]string, error) {
+			store.lock.Lock()
+			defer store.lock.Unlock()
+
+			names := make([]string, 0, len(store.arrs))
+			for name := range store.arrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return names, nil
+		},
+
+		Stat: func(name string) (*ArrayInfo, error) {
+			store.lock.Lock()
+			defer store.lock.Unlock()
+
+			arr, ok := store.arrs[name]
+			if !ok {
+				return nil, fmt.Errorf("Array %v does not exist", name)
+			}
+			return &ArrayInfo{Name: name, Shape: CreateShapeFrom(arr.shape), ModTime: arr.modTime}, nil
+		},
+
+		Exists: func(name string) (bool, error) {
+			store.lock.Lock()
+			defer store.lock.Unlock()
+
+			_, ok := store.arrs[name]
+			return ok, nil
+		},
+	}
+}
+
+type tieredPart struct {
+	mem     []byte
+	spilled bool
+
+	// Set while the partition is being written to disk. Writers wait for it
+	// to clear, readers keep using mem until the partition is spilled.
+	busy bool
+
+	// Position in store.lru, nil unless the partition has data in memory
+	lruElem *list.Element
+}
+
+type tieredPartRef struct {
+	arr    *TieredDistribArray
+	partId int
+}
+
+// A partition picked by startSpill. mem (the partition's data in memory, if
+// any) and data (new bytes to append) are written to disk by runSpill.
+type tieredSpill struct {
+	tieredPartRef
+	mem  []byte
+	data []byte
+}
+
+// A DistribArray that lives in memory as long as its TieredStore has room
+// and on disk otherwise. Like MemDistribArray, arrays are only visible within
+// this process and Close() is a nop.
+type TieredDistribArray struct {
+	Name  string
+	store *TieredStore
+	shape DistribArrayShape
+	parts []tieredPart
+
+	// Created by the first spill. Writing it requires spillLock and
+	// store.lock, reading it either one.
+	spill     *FileDistribArray
+	spillLock sync.Mutex
+
+	// Number of busy partitions
+	nBusy int
+
+	modTime   time.Time
+	destroyed bool
+}
+
+type TieredDistribWriter struct {
+	arr    *TieredDistribArray
+	partId int
+}
+
+func CreateTieredDistribArray(store *TieredStore, name string, shape DistribArrayShape) (*TieredDistribArray, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.arrs[name]; ok {
+		return nil, fmt.Errorf("Array %v exists", name)
+	}
+
+	// Spill directories are private to the store, anything here is left over
+	// from a previous process
+	if err := os.RemoveAll(filepath.Join(store.spillDir, name)); err != nil {
+		return nil, errors.Wrap(err, "Failed to remove stale spill directory")
+	}
+
+	arr := &TieredDistribArray{Name: name, store: store, modTime: time.Now()}
+	arr.shape = CreateShape(shape.caps)
+	arr.parts = make([]tieredPart, len(shape.caps))
+
+	store.arrs[name] = arr
+	return arr, nil
+}
+
+func OpenTieredDistribArray(store *TieredStore, name string) (*TieredDistribArray, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	arr, ok := store.arrs[name]
+	if !ok {
+		return nil, fmt.Errorf("Array %v does not exist", name)
+	}
+	return arr, nil
+}
+
+// Returns true if partId is currently held in memory
+func (self *TieredDistribArray) InMemory(partId int) bool {
+	self.store.lock.Lock()
+	defer self.store.lock.Unlock()
+	return !self.parts[partId].spilled
+}
+
+// Mark a partition as recently used, the caller holds store.lock
+func (self *TieredDistribArray) touch(partId int) {
+	if elem := self.parts[partId].lruElem; elem != nil {
+		self.store.lru.MoveToBack(elem)
+	}
+}
+
+// Returns the spill array, creating it if needed. The caller must not hold
+// store.lock.
+func (self *TieredDistribArray) getSpill() (*FileDistribArray, error) {
+	self.spillLock.Lock()
+	defer self.spillLock.Unlock()
+
+	if self.spill == nil {
+		spill, err := CreateFileDistribArray(filepath.Join(self.store.spillDir, self.Name),
+			CreateShape(self.shape.caps), WithLayout(PERPART))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create spill array")
+		}
+
+		self.store.lock.Lock()
+		self.spill = spill
+		self.store.lock.Unlock()
+	}
+	return self.spill, nil
+}
+
+// Mark a partition busy and take its memory out of the budget, the caller
+// holds store.lock and must pass the result to runSpill. Works for partitions
+// that are already on disk too (to append to them).
+func (self *TieredDistribArray) startSpill(partId int) tieredSpill {
+	store := self.store
+	part := &self.parts[partId]
+
+	part.busy = true
+	self.nBusy++
+	if part.lruElem != nil {
+		store.lru.Remove(part.lruElem)
+		part.lruElem = nil
+	}
+	store.stats.MemBytes -= (int64)(len(part.mem))
+
+	return tieredSpill{tieredPartRef: tieredPartRef{self, partId}, mem: part.mem}
+}
+
+// Write a partition picked by startSpill to disk and mark it spilled. If
+// that fails the partition stays in memory. The caller must not hold
+// store.lock.
+func (self *TieredDistribArray) runSpill(spill tieredSpill) error {
+	n, err := self.spillWrite(spill.partId, spill.mem, spill.data)
+
+	store := self.store
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	part := &self.parts[spill.partId]
+	part.busy = false
+	self.nBusy--
+	store.ioDone.Broadcast()
+
+	if err != nil {
+		if !part.spilled && len(part.mem) != 0 {
+			store.stats.MemBytes += (int64)(len(part.mem))
+			part.lruElem = store.lru.PushFront(spill.tieredPartRef)
+		}
+		return err
+	}
+
+	store.stats.DiskBytes += n
+	store.stats.SpilledBytes += n
+	if !part.spilled {
+		store.stats.NSpill++
+		part.mem = nil
+		part.spilled = true
+	}
+	self.shape.lens[spill.partId] += (int64)(len(spill.data))
+	return nil
+}
+
+// Run each spill in turn, returns the first error
+func runSpills(spills []tieredSpill) error {
+	var spillErr error
+	for _, spill := range spills {
+		if err := spill.arr.runSpill(spill); err != nil && spillErr == nil {
+			spillErr = err
+		}
+	}
+	return spillErr
+}
+
+// Append bufs to the spilled copy of a partition, returns the number of bytes
+// written. The caller must not hold store.lock.
+func (self *TieredDistribArray) spillWrite(partId int, bufs ...[]byte) (int64, error) {
+	spill, err := self.getSpill()
+	if err != nil {
+		return 0, err
+	}
+
+	writer, err := spill.GetPartWriter(partId)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to spill partition %v", partId)
+	}
+
+	n := (int64)(0)
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+
+		var nBuf int
+		nBuf, err = writer.Write(buf)
+		n += (int64)(nBuf)
+		if err != nil {
+			break
+		}
+	}
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, errors.Wrapf(err, "Failed to spill partition %v", partId)
+	}
+	return n, nil
+}
+
+// Pick the least recently used partitions to spill until nbyte more bytes fit
+// in memory. partId may be picked itself (last) if nothing else is left. The
+// caller holds store.lock and must pass the result to runSpills.
+func (self *TieredDistribArray) reserve(partId int, nbyte int64) []tieredSpill {
+	store := self.store
+
+	// Partitions that could never fit don't push anything else out
+	if (int64)(len(self.parts[partId].mem))+nbyte > store.memBudget {
+		return []tieredSpill{self.startSpill(partId)}
+	}
+
+	var spills []tieredSpill
+	for store.stats.MemBytes+nbyte > store.memBudget && store.lru.Len() != 0 {
+		victim := store.lru.Front().Value.(tieredPartRef)
+		spills = append(spills, victim.arr.startSpill(victim.partId))
+
+		if victim.arr == self && victim.partId == partId {
+			break
+		}
+	}
+	return spills
+}
+
+func (self *TieredDistribArray) ArrayName() string {
+	return self.Name
+}
+
+func (self *TieredDistribArray) GetShape() (*DistribArrayShape, error) {
+	self.store.lock.Lock()
+	defer self.store.lock.Unlock()
+	if self.destroyed {
+		return nil, ErrClosed
+	}
+
+	// Writers update lens
+	shape := CreateShapeFrom(self.shape)
+	return &shape, nil
+}
+
+func (self *TieredDistribArray) GetPartRangeReader(partId, start, end int) (io.ReadCloser, error) {
+	store := self.store
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+
+	// Appends to spilled partitions change the spill array's shape
+	part := &self.parts[partId]
+	for part.busy && part.spilled && !self.destroyed {
+		store.ioDone.Wait()
+	}
+
+	limit, err := self.rangeLimit(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	self.touch(partId)
+	if part.spilled {
+		// An end of 0 would mean "the whole partition" to the spill array
+		if limit == start {
+			return &MemDistribPartReadCloser{}, nil
+		}
+		return self.spill.GetPartRangeReader(partId, start, limit)
+	}
+	return &MemDistribPartReadCloser{buf: part.mem, start: start, limit: limit}, nil
+}
+
+// Validate a range and resolve its end, the caller holds store.lock
+func (self *TieredDistribArray) rangeLimit(partId, start, end int) (int, error) {
+	if self.destroyed {
+		return 0, ErrClosed
+	}
+	return self.shape.resolveRange(partId, start, end)
+}
+
+func (self *TieredDistribArray) GetPartReader(partId int) (io.ReadCloser, error) {
+	return self.GetPartRangeReader(partId, 0, 0)
+}
+
+// In-memory partitions are returned without copying, spilled partitions are
+// read into a new buffer
+func (self *TieredDistribArray) GetPartRangeBytes(partId, start, end int) ([]byte, error) {
+	self.store.lock.Lock()
+	limit, err := self.rangeLimit(partId, start, end)
+	if err != nil {
+		self.store.lock.Unlock()
+		return nil, err
+	}
+
+	// Partitions being spilled are still in memory
+	part := &self.parts[partId]
+	if !part.spilled {
+		defer self.store.lock.Unlock()
+
+		self.touch(partId)
+		return part.mem[start:limit], nil
+	}
+	self.store.lock.Unlock()
+
+	reader, err := self.GetPartRangeReader(partId, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (self *TieredDistribArray) GetPartWriter(partId int) (io.WriteCloser, error) {
+	self.store.lock.Lock()
+	destroyed := self.destroyed
+	self.store.lock.Unlock()
+	if destroyed {
+		return nil, ErrClosed
+	}
+
+	if err := self.shape.checkPart(partId); err != nil {
+		return nil, err
+	}
+	return &TieredDistribWriter{arr: self, partId: partId}, nil
+}
+
+func (self *TieredDistribArray) Close() error {
+	return nil
+}
+
+func (self *TieredDistribArray) Destroy() error {
+	store := self.store
+	store.lock.Lock()
+
+	if self.destroyed {
+		store.lock.Unlock()
+		return nil
+	}
+	self.destroyed = true
+	delete(store.arrs, self.Name)
+
+	// Running spills still use the spill array (and update the stats)
+	for self.nBusy != 0 {
+		store.ioDone.Wait()
+	}
+
+	for i := range self.parts {
+		part := &self.parts[i]
+		if part.spilled {
+			store.stats.DiskBytes -= self.shape.lens[i]
+		} else {
+			store.stats.MemBytes -= (int64)(len(part.mem))
+		}
+		if part.lruElem != nil {
+			store.lru.Remove(part.lruElem)
+			part.lruElem = nil
+		}
+		part.mem = nil
+	}
+
+	spill := self.spill
+	store.lock.Unlock()
+
+	if spill != nil {
+		return spill.Destroy()
+	}
+	return nil
+}
+
+func (self *TieredDistribWriter) Write(data []byte) (n int, err error) {
+	arr := self.arr
+	store := arr.store
+	store.lock.Lock()
+
+	part := &arr.parts[self.partId]
+	for part.busy && !arr.destroyed {
+		store.ioDone.Wait()
+	}
+	if arr.destroyed {
+		store.lock.Unlock()
+		return 0, ErrClosed
+	}
+
+	// Capacities are strict, as in MemDistribArray
+	toWrite := (int64)(len(data))
+	nRemaining := arr.shape.caps[self.partId] - arr.shape.lens[self.partId]
+	if toWrite > nRemaining {
+		toWrite = nRemaining
+		err = io.EOF
+	}
+	if toWrite == 0 {
+		store.lock.Unlock()
+		return 0, err
+	}
+
+	arr.touch(self.partId)
+	arr.modTime = time.Now()
+
+	var spills []tieredSpill
+	if !part.spilled {
+		spills = arr.reserve(self.partId, toWrite)
+	}
+
+	if part.spilled || part.busy {
+		// The data goes to disk along with anything already in memory. If
+		// this partition was picked by reserve, it is the last spill.
+		if !part.busy {
+			spills = append(spills, arr.startSpill(self.partId))
+		}
+		spills[len(spills)-1].data = data[:toWrite]
+		store.lock.Unlock()
+
+		if spillErr := runSpills(spills); spillErr != nil {
+			return 0, spillErr
+		}
+		return (int)(toWrite), err
+	}
+
+	part.mem = append(part.mem, data[:toWrite]...)
+	if part.lruElem == nil {
+		part.lruElem = store.lru.PushBack(tieredPartRef{arr, self.partId})
+	}
+	arr.shape.lens[self.partId] += toWrite
+	store.stats.MemBytes += toWrite
+	if store.stats.MemBytes > store.stats.PeakMemBytes {
+		store.stats.PeakMemBytes = store.stats.MemBytes
+	}
+	store.lock.Unlock()
+
+	// Partitions pushed out to make room are written to disk after the lock
+	// is released
+	if spillErr := runSpills(spills); spillErr != nil {
+		return (int)(toWrite), spillErr
+	}
+	return (int)(toWrite), err
+}
+
+func (self *TieredDistribWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredDistribArr(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("Memory", func(t *testing.T) {
+		testDistribArr(t, NewTieredArrayFactory(NewTieredStore(1024*1024, tmpDir)))
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		testDistribArr(t, NewTieredArrayFactory(NewTieredStore(0, tmpDir)))
+	})
+
+	// Smaller than a single array
+	t.Run("Mixed", func(t *testing.T) {
+		testDistribArr(t, NewTieredArrayFactory(NewTieredStore(100, tmpDir)))
+	})
+}
+
+func TestTieredFactory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	testArrayFactory(t, NewTieredArrayFactory(NewTieredStore(100, tmpDir)))
+}
+
+func TestTieredPartRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	// Partition 0 stays in memory, partition 1 spills
+	store := NewTieredStore(4, tmpDir)
+	arr, err := CreateTieredDistribArray(store, "tieredRange", CreateShapeUniform(4, 2))
+	require.Nil(t, err)
+	defer arr.Destroy()
+
+	raw := generateBytes(t, arr, 4)
+	require.True(t, arr.InMemory(1), "Most recent partition was spilled")
+	require.False(t, arr.InMemory(0), "Least recent partition was not spilled")
+
+	for _, partId := range []int{0, 1} {
+		partRaw := raw[partId*4 : (partId+1)*4]
+		t.Run("Full Range", func(t *testing.T) { testTieredRange(t, arr, partId, partRaw, 0, 0) })
+		t.Run("Middle", func(t *testing.T) { testTieredRange(t, arr, partId, partRaw, 1, 3) })
+		t.Run("Negative End", func(t *testing.T) { testTieredRange(t, arr, partId, partRaw, 1, -1) })
+		t.Run("Empty", func(t *testing.T) { testTieredRange(t, arr, partId, partRaw, 2, 2) })
+	}
+}
+
+func testTieredRange(t *testing.T, arr *TieredDistribArray, partId int, partRaw []byte, start, end int) {
+	limit := end
+	if end <= 0 {
+		limit = len(partRaw) + end
+	}
+
+	reader, err := arr.GetPartRangeReader(partId, start, end)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	require.Equal(t, partRaw[start:limit], out, "Reader returned wrong data")
+
+	ref := &PartRef{Arr: arr, PartIdx: partId, Start: start, NByte: limit - start}
+	refBytes, err := ref.Bytes()
+	require.Nil(t, err)
+	require.Equal(t, partRaw[start:limit], refBytes, "PartRef.Bytes returned wrong data")
+}
+
+func TestTieredSpill(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	store := NewTieredStore(1000, tmpDir)
+	fact := NewTieredArrayFactory(store)
+
+	raw := make([]byte, 1500)
+	rand.Read(raw)
+
+	// Fits entirely in memory
+	arr0, err := fact.Create("spill0", CreateShapeUniform(500, 2))
+	require.Nil(t, err)
+	writeTieredPart(t, arr0, 0, raw[:500])
+	writeTieredPart(t, arr0, 1, raw[500:1000])
+	require.Equal(t, TieredStats{MemBytes: 1000, PeakMemBytes: 1000}, store.Stats())
+
+	// Touch arr0's partition 1 so partition 0 is the coldest
+	checkTieredPart(t, arr0, 1, raw[500:1000])
+
+	arr1, err := fact.Create("spill1", CreateShapeUniform(500, 1))
+	require.Nil(t, err)
+	writeTieredPart(t, arr1, 0, raw[1000:])
+
+	stats := store.Stats()
+	require.Equal(t, (int64)(1000), stats.MemBytes)
+	require.Equal(t, (int64)(500), stats.DiskBytes)
+	require.Equal(t, (int64)(500), stats.SpilledBytes)
+	require.Equal(t, 1, stats.NSpill)
+
+	tArr0 := arr0.(*TieredDistribArray)
+	require.False(t, tArr0.InMemory(0), "Coldest partition not spilled")
+	require.True(t, tArr0.InMemory(1), "Recently used partition spilled")
+	_, err = os.Stat(filepath.Join(tmpDir, "spill0"))
+	require.Nil(t, err, "Spill directory not created")
+
+	// Data is intact in both tiers and after re-opening
+	reArr0, err := fact.Open("spill0")
+	require.Nil(t, err)
+	checkArr(t, reArr0, raw[:1000])
+	checkArr(t, arr1, raw[1000:])
+
+	// Bigger than the whole budget, goes straight to disk
+	big, err := fact.Create("spillBig", CreateShapeUniform(2000, 1))
+	require.Nil(t, err)
+	bigRaw := make([]byte, 2000)
+	rand.Read(bigRaw)
+	writeTieredPart(t, big, 0, bigRaw)
+	checkArr(t, big, bigRaw)
+	require.Equal(t, (int64)(2500), store.Stats().DiskBytes)
+
+	require.Nil(t, arr0.Destroy())
+	require.Nil(t, arr1.Destroy())
+	require.Nil(t, big.Destroy())
+
+	stats = store.Stats()
+	require.Zero(t, stats.MemBytes, "Destroy didn't release memory")
+	require.Zero(t, stats.DiskBytes, "Destroy didn't release disk")
+	require.Equal(t, (int64)(1000), stats.PeakMemBytes)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "spill0"))
+	require.True(t, os.IsNotExist(err), "Spill directory not removed")
+}
+
+// Arrays that spill each other's partitions from different goroutines. Run
+// with -race to check the partition states.
+func TestTieredConcurrentSpill(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortDataTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	budget := (int64)(4096)
+	store := NewTieredStore(budget, tmpDir)
+	fact := NewTieredArrayFactory(store)
+
+	nArr := 8
+	nPart := 4
+	partLen := 4096
+	chunkSz := 512
+	raws := make([][]byte, nArr)
+	arrs := make([]DistribArray, nArr)
+	for i := range arrs {
+		raws[i] = make([]byte, nPart*partLen)
+		rand.Read(raws[i])
+		arrs[i], err = fact.Create(fmt.Sprintf("concurrent%v", i), CreateShapeUniform((int64)(partLen), nPart))
+		require.Nil(t, err)
+	}
+
+	errs := make([]error, nArr)
+	var wg sync.WaitGroup
+	wg.Add(nArr)
+	for i := 0; i < nArr; i++ {
+		go func(arrId int) {
+			defer wg.Done()
+			arr := arrs[arrId]
+			raw := raws[arrId]
+
+			writers := make([]io.WriteCloser, nPart)
+			for partId := range writers {
+				if writers[partId], errs[arrId] = arr.GetPartWriter(partId); errs[arrId] != nil {
+					return
+				}
+			}
+
+			// Read back what is already written (from either tier) between
+			// appends
+			for off := 0; off < partLen; off += chunkSz {
+				for partId, writer := range writers {
+					start := partId*partLen + off
+					if _, errs[arrId] = writer.Write(raw[start : start+chunkSz]); errs[arrId] != nil {
+						return
+					}
+
+					var out []byte
+					if out, errs[arrId] = arr.(*TieredDistribArray).GetPartRangeBytes(partId, 0, off+chunkSz); errs[arrId] != nil {
+						return
+					}
+					if !bytes.Equal(raw[partId*partLen:start+chunkSz], out) {
+						errs[arrId] = fmt.Errorf("Partition %v corrupted after %v bytes", partId, off+chunkSz)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		require.Nilf(t, err, "Array %v failed", i)
+	}
+
+	stats := store.Stats()
+	require.LessOrEqual(t, stats.PeakMemBytes, budget, "Memory budget exceeded")
+	require.Equal(t, (int64)(nArr*nPart*partLen), stats.MemBytes+stats.DiskBytes, "Bytes lost between tiers")
+
+	for i, arr := range arrs {
+		checkArr(t, arr, raws[i])
+		require.Nil(t, arr.Destroy())
+	}
+	require.Zero(t, store.Stats().MemBytes+store.Stats().DiskBytes, "Destroy didn't release everything")
+}
+
+func writeTieredPart(t *testing.T, arr DistribArray, partId int, raw []byte) {
+	writer, err := arr.GetPartWriter(partId)
+	require.Nil(t, err)
+	n, err := writer.Write(raw)
+	require.Nil(t, err)
+	require.Equal(t, len(raw), n)
+	require.Nil(t, writer.Close())
+}
+
+func checkTieredPart(t *testing.T, arr DistribArray, partId int, raw []byte) {
+	reader, err := arr.GetPartReader(partId)
+	require.Nil(t, err)
+	out, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(raw, out), "Partition %v corrupted", partId)
+}
@@ -0,0 +1,159 @@
+package faas
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/sort"
+	"github.com/pkg/errors"
+	"github.com/serverlessresearch/srk/pkg/srkmgr"
+)
+
+// Finds the GPUs that workers may use. Returns one ID per device, workers get
+// theirs through CUDA_VISIBLE_DEVICES. No IDs (and no error) means the
+// machine has no GPUs.
+type DeviceProvider func() ([]string, error)
+
+// Ask nvidia-smi for the GPUs of this machine. A machine without nvidia-smi
+// has no GPUs.
+func NvidiaSmiDevices() ([]string, error) {
+	out, err := exec.Command("nvidia-smi", "-L").Output()
+	if err != nil {
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Error determining GPU count")
+	}
+	return parseNvidiaSmi(out)
+}
+
+// Parse the output of nvidia-smi -L, one "GPU 0: Tesla V100 (UUID: ...)" line
+// per GPU
+func parseNvidiaSmi(out []byte) ([]string, error) {
+	var ids []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "GPU ") {
+			continue
+		}
+
+		sep := strings.Index(line, ":")
+		if sep == -1 {
+			return nil, fmt.Errorf("Unrecognized nvidia-smi output: %q", line)
+		}
+		id := strings.TrimSpace(line[len("GPU "):sep])
+		if _, err := strconv.Atoi(id); err != nil {
+			return nil, fmt.Errorf("Unrecognized nvidia-smi output: %q", line)
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// Use the GPUs listed in CUDA_VISIBLE_DEVICES (indices or UUIDs). As in CUDA,
+// the list ends at the first negative index. It is an error for the variable
+// to be unset.
+func CudaVisibleDevices() ([]string, error) {
+	env, ok := os.LookupEnv("CUDA_VISIBLE_DEVICES")
+	if !ok {
+		return nil, errors.New("CUDA_VISIBLE_DEVICES is not set")
+	}
+	return parseCudaVisible(env), nil
+}
+
+func parseCudaVisible(env string) []string {
+	var ids []string
+	for _, id := range strings.Split(env, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if idx, err := strconv.Atoi(id); err == nil && idx < 0 {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Always use the given GPUs (none for a CPU-only machine)
+func StaticDevices(ids ...string) DeviceProvider {
+	return func() ([]string, error) {
+		return ids, nil
+	}
+}
+
+// nDev made up GPUs ("0" to "nDev-1") for tests
+func FakeDevices(nDev int) DeviceProvider {
+	ids := make([]string, nDev)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	return StaticDevices(ids...)
+}
+
+// CUDA_VISIBLE_DEVICES if it is set, otherwise nvidia-smi
+func DefaultDevices() ([]string, error) {
+	if _, ok := os.LookupEnv("CUDA_VISIBLE_DEVICES"); ok {
+		return CudaVisibleDevices()
+	}
+	return NvidiaSmiDevices()
+}
+
+// Discovery runs the first time devices are needed (not at import, so
+// importing faas works on machines without GPUs or drivers). Failures aren't
+// cached.
+var deviceLock sync.Mutex
+var deviceProvider DeviceProvider = DefaultDevices
+var deviceIDs []string
+var gpuManager *sort.DeviceReserver
+
+// Replace the device provider (DefaultDevices to begin with). Devices are
+// rediscovered on next use, don't call this while workers are running.
+func SetDeviceProvider(provider DeviceProvider) {
+	deviceLock.Lock()
+	defer deviceLock.Unlock()
+
+	deviceProvider = provider
+	deviceIDs = nil
+	gpuManager = nil
+}
+
+// The GPUs of this machine, shared by FaaS workers and e.g.
+// sort.MultiDeviceOptions.Devices so that they never use the same GPU at once.
+// The reserver hands out indices into the returned IDs.
+func Devices() (*sort.DeviceReserver, []string, error) {
+	deviceLock.Lock()
+	defer deviceLock.Unlock()
+
+	if gpuManager == nil {
+		ids, err := deviceProvider()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to find GPUs")
+		}
+		deviceIDs = ids
+		gpuManager = sort.NewDeviceReserver(len(ids))
+	}
+	return gpuManager, deviceIDs, nil
+}
+
+// A FaaS worker if this machine has GPUs, otherwise a local worker that sorts
+// on the CPU
+func SelectWorker(mgr *srkmgr.SrkManager) (sort.DistribWorkerCtx, error) {
+	devices, _, err := Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	if devices.NDev() == 0 {
+		return sort.MultiDeviceWorker(sort.MultiDeviceOptions{}), nil
+	}
+	return InitFaasWorkerCtx(mgr), nil
+}
@@ -0,0 +1,73 @@
+package faas
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/sort"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNvidiaSmi(t *testing.T) {
+	out := []byte("GPU 0: Tesla V100-SXM2-16GB (UUID: GPU-0a1b)\nGPU 1: Tesla V100-SXM2-16GB (UUID: GPU-2c3d)\n")
+	ids, err := parseNvidiaSmi(out)
+	require.Nil(t, err, "Failed to parse nvidia-smi output")
+	require.Equal(t, []string{"0", "1"}, ids)
+
+	ids, err = parseNvidiaSmi([]byte(""))
+	require.Nil(t, err, "Failed to parse empty nvidia-smi output")
+	require.Empty(t, ids, "Found GPUs in empty output")
+
+	_, err = parseNvidiaSmi([]byte("GPU x: Broken\n"))
+	require.NotNil(t, err, "Accepted a malformed GPU line")
+}
+
+func TestParseCudaVisible(t *testing.T) {
+	require.Equal(t, []string{"2", "3"}, parseCudaVisible("2,3"))
+	require.Equal(t, []string{"GPU-0a1b", "1"}, parseCudaVisible("GPU-0a1b, 1"))
+	require.Equal(t, []string{"0"}, parseCudaVisible("0,-1,1"))
+	require.Empty(t, parseCudaVisible(""))
+	require.Empty(t, parseCudaVisible("-1"))
+}
+
+func TestDeviceProvider(t *testing.T) {
+	defer SetDeviceProvider(DefaultDevices)
+
+	SetDeviceProvider(func() ([]string, error) { return nil, errors.New("no driver") })
+	_, _, err := Devices()
+	require.NotNil(t, err, "Discovery error was ignored")
+
+	SetDeviceProvider(StaticDevices("2", "3"))
+	devices, ids, err := Devices()
+	require.Nil(t, err, "Failed to find GPUs")
+	require.Equal(t, 2, devices.NDev())
+	require.Equal(t, []string{"2", "3"}, ids)
+
+	again, _, err := Devices()
+	require.Nil(t, err)
+	require.True(t, devices == again, "Devices are rediscovered on every call")
+}
+
+// Without GPUs FaaS workers fail cleanly and SelectWorker falls back to the CPU
+func TestZeroDevices(t *testing.T) {
+	defer SetDeviceProvider(DefaultDevices)
+	SetDeviceProvider(FakeDevices(0))
+
+	err := InvokeFaasDirectCtx(context.Background(), &FaasArg{})
+	require.NotNil(t, err, "FaaS worker ran without a GPU")
+	require.Equal(t, sort.ErrNoDevices, errors.Cause(err))
+
+	tmpDir, err := ioutil.TempDir("", "radixSortZeroDevices")
+	require.Nil(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	worker, err := SelectWorker(nil)
+	require.Nil(t, err, "Failed to select a worker")
+	sort.DistribWorkerTest(t, data.NewFileArrayFactory(tmpDir), func(inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		return worker(context.Background(), inBkts, offset, width, baseName, factory)
+	})
+}
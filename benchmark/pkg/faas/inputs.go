@@ -27,6 +27,14 @@ type FaasArg struct {
 	Output  string             `json:"output"`
 }
 
+// Values of FaasArg.ArrType
+const (
+	ArrTypeFile  = "file"
+	ArrTypeS3    = "s3"
+	ArrTypeRedis = "redis"
+	ArrTypeHttp  = "http"
+)
+
 type FaasResp struct {
 	Success bool   `json:"success"`
 	Err     string `json:"err"`
@@ -48,6 +56,52 @@ func FilePartRefToFaas(ref *data.PartRef) (*FaasFilePartRef, error) {
 	return arg, nil
 }
 
+// Convert a data.PartRef from any array type the faas sorter understands.
+// Also returns the FaasArg.ArrType needed to interpret the reference.
+func PartRefToFaas(ref *data.PartRef) (*FaasFilePartRef, string, error) {
+	switch arr := ref.Arr.(type) {
+	case *data.FileDistribArray:
+		faasRef, err := FilePartRefToFaas(ref)
+		return faasRef, ArrTypeFile, err
+
+	case *data.S3DistribArray:
+		// Workers find the bucket and prefix through their environment (see
+		// data.S3ConfigFromEnv), only the name is passed
+		faasRef := &FaasFilePartRef{
+			ArrayName: arr.Name,
+			PartId:    ref.PartIdx,
+			Start:     ref.Start,
+			NByte:     ref.NByte,
+		}
+		return faasRef, ArrTypeS3, nil
+
+	case *data.RedisDistribArray:
+		// As with S3, workers get the server address from their environment
+		// (see data.RedisConfigFromEnv)
+		faasRef := &FaasFilePartRef{
+			ArrayName: arr.Name,
+			PartId:    ref.PartIdx,
+			Start:     ref.Start,
+			NByte:     ref.NByte,
+		}
+		return faasRef, ArrTypeRedis, nil
+
+	case *data.HttpDistribArray:
+		// Workers get the array server address from their environment (see
+		// data.ArrayServerFromEnv)
+		faasRef := &FaasFilePartRef{
+			ArrayName: arr.Name,
+			PartId:    ref.PartIdx,
+			Start:     ref.Start,
+			NByte:     ref.NByte,
+		}
+		return faasRef, ArrTypeHttp, nil
+
+	default:
+		return nil, "", fmt.Errorf("PartRef array has unsupported type \"%T\"", ref.Arr)
+	}
+}
+
 // Load a FaasFilePartRef into a local data.PartRef. localArrDir is the local mount
 // point for file distributed arrays (the directory shared between FaaS and
 // local for storing distributed arrays).
@@ -61,3 +115,36 @@ func LoadFaasFilePartRef(ref *FaasFilePartRef, localArrDir string) (*data.PartRe
 
 	return &data.PartRef{Arr: arr, PartIdx: ref.PartId, Start: ref.Start, NByte: ref.NByte}, nil
 }
+
+// Load a FaasFilePartRef with ArrType "s3" into a local data.PartRef. cfg
+// must point to the same bucket and prefix that the reference came from.
+func LoadFaasS3PartRef(ref *FaasFilePartRef, cfg data.S3Config) (*data.PartRef, error) {
+	arr, err := data.OpenS3DistribArray(cfg, ref.ArrayName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load referenced S3DistribArray")
+	}
+
+	return &data.PartRef{Arr: arr, PartIdx: ref.PartId, Start: ref.Start, NByte: ref.NByte}, nil
+}
+
+// Load a FaasFilePartRef with ArrType "redis" into a local data.PartRef. cfg
+// must point to the same server and prefix that the reference came from.
+func LoadFaasRedisPartRef(ref *FaasFilePartRef, cfg data.RedisConfig) (*data.PartRef, error) {
+	arr, err := data.OpenRedisDistribArray(cfg, ref.ArrayName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load referenced RedisDistribArray")
+	}
+
+	return &data.PartRef{Arr: arr, PartIdx: ref.PartId, Start: ref.Start, NByte: ref.NByte}, nil
+}
+
+// Load a FaasFilePartRef with ArrType "http" into a local data.PartRef.
+// baseUrl must point to the array server that the reference came from.
+func LoadFaasHttpPartRef(ref *FaasFilePartRef, baseUrl string) (*data.PartRef, error) {
+	arr, err := data.OpenHttpDistribArray(baseUrl, ref.ArrayName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load referenced HttpDistribArray")
+	}
+
+	return &data.PartRef{Arr: arr, PartIdx: ref.PartId, Start: ref.Start, NByte: ref.NByte}, nil
+}
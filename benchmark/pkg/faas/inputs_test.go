@@ -3,11 +3,13 @@ package faas
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/datatest"
 	"github.com/stretchr/testify/require"
 )
 
@@ -57,3 +59,91 @@ func TestFaasFilePartRef(t *testing.T) {
 
 	arr.Destroy()
 }
+
+func TestFaasS3PartRef(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+	cfg := fake.Config("radixsort", "faas")
+
+	arr, err := data.CreateS3DistribArray(cfg, "TestFaasS3PartRef", data.CreateShapeUniform((int64)(0), 2))
+	require.Nilf(t, err, "Failed to initialize array: %v", err)
+	defer arr.Destroy()
+
+	localRef := &data.PartRef{Arr: arr, PartIdx: 1, Start: 1, NByte: 2}
+
+	faasRef, arrType, err := PartRefToFaas(localRef)
+	require.Nil(t, err, "Failed to convert local PartRef to FaaS")
+	require.Equal(t, ArrTypeS3, arrType, "Wrong array type")
+	require.Equal(t, "TestFaasS3PartRef", faasRef.ArrayName, "Array name not converted to FaaS")
+
+	newLocalRef, err := LoadFaasS3PartRef(faasRef, cfg)
+	require.Nil(t, err, "Failed to convert FaaS ref to local")
+
+	require.Equal(t, localRef.PartIdx, newLocalRef.PartIdx, "Part ID not converted to Local")
+	require.Equal(t, localRef.Start, newLocalRef.Start, "Start not converted to Local")
+	require.Equal(t, localRef.NByte, newLocalRef.NByte, "NByte not converted to Local")
+
+	newS3Arr, _ := newLocalRef.Arr.(*data.S3DistribArray)
+	require.Equal(t, arr.Name, newS3Arr.Name, "Array name not converted to Local")
+
+	memArr, err := data.CreateMemDistribArray("TestFaasS3PartRef", data.CreateShapeUniform((int64)(0), 1))
+	require.Nil(t, err)
+	defer memArr.Destroy()
+
+	_, _, err = PartRefToFaas(&data.PartRef{Arr: memArr})
+	require.NotNil(t, err, "Converted an unsupported array type")
+}
+
+func TestFaasRedisPartRef(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+	cfg := fake.Config("faas:")
+
+	arr, err := data.CreateRedisDistribArray(cfg, "TestFaasRedisPartRef", data.CreateShapeUniform((int64)(0), 2))
+	require.Nilf(t, err, "Failed to initialize array: %v", err)
+	defer arr.Destroy()
+
+	localRef := &data.PartRef{Arr: arr, PartIdx: 1, Start: 1, NByte: 2}
+
+	faasRef, arrType, err := PartRefToFaas(localRef)
+	require.Nil(t, err, "Failed to convert local PartRef to FaaS")
+	require.Equal(t, ArrTypeRedis, arrType, "Wrong array type")
+	require.Equal(t, "TestFaasRedisPartRef", faasRef.ArrayName, "Array name not converted to FaaS")
+
+	newLocalRef, err := LoadFaasRedisPartRef(faasRef, cfg)
+	require.Nil(t, err, "Failed to convert FaaS ref to local")
+
+	require.Equal(t, localRef.PartIdx, newLocalRef.PartIdx, "Part ID not converted to Local")
+	require.Equal(t, localRef.Start, newLocalRef.Start, "Start not converted to Local")
+	require.Equal(t, localRef.NByte, newLocalRef.NByte, "NByte not converted to Local")
+
+	newRedisArr, _ := newLocalRef.Arr.(*data.RedisDistribArray)
+	require.Equal(t, arr.Name, newRedisArr.Name, "Array name not converted to Local")
+}
+
+func TestFaasHttpPartRef(t *testing.T) {
+	server := httptest.NewServer(data.NewArrayServer(data.MemArrayFactory))
+	defer server.Close()
+
+	arr, err := data.CreateHttpDistribArray(server.URL, "TestFaasHttpPartRef", data.CreateShapeUniform((int64)(4), 2))
+	require.Nilf(t, err, "Failed to initialize array: %v", err)
+	defer arr.Destroy()
+
+	localRef := &data.PartRef{Arr: arr, PartIdx: 1, Start: 1, NByte: 2}
+
+	faasRef, arrType, err := PartRefToFaas(localRef)
+	require.Nil(t, err, "Failed to convert local PartRef to FaaS")
+	require.Equal(t, ArrTypeHttp, arrType, "Wrong array type")
+	require.Equal(t, "TestFaasHttpPartRef", faasRef.ArrayName, "Array name not converted to FaaS")
+
+	newLocalRef, err := LoadFaasHttpPartRef(faasRef, server.URL)
+	require.Nil(t, err, "Failed to convert FaaS ref to local")
+
+	require.Equal(t, localRef.PartIdx, newLocalRef.PartIdx, "Part ID not converted to Local")
+	require.Equal(t, localRef.Start, newLocalRef.Start, "Start not converted to Local")
+	require.Equal(t, localRef.NByte, newLocalRef.NByte, "NByte not converted to Local")
+
+	newHttpArr, _ := newLocalRef.Arr.(*data.HttpDistribArray)
+	require.Equal(t, arr.Name, newHttpArr.Name, "Array name not converted to Local")
+}
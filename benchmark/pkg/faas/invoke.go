@@ -1,69 +1,20 @@
 package faas
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sync/atomic"
 
 	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
 	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/sort"
 	"github.com/pkg/errors"
 	"github.com/serverlessresearch/srk/pkg/srkmgr"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/semaphore"
 )
 
-type gpuReserver struct {
-	devSemaphore *semaphore.Weighted
-	devs         []uint32
-}
-
-func (self *gpuReserver) reserve() (devId int, err error) {
-	self.devSemaphore.Acquire(context.Background(), 1)
-
-	devId = -1
-	for i := 0; i < len(self.devs); i++ {
-		success := atomic.CompareAndSwapUint32(&self.devs[i], (uint32)(0), (uint32)(1))
-		if success {
-			devId = i
-			break
-		}
-	}
-
-	// The semaphore ensures the above loop will succeed. This check should
-	// never fail.
-	if devId == -1 {
-		return devId, fmt.Errorf("Failed to find free device. This shouldn't happen!")
-	}
-
-	return devId, nil
-}
-
-func (self *gpuReserver) release(devId int) {
-	atomic.StoreUint32(&self.devs[devId], 0)
-	self.devSemaphore.Release(1)
-}
-
-var gpuManager gpuReserver
-
-func init() {
-	// Determine the number of GPUs
-	cmd := exec.Command("nvidia-smi", "-L")
-	out, err := cmd.Output()
-	if err != nil {
-		panic(fmt.Sprintf("Error determining GPU count: %v", err))
-	}
-
-	nDev := bytes.Count(out, []byte("\n"))
-
-	gpuManager = gpuReserver{semaphore.NewWeighted((int64)(nDev)), make([]uint32, nDev)}
-}
-
 // Creates a new srk manager (interface to SRK). Be sure to call mgr.Destroy()
 // to clean up (failure to do so may require manual cleanup for open-lambda)
 func GetMgr() *srkmgr.SrkManager {
@@ -116,11 +67,29 @@ func InvokeFaasSort(mgr *srkmgr.SrkManager, arg *FaasArg) error {
 // You muxt set RADIXBENCH_ROOTPATH to the root dir of the gpu-radix-sort repo
 // in your environment for this to work properly (source env.sh).
 func InvokeFaasDirect(arg *FaasArg) error {
-	devId, err := gpuManager.reserve()
+	return InvokeFaasDirectCtx(context.Background(), arg)
+}
+
+// Like InvokeFaasDirect but gives up waiting for a GPU, and kills the worker
+// process, once ctx is done
+func InvokeFaasDirectCtx(ctx context.Context, arg *FaasArg) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "Worker cancelled")
+	}
+
+	devices, ids, err := Devices()
+	if err != nil {
+		return err
+	}
+	if devices.NDev() == 0 {
+		return errors.Wrap(sort.ErrNoDevices, "FaaS workers need a GPU (see SelectWorker for a CPU fallback)")
+	}
+
+	devId, err := devices.Reserve(ctx)
 	if err != nil {
 		return errors.Wrap(err, "Failed to find free GPU")
 	}
-	defer gpuManager.release(devId)
+	defer devices.Release(devId)
 
 	rootPath := os.Getenv("RADIXBENCH_ROOTPATH")
 	if rootPath == "" {
@@ -133,10 +102,10 @@ func InvokeFaasDirect(arg *FaasArg) error {
 	}
 
 	funcPath := filepath.Join(rootPath, "faasTest/f.py")
-	cmd := exec.Command("python3", funcPath)
+	cmd := exec.CommandContext(ctx, "python3", funcPath)
 
 	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("CUDA_VISIBLE_DEVICES=%v", devId))
+		fmt.Sprintf("CUDA_VISIBLE_DEVICES=%v", ids[devId]))
 
 	cmdIn, err := cmd.StdinPipe()
 	if err != nil {
@@ -150,6 +119,9 @@ func InvokeFaasDirect(arg *FaasArg) error {
 
 	out, err := cmd.Output()
 	if err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), "Worker killed")
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return fmt.Errorf("Worker returned error: %s", exitErr.Stderr)
 		}
@@ -172,21 +144,48 @@ func InvokeFaasDirect(arg *FaasArg) error {
 
 // Returns a DistribWorker that uses mgr to sort via FaaS
 func InitFaasWorker(mgr *srkmgr.SrkManager) sort.DistribWorker {
+	worker := InitFaasWorkerCtx(mgr)
 	return func(inBkts []*data.PartRef,
 		offset int, width int, baseName string,
 		factory *data.ArrayFactory) (data.DistribArray, error) {
+		return worker(context.Background(), inBkts, offset, width, baseName, factory)
+	}
+}
+
+// Like InitFaasWorker but the worker process is killed once ctx is done
+func InitFaasWorkerCtx(mgr *srkmgr.SrkManager) sort.DistribWorkerCtx {
+	return func(ctx context.Context, inBkts []*data.PartRef,
+		offset int, width int, baseName string,
+		factory *data.ArrayFactory) (data.DistribArray, error) {
 
 		var err error
+		var arrType string
 
 		faasRefs := make([]*FaasFilePartRef, len(inBkts))
 		for i, bktRef := range inBkts {
-			faasRefs[i], err = FilePartRefToFaas(bktRef)
+			var refType string
+			faasRefs[i], refType, err = PartRefToFaas(bktRef)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Couldn't convert input %v", i)
+			}
+
+			// The protocol has a single ArrType per request
+			if arrType != "" && refType != arrType {
+				return nil, fmt.Errorf("Inputs mix array types %v and %v", arrType, refType)
+			}
+			arrType = refType
+		}
+
+		// The output has the same type as the inputs (and is opened through
+		// factory, which should agree)
+		if arrType == "" {
+			arrType = ArrTypeFile
 		}
 
 		faasArg := &FaasArg{
 			Offset:  offset,
 			Width:   width,
-			ArrType: "file",
+			ArrType: arrType,
 			Input:   faasRefs,
 			Output:  baseName + "_output",
 		}
@@ -197,8 +196,12 @@ func InitFaasWorker(mgr *srkmgr.SrkManager) sort.DistribWorker {
 		// we're calling directly for now. Technically we don't need mgr, but
 		// I'm lazy and don't feel like refactoring code just for a hack. We
 		// can create new code paths if we need. mgr can be nil in this mode.
-		err = InvokeFaasDirect(faasArg)
+		err = InvokeFaasDirectCtx(ctx, faasArg)
 		if err != nil {
+			// The worker may have created its output before failing
+			if partial, openErr := factory.Open(faasArg.Output); openErr == nil {
+				partial.Destroy()
+			}
 			return nil, errors.Wrap(err, "FaaS sort failure")
 		}
 
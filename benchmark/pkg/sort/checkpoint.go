@@ -0,0 +1,163 @@
+package sort
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// Progress of a checkpointed distributed sort. It is stored as JSON in a
+// single-partition array called ${baseName}_manifest in the sort's factory.
+type SortManifest struct {
+	// Last step to complete (-1 before the first step finishes)
+	Step int
+
+	// Radix width and number of workers of every step, these can't change
+	// part way through a sort
+	Width   int
+	NWorker int
+
+	// Number of bytes being sorted
+	Size int
+
+	// Names of the arrays output by Step, in order
+	Outputs []string
+}
+
+func newSortManifest(sz int) *SortManifest {
+	// NWorker is the degree of parallelism
+	return &SortManifest{Step: -1, Width: sortWidth, NWorker: 2, Size: sz}
+}
+
+func manifestName(baseName string) string {
+	return baseName + "_manifest"
+}
+
+// Name of a worker output. Workers name their output ${workerName}_output
+// but wrappers like WithRetries may rename it, arrays that know their name
+// are asked.
+func outputName(arr data.DistribArray, workerName string) string {
+	if named, ok := arr.(data.NamedArray); ok {
+		return named.ArrayName()
+	}
+	return workerName + "_output"
+}
+
+// Replace the manifest of baseName with state. The old manifest is destroyed
+// first so a failure here can lose the checkpoint, but never leaves one that
+// refers to destroyed arrays.
+func writeSortManifest(factory *data.ArrayFactory, baseName string, state *SortManifest) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	name := manifestName(baseName)
+	if old, err := factory.Open(name); err == nil {
+		if err := old.Destroy(); err != nil {
+			return errors.Wrap(err, "Failed to remove old manifest")
+		}
+	}
+
+	arr, err := factory.Create(name, data.CreateShape([]int64{(int64)(len(raw))}))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create manifest")
+	}
+	if _, err := data.WritePartCtx(context.Background(), arr, 0, raw); err != nil {
+		arr.Destroy()
+		return errors.Wrap(err, "Failed to write manifest")
+	}
+	return arr.Close()
+}
+
+// Read the manifest left by a checkpointed sort called baseName
+func ReadSortManifest(factory *data.ArrayFactory, baseName string) (*SortManifest, error) {
+	arr, err := factory.Open(manifestName(baseName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "No manifest for %v", baseName)
+	}
+	defer arr.Close()
+
+	reader, err := arr.GetPartReader(0)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read manifest")
+	}
+
+	state := &SortManifest{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, errors.Wrap(err, "Corrupted manifest")
+	}
+
+	if state.Width <= 0 || 32%state.Width != 0 {
+		return nil, fmt.Errorf("Invalid radix width in manifest: %v", state.Width)
+	}
+	if state.NWorker <= 0 || len(state.Outputs) != state.NWorker {
+		return nil, fmt.Errorf("Manifest lists %v outputs for %v workers", len(state.Outputs), state.NWorker)
+	}
+	if state.Step < 0 || state.Step >= 32/state.Width {
+		return nil, fmt.Errorf("Invalid step in manifest: %v", state.Step)
+	}
+	return state, nil
+}
+
+// Finish a checkpointed sort: the manifest is no longer needed
+func finishCheckpointed(factory *data.ArrayFactory, baseName string, outArrs []data.DistribArray) ([]data.DistribArray, error) {
+	if manifest, err := factory.Open(manifestName(baseName)); err == nil {
+		if err := manifest.Destroy(); err != nil {
+			return outArrs, errors.Wrap(err, "Failed to remove manifest")
+		}
+	}
+	return outArrs, nil
+}
+
+// Like SortDistribFromArrCtx but the sort can be resumed with
+// ResumeSortDistrib if it fails. A manifest is saved after each step and a
+// failure only destroys the outputs of the step that failed, the outputs of
+// the last completed step and the manifest are left for ResumeSortDistrib.
+// arr is consumed once the first step completes, if that step fails it is
+// left alone (there is nothing to resume). Nothing is left behind once the
+// sort succeeds.
+func SortDistribCheckpointed(ctx context.Context, arr data.DistribArray, sz int, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx) ([]data.DistribArray, error) {
+	outArrs, err := sortDistribSteps(ctx, newSortManifest(sz), []data.DistribArray{arr}, baseName, factory, worker, true)
+	if err != nil {
+		return nil, err
+	}
+	return finishCheckpointed(factory, baseName, outArrs)
+}
+
+// Continue a checkpointed sort called baseName from the last step it
+// completed. Resuming a sort whose last step completed just returns its
+// outputs. A failed resume can itself be resumed.
+func ResumeSortDistrib(ctx context.Context, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx) ([]data.DistribArray, error) {
+	state, err := ReadSortManifest(factory, baseName)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([]data.DistribArray, len(state.Outputs))
+	for i, name := range state.Outputs {
+		if inputs[i], err = factory.Open(name); err != nil {
+			for _, arr := range inputs[:i] {
+				arr.Close()
+			}
+			return nil, errors.Wrapf(err, "Failed to open output %v of step %v", name, state.Step)
+		}
+	}
+
+	outArrs, err := sortDistribSteps(ctx, state, inputs, baseName, factory, worker, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resume %v from step %v", baseName, state.Step)
+	}
+	return finishCheckpointed(factory, baseName, outArrs)
+}
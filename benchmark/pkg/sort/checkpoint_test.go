@@ -0,0 +1,77 @@
+package sort
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Create an array called name holding raw in a single partition
+func rawArray(t *testing.T, factory *data.ArrayFactory, name string, raw []byte) data.DistribArray {
+	arr, err := factory.Create(name, data.CreateShape([]int64{(int64)(len(raw))}))
+	require.Nil(t, err, "Failed to create input array")
+	_, err = data.WritePartCtx(context.Background(), arr, 0, raw)
+	require.Nil(t, err, "Failed to write input")
+	require.Nil(t, arr.Close(), "Failed to close input")
+	return arr
+}
+
+func TestSortDistribResume(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribResume"
+	arr := rawArray(t, data.MemArrayFactory, baseName+"_input", origRaw)
+	defer arr.Destroy()
+
+	// Step 2 always fails. Every other worker fails once so that their
+	// outputs are renamed by WithRetries.
+	flaky := newFlakyWorker(1)
+	failing := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, name string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		if strings.Contains(name, "_step2_") {
+			return nil, errors.New("injected failure")
+		}
+		return flaky.run(ctx, inBkts, offset, width, name, factory)
+	}
+	worker := WithRetries(failing, RetryPolicy{MaxRetries: 1, Backoff: time.Millisecond})
+
+	_, err = SortDistribCheckpointed(context.Background(), arr, len(origRaw), baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a failing step succeeded")
+
+	state, err := ReadSortManifest(data.MemArrayFactory, baseName)
+	require.Nil(t, err, "Failed to read manifest")
+	require.Equal(t, 1, state.Step, "Manifest has the wrong step")
+	require.Equal(t, sortWidth, state.Width)
+	require.Equal(t, len(origRaw), state.Size)
+	for _, name := range state.Outputs {
+		require.Contains(t, name, "_step1_", "Manifest lists the wrong outputs")
+		exists, err := data.MemArrayFactory.Exists(name)
+		require.Nil(t, err)
+		require.Truef(t, exists, "Checkpointed output %v was destroyed", name)
+	}
+
+	outArrs, err := ResumeSortDistrib(context.Background(), baseName, data.MemArrayFactory, LocalDistribWorkerCtx)
+	require.Nil(t, err, "Failed to resume sort")
+
+	reader, err := NewBucketReader(outArrs, STRIDED)
+	require.Nil(t, err, "Failed to get reader for output")
+	outRaw := make([]byte, len(origRaw))
+	_, err = bucketRead(reader, outRaw)
+	require.Nil(t, err, "Failed to read output")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Resumed sort did not sort correctly")
+
+	destroyArrs(outArrs)
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+func TestResumeSortDistribMissing(t *testing.T) {
+	_, err := ResumeSortDistrib(context.Background(), "testResumeSortDistribMissing", data.MemArrayFactory, LocalDistribWorkerCtx)
+	require.NotNil(t, err, "Resumed a sort with no manifest")
+}
@@ -0,0 +1,64 @@
+package sort
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Pure Go equivalents of the libsort sorts. They are much slower than the GPU
+// but work anywhere, they back the libsort API in builds with the nolibsort
+// tag (see libsort_cpu.go).
+
+// Sort in (interpreted as uint32s) on the CPU
+func CpuFull(in []byte) error {
+	if len(in)%4 != 0 {
+		return fmt.Errorf("Input length %v is not a multiple of 4", len(in))
+	}
+
+	// LSD radix sort, one byte at a time
+	boundaries := make([]int64, 256)
+	for offset := 0; offset < 32; offset += 8 {
+		if err := CpuPartial(in, boundaries, offset, 8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Same as GpuPartial but on the CPU: stable sort of in by the radix of width
+// bits starting at bit offset. boundaries (1 << width entries) receives the
+// byte offset of each radix group.
+func CpuPartial(in []byte, boundaries []int64, offset int, width int) error {
+	if len(in)%4 != 0 {
+		return fmt.Errorf("Input length %v is not a multiple of 4", len(in))
+	}
+	if len(boundaries) != 1<<width {
+		return fmt.Errorf("Need %v boundaries for a width of %v, got %v", 1<<width, width, len(boundaries))
+	}
+
+	for i := range boundaries {
+		boundaries[i] = 0
+	}
+	for i := 0; i < len(in); i += 4 {
+		boundaries[GroupBits(binary.LittleEndian.Uint32(in[i:]), offset, width)] += 4
+	}
+
+	// Counts to starting offsets
+	start := (int64)(0)
+	for i, count := range boundaries {
+		boundaries[i] = start
+		start += count
+	}
+
+	next := make([]int64, len(boundaries))
+	copy(next, boundaries)
+	out := make([]byte, len(in))
+	for i := 0; i < len(in); i += 4 {
+		group := GroupBits(binary.LittleEndian.Uint32(in[i:]), offset, width)
+		copy(out[next[group]:next[group]+4], in[i:i+4])
+		next[group] += 4
+	}
+	copy(in, out)
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package sort
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCpuFull(t *testing.T) {
+	test, err := GenerateInputs(4099)
+	require.Nil(t, err, "Failed to generate inputs")
+
+	ref := make([]byte, len(test))
+	copy(ref, test)
+
+	require.Nil(t, CpuFull(test), "Error while sorting")
+	require.Nil(t, CheckSort(ref, test), "Sorted wrong")
+}
+
+func TestCpuPartial(t *testing.T) {
+	test, err := GenerateInputs(4099)
+	require.Nil(t, err, "Failed to generate inputs")
+
+	ref := make([]byte, len(test))
+	copy(ref, test)
+
+	boundaries := make([]int64, 1<<4)
+	require.Nil(t, CpuPartial(test, boundaries, 0, 4), "Error while sorting")
+	checkPartial(t, test, boundaries, ref)
+
+	// Whichever backend the build uses must agree on the boundaries
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+	libTest := make([]byte, len(ref))
+	copy(libTest, ref)
+	libBoundaries := make([]int64, 1<<4)
+	require.Nil(t, GpuPartial(libTest, libBoundaries, 0, 4), "Error while sorting")
+	require.Equal(t, boundaries, libBoundaries, "CPU and libsort boundaries differ")
+
+	require.NotNil(t, CpuPartial(test[:5], boundaries, 4, 4), "Sorted a partial element")
+	require.NotNil(t, CpuPartial(test, boundaries[:3], 4, 4), "Sorted with the wrong number of boundaries")
+}
@@ -0,0 +1,62 @@
+package sort
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// Returned when reserving from a DeviceReserver with no devices
+var ErrNoDevices = errors.New("No devices available")
+
+// Hands out exclusive use of nDev devices (e.g. GPUs). Used by the FaaS
+// invoker to give each worker process its own GPU and by MultiDeviceWorker to
+// spread one partial sort across the GPUs of the local machine.
+type DeviceReserver struct {
+	devSemaphore *semaphore.Weighted
+	devs         []uint32
+}
+
+func NewDeviceReserver(nDev int) *DeviceReserver {
+	return &DeviceReserver{semaphore.NewWeighted((int64)(nDev)), make([]uint32, nDev)}
+}
+
+func (self *DeviceReserver) NDev() int {
+	return len(self.devs)
+}
+
+// Wait for a free device and reserve it, returns its index
+func (self *DeviceReserver) Reserve(ctx context.Context) (devId int, err error) {
+	if len(self.devs) == 0 {
+		return -1, ErrNoDevices
+	}
+
+	if err := self.devSemaphore.Acquire(ctx, 1); err != nil {
+		return -1, err
+	}
+
+	devId = -1
+	for i := 0; i < len(self.devs); i++ {
+		success := atomic.CompareAndSwapUint32(&self.devs[i], (uint32)(0), (uint32)(1))
+		if success {
+			devId = i
+			break
+		}
+	}
+
+	// The semaphore ensures the above loop will succeed. This check should
+	// never fail.
+	if devId == -1 {
+		return devId, fmt.Errorf("Failed to find free device. This shouldn't happen!")
+	}
+
+	return devId, nil
+}
+
+func (self *DeviceReserver) Release(devId int) {
+	atomic.StoreUint32(&self.devs[devId], 0)
+	self.devSemaphore.Release(1)
+}
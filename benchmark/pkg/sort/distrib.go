@@ -1,10 +1,13 @@
 package sort
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"runtime"
+	"runtime/debug"
+	"strings"
 	"sync"
 
 	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
@@ -22,7 +25,51 @@ func SetWidth(newWidth int) {
 // per unique radix value. Array names will be prefixed with baseName.
 type DistribWorker func(inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error)
 
+// A DistribWorker that can be cancelled. Once ctx is done the worker should
+// stop as soon as it can, destroy any output it created, and return an error.
+type DistribWorkerCtx func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error)
+
+// Adapt a worker without cancellation support. Sorts using it still stop
+// launching workers once cancelled, but wait for running workers to finish.
+func WorkerWithCtx(worker DistribWorker) DistribWorkerCtx {
+	return func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		return worker(inBkts, offset, width, baseName, factory)
+	}
+}
+
+// Input buffers of LocalDistribWorker, they're only needed until the outputs
+// are written
+var localInputBufs data.BufferPool
+
+// Read the input of a local worker into a buffer from localInputBufs. A single
+// reference to an array that exposes its storage (e.g. an mmapped file) is
+// read with PartRef.Bytes(), saving the read calls and goroutines of
+// FetchPartRefsCtx. The sorts work in place and the storage is read-only so it
+// still gets copied once.
+func fetchWorkerInput(ctx context.Context, inBkts []*data.PartRef) ([]byte, error) {
+	if len(inBkts) == 1 {
+		if _, ok := inBkts[0].Arr.(data.PartByteSlicer); ok {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			stored, err := inBkts[0].Bytes()
+			if err != nil {
+				return nil, err
+			}
+			inBytes := localInputBufs.Get(len(stored))
+			copy(inBytes, stored)
+			return inBytes, nil
+		}
+	}
+	return data.FetchPartRefsCtx(ctx, inBkts, data.FetchOptions{Pool: &localInputBufs})
+}
+
 func LocalDistribWorker(inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+	return LocalDistribWorkerCtx(context.Background(), inBkts, offset, width, baseName, factory)
+}
+
+func LocalDistribWorkerCtx(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
 	var err error
 
 	totalLen := 0
@@ -30,10 +77,11 @@ func LocalDistribWorker(inBkts []*data.PartRef, offset int, width int, baseName
 		totalLen += inBkts[i].NByte
 	}
 
-	inBytes, err := data.FetchPartRefs(inBkts)
+	inBytes, err := fetchWorkerInput(ctx, inBkts)
 	if err != nil {
 		return nil, errors.Wrap(err, "Couldn't read input references")
 	}
+	defer localInputBufs.Put(inBytes)
 
 	// Actual Sort
 	nBucket := 1 << width
@@ -53,6 +101,10 @@ func LocalDistribWorker(inBkts []*data.PartRef, offset int, width int, baseName
 
 	shape := data.CreateShape(partSzs)
 
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "Worker cancelled")
+	}
+
 	// Write Outputs
 	outArr, err := factory.Create(baseName+"_output", shape)
 	if err != nil {
@@ -63,24 +115,103 @@ func LocalDistribWorker(inBkts []*data.PartRef, offset int, width int, baseName
 		start := (int)(boundaries[i])
 		end := start + (int)(partSzs[i])
 
-		writer, err := outArr.GetPartWriter(i)
-		if err != nil {
+		if _, err := data.WritePartCtx(ctx, outArr, i, inBytes[start:end]); err != nil {
+			outArr.Destroy()
 			return nil, errors.Wrapf(err, "Failed to write bucket %v", i)
 		}
+		finishPart(outArr, i)
+	}
+
+	return outArr, nil
+}
+
+// Destroy every array in arrs that exists. This is only used to clean up
+// after failures so errors are ignored.
+func destroyArrs(arrs []data.DistribArray) {
+	for _, arr := range arrs {
+		if arr != nil {
+			arr.Destroy()
+		}
+	}
+}
+
+// A worker panicked, Stack is the worker goroutine's stack at the time
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("Worker panic: %v\n%s", self.Value, self.Stack)
+}
+
+// Run worker, converting a panic into a *PanicError
+func callWorker(worker DistribWorkerCtx, ctx context.Context, inBkts []*data.PartRef, offset int, width int,
+	baseName string, factory *data.ArrayFactory) (arr data.DistribArray, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			arr = nil
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return worker(ctx, inBkts, offset, width, baseName, factory)
+}
+
+// The failure of a single worker in a distributed sort
+type WorkerFailure struct {
+	Step   int
+	Worker int
+	Err    error
+}
+
+func (self *WorkerFailure) Error() string {
+	return fmt.Sprintf("Worker failure on step %v, worker %v: %v", self.Step, self.Worker, self.Err)
+}
+
+func (self *WorkerFailure) Cause() error {
+	return self.Err
+}
 
-		n, err := writer.Write(inBytes[start:end])
-		if err != nil && err != io.EOF {
-			writer.Close()
-			return nil, errors.Wrap(err, "Could not write to output")
+// Returned by SortDistribFromArrCtx (and friends) when workers fail. Every
+// failed worker of the step is listed, workers that were only cancelled
+// because another one failed come last. errors.Cause() returns the cause of
+// the first failure.
+type StepError struct {
+	Step     int
+	Failures []*WorkerFailure
+}
+
+func (self *StepError) Error() string {
+	msgs := make([]string, len(self.Failures))
+	for i, failure := range self.Failures {
+		msgs[i] = failure.Error()
+	}
+	return fmt.Sprintf("%v worker(s) failed on step %v: %v", len(self.Failures), self.Step, strings.Join(msgs, "; "))
+}
+
+func (self *StepError) Cause() error {
+	return self.Failures[0]
+}
+
+// Collect the failures of a step (indexed by worker, nil for workers that
+// succeeded) into a StepError. Returns nil if nothing failed.
+func newStepError(step int, failures []*WorkerFailure) *StepError {
+	var primary, cancelled []*WorkerFailure
+	for _, failure := range failures {
+		if failure == nil {
+			continue
 		}
-		if n != end-start {
-			writer.Close()
-			return nil, fmt.Errorf("Could not write enough bytes to output: wanted %v, got %v", partSzs[i], n)
+		if errors.Cause(failure.Err) == context.Canceled {
+			cancelled = append(cancelled, failure)
+		} else {
+			primary = append(primary, failure)
 		}
-		writer.Close()
 	}
 
-	return outArr, nil
+	if len(primary)+len(cancelled) == 0 {
+		return nil
+	}
+	return &StepError{Step: step, Failures: append(primary, cancelled...)}
 }
 
 // Distributed sort of arr. The bytes in arr will be interpreted as uint32's
@@ -89,6 +220,25 @@ func LocalDistribWorker(inBkts []*data.PartRef, offset int, width int, baseName
 // the number of bytes in arr.
 func SortDistribFromArr(arr data.DistribArray, sz int, baseName string,
 	factory *data.ArrayFactory, worker DistribWorker) ([]data.DistribArray, error) {
+	return SortDistribFromArrCtx(context.Background(), arr, sz, baseName, factory, WorkerWithCtx(worker))
+}
+
+// Like SortDistribFromArr but stops once ctx is done. The first worker to fail
+// cancels the rest of its step, worker failures (including panics) are
+// returned as a *StepError. The sort consumes arr: it is destroyed along with
+// every intermediate array whether the sort succeeds or fails.
+func SortDistribFromArrCtx(ctx context.Context, arr data.DistribArray, sz int, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx) ([]data.DistribArray, error) {
+	state := newSortManifest(sz)
+	return sortDistribSteps(ctx, state, []data.DistribArray{arr}, baseName, factory, worker, false)
+}
+
+// Run the steps of a distributed sort after state.Step. inputs are the
+// outputs of state.Step (or the array to sort if no step has run yet). If
+// checkpoint is set the state is saved with writeSortManifest after each step
+// and a failure leaves the last completed step's outputs in place.
+func sortDistribSteps(ctx context.Context, state *SortManifest, inputs []data.DistribArray, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx, checkpoint bool) ([]data.DistribArray, error) {
 	// Data Layout:
 	//	 - Distrib Arrays store all output from a single node
 	//	 - DistribParts represent radix sort buckets (there will be nbucket parts per DistribArray)
@@ -104,22 +254,31 @@ func SortDistribFromArr(arr data.DistribArray, sz int, baseName string,
 	//	   always exist.
 	//	 - Input distribArrays may be garbage collected after every worker has
 	//     provided their output (output distribArrays are copies, not references).
-	nworker := 2 //number of workers (degree of parallelism)
-	// nworker := 1 //number of workers (degree of parallelism)
-	nstep := (32 / sortWidth) // number of steps needed to fully sort
+	nworker := state.NWorker
+	nstep := (32 / state.Width) // number of steps needed to fully sort
 
 	// Target number of bytes to process per worker, the last worker might get less
-	nElem := sz / 4
+	nElem := state.Size / 4
 	maxPerWorker := (int)(math.Ceil((float64)(nElem)/(float64)(nworker))) * 4
 
-	// Initial input is the output for "step -1"
-	var outputs []data.DistribArray
-	outputs = []data.DistribArray{arr}
-
-	for step := 0; step < nstep; step++ {
+	outputs := inputs
+	for step := state.Step + 1; step < nstep; step++ {
 		inputs := outputs
 		outputs = make([]data.DistribArray, nworker)
 
+		// Checkpointed inputs are needed to resume, others (including the
+		// array to sort) are ours to clean up
+		cleanupInputs := func() {
+			if !checkpoint {
+				destroyArrs(inputs)
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			cleanupInputs()
+			return nil, errors.Wrapf(err, "Sort cancelled before step %v", step)
+		}
+
 		// This is perhaps over-optimization but it shaves ~6GB off the
 		// resident memory size for MemDistribArrays in the big test (13 vs
 		// 19). It likely would have little effect on other sorts of
@@ -129,39 +288,77 @@ func SortDistribFromArr(arr data.DistribArray, sz int, baseName string,
 
 		inGen, err := NewBucketReader(inputs, STRIDED)
 		if err != nil {
+			cleanupInputs()
 			return nil, err
 		}
 
-		var wg sync.WaitGroup
-		wg.Add(nworker)
-		errChan := make(chan error, nworker)
+		// Repartition previous output. Every worker's inputs are found before
+		// any are launched so that a bad input doesn't strand running workers.
+		workerInputs := make([][]*data.PartRef, nworker)
 		for workerId := 0; workerId < nworker; workerId++ {
-			// Repartition previous output
-			workerInputs, genErr := inGen.ReadRef(maxPerWorker)
+			var genErr error
+			workerInputs[workerId], genErr = inGen.ReadRef(maxPerWorker)
 			if genErr == io.EOF && workerId+1 != nworker {
+				cleanupInputs()
 				return nil, errors.New("Premature EOF from input generator")
 			} else if genErr != nil && genErr != io.EOF {
-				return nil, errors.Wrap(err, "Input generator had an error")
+				cleanupInputs()
+				return nil, errors.Wrap(genErr, "Input generator had an error")
 			}
+		}
+
+		// Cancelled by the first failure in this step
+		stepCtx, cancel := context.WithCancel(ctx)
 
+		var wg sync.WaitGroup
+		wg.Add(nworker)
+		failures := make([]*WorkerFailure, nworker)
+		for workerId := 0; workerId < nworker; workerId++ {
 			go func(id int, inputs []*data.PartRef) {
 				defer wg.Done()
 
 				workerName := fmt.Sprintf("%v_step%v_worker%v", baseName, step, id)
 
-				outputs[id], err = worker(inputs, step*sortWidth, sortWidth, workerName, factory)
+				var workerErr error
+				outputs[id], workerErr = callWorker(worker, stepCtx, inputs, step*state.Width, state.Width, workerName, factory)
 
-				if err != nil {
-					errChan <- errors.Wrapf(err, "Worker failure on step %v, worker %v", step, id)
+				if workerErr != nil {
+					// Workers should clean up after themselves but may not
+					// have had the chance
+					destroyPartialOutput(factory, workerName)
+					failures[id] = &WorkerFailure{Step: step, Worker: id, Err: workerErr}
+					cancel()
 					return
 				}
-			}(workerId, workerInputs)
+			}(workerId, workerInputs[workerId])
 		}
 		wg.Wait()
-		select {
-		case firstErr := <-errChan:
-			return nil, errors.Wrapf(firstErr, "Worker failure")
-		default:
+		cancel()
+		if stepErr := newStepError(step, failures); stepErr != nil {
+			destroyArrs(outputs)
+			cleanupInputs()
+			return nil, stepErr
+		}
+
+		// The inputs are only destroyed once the new outputs are committed
+		// and recorded (arrays remain readable after Close)
+		if checkpoint {
+			state.Step = step
+			state.Outputs = make([]string, nworker)
+			var ckptErr error
+			for id, out := range outputs {
+				if ckptErr == nil {
+					ckptErr = out.Close()
+				}
+				state.Outputs[id] = outputName(out, fmt.Sprintf("%v_step%v_worker%v", baseName, step, id))
+			}
+			if ckptErr == nil {
+				ckptErr = writeSortManifest(factory, baseName, state)
+			}
+			if ckptErr != nil {
+				destroyArrs(outputs)
+				return nil, errors.Wrapf(ckptErr, "Failed to checkpoint step %v", step)
+			}
 		}
 
 		var destroyErr error
@@ -171,7 +368,7 @@ func SortDistribFromArr(arr data.DistribArray, sz int, baseName string,
 			}
 		}
 		if destroyErr != nil {
-			return nil, errors.Wrapf(err, "Failed to destroy one or more intermediate arrays")
+			return nil, errors.Wrapf(destroyErr, "Failed to destroy one or more intermediate arrays")
 		}
 	}
 
@@ -182,6 +379,13 @@ func SortDistribFromArr(arr data.DistribArray, sz int, baseName string,
 // invoker 'worker'.
 func SortDistribFromRaw(inRaw []byte, baseName string,
 	factory *data.ArrayFactory, worker DistribWorker) ([]byte, error) {
+	return SortDistribFromRawCtx(context.Background(), inRaw, baseName, factory, WorkerWithCtx(worker))
+}
+
+// Like SortDistribFromRaw but stops once ctx is done. The input array is
+// consumed by SortDistribFromArrCtx.
+func SortDistribFromRawCtx(ctx context.Context, inRaw []byte, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx) ([]byte, error) {
 	var err error
 
 	err = InitLibSort()
@@ -209,7 +413,7 @@ func SortDistribFromRaw(inRaw []byte, baseName string,
 	writer.Close()
 
 	origArr.Close()
-	outArrs, err := SortDistribFromArr(origArr, len(inRaw), baseName, factory, worker)
+	outArrs, err := SortDistribFromArrCtx(ctx, origArr, len(inRaw), baseName, factory, worker)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to sort distribArrays")
 	}
@@ -236,12 +440,8 @@ func SortDistribFromRaw(inRaw []byte, baseName string,
 		}
 	}
 
-	if err = origArr.Destroy(); err != nil {
-		destroyErr = err
-	}
-
 	if destroyErr != nil {
-		return outRaw, errors.Wrapf(err, "Failed to clean up one or more arrays")
+		return outRaw, errors.Wrapf(destroyErr, "Failed to clean up one or more arrays")
 	}
 
 	return outRaw, nil
@@ -1,12 +1,20 @@
 package sort
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data/datatest"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -159,3 +167,230 @@ func TestSortFileDistrib(t *testing.T) {
 
 	SortDistribTest(t, "testSortFileDistrib", data.NewFileArrayFactory(tmpDir), LocalDistribWorker)
 }
+
+func TestSortFileDistribCompressed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortLocalTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	SortDistribTest(t, "testSortFileDistribCompressed", data.NewFileArrayFactory(tmpDir, data.WithCodec(data.DELTA)), LocalDistribWorker)
+}
+
+func TestSortS3Distrib(t *testing.T) {
+	fake := datatest.StartFakeS3()
+	defer fake.Close()
+
+	SortDistribTest(t, "testSortS3Distrib", data.NewS3ArrayFactory(fake.Config("radixsort", "sort")), LocalDistribWorker)
+}
+
+func TestSortRedisDistrib(t *testing.T) {
+	fake, err := datatest.StartFakeRedis()
+	require.Nil(t, err, "Failed to start fake redis")
+	defer fake.Close()
+
+	SortDistribTest(t, "testSortRedisDistrib", data.NewRedisArrayFactory(fake.Config("sort:")), LocalDistribWorker)
+}
+
+func TestSortHttpDistrib(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortHttpDistrib")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(data.NewArrayServer(data.NewFileArrayFactory(tmpDir)))
+	defer server.Close()
+
+	SortDistribTest(t, "testSortHttpDistrib", data.NewHttpArrayFactory(server.URL), LocalDistribWorker)
+}
+
+func TestSortTieredDistrib(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortTieredDistrib")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	// Roughly one intermediate array's worth of memory, the rest spills
+	store := data.NewTieredStore(2048, tmpDir)
+	SortDistribTest(t, "testSortTieredDistrib", data.NewTieredArrayFactory(store), LocalDistribWorker)
+
+	stats := store.Stats()
+	require.NotZero(t, stats.SpilledBytes, "Nothing was spilled")
+	require.LessOrEqual(t, stats.PeakMemBytes, (int64)(2048), "Memory budget exceeded")
+	require.Zero(t, stats.MemBytes+stats.DiskBytes, "Arrays were not cleaned up")
+}
+
+// Sort a file end-to-end: import, sort, export in sorted order
+func TestSortImportExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortImportExport")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	inPath := filepath.Join(tmpDir, "input.bin")
+	require.Nil(t, ioutil.WriteFile(inPath, origRaw, 0600))
+
+	arr, err := data.ImportFile(data.MemArrayFactory, "testSortImportExport_input", inPath,
+		data.ImportOptions{Format: data.BINARY, NPart: 3})
+	require.Nil(t, err, "Failed to import input")
+
+	outArrs, err := SortDistribFromArr(arr, len(origRaw), "testSortImportExport", data.MemArrayFactory, LocalDistribWorker)
+	require.Nil(t, err, "Sort Error")
+
+	outPath := filepath.Join(tmpDir, "output.parquet")
+	nElem, err := data.ExportArrays(outArrs, outPath, data.ExportOptions{Format: data.PARQUET})
+	require.Nil(t, err, "Failed to export output")
+	require.Equal(t, (int64)(1111), nElem)
+	for _, outArr := range outArrs {
+		require.Nil(t, outArr.Destroy())
+	}
+
+	sorted, err := data.ImportFile(data.MemArrayFactory, "testSortImportExport_output", outPath,
+		data.ImportOptions{Format: data.PARQUET})
+	require.Nil(t, err, "Failed to re-import output")
+	defer sorted.Destroy()
+
+	reader, err := sorted.GetPartReader(0)
+	require.Nil(t, err)
+	outRaw, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+
+	err = CheckSort(origRaw, outRaw)
+	require.Nilf(t, err, "Did not sort correctly: %v", err)
+}
+
+// Names of the arrays in factory starting with prefix
+func listPrefix(t *testing.T, factory *data.ArrayFactory, prefix string) []string {
+	names, err := factory.List()
+	require.Nil(t, err, "Failed to list arrays")
+
+	var matched []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+// A failed worker should cancel the rest of its step and leave no
+// intermediate arrays behind
+func TestSortDistribCancel(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribCancel"
+	failure := errors.New("injected failure")
+	worker := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, workerName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		switch workerName {
+		case baseName + "_step1_worker0":
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("worker was not cancelled")
+			}
+		case baseName + "_step1_worker1":
+			return nil, failure
+		}
+		return LocalDistribWorkerCtx(ctx, inBkts, offset, width, workerName, factory)
+	}
+
+	_, err = SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a failed worker succeeded")
+	require.Contains(t, err.Error(), "injected failure")
+	require.NotContains(t, err.Error(), "worker was not cancelled")
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+func TestSortDistribDeadline(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	// Workers never finish on their own
+	worker := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, workerName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	baseName := "testSortDistribDeadline"
+	_, err = SortDistribFromRawCtx(ctx, origRaw, baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort past its deadline succeeded")
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+func TestLocalDistribWorkerCancel(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1024)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testLocalDistribWorkerCancel"
+	arr, err := data.MemArrayFactory.Create(baseName+"_input", data.CreateShape([]int64{(int64)(len(origRaw))}))
+	require.Nil(t, err, "Failed to create input array")
+	defer arr.Destroy()
+	_, err = data.WritePartCtx(context.Background(), arr, 0, origRaw)
+	require.Nil(t, err, "Failed to write input")
+	require.Nil(t, arr.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	refs := []*data.PartRef{&data.PartRef{Arr: arr, PartIdx: 0, Start: 0, NByte: len(origRaw)}}
+	_, err = LocalDistribWorkerCtx(ctx, refs, 0, 4, baseName, data.MemArrayFactory)
+	require.NotNil(t, err, "Cancelled worker succeeded")
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	exists, err := data.MemArrayFactory.Exists(baseName + "_output")
+	require.Nil(t, err)
+	require.False(t, exists, "Cancelled worker left its output behind")
+}
+
+// Independent sorts share package state (buffer pools, memory arrays), run
+// with -race to check it
+func TestSortDistribConcurrent(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	nSort := 4
+	var wg sync.WaitGroup
+	wg.Add(nSort)
+	errChan := make(chan error, nSort)
+	for i := 0; i < nSort; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			origRaw, err := GenerateInputs(1111)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			outRaw, err := SortDistribFromRaw(origRaw, fmt.Sprintf("testSortDistribConcurrent%v", i), data.MemArrayFactory, LocalDistribWorker)
+			if err == nil {
+				err = CheckSort(origRaw, outRaw)
+			}
+			if err != nil {
+				errChan <- errors.Wrapf(err, "Sort %v failed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errChan:
+		t.Fatal(err)
+	default:
+	}
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, "testSortDistribConcurrent"), "Sorts left arrays behind")
+}
@@ -0,0 +1,257 @@
+package sort
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// The most elements libsort can sort on one device (nmax_per_dev)
+const MaxDeviceElems = 256 * 1024 * 1024
+
+type ExternalOptions struct {
+	// Number of elements per sorted run (default MaxDeviceElems). One run is
+	// held in memory at a time.
+	RunLen int
+
+	// Sorts one run in place (default GpuFull)
+	Sorter func([]byte) error
+
+	// Directory for the runs (default a new temporary directory). The runs
+	// need as much space as the input.
+	TmpDir string
+
+	// Bytes buffered per run while merging (default 64KB)
+	MergeBuffer int
+}
+
+func (self *ExternalOptions) withDefaults() (ExternalOptions, error) {
+	opts := *self
+	if opts.RunLen == 0 {
+		opts.RunLen = MaxDeviceElems
+	}
+	if opts.Sorter == nil {
+		opts.Sorter = GpuFull
+	}
+	if opts.MergeBuffer == 0 {
+		opts.MergeBuffer = 64 * 1024
+	}
+
+	if opts.RunLen < 0 || opts.RunLen > MaxDeviceElems {
+		return opts, fmt.Errorf("Invalid run length: %v (must be at most %v)", opts.RunLen, MaxDeviceElems)
+	}
+	if opts.MergeBuffer < 4 {
+		return opts, fmt.Errorf("Invalid merge buffer size: %v", opts.MergeBuffer)
+	}
+	return opts, nil
+}
+
+// Sort the uint32s in the file at inPath, which may be larger than device (or
+// host) memory, into a new file at outPath. The input is cut into runs of
+// opts.RunLen elements that are sorted one at a time with opts.Sorter and
+// stored as the partitions of a FileDistribArray, then the runs are merged
+// into outPath. outPath is removed if the sort fails.
+func SortFileExternal(ctx context.Context, inPath string, outPath string, opts ExternalOptions) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	if opts.TmpDir == "" {
+		if opts.TmpDir, err = ioutil.TempDir("", "radixSortExternal"); err != nil {
+			return errors.Wrap(err, "Failed to create temporary directory")
+		}
+		defer os.RemoveAll(opts.TmpDir)
+	}
+
+	if err := InitLibSort(); err != nil {
+		return errors.Wrap(err, "Failed to initialize libsort")
+	}
+
+	in, err := os.Open(inPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open input")
+	}
+	defer in.Close()
+
+	runs, err := sortRuns(ctx, in, filepath.Join(opts.TmpDir, filepath.Base(outPath)+"_runs"), opts)
+	if err != nil {
+		return err
+	}
+	defer runs.Destroy()
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create output")
+	}
+
+	err = mergeRuns(ctx, runs, out, opts.MergeBuffer)
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "Failed to close output")
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+// Read in one run at a time, sort it and write it to its own partition of a
+// new FileDistribArray at runPath
+func sortRuns(ctx context.Context, in *os.File, runPath string, opts ExternalOptions) (data.DistribArray, error) {
+	info, err := in.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to stat input")
+	}
+	sz := info.Size()
+	if sz%4 != 0 {
+		return nil, fmt.Errorf("Input length %v is not a multiple of 4", sz)
+	}
+
+	runSz := (int64)(opts.RunLen) * 4
+	nRun := (int)((sz + runSz - 1) / runSz)
+	caps := make([]int64, nRun)
+	for i := range caps {
+		caps[i] = runSz
+	}
+	if nRun != 0 && sz%runSz != 0 {
+		caps[nRun-1] = sz % runSz
+	}
+
+	runs, err := data.CreateFileDistribArray(runPath, data.CreateShape(caps))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create run array")
+	}
+
+	var buf []byte
+	if nRun != 0 {
+		buf = make([]byte, caps[0])
+	}
+	for i := 0; i < nRun; i++ {
+		if err := ctx.Err(); err != nil {
+			runs.Destroy()
+			return nil, errors.Wrapf(err, "Cancelled before run %v", i)
+		}
+
+		run := buf[:caps[i]]
+		if _, err := io.ReadFull(in, run); err != nil {
+			runs.Destroy()
+			return nil, errors.Wrapf(err, "Failed to read run %v", i)
+		}
+		if err := opts.Sorter(run); err != nil {
+			runs.Destroy()
+			return nil, errors.Wrapf(err, "Failed to sort run %v", i)
+		}
+		if _, err := data.WritePartCtx(ctx, runs, i, run); err != nil {
+			runs.Destroy()
+			return nil, errors.Wrapf(err, "Failed to write run %v", i)
+		}
+	}
+
+	if err := runs.Close(); err != nil {
+		runs.Destroy()
+		return nil, errors.Wrap(err, "Failed to commit runs")
+	}
+	return runs, nil
+}
+
+// The next element of one sorted run
+type mergeRun struct {
+	reader io.ReadCloser
+	buf    *bufio.Reader
+	head   uint32
+}
+
+// Load the run's next element, returns io.EOF once it is exhausted
+func (self *mergeRun) next() error {
+	var raw [4]byte
+	if _, err := io.ReadFull(self.buf, raw[:]); err != nil {
+		return err
+	}
+	self.head = binary.LittleEndian.Uint32(raw[:])
+	return nil
+}
+
+// Min-heap of runs by their next element
+type runHeap []*mergeRun
+
+func (self runHeap) Len() int            { return len(self) }
+func (self runHeap) Less(i, j int) bool  { return self[i].head < self[j].head }
+func (self runHeap) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self *runHeap) Push(x interface{}) { *self = append(*self, x.(*mergeRun)) }
+func (self *runHeap) Pop() interface{} {
+	old := *self
+	run := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return run
+}
+
+// How often (in elements) mergeRuns checks for cancellation
+const mergeCheckInterval = 64 * 1024
+
+// k-way merge of every partition of runs (each sorted) into out
+func mergeRuns(ctx context.Context, runs data.DistribArray, out io.Writer, bufSz int) error {
+	shape, err := runs.GetShape()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get shape of runs")
+	}
+
+	pending := make(runHeap, 0, shape.NPart())
+	defer func() {
+		for _, run := range pending {
+			run.reader.Close()
+		}
+	}()
+
+	for i := 0; i < shape.NPart(); i++ {
+		reader, err := runs.GetPartReader(i)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read run %v", i)
+		}
+		run := &mergeRun{reader: reader, buf: bufio.NewReaderSize(reader, bufSz)}
+		if err := run.next(); err == io.EOF {
+			reader.Close()
+			continue
+		} else if err != nil {
+			reader.Close()
+			return errors.Wrapf(err, "Failed to read run %v", i)
+		}
+		pending = append(pending, run)
+	}
+	heap.Init(&pending)
+
+	writer := bufio.NewWriterSize(out, bufSz)
+	var raw [4]byte
+	for nMerged := 0; len(pending) > 0; nMerged++ {
+		if nMerged%mergeCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return errors.Wrap(err, "Merge cancelled")
+			}
+		}
+
+		run := pending[0]
+		binary.LittleEndian.PutUint32(raw[:], run.head)
+		if _, err := writer.Write(raw[:]); err != nil {
+			return errors.Wrap(err, "Failed to write output")
+		}
+
+		if err := run.next(); err == io.EOF {
+			run.reader.Close()
+			heap.Pop(&pending)
+		} else if err != nil {
+			return errors.Wrap(err, "Failed to read run")
+		} else {
+			heap.Fix(&pending, 0)
+		}
+	}
+	return errors.Wrap(writer.Flush(), "Failed to write output")
+}
@@ -0,0 +1,83 @@
+package sort
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func externalSortTest(t *testing.T, nElem int, opts ExternalOptions) {
+	tmpDir, err := ioutil.TempDir("", "radixSortExternalTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	origRaw, err := GenerateInputs((uint64)(nElem))
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	inPath := filepath.Join(tmpDir, "input.dat")
+	outPath := filepath.Join(tmpDir, "output.dat")
+	require.Nil(t, ioutil.WriteFile(inPath, origRaw, 0644), "Failed to write input")
+
+	runDir := filepath.Join(tmpDir, "runs")
+	require.Nil(t, os.Mkdir(runDir, 0755), "Failed to create run directory")
+	opts.TmpDir = runDir
+
+	require.Nil(t, SortFileExternal(context.Background(), inPath, outPath, opts), "External sort failed")
+
+	outRaw, err := ioutil.ReadFile(outPath)
+	require.Nil(t, err, "Failed to read output")
+	require.Nil(t, CheckSort(origRaw, outRaw), "External sort did not sort correctly")
+
+	leftovers, err := ioutil.ReadDir(runDir)
+	require.Nil(t, err)
+	require.Empty(t, leftovers, "Sort left runs behind")
+}
+
+func TestSortFileExternal(t *testing.T) {
+	// Uneven last run, small merge buffers
+	t.Run("ManyRuns", func(t *testing.T) { externalSortTest(t, 10000, ExternalOptions{RunLen: 999, MergeBuffer: 16}) })
+	t.Run("OneRun", func(t *testing.T) { externalSortTest(t, 1000, ExternalOptions{RunLen: 1000}) })
+	t.Run("CPU", func(t *testing.T) { externalSortTest(t, 4096, ExternalOptions{RunLen: 256, Sorter: CpuFull}) })
+	t.Run("Empty", func(t *testing.T) { externalSortTest(t, 0, ExternalOptions{RunLen: 256}) })
+}
+
+func TestSortFileExternalFailure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortExternalTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	inPath := filepath.Join(tmpDir, "input.dat")
+	outPath := filepath.Join(tmpDir, "output.dat")
+	require.Nil(t, ioutil.WriteFile(inPath, make([]byte, 4096), 0644), "Failed to write input")
+
+	nCalls := 0
+	failing := func(run []byte) error {
+		nCalls++
+		if nCalls == 3 {
+			return errors.New("injected failure")
+		}
+		return CpuFull(run)
+	}
+
+	err = SortFileExternal(context.Background(), inPath, outPath, ExternalOptions{RunLen: 128, Sorter: failing})
+	require.NotNil(t, err, "Sort with a failing sorter succeeded")
+	require.Equal(t, "injected failure", errors.Cause(err).Error())
+
+	_, err = os.Stat(outPath)
+	require.True(t, os.IsNotExist(err), "Failed sort left output behind")
+
+	require.Nil(t, ioutil.WriteFile(inPath, make([]byte, 4097), 0644), "Failed to write input")
+	err = SortFileExternal(context.Background(), inPath, outPath, ExternalOptions{RunLen: 128})
+	require.NotNil(t, err, "Accepted input that isn't a multiple of 4")
+
+	require.Nil(t, ioutil.WriteFile(inPath, make([]byte, 4096), 0644), "Failed to write input")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = SortFileExternal(ctx, inPath, outPath, ExternalOptions{RunLen: 128})
+	require.Equal(t, context.Canceled, errors.Cause(err), "Cancelled sort succeeded")
+}
@@ -0,0 +1,101 @@
+package sort
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+type WorkerFaultKind int
+
+const (
+	// The worker returns WorkerFault.Err (data.ErrInjected if nil) without
+	// running
+	WorkerError WorkerFaultKind = iota
+
+	// The worker panics with WorkerFault.Err
+	WorkerPanic
+
+	// The worker starts after WorkerFault.Delay (or once it is cancelled)
+	WorkerLatency
+
+	// The worker runs, commits its output and then fails anyway, leaving
+	// the output behind as a crashed worker might
+	WorkerPartialOutput
+)
+
+// A failure to inject with FaultyWorker
+type WorkerFault struct {
+	Kind WorkerFaultKind
+
+	// Only affect workers whose name contains Worker (e.g. "_step1_worker0",
+	// "" for every worker)
+	Worker string
+
+	// Only affect the Nth matching call, counting from 1. 0 affects every
+	// matching call.
+	Call int
+
+	Err   error
+	Delay time.Duration
+}
+
+// Wrap worker so that it suffers the given faults, for testing error
+// handling without real failures. Combine with data.NewFaultyFactory to
+// inject storage failures.
+func FaultyWorker(worker DistribWorkerCtx, faults ...WorkerFault) DistribWorkerCtx {
+	var lock sync.Mutex
+	nCalls := make([]int, len(faults))
+
+	return func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		var active []WorkerFault
+		lock.Lock()
+		for i, fault := range faults {
+			if !strings.Contains(baseName, fault.Worker) {
+				continue
+			}
+			nCalls[i]++
+			if fault.Call == 0 || fault.Call == nCalls[i] {
+				active = append(active, fault)
+			}
+		}
+		lock.Unlock()
+
+		var partialErr error
+		for _, fault := range active {
+			err := fault.Err
+			if err == nil {
+				err = errors.Wrapf(data.ErrInjected, "Worker %v", baseName)
+			}
+
+			switch fault.Kind {
+			case WorkerError:
+				return nil, err
+			case WorkerPanic:
+				panic(err)
+			case WorkerLatency:
+				select {
+				case <-time.After(fault.Delay):
+				case <-ctx.Done():
+					return nil, errors.Wrap(ctx.Err(), "Worker cancelled")
+				}
+			case WorkerPartialOutput:
+				partialErr = err
+			}
+		}
+
+		arr, err := worker(ctx, inBkts, offset, width, baseName, factory)
+		if err != nil || partialErr == nil {
+			return arr, err
+		}
+
+		if err := arr.Close(); err != nil {
+			return nil, err
+		}
+		return nil, errors.Wrap(partialErr, "Failed after writing output")
+	}
+}
@@ -0,0 +1,119 @@
+package sort
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Truncated intermediate data fails the sort without leaving arrays behind
+func TestSortDistribTruncatedRead(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribTruncatedRead"
+	factory := data.NewFaultyFactory(data.MemArrayFactory,
+		data.Fault{Op: data.FaultRead, Kind: data.FaultTruncate, Array: "_step1_worker0", Bytes: 4})
+
+	_, err = SortDistribFromRawCtx(context.Background(), origRaw, baseName, factory, LocalDistribWorkerCtx)
+	require.NotNil(t, err, "Sort of truncated data succeeded")
+	require.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err), "Wrong error for truncated data")
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+// Workers that die after writing their output don't leak it
+func TestSortDistribPartialOutput(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribPartialOutput"
+	worker := FaultyWorker(LocalDistribWorkerCtx,
+		WorkerFault{Kind: WorkerPartialOutput, Worker: "_step2_worker1", Call: 1},
+		WorkerFault{Kind: WorkerLatency, Delay: time.Millisecond})
+
+	_, err = SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a failed worker succeeded")
+	require.Equal(t, data.ErrInjected, errors.Cause(err))
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+
+	// The same fault is survivable with retries
+	worker = WithRetries(FaultyWorker(LocalDistribWorkerCtx,
+		WorkerFault{Kind: WorkerPartialOutput, Worker: "_step2_worker1", Call: 1}), RetryPolicy{MaxRetries: 1})
+
+	outRaw, err := SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.Nil(t, err, "Sort with retries failed")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Did not sort correctly")
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+func TestSortDistribPrematureEOF(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(64)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribPrematureEOF"
+	arr := rawArray(t, data.MemArrayFactory, baseName+"_input", origRaw)
+	defer arr.Destroy()
+
+	// More data than the array holds, the first worker takes all of it
+	worker := FaultyWorker(LocalDistribWorkerCtx, WorkerFault{Kind: WorkerError, Err: errors.New("worker launched")})
+	_, err = SortDistribFromArrCtx(context.Background(), arr, 4*len(origRaw), baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort of a short array succeeded")
+	require.Contains(t, err.Error(), "Premature EOF")
+
+	// The input is consumed even though no worker ran
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+func TestFaultyWorkerPanic(t *testing.T) {
+	worker := FaultyWorker(LocalDistribWorkerCtx, WorkerFault{Kind: WorkerPanic, Worker: "panicky"})
+	require.Panics(t, func() {
+		worker(context.Background(), nil, 0, 4, "panicky", data.MemArrayFactory)
+	}, "Worker didn't panic")
+}
+
+// Panics become errors and every failed worker is reported
+func TestSortDistribWorkerPanic(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribWorkerPanic"
+	arr := rawArray(t, data.MemArrayFactory, baseName+"_input", origRaw)
+	defer arr.Destroy()
+
+	worker := FaultyWorker(LocalDistribWorkerCtx,
+		WorkerFault{Kind: WorkerPanic, Worker: "_step1_worker0"},
+		WorkerFault{Kind: WorkerError, Worker: "_step1_worker1", Err: errors.New("second failure")})
+
+	_, err = SortDistribFromArrCtx(context.Background(), arr, len(origRaw), baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a panicking worker succeeded")
+
+	stepErr, ok := err.(*StepError)
+	require.Truef(t, ok, "Sort returned %T instead of a StepError", err)
+	require.Equal(t, 1, stepErr.Step, "Wrong step reported")
+	require.Len(t, stepErr.Failures, 2, "Not every failure was reported")
+	require.Equal(t, 0, stepErr.Failures[0].Worker)
+	require.Equal(t, 1, stepErr.Failures[1].Worker)
+	require.Contains(t, err.Error(), "second failure")
+
+	panicErr, ok := errors.Cause(err).(*PanicError)
+	require.True(t, ok, "The panic wasn't converted to a PanicError")
+	require.Equal(t, data.ErrInjected, errors.Cause(panicErr.Value.(error)))
+	require.Contains(t, string(panicErr.Stack), "FaultyWorker", "Stack trace doesn't show the panic")
+
+	// The input was consumed by step 0
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
@@ -90,11 +90,20 @@ func (self *BucketReader) incIdxInOrder() bool {
 	return false
 }
 
+// Every partition has been read (later reads return io.EOF)
+func (self *BucketReader) finished() bool {
+	return self.arrX >= self.nArr || self.partX >= self.nPart
+}
+
 // Like Read but returns PartRefs instead of bytes
 func (self *BucketReader) ReadRef(sz int) ([]*data.PartRef, error) {
 	var out []*data.PartRef
 	nNeeded := sz
 
+	if self.finished() {
+		return nil, io.EOF
+	}
+
 	for done := false; !done; done = self.incIdx() {
 		partLen := (int)(self.shapes[self.arrX].Len(self.partX))
 
@@ -124,6 +133,10 @@ func (self *BucketReader) Read(out []byte) (n int, err error) {
 	nNeeded := len(out)
 	outX := 0
 
+	if self.finished() {
+		return 0, io.EOF
+	}
+
 	for done := false; !done; done = self.incIdx() {
 		partLen := (int)(self.shapes[self.arrX].Len(self.partX))
 
@@ -142,7 +155,7 @@ func (self *BucketReader) Read(out []byte) (n int, err error) {
 			outX += nRead
 
 			if readErr != io.EOF && readErr != nil {
-				return outX, errors.Wrapf(err, "Failed to read from partition %v:%v", self.arrX, self.partX)
+				return outX, errors.Wrapf(readErr, "Failed to read from partition %v:%v", self.arrX, self.partX)
 			} else if nNeeded == 0 {
 				// There is a corner case where nNeeded==0 and
 				// readErr==io.EOF. In this case, the next call to
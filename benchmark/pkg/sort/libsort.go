@@ -1,3 +1,5 @@
+// +build !nolibsort
+
 package sort
 
 // These are go wrappers for libsort so I don't have to
@@ -14,14 +16,20 @@ package sort
 import "C"
 import (
 	"errors"
+	"sync"
 	"unsafe"
 )
 
 // Perform one-time initialization of libsort, this must be called at least once
-// per process (calls after the first do nothing)
+// per process (calls after the first do nothing). Workers call it
+// concurrently so the flag is protected by libSortLock.
+var libSortLock sync.Mutex
 var libSortInitialized bool = false
 
 func InitLibSort() error {
+	libSortLock.Lock()
+	defer libSortLock.Unlock()
+
 	if !libSortInitialized {
 		success, _ := C.initLibSort()
 		if !success {
@@ -0,0 +1,30 @@
+// +build nolibsort
+
+package sort
+
+// The libsort API implemented with the pure Go sorts in cpusort.go, for
+// machines without CUDA or libsort (go build -tags nolibsort). The Gpu*
+// names are kept so that callers don't need to know which build they're in.
+
+import (
+	"math/rand"
+)
+
+func InitLibSort() error {
+	return nil
+}
+
+func GpuFull(in []byte) error {
+	return CpuFull(in)
+}
+
+func GpuPartial(in []byte, boundaries []int64, offset int, width int) error {
+	return CpuPartial(in, boundaries, offset, width)
+}
+
+// Generate 'len' uint32's and return the array as a byte slice (total bytes will be 4*len)
+func GenerateInputs(len uint64) ([]byte, error) {
+	arr := make([]byte, len*4)
+	rand.Read(arr)
+	return arr, nil
+}
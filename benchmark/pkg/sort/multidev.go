@@ -0,0 +1,160 @@
+package sort
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// Partially sorts in on device devId, as GpuPartial. CPU sorters get the
+// index of their chunk instead.
+type PartialSorter func(devId int, in []byte, boundaries []int64, offset int, width int) error
+
+// libsort picks a free device itself, the reservation only guarantees that no
+// more sorts run at once than there are devices
+func gpuPartialOnDev(devId int, in []byte, boundaries []int64, offset int, width int) error {
+	return GpuPartial(in, boundaries, offset, width)
+}
+
+func cpuPartialOnDev(devId int, in []byte, boundaries []int64, offset int, width int) error {
+	return CpuPartial(in, boundaries, offset, width)
+}
+
+type MultiDeviceOptions struct {
+	// Devices to spread each worker across (e.g. from faas.Devices()). Each chunk
+	// reserves a device while it is sorted. If nil, or there are no devices,
+	// chunks are sorted on the CPU instead.
+	Devices *DeviceReserver
+
+	// Number of chunks to split each worker's input into (default one per
+	// device, or runtime.NumCPU() on the CPU)
+	NChunk int
+
+	// Sorts one chunk (default GpuPartial with devices, CpuPartial without)
+	Sorter PartialSorter
+}
+
+// A local worker like LocalDistribWorkerCtx that splits its input into chunks
+// and sorts them in parallel on different devices (or CPU cores). The
+// buckets of each chunk are concatenated in chunk order so the result is the
+// same as sorting the whole input at once.
+func MultiDeviceWorker(opts MultiDeviceOptions) DistribWorkerCtx {
+	useDevices := opts.Devices != nil && opts.Devices.NDev() > 0
+
+	if opts.NChunk <= 0 {
+		if useDevices {
+			opts.NChunk = opts.Devices.NDev()
+		} else {
+			opts.NChunk = runtime.NumCPU()
+		}
+	}
+	if opts.Sorter == nil {
+		if useDevices {
+			opts.Sorter = gpuPartialOnDev
+		} else {
+			opts.Sorter = cpuPartialOnDev
+		}
+	}
+
+	return func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		inBytes, err := fetchWorkerInput(ctx, inBkts)
+		if err != nil {
+			return nil, errors.Wrap(err, "Couldn't read input references")
+		}
+		defer localInputBufs.Put(inBytes)
+
+		// Chunks are whole elements, the first chunks get any extras
+		nElem := len(inBytes) / 4
+		nChunk := opts.NChunk
+		if nChunk > nElem {
+			nChunk = nElem
+		}
+		chunks := make([][]byte, nChunk)
+		chunkStart := 0
+		for i := 0; i < nChunk; i++ {
+			chunkLen := nElem / nChunk
+			if i < nElem%nChunk {
+				chunkLen++
+			}
+			chunks[i] = inBytes[chunkStart : chunkStart+chunkLen*4]
+			chunkStart += chunkLen * 4
+		}
+
+		// Actual Sort
+		nBucket := 1 << width
+		boundaries := make([][]int64, nChunk)
+		sortErrs := make([]error, nChunk)
+		var wg sync.WaitGroup
+		wg.Add(nChunk)
+		for i := 0; i < nChunk; i++ {
+			go func(chunkId int) {
+				defer wg.Done()
+
+				devId := chunkId
+				if useDevices {
+					var err error
+					if devId, err = opts.Devices.Reserve(ctx); err != nil {
+						sortErrs[chunkId] = errors.Wrap(err, "Failed to reserve a device")
+						return
+					}
+					defer opts.Devices.Release(devId)
+				}
+
+				boundaries[chunkId] = make([]int64, nBucket)
+				if err := opts.Sorter(devId, chunks[chunkId], boundaries[chunkId], offset, width); err != nil {
+					sortErrs[chunkId] = errors.Wrapf(err, "Failed to sort chunk %v", chunkId)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range sortErrs {
+			if err != nil {
+				return nil, errors.Wrap(err, "Local sort failed")
+			}
+		}
+
+		// Bucket i of the output is bucket i of every chunk in turn
+		bucketSz := func(chunkId int, bucket int) int64 {
+			if bucket == nBucket-1 {
+				return (int64)(len(chunks[chunkId])) - boundaries[chunkId][bucket]
+			}
+			return boundaries[chunkId][bucket+1] - boundaries[chunkId][bucket]
+		}
+
+		partSzs := make([]int64, nBucket)
+		for i := 0; i < nBucket; i++ {
+			for chunkId := 0; chunkId < nChunk; chunkId++ {
+				partSzs[i] += bucketSz(chunkId, i)
+			}
+		}
+
+		shape := data.CreateShape(partSzs)
+
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "Worker cancelled")
+		}
+
+		// Write Outputs
+		outArr, err := factory.Create(baseName+"_output", shape)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not allocate output")
+		}
+
+		for i := 0; i < nBucket; i++ {
+			for chunkId := 0; chunkId < nChunk; chunkId++ {
+				start := boundaries[chunkId][i]
+				if _, err := data.WritePartCtx(ctx, outArr, i, chunks[chunkId][start:start+bucketSz(chunkId, i)]); err != nil {
+					outArr.Destroy()
+					return nil, errors.Wrapf(err, "Failed to write bucket %v", i)
+				}
+			}
+			finishPart(outArr, i)
+		}
+
+		return outArr, nil
+	}
+}
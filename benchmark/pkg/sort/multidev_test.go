@@ -0,0 +1,116 @@
+package sort
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+// The non-Ctx signature used by DistribWorkerTest and SortDistribTest
+func withoutCtx(worker DistribWorkerCtx) DistribWorker {
+	return func(inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		return worker(context.Background(), inBkts, offset, width, baseName, factory)
+	}
+}
+
+func TestMultiDeviceWorkerCpu(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortMultiDeviceTest")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	worker := withoutCtx(MultiDeviceWorker(MultiDeviceOptions{NChunk: 3}))
+	DistribWorkerTest(t, data.NewFileArrayFactory(tmpDir), worker)
+	SortDistribTest(t, "testMultiDeviceWorkerCpu", data.MemArrayFactory, worker)
+}
+
+// Chunks share the devices without ever sharing one
+func TestMultiDeviceWorkerDevices(t *testing.T) {
+	devices := NewDeviceReserver(2)
+
+	var lock sync.Mutex
+	inUse := make(map[int]bool)
+	maxInUse := 0
+	shared := false
+	sorter := func(devId int, in []byte, boundaries []int64, offset int, width int) error {
+		lock.Lock()
+		if inUse[devId] {
+			shared = true
+		}
+		inUse[devId] = true
+		if len(inUse) > maxInUse {
+			maxInUse = len(inUse)
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+		err := CpuPartial(in, boundaries, offset, width)
+
+		lock.Lock()
+		delete(inUse, devId)
+		lock.Unlock()
+		return err
+	}
+
+	worker := MultiDeviceWorker(MultiDeviceOptions{Devices: devices, NChunk: 5, Sorter: sorter})
+	SortDistribTest(t, "testMultiDeviceWorkerDevices", data.MemArrayFactory, withoutCtx(worker))
+	require.False(t, shared, "A device was used by two chunks at once")
+	require.LessOrEqual(t, maxInUse, 2, "More chunks sorted at once than there are devices")
+}
+
+// Splitting across devices gives exactly the same buckets as one sort
+func TestMultiDeviceWorkerMatchesLocal(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1021)
+	require.Nil(t, err, "Failed to generate test inputs")
+	arr := rawArray(t, data.MemArrayFactory, "testMultiDeviceMatches_input", origRaw)
+	defer arr.Destroy()
+	refs := []*data.PartRef{&data.PartRef{Arr: arr, PartIdx: 0, Start: 0, NByte: len(origRaw)}}
+
+	localArr, err := LocalDistribWorkerCtx(context.Background(), refs, 8, 4, "testMultiDeviceMatches_local", data.MemArrayFactory)
+	require.Nil(t, err, "Local worker failed")
+	defer localArr.Destroy()
+
+	multiArr, err := MultiDeviceWorker(MultiDeviceOptions{NChunk: 4})(context.Background(), refs, 8, 4, "testMultiDeviceMatches_multi", data.MemArrayFactory)
+	require.Nil(t, err, "Multi-device worker failed")
+	defer multiArr.Destroy()
+
+	for i := 0; i < 1<<4; i++ {
+		localReader, err := localArr.GetPartReader(i)
+		require.Nil(t, err)
+		localPart, err := ioutil.ReadAll(localReader)
+		require.Nil(t, err)
+
+		multiReader, err := multiArr.GetPartReader(i)
+		require.Nil(t, err)
+		multiPart, err := ioutil.ReadAll(multiReader)
+		require.Nil(t, err)
+
+		require.Truef(t, bytes.Equal(localPart, multiPart), "Bucket %v differs", i)
+	}
+}
+
+func TestDeviceReserver(t *testing.T) {
+	_, err := NewDeviceReserver(0).Reserve(context.Background())
+	require.Equal(t, ErrNoDevices, err, "Reserved a device that doesn't exist")
+
+	devices := NewDeviceReserver(1)
+	devId, err := devices.Reserve(context.Background())
+	require.Nil(t, err, "Failed to reserve a free device")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = devices.Reserve(ctx)
+	require.NotNil(t, err, "Reserved a device twice")
+
+	devices.Release(devId)
+	_, err = devices.Reserve(context.Background())
+	require.Nil(t, err, "Released device wasn't reusable")
+}
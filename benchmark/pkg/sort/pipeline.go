@@ -0,0 +1,441 @@
+package sort
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// Dependency tracking for pipelined sorts. A worker of step k+1 reads a
+// contiguous range of step k's outputs in STRIDED order, so it can start as
+// soon as every partition in (and before) its range is final rather than
+// waiting for all of step k.
+//
+// A partition is final once the worker producing it returns, or earlier if
+// the worker writes it through the factory it was given (as
+// LocalDistribWorkerCtx does): then a partition is final once a writer for it
+// is closed and it is full. Unlimited partitions can always grow, so they are
+// only final once their worker returns or marks them complete (see
+// partFinisher). Outputs created elsewhere (e.g. by FaaS workers) or under
+// another name (e.g. retries from WithRetries) are also only final once their
+// worker returns.
+
+// Completion state of the outputs of one step (or of the sort's input)
+type stepOutputs struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	arrs     []data.DistribArray // Readable output of each worker, nil until known
+	lens     [][]int64           // Bytes of each partition written through closed writers
+	caps     [][]int64
+	closed   [][]bool
+	finished [][]bool // The worker marked the partition complete
+	done     []bool   // The worker returned its output
+	consumed []bool   // Partitions were used before the worker returned
+
+	// Set when the sort fails, wakes every waiter
+	err error
+}
+
+func newStepOutputs(nworker int) *stepOutputs {
+	outputs := &stepOutputs{
+		arrs:     make([]data.DistribArray, nworker),
+		lens:     make([][]int64, nworker),
+		caps:     make([][]int64, nworker),
+		closed:   make([][]bool, nworker),
+		finished: make([][]bool, nworker),
+		done:     make([]bool, nworker),
+		consumed: make([]bool, nworker),
+	}
+	outputs.cond = sync.NewCond(&outputs.lock)
+	return outputs
+}
+
+// Outputs that are already complete (the input of the first step)
+func completeStepOutputs(arrs []data.DistribArray) (*stepOutputs, error) {
+	outputs := newStepOutputs(len(arrs))
+	for i, arr := range arrs {
+		if err := outputs.finish(i, arr); err != nil {
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+// Record an output created by worker through the tracking factory
+func (self *stepOutputs) create(worker int, arr data.DistribArray, shape data.DistribArrayShape) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	nPart := shape.NPart()
+	self.arrs[worker] = arr
+	self.lens[worker] = make([]int64, nPart)
+	self.caps[worker] = make([]int64, nPart)
+	self.closed[worker] = make([]bool, nPart)
+	self.finished[worker] = make([]bool, nPart)
+	for i := 0; i < nPart; i++ {
+		self.caps[worker][i] = shape.Cap(i)
+	}
+}
+
+func (self *stepOutputs) writerClosed(worker int, arr data.DistribArray, partId int, nByte int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.arrs[worker] != arr {
+		return
+	}
+	self.lens[worker][partId] += nByte
+	self.closed[worker][partId] = true
+	self.cond.Broadcast()
+}
+
+func (self *stepOutputs) partFinished(worker int, arr data.DistribArray, partId int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.arrs[worker] != arr {
+		return
+	}
+	self.finished[worker][partId] = true
+	self.cond.Broadcast()
+}
+
+// A tracked output was destroyed before its worker returned (e.g. a failed
+// attempt under WithRetries). That is only a problem if it was already read.
+func (self *stepOutputs) revoke(worker int, arr data.DistribArray) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.arrs[worker] != arr || self.done[worker] {
+		return nil
+	}
+	if self.consumed[worker] {
+		return fmt.Errorf("Output of worker %v was destroyed after the next step started reading it", worker)
+	}
+	self.arrs[worker] = nil
+	self.lens[worker] = nil
+	self.caps[worker] = nil
+	self.closed[worker] = nil
+	self.finished[worker] = nil
+	return nil
+}
+
+// The worker returned arr, every partition is final
+func (self *stepOutputs) finish(worker int, arr data.DistribArray) error {
+	shape, err := arr.GetShape()
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.consumed[worker] && self.arrs[worker] != arr {
+		return fmt.Errorf("Worker %v returned a different array than the one already being read", worker)
+	}
+
+	nPart := shape.NPart()
+	self.arrs[worker] = arr
+	self.lens[worker] = make([]int64, nPart)
+	self.caps[worker] = make([]int64, nPart)
+	self.closed[worker] = make([]bool, nPart)
+	self.finished[worker] = make([]bool, nPart)
+	for i := 0; i < nPart; i++ {
+		self.lens[worker][i] = shape.Len(i)
+		self.caps[worker][i] = shape.Cap(i)
+		self.closed[worker][i] = true
+	}
+	self.done[worker] = true
+	self.cond.Broadcast()
+	return nil
+}
+
+func (self *stepOutputs) fail(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.err == nil {
+		self.err = err
+	}
+	self.cond.Broadcast()
+}
+
+// Wait for partition partId of worker's output to be final. Returns the
+// output, its length and its number of partitions.
+func (self *stepOutputs) waitPart(worker int, partId int) (data.DistribArray, int64, int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for {
+		if self.err != nil {
+			return nil, 0, 0, self.err
+		}
+
+		if self.arrs[worker] != nil {
+			nPart := len(self.caps[worker])
+			if partId >= nPart {
+				return self.arrs[worker], 0, nPart, nil
+			}
+
+			partCap := self.caps[worker][partId]
+			partLen := self.lens[worker][partId]
+			if self.done[worker] || self.finished[worker][partId] ||
+				(self.closed[worker][partId] && partCap != 0 && partLen == partCap) {
+				if !self.done[worker] {
+					self.consumed[worker] = true
+				}
+				return self.arrs[worker], partLen, nPart, nil
+			}
+		}
+		self.cond.Wait()
+	}
+}
+
+// Wait until every partition of the bytes [start, end) (in STRIDED order) is
+// final and return references to them
+func (self *stepOutputs) plan(start int, end int) ([]*data.PartRef, error) {
+	var refs []*data.PartRef
+	pos := 0
+	for partId := 0; pos < end; partId++ {
+		for worker := 0; worker < len(self.arrs) && pos < end; worker++ {
+			arr, partLen, nPart, err := self.waitPart(worker, partId)
+			if err != nil {
+				return nil, err
+			}
+			if partId >= nPart {
+				return nil, errors.New("Premature EOF from input generator")
+			}
+
+			partStart := pos
+			pos += (int)(partLen)
+			if pos <= start {
+				continue
+			}
+
+			refStart := 0
+			if start > partStart {
+				refStart = start - partStart
+			}
+			refEnd := (int)(partLen)
+			if end < pos {
+				refEnd -= pos - end
+			}
+			if refEnd > refStart {
+				refs = append(refs, &data.PartRef{Arr: arr, PartIdx: partId, Start: refStart, NByte: refEnd - refStart})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// Destroy every output known to the tracker
+func (self *stepOutputs) destroyAll() {
+	self.lock.Lock()
+	arrs := append([]data.DistribArray{}, self.arrs...)
+	self.lock.Unlock()
+	destroyArrs(arrs)
+}
+
+// A factory for worker that reports the progress of its output (an array
+// called outName) to self. Other arrays are created normally.
+func (self *stepOutputs) trackingFactory(worker int, outName string, factory *data.ArrayFactory) *data.ArrayFactory {
+	return &data.ArrayFactory{
+		Create: func(name string, shape data.DistribArrayShape) (data.DistribArray, error) {
+			arr, err := factory.Create(name, shape)
+			if err != nil || name != outName {
+				return arr, err
+			}
+
+			tracked := &trackedOutput{DistribArray: arr, name: name, outputs: self, worker: worker}
+			self.create(worker, tracked, shape)
+			return tracked, nil
+		},
+		Open:   factory.Open,
+		List:   factory.List,
+		Stat:   factory.Stat,
+		Exists: factory.Exists,
+		Remove: factory.Remove,
+
+		Unlimited: factory.Unlimited,
+	}
+}
+
+// Implemented by the outputs of pipelined sorts. Workers call finishPart once
+// they won't write to a partition again, so that unlimited partitions (e.g.
+// empty buckets) don't have to wait for the worker to return.
+type partFinisher interface {
+	finishPart(partId int)
+}
+
+// Mark partition partId of arr complete if arr is a pipelined output
+func finishPart(arr data.DistribArray, partId int) {
+	if finisher, ok := arr.(partFinisher); ok {
+		finisher.finishPart(partId)
+	}
+}
+
+// An output array being written by a worker in a pipelined sort
+type trackedOutput struct {
+	data.DistribArray
+	name    string
+	outputs *stepOutputs
+	worker  int
+}
+
+func (self *trackedOutput) ArrayName() string {
+	return self.name
+}
+
+func (self *trackedOutput) GetPartWriter(partId int) (io.WriteCloser, error) {
+	writer, err := self.DistribArray.GetPartWriter(partId)
+	if err != nil {
+		return nil, err
+	}
+	return &trackedWriter{WriteCloser: writer, arr: self, partId: partId}, nil
+}
+
+func (self *trackedOutput) finishPart(partId int) {
+	self.outputs.partFinished(self.worker, self, partId)
+}
+
+func (self *trackedOutput) Destroy() error {
+	if err := self.outputs.revoke(self.worker, self); err != nil {
+		self.outputs.fail(err)
+	}
+	return self.DistribArray.Destroy()
+}
+
+type trackedWriter struct {
+	io.WriteCloser
+	arr    *trackedOutput
+	partId int
+	nByte  int64
+}
+
+func (self *trackedWriter) Write(b []byte) (int, error) {
+	n, err := self.WriteCloser.Write(b)
+	self.nByte += (int64)(n)
+	return n, err
+}
+
+func (self *trackedWriter) Close() error {
+	err := self.WriteCloser.Close()
+	if err == nil {
+		self.arr.outputs.writerClosed(self.arr.worker, self.arr, self.partId, self.nByte)
+	}
+	return err
+}
+
+// Like SortDistribFromArrCtx but steps overlap: each worker starts as soon as
+// the particular partitions it reads are final instead of waiting for the
+// whole previous step (see the top of pipeline.go for when partitions count as
+// final). arr is consumed and failures are reported and cleaned up as in
+// SortDistribFromArrCtx, a *StepError names the earliest step with a worker
+// that failed (rather than being cancelled). Pipelined sorts can't be
+// checkpointed.
+func SortDistribPipelined(ctx context.Context, arr data.DistribArray, sz int, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx) ([]data.DistribArray, error) {
+	state := newSortManifest(sz)
+	nworker := state.NWorker
+	nstep := (32 / state.Width)
+	nElem := state.Size / 4
+	maxPerWorker := (int)(math.Ceil((float64)(nElem)/(float64)(nworker))) * 4
+
+	// steps[k] holds the inputs of step k, steps[nstep] the final outputs
+	steps := make([]*stepOutputs, nstep+1)
+	var err error
+	if steps[0], err = completeStepOutputs([]data.DistribArray{arr}); err != nil {
+		return nil, errors.Wrap(err, "Failed to get shape of input")
+	}
+	for step := 1; step <= nstep; step++ {
+		steps[step] = newStepOutputs(nworker)
+	}
+
+	pipeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	abort := func(err error) {
+		cancel()
+		for _, outputs := range steps {
+			outputs.fail(err)
+		}
+	}
+
+	// The inputs of a step are destroyed once all of its workers returned
+	var consumerLock sync.Mutex
+	nConsumers := make([]int, nstep)
+
+	var wg sync.WaitGroup
+	failures := make([][]*WorkerFailure, nstep)
+	for step := 0; step < nstep; step++ {
+		failures[step] = make([]*WorkerFailure, nworker)
+		for workerId := 0; workerId < nworker; workerId++ {
+			wg.Add(1)
+			go func(step int, id int) {
+				defer wg.Done()
+
+				workerName := fmt.Sprintf("%v_step%v_worker%v", baseName, step, id)
+				inputs, outputs := steps[step], steps[step+1]
+
+				workerErr := func() error {
+					start := id * maxPerWorker
+					end := start + maxPerWorker
+					if id+1 == nworker || end > state.Size {
+						end = state.Size
+					}
+					refs, err := inputs.plan(start, end)
+					if err != nil {
+						return err
+					}
+
+					outArr, err := callWorker(worker, pipeCtx, refs, step*state.Width, state.Width, workerName,
+						outputs.trackingFactory(id, workerName+"_output", factory))
+					if err != nil {
+						destroyPartialOutput(factory, workerName)
+						return err
+					}
+					return outputs.finish(id, outArr)
+				}()
+
+				if workerErr != nil {
+					failures[step][id] = &WorkerFailure{Step: step, Worker: id, Err: workerErr}
+					abort(errors.Wrapf(context.Canceled, "Step %v, worker %v failed", step, id))
+					return
+				}
+
+				consumerLock.Lock()
+				nConsumers[step]++
+				lastConsumer := nConsumers[step] == nworker
+				consumerLock.Unlock()
+				if lastConsumer {
+					inputs.destroyAll()
+				}
+			}(step, workerId)
+		}
+	}
+	wg.Wait()
+
+	// Report the first step with a real failure, or the first with any
+	var stepErr *StepError
+	for step := nstep - 1; step >= 0; step-- {
+		if candidate := newStepError(step, failures[step]); candidate != nil {
+			if stepErr == nil || errors.Cause(candidate) != context.Canceled || errors.Cause(stepErr) == context.Canceled {
+				stepErr = candidate
+			}
+		}
+	}
+
+	if stepErr != nil {
+		for step := 0; step <= nstep; step++ {
+			steps[step].destroyAll()
+		}
+		return nil, stepErr
+	}
+
+	return steps[nstep].arrs, nil
+}
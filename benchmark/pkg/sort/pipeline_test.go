@@ -0,0 +1,278 @@
+package sort
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Records when each worker (by name) started and finished
+type workerTimer struct {
+	lock   sync.Mutex
+	starts map[string]time.Time
+	ends   map[string]time.Time
+}
+
+func newWorkerTimer() *workerTimer {
+	return &workerTimer{starts: make(map[string]time.Time), ends: make(map[string]time.Time)}
+}
+
+func (self *workerTimer) wrap(worker DistribWorkerCtx) DistribWorkerCtx {
+	return func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		self.lock.Lock()
+		self.starts[baseName] = time.Now()
+		self.lock.Unlock()
+
+		arr, err := worker(ctx, inBkts, offset, width, baseName, factory)
+
+		self.lock.Lock()
+		self.ends[baseName] = time.Now()
+		self.lock.Unlock()
+		return arr, err
+	}
+}
+
+// Total time worker slots spent between finishing one step and starting the
+// next
+func (self *workerTimer) idle(baseName string, nstep int, nworker int) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	idle := (time.Duration)(0)
+	for step := 1; step < nstep; step++ {
+		for id := 0; id < nworker; id++ {
+			start := self.starts[fmt.Sprintf("%v_step%v_worker%v", baseName, step, id)]
+			prevEnd := self.ends[fmt.Sprintf("%v_step%v_worker%v", baseName, step-1, id)]
+			if gap := start.Sub(prevEnd); gap > 0 {
+				idle += gap
+			}
+		}
+	}
+	return idle
+}
+
+// Run a pipelined sort of a fresh array and check the result
+func pipelinedSortTest(t *testing.T, baseName string, factory *data.ArrayFactory, worker DistribWorkerCtx) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	arr := rawArray(t, factory, baseName+"_input", origRaw)
+	defer arr.Destroy()
+
+	outArrs, err := SortDistribPipelined(context.Background(), arr, len(origRaw), baseName, factory, worker)
+	require.Nil(t, err, "Pipelined sort failed")
+
+	reader, err := NewBucketReader(outArrs, STRIDED)
+	require.Nil(t, err, "Failed to get reader for output")
+	outRaw := make([]byte, len(origRaw))
+	_, err = bucketRead(reader, outRaw)
+	require.Nil(t, err, "Failed to read output")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Pipelined sort did not sort correctly")
+
+	for _, outArr := range outArrs {
+		require.Nil(t, outArr.Destroy(), "Failed to destroy output")
+	}
+}
+
+func TestSortPipelinedMem(t *testing.T) {
+	pipelinedSortTest(t, "testSortPipelinedMem", data.MemArrayFactory, LocalDistribWorkerCtx)
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, "testSortPipelinedMem"), "Sort left arrays behind")
+}
+
+func TestSortPipelinedFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortPipelined")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	factory := data.NewFileArrayFactory(tmpDir)
+	pipelinedSortTest(t, "testSortPipelinedFile", factory, LocalDistribWorkerCtx)
+	require.Empty(t, listPrefix(t, factory, "testSortPipelinedFile"), "Sort left arrays behind")
+}
+
+// Workers whose writes aren't visible run bulk-synchronously but still sort
+func TestSortPipelinedOpaqueWorker(t *testing.T) {
+	opaque := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		return LocalDistribWorkerCtx(ctx, inBkts, offset, width, baseName, data.MemArrayFactory)
+	}
+	pipelinedSortTest(t, "testSortPipelinedOpaque", data.MemArrayFactory, opaque)
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, "testSortPipelinedOpaque"), "Sort left arrays behind")
+}
+
+// Slow writes give the next step time to start early
+func TestSortPipelinedOverlap(t *testing.T) {
+	timer := newWorkerTimer()
+	factory := data.NewFaultyFactory(data.MemArrayFactory,
+		data.Fault{Op: data.FaultWrite, Kind: data.FaultLatency, Array: "testSortPipelinedOverlap", Delay: 100 * time.Microsecond})
+
+	pipelinedSortTest(t, "testSortPipelinedOverlap", factory, timer.wrap(LocalDistribWorkerCtx))
+
+	timer.lock.Lock()
+	defer timer.lock.Unlock()
+	overlapped := false
+	for step := 1; step < 32/sortWidth; step++ {
+		start := timer.starts[fmt.Sprintf("testSortPipelinedOverlap_step%v_worker0", step)]
+		for id := 0; id < 2; id++ {
+			if start.Before(timer.ends[fmt.Sprintf("testSortPipelinedOverlap_step%v_worker%v", step-1, id)]) {
+				overlapped = true
+			}
+		}
+	}
+	require.True(t, overlapped, "No worker started before the previous step finished")
+}
+
+func TestSortPipelinedFailure(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortPipelinedFailure"
+	arr := rawArray(t, data.MemArrayFactory, baseName+"_input", origRaw)
+	defer arr.Destroy()
+
+	worker := FaultyWorker(LocalDistribWorkerCtx,
+		WorkerFault{Kind: WorkerError, Worker: "_step2_worker1", Err: errors.New("injected failure")})
+
+	_, err = SortDistribPipelined(context.Background(), arr, len(origRaw), baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a failed worker succeeded")
+
+	stepErr, ok := err.(*StepError)
+	require.Truef(t, ok, "Sort returned %T instead of a StepError", err)
+	require.Equal(t, 2, stepErr.Step, "Wrong step blamed")
+	require.Equal(t, "injected failure", errors.Cause(err).Error())
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+// The input is consumed even if step 0 fails
+func TestSortPipelinedFirstStepFailure(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortPipelinedFirstStepFailure"
+	arr := rawArray(t, data.MemArrayFactory, baseName+"_input", origRaw)
+
+	worker := FaultyWorker(LocalDistribWorkerCtx,
+		WorkerFault{Kind: WorkerError, Worker: "_step0_worker0", Err: errors.New("injected failure")})
+
+	_, err = SortDistribPipelined(context.Background(), arr, len(origRaw), baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort with a failed worker succeeded")
+	require.Equal(t, "injected failure", errors.Cause(err).Error())
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Sort left arrays behind")
+}
+
+// A closed writer only finalizes partitions with a capacity, more writers may
+// still append to unlimited ones
+func TestStepOutputsUnlimited(t *testing.T) {
+	arr, err := data.MemArrayFactory.Create("testStepOutputsUnlimited", data.CreateShape([]int64{4, 0}))
+	require.Nil(t, err)
+	defer arr.Destroy()
+	shape, err := arr.GetShape()
+	require.Nil(t, err)
+
+	outputs := newStepOutputs(1)
+	outputs.create(0, arr, *shape)
+
+	waitLen := func(partId int) chan int64 {
+		res := make(chan int64, 1)
+		go func() {
+			_, partLen, _, err := outputs.waitPart(0, partId)
+			if err != nil {
+				partLen = -1
+			}
+			res <- partLen
+		}()
+		return res
+	}
+
+	_, err = data.WritePartCtx(context.Background(), arr, 0, []byte{1, 2, 3, 4})
+	require.Nil(t, err)
+	outputs.writerClosed(0, arr, 0, 4)
+	require.Equal(t, (int64)(4), <-waitLen(0), "Full partition was not final")
+
+	unlimited := waitLen(1)
+	for i := 0; i < 2; i++ {
+		_, err = data.WritePartCtx(context.Background(), arr, 1, []byte{1, 2, 3, 4})
+		require.Nil(t, err)
+		outputs.writerClosed(0, arr, 1, 4)
+
+		select {
+		case <-unlimited:
+			require.Fail(t, "Unlimited partition was final before its worker returned")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	require.Nil(t, outputs.finish(0, arr))
+	require.Equal(t, (int64)(8), <-unlimited, "Wrong length for the unlimited partition")
+
+	// Workers can finish unlimited partitions early
+	outputs = newStepOutputs(1)
+	tracked := &trackedOutput{DistribArray: arr, name: "testStepOutputsUnlimited", outputs: outputs}
+	outputs.create(0, tracked, *shape)
+	outputs.writerClosed(0, tracked, 1, 8)
+	finishPart(tracked, 1)
+	require.Equal(t, (int64)(8), <-waitLen(1), "Finished partition was not final")
+}
+
+// Compare bulk-synchronous and pipelined sorts when writing output is slow.
+// idle-ms is the time worker slots spend waiting between steps.
+func benchmarkSortDistrib(b *testing.B, pipelined bool) {
+	require.Nil(b, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(64 * 1024)
+	require.Nil(b, err, "Failed to generate test inputs")
+
+	baseName := "benchmarkSortDistrib"
+	factory := data.NewFaultyFactory(data.MemArrayFactory,
+		data.Fault{Op: data.FaultWrite, Kind: data.FaultLatency, Array: "_output", Delay: 50 * time.Microsecond})
+
+	idle := (time.Duration)(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		arr, err := data.MemArrayFactory.Create(baseName+"_input", data.CreateShape([]int64{(int64)(len(origRaw))}))
+		require.Nil(b, err)
+		_, err = data.WritePartCtx(context.Background(), arr, 0, origRaw)
+		require.Nil(b, err)
+		timer := newWorkerTimer()
+		worker := timer.wrap(LocalDistribWorkerCtx)
+		b.StartTimer()
+
+		var outArrs []data.DistribArray
+		if pipelined {
+			outArrs, err = SortDistribPipelined(context.Background(), arr, len(origRaw), baseName, factory, worker)
+		} else {
+			outArrs, err = SortDistribFromArrCtx(context.Background(), arr, len(origRaw), baseName, factory, worker)
+		}
+		require.Nil(b, err, "Sort failed")
+
+		b.StopTimer()
+		idle += timer.idle(baseName, 32/sortWidth, 2)
+		destroyArrs(outArrs)
+		arr.Destroy()
+		b.StartTimer()
+	}
+	b.ReportMetric((float64)(idle.Milliseconds())/(float64)(b.N), "idle-ms/op")
+}
+
+func BenchmarkSortDistribBSP(b *testing.B) {
+	benchmarkSortDistrib(b, false)
+}
+
+func BenchmarkSortDistribPipelined(b *testing.B) {
+	benchmarkSortDistrib(b, true)
+}
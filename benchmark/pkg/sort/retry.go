@@ -0,0 +1,175 @@
+package sort
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// Controls how WithRetries re-runs a worker. The zero value runs every worker
+// exactly once.
+type RetryPolicy struct {
+	// Number of failed attempts to tolerate before giving up
+	MaxRetries int
+
+	// Delay before the first retry, doubled for every retry after that (up to
+	// MaxBackoff if it is set)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// If a worker hasn't finished after SpeculateAfter, launch a duplicate of
+	// it (and another every SpeculateAfter after that, up to MaxSpeculative).
+	// The first attempt to succeed wins. 0 disables speculation.
+	SpeculateAfter time.Duration
+	MaxSpeculative int
+}
+
+func (self *RetryPolicy) backoff(nFailed int) time.Duration {
+	delay := self.Backoff
+	for i := 1; i < nFailed; i++ {
+		delay *= 2
+		if self.MaxBackoff != 0 && delay >= self.MaxBackoff {
+			break
+		}
+	}
+	if self.MaxBackoff != 0 && delay > self.MaxBackoff {
+		delay = self.MaxBackoff
+	}
+	return delay
+}
+
+// Name used by attempt number 'attempt' of the worker called baseName. The
+// first attempt keeps the original name, later ones get a suffix so that they
+// never share an output array.
+func attemptName(baseName string, attempt int) string {
+	if attempt == 0 {
+		return baseName
+	}
+	return fmt.Sprintf("%v_attempt%v", baseName, attempt)
+}
+
+// Remove whatever output a failed or abandoned attempt left behind
+func destroyPartialOutput(factory *data.ArrayFactory, name string) {
+	if partial, err := factory.Open(name + "_output"); err == nil {
+		partial.Destroy()
+	}
+}
+
+type attemptResult struct {
+	arr  data.DistribArray
+	name string
+	err  error
+}
+
+// Wait for the remaining n attempts to finish and destroy their outputs
+func discardAttempts(results chan attemptResult, n int) {
+	for ; n > 0; n-- {
+		res := <-results
+		if res.err == nil {
+			res.arr.Destroy()
+		}
+	}
+}
+
+// Wrap worker so that failed attempts are retried, and stragglers duplicated,
+// according to policy. Workers only depend on their inputs so any successful
+// attempt is as good as any other. The outputs of failed attempts are
+// destroyed before retrying. Once an attempt succeeds the others are
+// cancelled and their outputs destroyed in the background.
+func WithRetries(worker DistribWorkerCtx, policy RetryPolicy) DistribWorkerCtx {
+	return func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// Every attempt sends exactly one result, the buffer means abandoned
+		// attempts never block
+		results := make(chan attemptResult, 1+policy.MaxRetries+policy.MaxSpeculative)
+
+		nLaunched := 0
+		nRunning := 0
+		launch := func() {
+			name := attemptName(baseName, nLaunched)
+			nLaunched++
+			nRunning++
+			go func() {
+				arr, err := callWorker(worker, attemptCtx, inBkts, offset, width, name, factory)
+				if err != nil {
+					destroyPartialOutput(factory, name)
+				}
+				results <- attemptResult{arr: arr, name: name, err: err}
+			}()
+		}
+		launch()
+
+		var speculate <-chan time.Time
+		if policy.SpeculateAfter > 0 && policy.MaxSpeculative > 0 {
+			ticker := time.NewTicker(policy.SpeculateAfter)
+			defer ticker.Stop()
+			speculate = ticker.C
+		}
+		nSpeculative := 0
+
+		// Failures that still need a retry, launched one per backoff timer
+		var retry <-chan time.Time
+		nPending := 0
+		nFailed := 0
+		var lastErr error
+		for {
+			select {
+			case res := <-results:
+				nRunning--
+				if res.err == nil {
+					cancel()
+					go discardAttempts(results, nRunning)
+					return res.arr, nil
+				}
+
+				nFailed++
+				lastErr = errors.Wrapf(res.err, "Attempt %v failed", res.name)
+				if ctx.Err() != nil {
+					break
+				}
+				if nFailed <= policy.MaxRetries {
+					nPending++
+					if retry == nil {
+						retry = time.After(policy.backoff(nFailed))
+					}
+					continue
+				}
+				if nRunning != 0 || nPending != 0 {
+					continue
+				}
+
+			case <-retry:
+				retry = nil
+				nPending--
+				launch()
+				if nPending != 0 {
+					retry = time.After(policy.backoff(nFailed))
+				}
+				continue
+
+			case <-speculate:
+				if nSpeculative < policy.MaxSpeculative {
+					nSpeculative++
+					launch()
+				}
+				continue
+
+			case <-ctx.Done():
+				lastErr = errors.Wrap(ctx.Err(), "Worker cancelled")
+			}
+
+			// Out of retries or cancelled
+			cancel()
+			discardAttempts(results, nRunning)
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+			return nil, errors.Wrapf(lastErr, "Giving up after %v failed attempts", nFailed)
+		}
+	}
+}
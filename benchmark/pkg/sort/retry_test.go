@@ -0,0 +1,176 @@
+package sort
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// Fault-injecting worker. The first nFail attempts of every worker create a
+// partial output and then fail, later attempts run LocalDistribWorkerCtx.
+type flakyWorker struct {
+	nFail int
+
+	lock     sync.Mutex
+	attempts map[string]int
+}
+
+func newFlakyWorker(nFail int) *flakyWorker {
+	return &flakyWorker{nFail: nFail, attempts: make(map[string]int)}
+}
+
+func (self *flakyWorker) run(ctx context.Context, inBkts []*data.PartRef, offset int, width int, baseName string, factory *data.ArrayFactory) (data.DistribArray, error) {
+	workerName := strings.Split(baseName, "_attempt")[0]
+
+	self.lock.Lock()
+	attempt := self.attempts[workerName]
+	self.attempts[workerName]++
+	self.lock.Unlock()
+
+	if attempt < self.nFail {
+		partial, err := factory.Create(baseName+"_output", data.CreateShapeUniform(4, 1))
+		if err != nil {
+			return nil, err
+		}
+		partial.Close()
+		return nil, errors.New("injected failure")
+	}
+	return LocalDistribWorkerCtx(ctx, inBkts, offset, width, baseName, factory)
+}
+
+func (self *flakyWorker) maxAttempts() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	max := 0
+	for _, n := range self.attempts {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func TestSortDistribRetry(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribRetry"
+	flaky := newFlakyWorker(2)
+	worker := WithRetries(flaky.run, RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond})
+
+	outRaw, err := SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.Nil(t, err, "Sort with retries failed")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Did not sort correctly")
+	require.Equal(t, 3, flaky.maxAttempts(), "Workers were not retried")
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Partial outputs were not destroyed")
+}
+
+func TestSortDistribRetryExhausted(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribRetryExhausted"
+	flaky := newFlakyWorker(3)
+	worker := WithRetries(flaky.run, RetryPolicy{MaxRetries: 2})
+
+	_, err = SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.NotNil(t, err, "Sort succeeded without enough retries")
+	require.Contains(t, err.Error(), "injected failure")
+	require.Equal(t, 3, flaky.maxAttempts(), "Wrong number of attempts")
+
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Partial outputs were not destroyed")
+}
+
+func TestSortDistribRetryOverlapping(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribRetryOverlapping"
+
+	// The original and the speculative attempt both fail during the first
+	// backoff, the first retry hangs and only the second retry can succeed
+	hung := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, name string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		switch {
+		case !strings.Contains(name, "_attempt"), strings.HasSuffix(name, "_attempt1"):
+			return nil, errors.New("injected failure")
+		case strings.HasSuffix(name, "_attempt2"):
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("only one retry was launched for two failures")
+			}
+		}
+		return LocalDistribWorkerCtx(ctx, inBkts, offset, width, name, factory)
+	}
+	worker := WithRetries(hung, RetryPolicy{MaxRetries: 2, Backoff: 50 * time.Millisecond,
+		SpeculateAfter: time.Millisecond, MaxSpeculative: 1})
+
+	start := time.Now()
+	outRaw, err := SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.Nil(t, err, "Sort with overlapping failures failed")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Did not sort correctly")
+	require.Less(t, (int64)(time.Since(start)), (int64)(5*time.Second), "Sort waited for the hung retry")
+
+	require.Eventually(t, func() bool {
+		return len(listPrefix(t, data.MemArrayFactory, baseName)) == 0
+	}, time.Second, time.Millisecond, "Sort left arrays behind")
+}
+
+func TestSortDistribSpeculate(t *testing.T) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	baseName := "testSortDistribSpeculate"
+
+	// The first attempt of every worker hangs until it is cancelled
+	var nCancelled int
+	var lock sync.Mutex
+	straggler := func(ctx context.Context, inBkts []*data.PartRef, offset int, width int, name string, factory *data.ArrayFactory) (data.DistribArray, error) {
+		if !strings.Contains(name, "_attempt") {
+			select {
+			case <-ctx.Done():
+				lock.Lock()
+				nCancelled++
+				lock.Unlock()
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("straggler was not cancelled")
+			}
+		}
+		return LocalDistribWorkerCtx(ctx, inBkts, offset, width, name, factory)
+	}
+	worker := WithRetries(straggler, RetryPolicy{SpeculateAfter: 10 * time.Millisecond, MaxSpeculative: 1})
+
+	start := time.Now()
+	outRaw, err := SortDistribFromRawCtx(context.Background(), origRaw, baseName, data.MemArrayFactory, worker)
+	require.Nil(t, err, "Speculative sort failed")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Did not sort correctly")
+	require.Less(t, (int64)(time.Since(start)), (int64)(5*time.Second), "Sort waited for stragglers")
+
+	// Losers are cleaned up in the background
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return nCancelled == 2*(32/sortWidth)
+	}, time.Second, time.Millisecond, "Stragglers were not cancelled")
+	require.Eventually(t, func() bool {
+		return len(listPrefix(t, data.MemArrayFactory, baseName)) == 0
+	}, time.Second, time.Millisecond, "Sort left arrays behind")
+}
@@ -0,0 +1,159 @@
+package sort
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/pkg/errors"
+)
+
+type StreamOptions struct {
+	// Number of bytes read from the input at a time, rounded down to a
+	// multiple of 4 (default 1MB). Only one chunk is held in memory.
+	ChunkSize int
+
+	// Number of partitions in the input array (default 16). Chunks are
+	// appended to the partitions round-robin.
+	NPart int
+}
+
+func (self *StreamOptions) withDefaults() (StreamOptions, error) {
+	opts := *self
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 1024 * 1024
+	}
+	if opts.NPart == 0 {
+		opts.NPart = 16
+	}
+
+	opts.ChunkSize -= opts.ChunkSize % 4
+	if opts.ChunkSize <= 0 {
+		return opts, fmt.Errorf("Invalid chunk size: %v", self.ChunkSize)
+	}
+	if opts.NPart < 0 {
+		return opts, fmt.Errorf("Invalid number of partitions: %v", opts.NPart)
+	}
+	return opts, nil
+}
+
+// Copy r into a new array called name, one chunk at a time. The partitions
+// have unlimited capacity so factory.Unlimited must be set (e.g. memory,
+// Redis, S3 or PERPART file arrays). Returns the array (closed) and the
+// number of bytes in it. Nothing is left behind on failure.
+func streamToArray(ctx context.Context, r io.Reader, name string, factory *data.ArrayFactory, opts StreamOptions) (data.DistribArray, int, error) {
+	arr, err := factory.Create(name, data.CreateShape(make([]int64, opts.NPart)))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to create input array")
+	}
+
+	chunk := make([]byte, opts.ChunkSize)
+	sz := 0
+	for chunkX := 0; ; chunkX++ {
+		if err := ctx.Err(); err != nil {
+			arr.Destroy()
+			return nil, 0, errors.Wrap(err, "Cancelled while reading input")
+		}
+
+		n, readErr := io.ReadFull(r, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			arr.Destroy()
+			return nil, 0, errors.Wrapf(readErr, "Failed to read input after %v bytes", sz)
+		}
+
+		if n != 0 {
+			if _, err := data.WritePartCtx(ctx, arr, chunkX%opts.NPart, chunk[:n]); err != nil {
+				arr.Destroy()
+				return nil, 0, errors.Wrapf(err, "Failed to write chunk %v of input", chunkX)
+			}
+			sz += n
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if sz%4 != 0 {
+		arr.Destroy()
+		return nil, 0, fmt.Errorf("Input length %v is not a multiple of 4", sz)
+	}
+
+	if err := arr.Close(); err != nil {
+		arr.Destroy()
+		return nil, 0, errors.Wrap(err, "Failed to commit input array")
+	}
+	return arr, sz, nil
+}
+
+// Reads the output of a streamed sort, Close destroys the output arrays
+type sortedStream struct {
+	*BucketReader
+	arrs []data.DistribArray
+}
+
+func (self *sortedStream) Close() error {
+	var destroyErr error
+	for _, arr := range self.arrs {
+		if err := arr.Destroy(); err != nil {
+			destroyErr = err
+		}
+	}
+	self.arrs = nil
+
+	if destroyErr != nil {
+		return errors.Wrap(destroyErr, "Failed to clean up one or more arrays")
+	}
+	return nil
+}
+
+// Like SortDistribFromRawCtx but the input is read from r (of unknown length)
+// in chunks of opts.ChunkSize instead of being held in memory. The sorted
+// output is streamed from the returned reader as it is read, the caller must
+// Close it to destroy the output arrays. Only the host avoids holding the
+// input: workers still read their whole share of each step into memory as in
+// SortDistribFromArrCtx. factory must support unlimited partitions (see
+// streamToArray), others are rejected before r is read.
+func SortDistribFromReader(ctx context.Context, r io.Reader, baseName string,
+	factory *data.ArrayFactory, worker DistribWorkerCtx, opts StreamOptions) (io.ReadCloser, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	if !factory.Unlimited {
+		return nil, fmt.Errorf("Streaming sorts need a factory with unlimited partitions (e.g. memory, Redis, S3 or PERPART file arrays)")
+	}
+
+	if err := InitLibSort(); err != nil {
+		return nil, errors.Wrap(err, "Failed to initialize libsort")
+	}
+
+	inArr, sz, err := streamToArray(ctx, r, baseName+"_input", factory, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// There are no elements to hand out to workers
+	if sz == 0 {
+		if err := inArr.Destroy(); err != nil {
+			return nil, errors.Wrap(err, "Failed to destroy input array")
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	outArrs, err := SortDistribFromArrCtx(ctx, inArr, sz, baseName, factory, worker)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to sort distribArrays")
+	}
+
+	reader, err := NewBucketReader(outArrs, STRIDED)
+	if err != nil {
+		destroyArrs(outArrs)
+		return nil, errors.Wrap(err, "Failed to get reader for output")
+	}
+	return &sortedStream{BucketReader: reader, arrs: outArrs}, nil
+}
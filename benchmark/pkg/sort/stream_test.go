@@ -0,0 +1,94 @@
+package sort
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nathantp/gpu-radix-sort/benchmark/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func streamSortTest(t *testing.T, baseName string, factory *data.ArrayFactory, in io.Reader, origRaw []byte, opts StreamOptions) {
+	require.Nil(t, InitLibSort(), "Failed to initialize libsort")
+
+	out, err := SortDistribFromReader(context.Background(), in, baseName, factory, LocalDistribWorkerCtx, opts)
+	require.Nil(t, err, "Streaming sort failed")
+
+	outRaw, err := ioutil.ReadAll(out)
+	require.Nil(t, err, "Failed to read sorted output")
+	require.Equal(t, len(origRaw), len(outRaw), "Output has the wrong length")
+	require.Nil(t, CheckSort(origRaw, outRaw), "Streaming sort did not sort correctly")
+
+	n, err := out.Read(make([]byte, 4))
+	require.Equal(t, 0, n, "Read more data after EOF")
+	require.Equal(t, io.EOF, err, "Reads after EOF should keep returning EOF")
+
+	require.Nil(t, out.Close(), "Failed to close output")
+	require.Empty(t, listPrefix(t, factory, baseName), "Sort left arrays behind")
+}
+
+func TestSortFromReaderMem(t *testing.T) {
+	origRaw, err := GenerateInputs(1111)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	// Small odd-sized chunks and reads, the last chunk is partial
+	streamSortTest(t, "testSortFromReaderMem", data.MemArrayFactory,
+		iotest.OneByteReader(bytes.NewReader(origRaw)), origRaw, StreamOptions{ChunkSize: 103, NPart: 3})
+}
+
+func TestSortFromReaderFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortStream")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	origRaw, err := GenerateInputs(4096)
+	require.Nil(t, err, "Failed to generate test inputs")
+
+	factory := data.NewFileArrayFactory(tmpDir, data.WithLayout(data.PERPART))
+	streamSortTest(t, "testSortFromReaderFile", factory, bytes.NewReader(origRaw), origRaw, StreamOptions{ChunkSize: 1024})
+}
+
+func TestSortFromReaderEmpty(t *testing.T) {
+	streamSortTest(t, "testSortFromReaderEmpty", data.MemArrayFactory, bytes.NewReader(nil), nil, StreamOptions{})
+}
+
+func TestSortFromReaderBadInput(t *testing.T) {
+	baseName := "testSortFromReaderBadInput"
+
+	_, err := SortDistribFromReader(context.Background(), bytes.NewReader(make([]byte, 4097)), baseName,
+		data.MemArrayFactory, LocalDistribWorkerCtx, StreamOptions{ChunkSize: 1024})
+	require.NotNil(t, err, "Accepted input that isn't a multiple of 4")
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Failed sort left arrays behind")
+
+	failing := io.MultiReader(bytes.NewReader(make([]byte, 2048)), iotest.TimeoutReader(bytes.NewReader(make([]byte, 8))))
+	_, err = SortDistribFromReader(context.Background(), failing, baseName,
+		data.MemArrayFactory, LocalDistribWorkerCtx, StreamOptions{ChunkSize: 1024})
+	require.NotNil(t, err, "Ignored an error from the input reader")
+	require.Empty(t, listPrefix(t, data.MemArrayFactory, baseName), "Failed sort left arrays behind")
+
+	_, err = SortDistribFromReader(context.Background(), bytes.NewReader(nil), baseName,
+		data.MemArrayFactory, LocalDistribWorkerCtx, StreamOptions{ChunkSize: 3})
+	require.NotNil(t, err, "Accepted a chunk size smaller than an element")
+}
+
+// PACKED file arrays can't hold unlimited partitions
+func TestSortFromReaderLimitedFactory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "radixSortStream")
+	require.Nilf(t, err, "Couldn't create temporary test directory")
+	defer os.RemoveAll(tmpDir)
+
+	baseName := "testSortFromReaderLimited"
+	factory := data.NewFileArrayFactory(tmpDir)
+	in := bytes.NewReader(make([]byte, 4096))
+
+	_, err = SortDistribFromReader(context.Background(), in, baseName, factory, LocalDistribWorkerCtx, StreamOptions{})
+	require.NotNil(t, err, "Streamed into a factory without unlimited partitions")
+	require.Contains(t, err.Error(), "unlimited partitions")
+	require.Equal(t, 4096, in.Len(), "Input was read before the factory was rejected")
+	require.Empty(t, listPrefix(t, factory, baseName), "Failed sort left arrays behind")
+}
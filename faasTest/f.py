@@ -43,11 +43,10 @@ if pathlib.Path('/handler/libsort.so').exists():
 import pylibsort
 
 def f(event):
-    # Temporary limitation for testing
-    if event['arrType'] != 'file':
+    if event['arrType'] not in ('file', 's3', 'redis', 'http'):
         return {
                 "success" : False,
-                "err" : "Function currently only supports file distributed arrays"
+                "err" : "Unsupported arrType: " + str(event['arrType'])
                 }
 
     refs = pylibsort.getPartRefs(event)
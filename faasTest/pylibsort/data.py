@@ -7,6 +7,15 @@ import shutil
 import itertools
 import operator
 import json
+import zlib
+import socket
+import hmac
+import hashlib
+import datetime
+import urllib.request
+import urllib.error
+import urllib.parse
+import xml.etree.ElementTree as ET
 import numpy as np
 
 # ol-install: numpy
@@ -112,7 +121,12 @@ class fileDistribArray(DistribArray):
     """A distributed array that stores its data in the filesystem. If the
     provided path already exists, it is used directly, otherwise a directory is
     created for the new array. If the array already exists, the npart argument
-    is ignored."""
+    is ignored.
+
+    Arrays created here are always 'packed' (one data.dat for all partitions)
+    and uncompressed, but arrays with the 'perpart' layout (one p${partID}.dat
+    per partition) or with compressed partitions can be opened as well.
+    Compressed arrays are read-only."""
     shape = None
 
     def __init__(self, rootPath):
@@ -121,15 +135,31 @@ class fileDistribArray(DistribArray):
         self.rootPath = pathlib.Path(rootPath)
         self.datPath = self.rootPath / 'data.dat'
         self.metaPath = self.rootPath / 'meta.json'
+        self.layout = 'packed'
+        self.codec = 'raw'
+        # Block index for compressed arrays (see the Go FileDistribArray)
+        self.blockSz = 0
+        self.blocks = None
+        self.dataF = None
         self.closed = False
 
 
     def __commitMeta(self):
         with open(self.metaPath, 'w') as metaF:
             jsonShape = {"Lens" : self.shape.lens, "Caps" : self.shape.caps}
+            if self.layout != 'packed':
+                jsonShape['Layout'] = self.layout
+            if self.codec != 'raw':
+                jsonShape['Codec'] = self.codec
+                jsonShape['BlockSz'] = self.blockSz
+                jsonShape['Blocks'] = self.blocks
             json.dump(jsonShape, metaF)
 
 
+    def __partPath(self, partID):
+        return self.rootPath / "p{}.dat".format(partID)
+
+
     @classmethod
     def Create(cls, rootPath, shape: ArrayShape):
         arr = cls(rootPath)
@@ -156,8 +186,19 @@ class fileDistribArray(DistribArray):
         with open(arr.metaPath, 'r') as metaF:
             jsonShape = json.load(metaF)
             arr.shape = ArrayShape(lens = jsonShape['Lens'], caps = jsonShape['Caps'])
-        
-        arr.dataF = open(arr.datPath, 'r+b')
+            arr.layout = jsonShape.get('Layout', 'packed')
+            arr.codec = jsonShape.get('Codec', 'raw')
+            if arr.codec != 'raw':
+                arr.blockSz = jsonShape['BlockSz']
+                arr.blocks = jsonShape.get('Blocks') or [[] for i in range(arr.shape.npart)]
+
+        if arr.layout == 'packed':
+            arr.dataF = open(arr.datPath, 'r+b')
+        elif arr.layout != 'perpart':
+            raise DistribArrayError("Array {} has unrecognized layout {}".format(rootPath, arr.layout))
+
+        if arr.codec not in ('raw', 'flate', 'delta'):
+            raise DistribArrayError("Array {} has unrecognized codec {}".format(rootPath, arr.codec))
 
         return arr
 
@@ -165,7 +206,8 @@ class fileDistribArray(DistribArray):
     def Close(self):
         # Being idempotent just makes things easier
         if not self.closed:
-            self.dataF.close()
+            if self.dataF is not None:
+                self.dataF.close()
             self.__commitMeta()
             self.closed = True
 
@@ -184,6 +226,25 @@ class fileDistribArray(DistribArray):
         if start > self.shape.lens[partID] or start+nbyte > self.shape.lens[partID]:
             raise DistribArrayError("Read beyond end of partition {} (asked for {}+{}, limit {}".format(partID, start, nbyte, self.shape.lens[partID])) 
 
+        if self.codec != 'raw':
+            out = self.__readCompressed(partID, start, nbyte)
+            if dest is None:
+                return out
+            dest[:nbyte] = out
+            return
+
+        if self.layout == 'perpart':
+            if nbyte == 0:
+                return bytearray() if dest is None else None
+
+            with open(self.__partPath(partID), 'rb') as partF:
+                partF.seek(start)
+                if dest is None:
+                    return bytearray(partF.read(nbyte))
+                else:
+                    partF.readinto(dest[:nbyte])
+                    return
+
         self.dataF.seek(self.shape.starts[partID] + start)
 
         if dest is None:
@@ -192,13 +253,55 @@ class fileDistribArray(DistribArray):
             self.dataF.readinto(dest[:nbyte])
 
 
+    def __readStored(self, partID, offset, nbyte):
+        """Read nbyte bytes stored at offset within partID (no decompression)"""
+        if self.layout == 'perpart':
+            with open(self.__partPath(partID), 'rb') as partF:
+                partF.seek(offset)
+                return partF.read(nbyte)
+
+        self.dataF.seek(self.shape.starts[partID] + offset)
+        return self.dataF.read(nbyte)
+
+
+    def __readCompressed(self, partID, start, nbyte):
+        out = bytearray()
+        if nbyte == 0:
+            return out
+
+        blocks = self.blocks[partID]
+        firstBlock = start // self.blockSz
+        lastBlock = (start + nbyte - 1) // self.blockSz
+
+        offset = sum(blocks[:firstBlock])
+        stored = self.__readStored(partID, offset, sum(blocks[firstBlock:lastBlock+1]))
+
+        pos = 0
+        for b in range(firstBlock, lastBlock+1):
+            rawLen = min(self.blockSz, self.shape.lens[partID] - b*self.blockSz)
+            out += _decodeBlock(self.codec, stored[pos:pos+blocks[b]], rawLen)
+            pos += blocks[b]
+
+        skip = start - firstBlock*self.blockSz
+        return out[skip:skip+nbyte]
+
+
     def WritePart(self, partId, buf):
-        if self.shape.lens[partId] + len(buf) > self.shape.caps[partId]:
+        if self.codec != 'raw':
+            raise DistribArrayError("Writing to compressed arrays is not supported")
+
+        # perpart arrays treat a zero capacity as unlimited
+        unlimited = self.layout == 'perpart' and self.shape.caps[partId] == 0
+        if not unlimited and self.shape.lens[partId] + len(buf) > self.shape.caps[partId]:
             raise DistribArrayError("Wrote beyond end of partition (asked for {}b, limit {}b)".format(len(buf),
                 self.shape.caps[partId] - self.shape.lens[partId]))
 
-        self.dataF.seek(self.shape.starts[partId] + self.shape.lens[partId])
-        self.dataF.write(buf)
+        if self.layout == 'perpart':
+            with open(self.__partPath(partId), 'ab') as partF:
+                partF.write(buf)
+        else:
+            self.dataF.seek(self.shape.starts[partId] + self.shape.lens[partId])
+            self.dataF.write(buf)
         self.shape.lens[partId] += len(buf)
 
 
@@ -207,6 +310,13 @@ class fileDistribArray(DistribArray):
         returned buffer will match the total reserved capacity of the array,
         use the shape attribute to determine partition boundaries and the valid
         portions of each partition."""
+        if self.layout == 'perpart' or self.codec != 'raw':
+            out = bytearray(self.shape.starts[self.shape.npart])
+            for partID in range(self.shape.npart):
+                start = self.shape.starts[partID]
+                self.ReadPart(partID, dest=memoryview(out)[start:])
+            return memoryview(out)
+
         self.dataF.seek(0)
         # return bytearray(self.dataF.read())
         return memoryview(self.dataF.read())
@@ -219,12 +329,604 @@ class fileDistribArray(DistribArray):
         if len(buf) != totalCap:
             raise DistribArrayError("Buffer length {}b does not match array capacity {}b".format(len(buf), totalCap))
 
+        if self.codec != 'raw':
+            raise DistribArrayError("Writing to compressed arrays is not supported")
+
+        if self.layout == 'perpart':
+            for partID in range(self.shape.npart):
+                with open(self.__partPath(partID), 'wb') as partF:
+                    partF.write(buf[self.shape.starts[partID]:self.shape.starts[partID+1]])
+            self.shape.lens = self.shape.caps.copy()
+            return
+
         self.dataF.seek(0)
         self.dataF.write(buf)
 
         self.shape.lens = self.shape.caps.copy()
         
 
+def _decodeDelta(stored, rawLen):
+    """Undo the Go DELTA codec: zig-zag varint deltas between consecutive
+    little-endian uint32s, followed by any trailing bytes as-is"""
+    nWord = rawLen // 4
+    nTail = rawLen - nWord*4
+    tail = bytes(stored[len(stored)-nTail:])
+    if nWord == 0:
+        return bytearray(tail)
+
+    varints = np.frombuffer(stored, dtype=np.uint8, count=len(stored)-nTail)
+    ends = np.flatnonzero((varints & 0x80) == 0)
+    starts = np.concatenate(([0], ends[:-1] + 1))
+    if len(ends) != nWord or ends[-1] != len(varints) - 1:
+        raise DistribArrayError("Corrupted delta block")
+
+    # Position of each byte within its varint
+    bytePos = np.arange(len(varints)) - np.repeat(starts, ends - starts + 1)
+    parts = (varints & 0x7f).astype(np.uint64) << (7*bytePos).astype(np.uint64)
+    zigzag = np.add.reduceat(parts, starts)
+
+    deltas = (zigzag >> np.uint64(1)).astype(np.int64) ^ -(zigzag & np.uint64(1)).astype(np.int64)
+    vals = np.cumsum(deltas).astype('<u4')
+
+    return bytearray(vals.tobytes() + tail)
+
+
+def _decodeBlock(codec, stored, rawLen):
+    # Blocks that didn't compress are stored as-is
+    if len(stored) == rawLen:
+        return bytearray(stored)
+
+    if codec == 'flate':
+        return bytearray(zlib.decompress(stored, -15))
+    elif codec == 'delta':
+        return _decodeDelta(stored, rawLen)
+    else:
+        raise DistribArrayError("Unrecognized codec {}".format(codec))
+
+
+class s3Config():
+    """Where s3DistribArrays live. Values default to the same environment
+    variables the Go benchmark uses (see data.S3ConfigFromEnv):
+    RADIXBENCH_S3_ENDPOINT, RADIXBENCH_S3_REGION, RADIXBENCH_S3_BUCKET,
+    RADIXBENCH_S3_PREFIX, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY."""
+    def __init__(self, endpoint=None, bucket=None, prefix=None, region=None,
+            accessKey=None, secretKey=None):
+        env = os.environ
+        self.endpoint = (endpoint or env.get('RADIXBENCH_S3_ENDPOINT', "")).rstrip('/')
+        self.bucket = bucket or env.get('RADIXBENCH_S3_BUCKET', "")
+        self.prefix = prefix if prefix is not None else env.get('RADIXBENCH_S3_PREFIX', "")
+        self.region = region or env.get('RADIXBENCH_S3_REGION') or 'us-east-1'
+        self.accessKey = accessKey or env.get('AWS_ACCESS_KEY_ID', "")
+        self.secretKey = secretKey or env.get('AWS_SECRET_ACCESS_KEY', "")
+
+        if self.endpoint == "" or self.bucket == "":
+            raise DistribArrayError("RADIXBENCH_S3_ENDPOINT and RADIXBENCH_S3_BUCKET must be set to use S3 arrays")
+
+
+def _s3Quote(s, safe='/'):
+    return urllib.parse.quote(s, safe=safe + '-_.~')
+
+
+class _s3Client():
+    """Just enough of the S3 REST API (path-style, SigV4 signed) for
+    s3DistribArray. Mirrors the Go client in benchmark/pkg/data/s3client.go."""
+    def __init__(self, cfg: s3Config):
+        self.cfg = cfg
+
+
+    def __sign(self, method, path, query, headers, payloadHash):
+        now = datetime.datetime.utcnow()
+        amzDate = now.strftime('%Y%m%dT%H%M%SZ')
+        date = amzDate[:8]
+
+        headers['x-amz-date'] = amzDate
+        headers['x-amz-content-sha256'] = payloadHash
+
+        signed = sorted(h.lower() for h in headers)
+        canonHdrs = ''.join("{}:{}\n".format(h, str(headers[h]).strip()) for h in signed)
+        canonReq = '\n'.join([method, path, query, canonHdrs, ';'.join(signed), payloadHash])
+
+        scope = "{}/{}/s3/aws4_request".format(date, self.cfg.region)
+        toSign = '\n'.join(["AWS4-HMAC-SHA256", amzDate, scope,
+            hashlib.sha256(canonReq.encode()).hexdigest()])
+
+        key = ("AWS4" + self.cfg.secretKey).encode()
+        for msg in (date, self.cfg.region, "s3", "aws4_request"):
+            key = hmac.new(key, msg.encode(), hashlib.sha256).digest()
+        sig = hmac.new(key, toSign.encode(), hashlib.sha256).hexdigest()
+
+        headers['Authorization'] = "AWS4-HMAC-SHA256 Credential={}/{}, SignedHeaders={}, Signature={}".format(
+                self.cfg.accessKey, scope, ';'.join(signed), sig)
+
+
+    def request(self, method, key="", query=None, headers=None, body=b''):
+        """Issue a signed request and return the response body. Raises
+        DistribArrayError on failure, missing keys raise KeyError."""
+        path = "/" + _s3Quote(self.cfg.bucket, safe='')
+        if key != "":
+            path += "/" + _s3Quote(key)
+
+        query = query or {}
+        canonQuery = '&'.join("{}={}".format(_s3Quote(k, safe=''), _s3Quote(v, safe=''))
+                for k, v in sorted(query.items()))
+
+        body = bytes(body)
+        headers = dict(headers or {})
+        headers['host'] = urllib.parse.urlsplit(self.cfg.endpoint).netloc
+        self.__sign(method, path, canonQuery, headers, hashlib.sha256(body).hexdigest())
+
+        url = self.cfg.endpoint + path
+        if canonQuery != "":
+            url += "?" + canonQuery
+
+        req = urllib.request.Request(url, data=body if method in ('PUT', 'POST') else None,
+                headers=headers, method=method)
+        try:
+            with urllib.request.urlopen(req) as resp:
+                return resp.read()
+        except urllib.error.HTTPError as e:
+            if e.code == 404:
+                raise KeyError(key)
+            raise DistribArrayError("S3 {} {} failed ({}): {}".format(method, key, e.code, e.read()))
+
+
+    def get(self, key, start=None, end=None):
+        """Fetch key, or just bytes [start, end) of it"""
+        headers = {}
+        if start is not None:
+            headers['range'] = "bytes={}-{}".format(start, end-1)
+        return self.request('GET', key, headers=headers)
+
+
+    def put(self, key, body):
+        self.request('PUT', key, body=body)
+
+
+    def delete(self, key):
+        self.request('DELETE', key)
+
+
+    def list(self, prefix):
+        keys = []
+        token = None
+        while True:
+            query = {'list-type' : '2', 'prefix' : prefix}
+            if token is not None:
+                query['continuation-token'] = token
+
+            root = ET.fromstring(self.request('GET', query=query))
+            # Responses are namespaced on real S3, but not always elsewhere
+            ns = root.tag[:root.tag.find('}')+1] if root.tag.startswith('{') else ''
+            keys += [c.find(ns + 'Key').text for c in root.findall(ns + 'Contents')]
+
+            if root.findtext(ns + 'IsTruncated') != 'true':
+                return keys
+            token = root.findtext(ns + 'NextContinuationToken')
+
+
+class s3DistribArray(DistribArray):
+    """A distributed array stored in an S3-compatible object store, see the Go
+    S3DistribArray for the object layout (${prefix}/${name}/meta.json and one
+    ${prefix}/${name}/p${partID}.dat object per partition). Writes are sent
+    immediately, appending to a non-empty partition re-uploads it."""
+    shape = None
+
+    def __init__(self, name, cfg: s3Config = None):
+        """Prepare the array for opening or creation. You almost certainly
+        don't want to call this directly, use Open or Create instead"""
+        self.cfg = cfg or s3Config()
+        self.client = _s3Client(self.cfg)
+        self.name = name
+        self.rootKey = "/".join(p for p in (self.cfg.prefix.strip('/'), name) if p) + "/"
+        self.closed = False
+
+
+    def __commitMeta(self):
+        jsonShape = {"Lens" : self.shape.lens, "Caps" : self.shape.caps, "Layout" : "perpart"}
+        self.client.put(self.rootKey + "meta.json", json.dumps(jsonShape).encode())
+
+
+    def __partKey(self, partID):
+        return self.rootKey + "p{}.dat".format(partID)
+
+
+    @classmethod
+    def Create(cls, name, shape: ArrayShape, cfg: s3Config = None):
+        arr = cls(name, cfg)
+        arr.shape = ArrayShape(lens=shape.lens.copy(), caps=shape.caps.copy())
+        arr.__commitMeta()
+        return arr
+
+
+    @classmethod
+    def Open(cls, name, cfg: s3Config = None):
+        arr = cls(name, cfg)
+
+        try:
+            jsonShape = json.loads(arr.client.get(arr.rootKey + "meta.json"))
+        except KeyError:
+            raise DistribArrayError("Array {} does not exist".format(name))
+
+        if jsonShape.get('Layout') != 'perpart' or jsonShape.get('Codec', 'raw') != 'raw':
+            raise DistribArrayError("Array {} has an unsupported format".format(name))
+
+        arr.shape = ArrayShape(lens = jsonShape['Lens'], caps = jsonShape['Caps'])
+        return arr
+
+
+    def Close(self):
+        if not self.closed:
+            self.__commitMeta()
+            self.closed = True
+
+
+    def Destroy(self):
+        for key in self.client.list(self.rootKey):
+            self.client.delete(key)
+        self.closed = True
+
+
+    def ReadPart(self, partID, start=0, nbyte=-1, dest=None):
+        if nbyte == -1:
+            nbyte = self.shape.lens[partID] - start
+
+        if start > self.shape.lens[partID] or start+nbyte > self.shape.lens[partID]:
+            raise DistribArrayError("Read beyond end of partition {} (asked for {}+{}, limit {}".format(partID, start, nbyte, self.shape.lens[partID])) 
+
+        out = b''
+        if nbyte != 0:
+            out = self.client.get(self.__partKey(partID), start, start+nbyte)
+
+        if dest is None:
+            return bytearray(out)
+        dest[:nbyte] = out
+
+
+    def WritePart(self, partID, buf):
+        unlimited = self.shape.caps[partID] == 0
+        if not unlimited and self.shape.lens[partID] + len(buf) > self.shape.caps[partID]:
+            raise DistribArrayError("Wrote beyond end of partition (asked for {}b, limit {}b)".format(len(buf),
+                self.shape.caps[partID] - self.shape.lens[partID]))
+
+        data = bytes(buf)
+        if self.shape.lens[partID] != 0:
+            data = self.client.get(self.__partKey(partID)) + data
+
+        self.client.put(self.__partKey(partID), data)
+        self.shape.lens[partID] += len(buf)
+
+
+    def ReadAll(self):
+        out = bytearray(self.shape.starts[self.shape.npart])
+        for partID in range(self.shape.npart):
+            start = self.shape.starts[partID]
+            self.ReadPart(partID, dest=memoryview(out)[start:])
+        return memoryview(out)
+
+
+    def WriteAll(self, buf):
+        totalCap = sum(self.shape.caps)
+        if len(buf) != totalCap:
+            raise DistribArrayError("Buffer length {}b does not match array capacity {}b".format(len(buf), totalCap))
+
+        for partID in range(self.shape.npart):
+            partBuf = buf[self.shape.starts[partID]:self.shape.starts[partID+1]]
+            if len(partBuf) != 0:
+                self.client.put(self.__partKey(partID), partBuf)
+        self.shape.lens = self.shape.caps.copy()
+
+
+class redisConfig():
+    """Where redisDistribArrays live. Values default to the same environment
+    variables the Go benchmark uses (see data.RedisConfigFromEnv):
+    RADIXBENCH_REDIS_ADDR (host:port), RADIXBENCH_REDIS_PASSWORD,
+    RADIXBENCH_REDIS_DB and RADIXBENCH_REDIS_PREFIX."""
+    def __init__(self, addr=None, password=None, db=None, prefix=None):
+        env = os.environ
+        self.addr = addr or env.get('RADIXBENCH_REDIS_ADDR', "")
+        self.password = password if password is not None else env.get('RADIXBENCH_REDIS_PASSWORD', "")
+        self.db = db if db is not None else int(env.get('RADIXBENCH_REDIS_DB') or 0)
+        self.prefix = prefix if prefix is not None else env.get('RADIXBENCH_REDIS_PREFIX', "")
+
+        if self.addr == "":
+            raise DistribArrayError("RADIXBENCH_REDIS_ADDR must be set to use redis arrays")
+
+
+class _redisClient():
+    """A single RESP2 connection, just enough for redisDistribArray"""
+    def __init__(self, cfg: redisConfig):
+        host, port = cfg.addr.rsplit(':', 1)
+        self.sock = socket.create_connection((host, int(port)))
+        self.rd = self.sock.makefile('rb')
+
+        if cfg.password != "":
+            self.do("AUTH", cfg.password)
+        if cfg.db != 0:
+            self.do("SELECT", str(cfg.db))
+
+
+    def close(self):
+        self.rd.close()
+        self.sock.close()
+
+
+    def do(self, *args):
+        """Run a command, arguments may be str or bytes-like"""
+        cmd = [b"*%d\r\n" % len(args)]
+        for arg in args:
+            if isinstance(arg, str):
+                arg = arg.encode()
+            cmd += [b"$%d\r\n" % len(arg), arg, b"\r\n"]
+        self.sock.sendall(b"".join(bytes(c) for c in cmd))
+        return self.__readReply()
+
+
+    def __readReply(self):
+        line = self.rd.readline()
+        if not line.endswith(b"\r\n"):
+            raise DistribArrayError("Redis connection closed")
+        kind, body = line[:1], line[1:-2]
+
+        if kind == b"+":
+            return body.decode()
+        elif kind == b"-":
+            raise DistribArrayError("Redis error: " + body.decode())
+        elif kind == b":":
+            return int(body)
+        elif kind == b"$":
+            n = int(body)
+            if n < 0:
+                return None
+            data = self.rd.read(n + 2)
+            return data[:n]
+        elif kind == b"*":
+            n = int(body)
+            return None if n < 0 else [self.__readReply() for i in range(n)]
+        else:
+            raise DistribArrayError("Unrecognized redis reply: " + repr(line))
+
+
+# Largest single GETRANGE/APPEND, matches the Go client
+_redisChunkSz = 4*1024*1024
+
+class redisDistribArray(DistribArray):
+    """A distributed array stored in redis, see the Go RedisDistribArray for
+    the key layout (a ${prefix}${name}:meta hash plus one ${prefix}${name}:p${partID}
+    string per partition)."""
+    shape = None
+
+    def __init__(self, name, cfg: redisConfig = None):
+        """Prepare the array for opening or creation. You almost certainly
+        don't want to call this directly, use Open or Create instead"""
+        self.cfg = cfg or redisConfig()
+        self.client = _redisClient(self.cfg)
+        self.name = name
+        self.metaKey = self.cfg.prefix + name + ":meta"
+        self.closed = False
+
+
+    def __commitMeta(self):
+        self.client.do("HSET", self.metaKey, "Lens", json.dumps(self.shape.lens),
+                "Caps", json.dumps(self.shape.caps))
+
+
+    def __partKey(self, partID):
+        return "{}{}:p{}".format(self.cfg.prefix, self.name, partID)
+
+
+    @classmethod
+    def Create(cls, name, shape: ArrayShape, cfg: redisConfig = None):
+        arr = cls(name, cfg)
+        arr.shape = ArrayShape(lens=shape.lens.copy(), caps=shape.caps.copy())
+
+        if arr.client.do("HSETNX", arr.metaKey, "Caps", json.dumps(arr.shape.caps)) == 0:
+            arr.client.close()
+            raise DistribArrayError("Array {} exists".format(name))
+
+        arr.client.do("DEL", *[arr.__partKey(i) for i in range(arr.shape.npart)])
+        arr.__commitMeta()
+        return arr
+
+
+    @classmethod
+    def Open(cls, name, cfg: redisConfig = None):
+        arr = cls(name, cfg)
+
+        lens, caps = arr.client.do("HMGET", arr.metaKey, "Lens", "Caps")
+        if lens is None or caps is None:
+            arr.client.close()
+            raise DistribArrayError("Array {} does not exist".format(name))
+
+        arr.shape = ArrayShape(lens = json.loads(lens), caps = json.loads(caps))
+        return arr
+
+
+    def Close(self):
+        if not self.closed:
+            self.__commitMeta()
+            self.client.close()
+            self.closed = True
+
+
+    def Destroy(self):
+        self.client.do("DEL", self.metaKey, *[self.__partKey(i) for i in range(self.shape.npart)])
+        self.client.close()
+        self.closed = True
+
+
+    def ReadPart(self, partID, start=0, nbyte=-1, dest=None):
+        if nbyte == -1:
+            nbyte = self.shape.lens[partID] - start
+
+        if start > self.shape.lens[partID] or start+nbyte > self.shape.lens[partID]:
+            raise DistribArrayError("Read beyond end of partition {} (asked for {}+{}, limit {}".format(partID, start, nbyte, self.shape.lens[partID])) 
+
+        out = bytearray(nbyte) if dest is None else dest
+        pos = 0
+        while pos < nbyte:
+            n = min(_redisChunkSz, nbyte - pos)
+            # GETRANGE's end is inclusive
+            out[pos:pos+n] = self.client.do("GETRANGE", self.__partKey(partID),
+                    str(start+pos), str(start+pos+n-1))
+            pos += n
+
+        if dest is None:
+            return out
+
+
+    def WritePart(self, partID, buf):
+        unlimited = self.shape.caps[partID] == 0
+        if not unlimited and self.shape.lens[partID] + len(buf) > self.shape.caps[partID]:
+            raise DistribArrayError("Wrote beyond end of partition (asked for {}b, limit {}b)".format(len(buf),
+                self.shape.caps[partID] - self.shape.lens[partID]))
+
+        buf = memoryview(buf)
+        for pos in range(0, len(buf), _redisChunkSz):
+            self.client.do("APPEND", self.__partKey(partID), buf[pos:pos+_redisChunkSz])
+        self.shape.lens[partID] += len(buf)
+
+
+    def ReadAll(self):
+        out = bytearray(self.shape.starts[self.shape.npart])
+        for partID in range(self.shape.npart):
+            start = self.shape.starts[partID]
+            self.ReadPart(partID, dest=memoryview(out)[start:])
+        return memoryview(out)
+
+
+    def WriteAll(self, buf):
+        totalCap = sum(self.shape.caps)
+        if len(buf) != totalCap:
+            raise DistribArrayError("Buffer length {}b does not match array capacity {}b".format(len(buf), totalCap))
+
+        self.client.do("DEL", *[self.__partKey(i) for i in range(self.shape.npart)])
+        self.shape.lens = [0]*self.shape.npart
+        for partID in range(self.shape.npart):
+            self.WritePart(partID, buf[self.shape.starts[partID]:self.shape.starts[partID+1]])
+
+
+class httpDistribArray(DistribArray):
+    """A distributed array hosted by an array server (see the Go ArrayServer
+    and cmd/arrayserver). baseURL defaults to RADIXBENCH_ARRAY_SERVER."""
+    shape = None
+
+    def __init__(self, name, baseURL=None):
+        """Prepare the array for opening or creation. You almost certainly
+        don't want to call this directly, use Open or Create instead"""
+        self.baseURL = baseURL or os.environ.get('RADIXBENCH_ARRAY_SERVER', "")
+        if self.baseURL == "":
+            raise DistribArrayError("RADIXBENCH_ARRAY_SERVER must be set to use http arrays")
+
+        self.name = name
+        self.arrURL = self.baseURL.rstrip('/') + "/arrays/" + urllib.parse.quote(name, safe='')
+        self.closed = False
+
+
+    def __call(self, method, suffix="", body=None, query=None):
+        """Issue a request against this array and return the response body"""
+        url = self.arrURL + suffix
+        if query is not None:
+            url += "?" + urllib.parse.urlencode(query)
+
+        req = urllib.request.Request(url, data=body, method=method)
+        try:
+            with urllib.request.urlopen(req) as resp:
+                return resp.read()
+        except urllib.error.HTTPError as e:
+            raw = e.read()
+            try:
+                msg = json.loads(raw)['Err']
+            except (ValueError, KeyError, TypeError):
+                msg = raw.decode(errors='replace')
+            raise DistribArrayError("Array server error ({}): {}".format(e.code, msg)) from e
+        except urllib.error.URLError as e:
+            raise DistribArrayError("Couldn't reach array server: {}".format(e.reason)) from e
+
+
+    def __loadShape(self, raw):
+        jsonShape = json.loads(raw)
+        self.shape = ArrayShape(lens = jsonShape['Lens'], caps = jsonShape['Caps'])
+
+
+    @classmethod
+    def Create(cls, name, shape: ArrayShape, baseURL=None):
+        arr = cls(name, baseURL)
+        arr.__loadShape(arr.__call("PUT", body=json.dumps({"Caps" : shape.caps}).encode()))
+        return arr
+
+
+    @classmethod
+    def Open(cls, name, baseURL=None):
+        arr = cls(name, baseURL)
+        arr.__loadShape(arr.__call("POST", "/open"))
+        return arr
+
+
+    def Close(self):
+        if not self.closed:
+            self.__call("POST", "/close")
+            self.closed = True
+
+
+    def Destroy(self):
+        self.__call("DELETE")
+        self.closed = True
+
+
+    def ReadPart(self, partID, start=0, nbyte=-1, dest=None):
+        if nbyte == -1:
+            nbyte = self.shape.lens[partID] - start
+
+        if start > self.shape.lens[partID] or start+nbyte > self.shape.lens[partID]:
+            raise DistribArrayError("Read beyond end of partition {} (asked for {}+{}, limit {}".format(partID, start, nbyte, self.shape.lens[partID])) 
+
+        out = b''
+        if nbyte != 0:
+            out = self.__call("GET", "/{}".format(partID), query={"start" : start, "end" : start+nbyte})
+            if len(out) != nbyte:
+                raise DistribArrayError("Array server returned {}b for partition {}, expected {}b".format(len(out), partID, nbyte))
+
+        if dest is None:
+            return bytearray(out)
+        dest[:nbyte] = out
+
+
+    def WritePart(self, partID, buf):
+        unlimited = self.shape.caps[partID] == 0
+        if not unlimited and self.shape.lens[partID] + len(buf) > self.shape.caps[partID]:
+            raise DistribArrayError("Wrote beyond end of partition (asked for {}b, limit {}b)".format(len(buf),
+                self.shape.caps[partID] - self.shape.lens[partID]))
+
+        if len(buf) == 0:
+            return
+
+        resp = json.loads(self.__call("POST", "/{}".format(partID), body=bytes(buf)))
+        if resp['N'] != len(buf):
+            raise DistribArrayError("Array server only accepted {} of {}b for partition {}".format(resp['N'], len(buf), partID))
+        self.shape.lens[partID] = resp['Len']
+
+
+    def ReadAll(self):
+        out = bytearray(self.shape.starts[self.shape.npart])
+        for partID in range(self.shape.npart):
+            start = self.shape.starts[partID]
+            self.ReadPart(partID, dest=memoryview(out)[start:])
+        return memoryview(out)
+
+
+    def WriteAll(self, buf):
+        totalCap = sum(self.shape.caps)
+        if len(buf) != totalCap:
+            raise DistribArrayError("Buffer length {}b does not match array capacity {}b".format(len(buf), totalCap))
+
+        # Arrays can only be appended to, WriteAll is meant for new arrays
+        if any(l != 0 for l in self.shape.lens):
+            raise DistribArrayError("WriteAll requires an empty array")
+
+        for partID in range(self.shape.npart):
+            self.WritePart(partID, buf[self.shape.starts[partID]:self.shape.starts[partID+1]])
+
+
 class partRef():
     """Reference to a segment of a partition to read."""
     def __init__(self, arr: DistribArray, partID=0, start=0, nbyte=-1):
@@ -239,19 +941,34 @@ class partRef():
         else:
             return self.arr.ReadPart(self.partID, start=self.start, nbyte=self.nbyte, dest=dest)
 
-# {arrayName : fileDistribArray}, minimize the number of re-opened files. This
+# {(arrType, arrayName) : DistribArray}, minimize the number of re-opened files. This
 # makes the partRefs list non-threadsafe and makes it so you have to close all
 # or none, closing one may close many others.
 openArrs = {}
 
-def __fileGetRef(req) -> partRef:
-    """Return a partRef from an entry in the 'input' field of a req"""
-    arr = None
-    if req['arrayName'] in openArrs:
-        arr = openArrs[req['arrayName']]
+def __openArr(arrType, name):
+    """Open (or re-use) the array called name"""
+    if (arrType, name) in openArrs:
+        return openArrs[(arrType, name)]
+
+    if arrType == "file":
+        arr = fileDistribArray.Open(FileDistribArrayMount / name)
+    elif arrType == "s3":
+        arr = s3DistribArray.Open(name)
+    elif arrType == "redis":
+        arr = redisDistribArray.Open(name)
+    elif arrType == "http":
+        arr = httpDistribArray.Open(name)
     else:
-        arr = fileDistribArray.Open(FileDistribArrayMount / req['arrayName'])
-        openArrs[req['arrayName']] = arr
+        raise ValueError("Invalid request type: " + str(arrType))
+
+    openArrs[(arrType, name)] = arr
+    return arr
+
+
+def __getRef(arrType, req) -> partRef:
+    """Return a partRef from an entry in the 'input' field of a req"""
+    arr = __openArr(arrType, req['arrayName'])
 
     # Internally, it's easier to work with absolute numbers, so we convert -1
     # nbyte's from the request into their real value
@@ -280,20 +997,21 @@ def readPartRefs(refs):
 def getPartRefs(req: dict):
     """Returns a list of partRefs from a sort request dictionary."""
 
-    if req['arrType'] == "file":
-        return [__fileGetRef(r) for r in req['input']]
-    else:
-        raise ValueError("Invalid request type: " + str(req['arrType']))
-
+    return [__getRef(req['arrType'], r) for r in req['input']]
 
-def __fileGetOutputArray(req, shape: ArrayShape) -> fileDistribArray:
-    return fileDistribArray.Create(FileDistribArrayMount / req['output'], shape)
 
-def getOutputArray(req: dict):
-    """Returns a FileDistribArray to use for the output of req"""
+def getOutputArray(req: dict, shape: ArrayShape):
+    """Returns a new DistribArray (of the request's arrType) to use for the
+    output of req"""
 
     if req['arrType'] == "file":
-        return __fileGetOutputArray(req)
+        return fileDistribArray.Create(FileDistribArrayMount / req['output'], shape)
+    elif req['arrType'] == "s3":
+        return s3DistribArray.Create(req['output'], shape)
+    elif req['arrType'] == "redis":
+        return redisDistribArray.Create(req['output'], shape)
+    elif req['arrType'] == "http":
+        return httpDistribArray.Create(req['output'], shape)
     else:
         raise ValueError("Invalid request type: " + str(req['arrType']))
 
@@ -304,7 +1022,7 @@ def writeOutput(req: dict, rawBytes, boundaries):
     caps = np.diff(caps, append=len(rawBytes))
     
     shape = ArrayShape.fromCaps(caps.tolist())
-    outArr = fileDistribArray.Create(FileDistribArrayMount / req['output'], shape)
+    outArr = getOutputArray(req, shape)
     outArr.WriteAll(rawBytes)
     outArr.Close()
 